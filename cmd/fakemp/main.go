@@ -0,0 +1,23 @@
+// Command fakemp serves the in-memory Mercado Pago API from internal/fakemp.
+// Point the checkout service at it with MP_BASE_URL=http://localhost:8082.
+package main
+
+import (
+	"github.com/mateoferrari97/mercadopago/cmd/internal/fakemp"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8082"
+		log.Printf("defaulting to port %s", port)
+	}
+
+	port = strings.TrimPrefix(port, ":")
+	log.Printf("Fake Mercado Pago listening on port %s", port)
+	log.Fatal(http.ListenAndServe(":"+port, fakemp.NewServer()))
+}
@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_breakerFailureThreshold = 5
+	_breakerCooldown         = 30 * time.Second
+	_breakerMaxInFlight      = 32
+	_breakerBusyRetryAfter   = time.Second
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+type BreakerStatus struct {
+	Operation   string       `json:"operation"`
+	State       BreakerState `json:"state"`
+	Failures    int          `json:"consecutive_failures"`
+	InFlight    int          `json:"in_flight"`
+	MaxInFlight int          `json:"max_in_flight"`
+	OpenedAt    *time.Time   `json:"opened_at,omitempty"`
+}
+
+type breaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	inFlight int
+	probing  bool
+}
+
+// BreakerClient guards each upstream operation, e.g. token, preferences or
+// payments, with a circuit breaker and a limit on concurrent calls. After
+// enough consecutive failures the circuit opens and calls fail right away
+// with a 503 until the cooldown passes; then a single probe goes through and
+// its outcome closes the circuit or opens it again. Calls over the limit are
+// rejected the same way instead of queueing behind a slow upstream; a call
+// holds its slot until its response body is closed. It goes under a
+// RetryClient, so every attempt counts and no call holds a slot while it waits
+// to retry.
+type BreakerClient struct {
+	Client           Client
+	failureThreshold int
+	cooldown         time.Duration
+	maxInFlight      int
+	now              func() time.Time
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+func NewBreakerClient(client Client) *BreakerClient {
+	return &BreakerClient{
+		Client:           client,
+		failureThreshold: _breakerFailureThreshold,
+		cooldown:         _breakerCooldown,
+		maxInFlight:      _breakerMaxInFlight,
+		now:              time.Now,
+		breakers:         make(map[string]*breaker),
+	}
+}
+
+func (c *BreakerClient) Do(req *http.Request) (*http.Response, error) {
+	operation := upstreamOperation(req.URL.Path)
+	probe, err := c.acquire(operation)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Client.Do(req)
+	c.record(operation, probe, errors.Is(err, context.Canceled), failed(resp, err))
+	if err != nil || resp.Body == nil {
+		c.release(operation)
+		return resp, err
+	}
+
+	resp.Body = &breakerBody{ReadCloser: resp.Body, release: func() { c.release(operation) }}
+	return resp, nil
+}
+
+// breakerBody frees the slot of a call once its body is closed, as the
+// connection is busy until then.
+type breakerBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *breakerBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Status reports every operation called so far, sorted by name.
+func (c *BreakerClient) Status() []BreakerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	statuses := make([]BreakerStatus, 0, len(c.breakers))
+	for operation, b := range c.breakers {
+		// An open circuit whose cooldown passed lets the next call probe, it
+		// only turns half open on that call.
+		state := b.state
+		if state == BreakerOpen && !now.Before(b.openedAt.Add(c.cooldown)) {
+			state = BreakerHalfOpen
+		}
+
+		status := BreakerStatus{
+			Operation:   operation,
+			State:       state,
+			Failures:    b.failures,
+			InFlight:    b.inFlight,
+			MaxInFlight: c.maxInFlight,
+		}
+
+		if b.state != BreakerClosed {
+			openedAt := b.openedAt
+			status.OpenedAt = &openedAt
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Operation < statuses[j].Operation })
+	return statuses
+}
+
+// acquire lets a call through or says why not. It reports whether the call
+// is the probe of a half open circuit.
+func (c *BreakerClient) acquire(operation string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[operation]
+	if !ok {
+		b = &breaker{state: BreakerClosed}
+		c.breakers[operation] = b
+	}
+
+	if b.state == BreakerOpen {
+		if wait := b.openedAt.Add(c.cooldown).Sub(c.now()); wait > 0 {
+			return false, unavailable(fmt.Sprintf("mercado pago %s is failing, calls are suspended", operation), wait)
+		}
+
+		b.state = BreakerHalfOpen
+	}
+
+	if b.state == BreakerHalfOpen && b.probing {
+		return false, unavailable(fmt.Sprintf("mercado pago %s is failing, calls are suspended", operation), _breakerBusyRetryAfter)
+	}
+
+	if b.inFlight >= c.maxInFlight {
+		return false, unavailable(fmt.Sprintf("too many concurrent calls to mercado pago %s", operation), _breakerBusyRetryAfter)
+	}
+
+	b.inFlight++
+	if b.state == BreakerHalfOpen {
+		b.probing = true
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// record records how a call went. A canceled call says nothing about the
+// upstream, so it changes nothing, and a canceled probe leaves the circuit
+// half open for the next call to probe.
+func (c *BreakerClient) record(operation string, probe bool, canceled bool, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := c.breakers[operation]
+	if probe {
+		b.probing = false
+	}
+
+	switch {
+	case canceled:
+	case !failed:
+		b.failures = 0
+		if probe {
+			b.state = BreakerClosed
+		}
+	case probe:
+		b.state = BreakerOpen
+		b.openedAt = c.now()
+	case b.state == BreakerClosed:
+		b.failures++
+		if b.failures >= c.failureThreshold {
+			b.state = BreakerOpen
+			b.openedAt = c.now()
+		}
+	}
+}
+
+// failed tells whether a call counts against the upstream: it couldn't be
+// made, took too long, or got a 429 or 5xx back. Calls canceled on our side
+// don't count.
+func failed(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// release frees the slot a call took.
+func (c *BreakerClient) release(operation string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.breakers[operation].inFlight--
+}
+
+func unavailable(message string, retryAfter time.Duration) *Error {
+	err := NewError(message, http.StatusServiceUnavailable)
+	err.Code = "upstream_unavailable"
+	err.RetryAfter = retryAfter
+	return err
+}
+
+// upstreamOperation groups Mercado Pago paths into the operations we keep a
+// breaker for.
+func upstreamOperation(path string) string {
+	for _, o := range []struct {
+		prefix    string
+		operation string
+	}{
+		{prefix: "/oauth/token", operation: "token"},
+		{prefix: "/checkout/preferences", operation: "preferences"},
+		{prefix: "/v1/payments", operation: "payments"},
+		{prefix: "/v1/payment_methods", operation: "payment_methods"},
+		{prefix: "/v1/customers", operation: "customers"},
+		{prefix: "/merchant_orders", operation: "merchant_orders"},
+		{prefix: "/preapproval", operation: "preapprovals"},
+	} {
+		if strings.HasPrefix(path, o.prefix) {
+			return o.operation
+		}
+	}
+
+	return "other"
+}
+
+type StatusHandler struct {
+	Breakers *BreakerClient
+}
+
+func NewStatusHandler(breakers *BreakerClient) *StatusHandler {
+	return &StatusHandler{Breakers: breakers}
+}
+
+// Status lists the breaker of every upstream operation called so far.
+func (h *StatusHandler) Status(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"upstreams": h.Breakers.Status()})
+}
@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type BlockingClientStub struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *BlockingClientStub) Do(_ *http.Request) (*http.Response, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return newResponse(http.StatusOK, nil), nil
+}
+
+func newTestBreakerClient(c Client, now *time.Time) *BreakerClient {
+	b := NewBreakerClient(c)
+	b.failureThreshold = 2
+	b.now = func() time.Time { return *now }
+	return b
+}
+
+func doGet(t *testing.T, c Client, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, "https://api.mercadopago.com"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.Do(req)
+}
+
+func TestBreakerClient_Open(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+	c := &SequenceClientStub{resps: []*http.Response{newResponse(500, nil), newResponse(503, nil), newResponse(200, nil)}}
+	b := newTestBreakerClient(c, &now)
+
+	// When
+	doGet(t, b, "/v1/payments/1")
+	doGet(t, b, "/v1/payments/2")
+	now = now.Add(10 * time.Second)
+	_, openErr := doGet(t, b, "/v1/payments/3")
+	resp, err := doGet(t, b, "/checkout/preferences/123-abc")
+
+	// Then
+	var e *Error
+	require.True(t, errors.As(openErr, &e))
+	require.Equal(t, http.StatusServiceUnavailable, e.StatusCode)
+	require.Equal(t, 20*time.Second, e.RetryAfter)
+	require.Equal(t, "mercado pago payments is failing, calls are suspended", e.Message)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, c.reqs, 3)
+}
+
+func TestBreakerClient_HalfOpen(t *testing.T) {
+	tt := []struct {
+		name        string
+		probeStatus int
+		wantState   BreakerState
+	}{
+		{name: "probe succeeds", probeStatus: http.StatusOK, wantState: BreakerClosed},
+		{name: "probe fails", probeStatus: http.StatusBadGateway, wantState: BreakerOpen},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+			c := &SequenceClientStub{resps: []*http.Response{newResponse(500, nil), newResponse(500, nil), newResponse(tc.probeStatus, nil)}}
+			b := newTestBreakerClient(c, &now)
+			doGet(t, b, "/oauth/token")
+			doGet(t, b, "/oauth/token")
+			now = now.Add(_breakerCooldown)
+
+			// When
+			probe, err := doGet(t, b, "/oauth/token")
+
+			// Then
+			require.NoError(t, err)
+			require.Equal(t, tc.probeStatus, probe.StatusCode)
+			require.Equal(t, tc.wantState, b.Status()[0].State)
+		})
+	}
+}
+
+func TestBreakerClient_HalfOpen_ProbeCanceled(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+	c := &SequenceClientStub{errs: []error{context.Canceled, nil}, resps: []*http.Response{nil, newResponse(http.StatusOK, nil)}}
+	b := newTestBreakerClient(c, &now)
+	b.breakers["payments"] = &breaker{state: BreakerOpen, failures: 2, openedAt: now.Add(-_breakerCooldown)}
+
+	// When
+	_, canceledErr := doGet(t, b, "/v1/payments/1")
+	canceled := b.Status()[0]
+	resp, err := doGet(t, b, "/v1/payments/1")
+
+	// Then
+	require.True(t, errors.Is(canceledErr, context.Canceled))
+	require.Equal(t, BreakerHalfOpen, canceled.State)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, BreakerClosed, b.Status()[0].State)
+}
+
+func TestBreakerClient_HalfOpen_SingleProbe(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+	c := &BlockingClientStub{started: make(chan struct{}), release: make(chan struct{})}
+	b := newTestBreakerClient(c, &now)
+	b.breakers["payments"] = &breaker{state: BreakerOpen, failures: 2, openedAt: now.Add(-_breakerCooldown)}
+
+	done := make(chan error)
+	go func() {
+		_, err := doGet(t, b, "/v1/payments/1")
+		done <- err
+	}()
+	<-c.started
+
+	// When
+	_, err := doGet(t, b, "/v1/payments/2")
+	status := b.Status()
+	close(c.release)
+
+	// Then
+	require.NoError(t, <-done)
+	require.Equal(t, http.StatusServiceUnavailable, getStatusCodeFromError(err))
+	require.Equal(t, BreakerHalfOpen, status[0].State)
+	require.Equal(t, BreakerClosed, b.Status()[0].State)
+}
+
+func TestBreakerClient_MaxInFlight(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+	c := &BlockingClientStub{started: make(chan struct{}), release: make(chan struct{})}
+	b := newTestBreakerClient(c, &now)
+	b.maxInFlight = 1
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, _ := doGet(t, b, "/v1/payments/1")
+		done <- resp
+	}()
+	<-c.started
+
+	// When
+	_, err := doGet(t, b, "/v1/payments/2")
+	close(c.release)
+	resp := <-done
+	_, unreadErr := doGet(t, b, "/v1/payments/3")
+	resp.Body.Close()
+
+	// Then
+	require.EqualError(t, err, "too many concurrent calls to mercado pago payments")
+	require.Equal(t, http.StatusServiceUnavailable, getStatusCodeFromError(err))
+	require.EqualError(t, unreadErr, "too many concurrent calls to mercado pago payments")
+	require.Equal(t, 0, b.Status()[0].InFlight)
+	require.Equal(t, BreakerClosed, b.Status()[0].State)
+}
+
+func TestBreakerClient_Status_CooldownPassed(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+	c := &SequenceClientStub{resps: []*http.Response{newResponse(500, nil), newResponse(500, nil)}}
+	b := newTestBreakerClient(c, &now)
+	doGet(t, b, "/v1/payments/1")
+	doGet(t, b, "/v1/payments/1")
+	open := b.Status()[0]
+
+	// When
+	now = now.Add(_breakerCooldown)
+	status := b.Status()[0]
+
+	// Then
+	require.Equal(t, BreakerOpen, open.State)
+	require.Equal(t, BreakerHalfOpen, status.State)
+	require.NotNil(t, status.OpenedAt)
+}
+
+func TestBreakerClient_Canceled(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+	c := &SequenceClientStub{errs: []error{context.Canceled, context.Canceled, context.DeadlineExceeded}}
+	b := newTestBreakerClient(c, &now)
+
+	// When
+	doGet(t, b, "/v1/payments/1")
+	doGet(t, b, "/v1/payments/1")
+	canceled := b.Status()[0]
+	doGet(t, b, "/v1/payments/1")
+
+	// Then
+	require.Equal(t, 0, canceled.Failures)
+	require.Equal(t, 1, b.Status()[0].Failures)
+}
+
+func TestBreakerClient_UnderRetryClient(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+	c := &SequenceClientStub{resps: []*http.Response{newResponse(503, nil), newResponse(200, nil)}}
+	b := newTestBreakerClient(c, &now)
+	b.maxInFlight = 1
+
+	var waitingInFlight []int
+	r := NewRetryClient(b)
+	r.sleep = func(_ context.Context, _ time.Duration) error {
+		waitingInFlight = append(waitingInFlight, b.Status()[0].InFlight)
+		return nil
+	}
+
+	// When
+	resp, err := doGet(t, r, "/v1/payments/1")
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []int{0}, waitingInFlight)
+}
+
+func TestBreakerClient_UnderRetryClient_Open(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+	c := &SequenceClientStub{resps: []*http.Response{newResponse(500, nil), newResponse(500, nil), newResponse(200, nil)}}
+	b := newTestBreakerClient(c, &now)
+	var waits []time.Duration
+	r := newTestRetryClient(b, &waits)
+	r.maxAttempts = 5
+
+	// When
+	_, err := doGet(t, r, "/v1/payments/1")
+
+	// Then
+	require.EqualError(t, err, "mercado pago payments is failing, calls are suspended")
+	require.Len(t, c.reqs, 2)
+	require.Len(t, waits, 2)
+	require.Equal(t, BreakerOpen, b.Status()[0].State)
+}
+
+func TestUpstreamOperation(t *testing.T) {
+	tt := map[string]string{
+		"/oauth/token":                     "token",
+		"/checkout/preferences/search":     "preferences",
+		"/v1/payments/123/refunds":         "payments",
+		"/v1/payment_methods/installments": "payment_methods",
+		"/v1/customers/123/cards":          "customers",
+		"/merchant_orders/search":          "merchant_orders",
+		"/preapproval_plan/abc":            "preapprovals",
+		"/users/me":                        "other",
+	}
+
+	for path, want := range tt {
+		t.Run(path, func(t *testing.T) {
+			require.Equal(t, want, upstreamOperation(path))
+		})
+	}
+}
+
+func TestStatusHandler_Status(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+	c := &SequenceClientStub{resps: []*http.Response{newResponse(200, nil), newResponse(500, nil), newResponse(500, nil)}}
+	b := newTestBreakerClient(c, &now)
+	doGet(t, b, "/oauth/token")
+	doGet(t, b, "/v1/payments/1")
+	doGet(t, b, "/v1/payments/1")
+
+	h := NewStatusHandler(b)
+	ts := httptest.NewServer(http.HandlerFunc(h.Status))
+	defer ts.Close()
+
+	// When
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Upstreams []BreakerStatus `json:"upstreams"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, body.Upstreams, 2)
+	require.Equal(t, "payments", body.Upstreams[0].Operation)
+	require.Equal(t, BreakerOpen, body.Upstreams[0].State)
+	require.Equal(t, now, body.Upstreams[0].OpenedAt.UTC())
+	require.Equal(t, "token", body.Upstreams[1].Operation)
+	require.Equal(t, BreakerClosed, body.Upstreams[1].State)
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const _maxCacheEntries = 1024
+
+type cacheEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+// ttlCache is a small in-process cache for upstream lookups that rarely
+// change, such as payment methods and installment plans. Once it holds
+// maxEntries the least recently used entry makes room for the new one. Keys
+// often carry an access token, so only their hash is kept.
+type ttlCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+	// order has the most recently used entry at the front.
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newTTLCache(ttl time.Duration) *ttlCache {
+	return &ttlCache{
+		ttl:        ttl,
+		maxEntries: _maxCacheEntries,
+		now:        time.Now,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (c *ttlCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[cacheKey(key)]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.remove(e)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *ttlCache) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key = cacheKey(key)
+	expiresAt := c.now().Add(c.ttl)
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{
+		key:       key,
+		value:     value,
+		expiresAt: expiresAt,
+	})
+
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *ttlCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+func cacheKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return string(sum[:])
+}
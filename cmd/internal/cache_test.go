@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTTLCache(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 0, 0, 0, 0, time.UTC)
+	c := newTTLCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	// When
+	c.Set("payment_methods", []string{"visa"})
+	value, ok := c.Get("payment_methods")
+
+	// Then
+	require.True(t, ok)
+	require.Equal(t, []string{"visa"}, value)
+}
+
+func TestTTLCache_Expired(t *testing.T) {
+	// Given
+	now := time.Date(2020, 6, 14, 0, 0, 0, 0, time.UTC)
+	c := newTTLCache(time.Minute)
+	c.now = func() time.Time { return now }
+	c.Set("payment_methods", []string{"visa"})
+
+	// When
+	now = now.Add(time.Minute)
+	_, ok := c.Get("payment_methods")
+
+	// Then
+	require.False(t, ok)
+	require.Empty(t, c.entries)
+}
+
+func TestTTLCache_MaxEntries(t *testing.T) {
+	// Given
+	c := newTTLCache(time.Minute)
+	c.maxEntries = 2
+	c.Set("payment_methods:APP_USR-1", []string{"visa"})
+	c.Set("payment_methods:APP_USR-2", []string{"master"})
+	c.Get("payment_methods:APP_USR-1")
+
+	// When
+	c.Set("payment_methods:APP_USR-3", []string{"amex"})
+	_, first := c.Get("payment_methods:APP_USR-1")
+	_, second := c.Get("payment_methods:APP_USR-2")
+	_, third := c.Get("payment_methods:APP_USR-3")
+
+	// Then
+	require.True(t, first)
+	require.False(t, second)
+	require.True(t, third)
+	require.Len(t, c.entries, 2)
+	for key := range c.entries {
+		require.NotContains(t, key, "APP_USR")
+	}
+}
@@ -2,143 +2,1007 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const _baseURL = "https://api.mercadopago.com"
+const (
+	_baseURL        = "https://api.mercadopago.com"
+	_defaultTimeout = 10 * time.Second
+)
+
+// Environment decides which checkout URL buyers are sent to. Sandbox is for
+// test credentials and test users; both talk to the same API.
+type Environment string
+
+const (
+	Production Environment = "production"
+	Sandbox    Environment = "sandbox"
+)
+
+func ParseEnvironment(s string) (Environment, error) {
+	switch e := Environment(s); e {
+	case "":
+		return Production, nil
+	case Production, Sandbox:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unknown environment %q: must be %s or %s", s, Production, Sandbox)
+	}
+}
+
+// CheckoutURL returns the init point of the preference buyers should use in
+// this environment.
+func (e Environment) CheckoutURL(p Preference) string {
+	if e == Sandbox {
+		return p.SandboxInitPoint
+	}
+
+	return p.InitPoint
+}
 
 type Client interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// Timeouts bounds each call to Mercado Pago. Operations are named after the
+// Gateway method, e.g. "CreatePayment", or "Token" for every /oauth/token
+// call; the ones not listed get Default. Zero means no limit.
+type Timeouts struct {
+	Default    time.Duration
+	Operations map[string]time.Duration
+}
+
+// ParseTimeouts reads a default duration and a comma separated list of
+// operation=duration overrides, e.g. "SearchPayments=30s,Token=5s".
+func ParseTimeouts(defaultTimeout string, operations string) (Timeouts, error) {
+	t := Timeouts{Default: _defaultTimeout, Operations: make(map[string]time.Duration)}
+	if defaultTimeout != "" {
+		d, err := time.ParseDuration(defaultTimeout)
+		if err != nil {
+			return Timeouts{}, fmt.Errorf("invalid default timeout %q: %w", defaultTimeout, err)
+		}
+
+		t.Default = d
+	}
+
+	for _, o := range strings.Split(operations, ",") {
+		if strings.TrimSpace(o) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(o, "=", 2)
+		if len(parts) != 2 {
+			return Timeouts{}, fmt.Errorf("invalid timeout %q: must be operation=duration", o)
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return Timeouts{}, fmt.Errorf("invalid timeout for %s: %w", parts[0], err)
+		}
+
+		t.Operations[strings.TrimSpace(parts[0])] = d
+	}
+
+	return t, nil
+}
+
+func (t Timeouts) context(ctx context.Context, operation string) (context.Context, context.CancelFunc) {
+	timeout, ok := t.Operations[operation]
+	if !ok {
+		timeout = t.Default
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
 type Gateway struct {
 	Client Client
+	// Environment defaults to Production.
+	Environment Environment
+	// BaseURL overrides the Mercado Pago API, e.g. to point at a fake server.
+	BaseURL  string
+	Timeouts Timeouts
 }
 
 func NewClientGateway(client Client) *Gateway {
 	return &Gateway{
-		Client: client,
+		Client:      client,
+		Environment: Production,
+		Timeouts:    Timeouts{Default: _defaultTimeout},
+	}
+}
+
+func (g *Gateway) baseURL() string {
+	if g.BaseURL != "" {
+		return strings.TrimSuffix(g.BaseURL, "/")
 	}
+
+	return _baseURL
+}
+
+// GetToken gets the application's own token with the client_credentials
+// grant.
+func (g *Gateway) GetToken(ctx context.Context, credentials Credentials) (OAuthToken, error) {
+	return g.requestToken(ctx, map[string]string{
+		"client_id":     credentials.ClientID,
+		"client_secret": credentials.ClientSecret,
+		"grant_type":    "client_credentials",
+	})
 }
 
-func (g *Gateway) GetAccessToken(credentials Credentials) (string, error) {
-	path := &url.Values{}
-	path.Add("client_id", credentials.ClientID)
-	path.Add("client_secret", credentials.ClientSecret)
-	path.Add("grant_type", "client_credentials")
-	queryParams := path.Encode()
+// ExchangeAuthorizationCode trades the code Mercado Pago sent to redirectURI
+// for the seller's tokens. codeVerifier is only required if the authorization
+// request carried a PKCE code_challenge.
+func (g *Gateway) ExchangeAuthorizationCode(ctx context.Context, credentials Credentials, code string, redirectURI string, codeVerifier string) (OAuthToken, error) {
+	return g.requestToken(ctx, map[string]string{
+		"client_id":     credentials.ClientID,
+		"client_secret": credentials.ClientSecret,
+		"grant_type":    "authorization_code",
+		"code":          code,
+		"redirect_uri":  redirectURI,
+		"code_verifier": codeVerifier,
+	})
+}
+
+func (g *Gateway) RefreshAccessToken(ctx context.Context, credentials Credentials, refreshToken string) (OAuthToken, error) {
+	return g.requestToken(ctx, map[string]string{
+		"client_id":     credentials.ClientID,
+		"client_secret": credentials.ClientSecret,
+		"grant_type":    "refresh_token",
+		"refresh_token": refreshToken,
+	})
+}
+
+func (g *Gateway) requestToken(ctx context.Context, params map[string]string) (OAuthToken, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "Token")
+	defer cancel()
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s%s%s", _baseURL, "/oauth/token?", queryParams), nil)
+	for key, value := range params {
+		if value == "" {
+			delete(params, key)
+		}
+	}
+
+	b, err := json.Marshal(params)
 	if err != nil {
-		return "", err
+		return OAuthToken{}, err
 	}
 
-	resp, err := g.Client.Do(req)
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s%s", g.baseURL(), "/oauth/token"), bytes.NewReader(b))
 	if err != nil {
-		return "", err
+		return OAuthToken{}, err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	req.Header.Set("Content-Type", "application/json")
+
+	var token OAuthToken
+	if err := g.do(req, &token); err != nil {
+		return OAuthToken{}, err
+	}
+
+	return token, nil
+}
+
+func (g *Gateway) CreatePreference(ctx context.Context, accessToken string, preference NewPreference) (Preference, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "CreatePreference")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	b, err := json.Marshal(preference)
 	if err != nil {
-		return "", err
+		return Preference{}, err
 	}
 
-	if resp.StatusCode >= http.StatusBadRequest {
-		return "", NewError(string(body), resp.StatusCode)
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s%s%s", g.baseURL(), "/checkout/preferences?", queryParams), bytes.NewReader(b))
+	if err != nil {
+		return Preference{}, err
 	}
 
-	var r struct {
-		AccessToken string `json:"access_token"`
+	var created Preference
+	if err := g.do(req, &created); err != nil {
+		return Preference{}, err
 	}
 
-	if err := json.Unmarshal(body, &r); err != nil {
-		return "", err
+	created.CheckoutURL = g.Environment.CheckoutURL(created)
+	return created, nil
+}
+
+func (g *Gateway) GetPreference(ctx context.Context, accessToken string, preferenceID string) (Preference, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "GetPreference")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s?%s", g.baseURL(), "/checkout/preferences/", url.PathEscape(preferenceID), queryParams), nil)
+	if err != nil {
+		return Preference{}, err
+	}
+
+	var preference Preference
+	if err := g.do(req, &preference); err != nil {
+		return Preference{}, err
 	}
 
-	return r.AccessToken, nil
+	preference.CheckoutURL = g.Environment.CheckoutURL(preference)
+	return preference, nil
 }
 
-func (g *Gateway) CreatePreference(accessToken string, preference NewPreference) (string, error) {
+func (g *Gateway) UpdatePreference(ctx context.Context, accessToken string, preferenceID string, update PreferenceUpdate) (Preference, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "UpdatePreference")
+	defer cancel()
+
 	queryValues := &url.Values{}
 	queryValues.Add("access_token", accessToken)
 	queryParams := queryValues.Encode()
 
-	b, err := json.Marshal(preference)
+	b, err := json.Marshal(update)
 	if err != nil {
-		return "", err
+		return Preference{}, err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s%s%s", _baseURL, "/checkout/preferences?", queryParams), bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%s%s%s?%s", g.baseURL(), "/checkout/preferences/", url.PathEscape(preferenceID), queryParams), bytes.NewReader(b))
 	if err != nil {
-		return "", err
+		return Preference{}, err
 	}
 
-	resp, err := g.Client.Do(req)
+	var preference Preference
+	if err := g.do(req, &preference); err != nil {
+		return Preference{}, err
+	}
+
+	preference.CheckoutURL = g.Environment.CheckoutURL(preference)
+	return preference, nil
+}
+
+func (g *Gateway) SearchPreferences(ctx context.Context, accessToken string, search PreferenceSearch) (PreferenceSearchResult, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "SearchPreferences")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryValues.Add("external_reference", search.ExternalReference)
+	if search.Limit > 0 {
+		queryValues.Add("limit", strconv.Itoa(search.Limit))
+	}
+
+	queryValues.Add("offset", strconv.Itoa(search.Offset))
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s", g.baseURL(), "/checkout/preferences/search?", queryParams), nil)
 	if err != nil {
-		return "", err
+		return PreferenceSearchResult{}, err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	var result PreferenceSearchResult
+	if err := g.do(req, &result); err != nil {
+		return PreferenceSearchResult{}, err
+	}
+
+	for i := range result.Elements {
+		result.Elements[i].CheckoutURL = g.Environment.CheckoutURL(result.Elements[i])
+	}
+
+	return result, nil
+}
+
+func (g *Gateway) GetTotalPayments(ctx context.Context, accessToken string, status string) (int, error) {
+	result, err := g.SearchPayments(ctx, accessToken, PaymentSearch{
+		Status: status,
+		Limit:  1,
+	})
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 
-	if resp.StatusCode >= http.StatusBadRequest {
-		return "", NewError(string(body), resp.StatusCode)
+	return result.Paging.Total, nil
+}
+
+func (g *Gateway) SearchPayments(ctx context.Context, accessToken string, search PaymentSearch) (PaymentSearchResult, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "SearchPayments")
+	defer cancel()
+
+	queryValues := search.queryValues()
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s", g.baseURL(), "/v1/payments/search?", queryParams), nil)
+	if err != nil {
+		return PaymentSearchResult{}, err
 	}
 
-	var r struct {
-		CheckoutURL string `json:"init_point"`
+	var result PaymentSearchResult
+	if err := g.do(req, &result); err != nil {
+		return PaymentSearchResult{}, err
 	}
 
-	if err := json.Unmarshal(body, &r); err != nil {
-		return "", err
+	return result, nil
+}
+
+func (g *Gateway) GetPayment(ctx context.Context, accessToken string, paymentID int64) (Payment, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "GetPayment")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%d?%s", g.baseURL(), "/v1/payments/", paymentID, queryParams), nil)
+	if err != nil {
+		return Payment{}, err
 	}
 
-	return r.CheckoutURL, nil
+	var payment Payment
+	if err := g.do(req, &payment); err != nil {
+		return Payment{}, err
+	}
+
+	return payment, nil
 }
 
-func (g *Gateway) GetTotalPayments(accessToken string, status string) (int, error) {
+func (g *Gateway) CreatePayment(ctx context.Context, accessToken string, payment NewPayment) (Payment, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "CreatePayment")
+	defer cancel()
+
 	queryValues := &url.Values{}
-	queryValues.Add("limit", "1")
-	queryValues.Add("offset", "0")
 	queryValues.Add("access_token", accessToken)
-	queryValues.Add("status", status)
+	queryParams := queryValues.Encode()
+
+	b, err := json.Marshal(payment)
+	if err != nil {
+		return Payment{}, err
+	}
 
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s%s%s", g.baseURL(), "/v1/payments?", queryParams), bytes.NewReader(b))
+	if err != nil {
+		return Payment{}, err
+	}
+
+	var created Payment
+	if err := g.do(req, &created); err != nil {
+		return Payment{}, err
+	}
+
+	return created, nil
+}
+
+func (g *Gateway) UpdatePayment(ctx context.Context, accessToken string, paymentID int64, update PaymentUpdate) (Payment, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "UpdatePayment")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
 	queryParams := queryValues.Encode()
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s%s", _baseURL, "/v1/payments/search?", queryParams), nil)
+	b, err := json.Marshal(update)
 	if err != nil {
-		return 0, err
+		return Payment{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%s%s%d?%s", g.baseURL(), "/v1/payments/", paymentID, queryParams), bytes.NewReader(b))
+	if err != nil {
+		return Payment{}, err
+	}
+
+	var payment Payment
+	if err := g.do(req, &payment); err != nil {
+		return Payment{}, err
+	}
+
+	return payment, nil
+}
+
+func (g *Gateway) CreateRefund(ctx context.Context, accessToken string, paymentID int64, refund NewRefund) (Refund, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "CreateRefund")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	b, err := json.Marshal(refund)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s%s%d%s%s", g.baseURL(), "/v1/payments/", paymentID, "/refunds?", queryParams), bytes.NewReader(b))
+	if err != nil {
+		return Refund{}, err
+	}
+
+	var r Refund
+	if err := g.do(req, &r); err != nil {
+		return Refund{}, err
+	}
+
+	return r, nil
+}
+
+func (g *Gateway) GetRefunds(ctx context.Context, accessToken string, paymentID int64) ([]Refund, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "GetRefunds")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%d%s%s", g.baseURL(), "/v1/payments/", paymentID, "/refunds?", queryParams), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var refunds []Refund
+	if err := g.do(req, &refunds); err != nil {
+		return nil, err
+	}
+
+	return refunds, nil
+}
+
+func (g *Gateway) CreateCustomer(ctx context.Context, accessToken string, customer NewCustomer) (Customer, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "CreateCustomer")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	b, err := json.Marshal(customer)
+	if err != nil {
+		return Customer{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s%s%s", g.baseURL(), "/v1/customers?", queryParams), bytes.NewReader(b))
+	if err != nil {
+		return Customer{}, err
+	}
+
+	var created Customer
+	if err := g.do(req, &created); err != nil {
+		return Customer{}, err
+	}
+
+	return created, nil
+}
+
+func (g *Gateway) GetCustomer(ctx context.Context, accessToken string, customerID string) (Customer, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "GetCustomer")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s?%s", g.baseURL(), "/v1/customers/", url.PathEscape(customerID), queryParams), nil)
+	if err != nil {
+		return Customer{}, err
+	}
+
+	var customer Customer
+	if err := g.do(req, &customer); err != nil {
+		return Customer{}, err
+	}
+
+	return customer, nil
+}
+
+func (g *Gateway) SearchCustomers(ctx context.Context, accessToken string, email string) (CustomerSearchResult, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "SearchCustomers")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryValues.Add("email", email)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s", g.baseURL(), "/v1/customers/search?", queryParams), nil)
+	if err != nil {
+		return CustomerSearchResult{}, err
+	}
+
+	var result CustomerSearchResult
+	if err := g.do(req, &result); err != nil {
+		return CustomerSearchResult{}, err
+	}
+
+	return result, nil
+}
+
+func (g *Gateway) UpdateCustomer(ctx context.Context, accessToken string, customerID string, update CustomerUpdate) (Customer, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "UpdateCustomer")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	b, err := json.Marshal(update)
+	if err != nil {
+		return Customer{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%s%s%s?%s", g.baseURL(), "/v1/customers/", url.PathEscape(customerID), queryParams), bytes.NewReader(b))
+	if err != nil {
+		return Customer{}, err
+	}
+
+	var customer Customer
+	if err := g.do(req, &customer); err != nil {
+		return Customer{}, err
+	}
+
+	return customer, nil
+}
+
+func (g *Gateway) DeleteCustomer(ctx context.Context, accessToken string, customerID string) error {
+	ctx, cancel := g.Timeouts.context(ctx, "DeleteCustomer")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s%s%s?%s", g.baseURL(), "/v1/customers/", url.PathEscape(customerID), queryParams), nil)
+	if err != nil {
+		return err
+	}
+
+	return g.do(req, nil)
+}
+
+func (g *Gateway) CreateCard(ctx context.Context, accessToken string, customerID string, card NewCard) (Card, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "CreateCard")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	b, err := json.Marshal(card)
+	if err != nil {
+		return Card{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s%s%s%s%s", g.baseURL(), "/v1/customers/", url.PathEscape(customerID), "/cards?", queryParams), bytes.NewReader(b))
+	if err != nil {
+		return Card{}, err
+	}
+
+	var created Card
+	if err := g.do(req, &created); err != nil {
+		return Card{}, err
+	}
+
+	return created, nil
+}
+
+func (g *Gateway) GetCards(ctx context.Context, accessToken string, customerID string) ([]Card, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "GetCards")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s%s%s", g.baseURL(), "/v1/customers/", url.PathEscape(customerID), "/cards?", queryParams), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var cards []Card
+	if err := g.do(req, &cards); err != nil {
+		return nil, err
+	}
+
+	return cards, nil
+}
+
+func (g *Gateway) DeleteCard(ctx context.Context, accessToken string, customerID string, cardID string) error {
+	ctx, cancel := g.Timeouts.context(ctx, "DeleteCard")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s%s%s%s%s?%s", g.baseURL(), "/v1/customers/", url.PathEscape(customerID), "/cards/", url.PathEscape(cardID), queryParams), nil)
+	if err != nil {
+		return err
+	}
+
+	return g.do(req, nil)
+}
+
+func (g *Gateway) GetPaymentMethods(ctx context.Context, accessToken string) ([]PaymentMethod, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "GetPaymentMethods")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s", g.baseURL(), "/v1/payment_methods?", queryParams), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var paymentMethods []PaymentMethod
+	if err := g.do(req, &paymentMethods); err != nil {
+		return nil, err
+	}
+
+	return paymentMethods, nil
+}
+
+func (g *Gateway) GetCardIssuers(ctx context.Context, accessToken string, paymentMethodID string) ([]Issuer, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "GetCardIssuers")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryValues.Add("payment_method_id", paymentMethodID)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s", g.baseURL(), "/v1/payment_methods/card_issuers?", queryParams), nil)
+	if err != nil {
+		return nil, err
 	}
 
+	var issuers []Issuer
+	if err := g.do(req, &issuers); err != nil {
+		return nil, err
+	}
+
+	return issuers, nil
+}
+
+func (g *Gateway) GetInstallments(ctx context.Context, accessToken string, search InstallmentsSearch) ([]Installments, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "GetInstallments")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryValues.Add("amount", strconv.FormatFloat(search.Amount, 'f', -1, 64))
+	if search.Bin != "" {
+		queryValues.Add("bin", search.Bin)
+	}
+
+	if search.PaymentMethodID != "" {
+		queryValues.Add("payment_method_id", search.PaymentMethodID)
+	}
+
+	if search.IssuerID != "" {
+		queryValues.Add("issuer.id", search.IssuerID)
+	}
+
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s", g.baseURL(), "/v1/payment_methods/installments?", queryParams), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var installments []Installments
+	if err := g.do(req, &installments); err != nil {
+		return nil, err
+	}
+
+	return installments, nil
+}
+
+func (g *Gateway) GetMerchantOrder(ctx context.Context, accessToken string, merchantOrderID int64) (MerchantOrder, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "GetMerchantOrder")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%d?%s", g.baseURL(), "/merchant_orders/", merchantOrderID, queryParams), nil)
+	if err != nil {
+		return MerchantOrder{}, err
+	}
+
+	var merchantOrder MerchantOrder
+	if err := g.do(req, &merchantOrder); err != nil {
+		return MerchantOrder{}, err
+	}
+
+	return merchantOrder, nil
+}
+
+func (g *Gateway) SearchMerchantOrders(ctx context.Context, accessToken string, search MerchantOrderSearch) (MerchantOrderSearchResult, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "SearchMerchantOrders")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	if search.PreferenceID != "" {
+		queryValues.Add("preference_id", search.PreferenceID)
+	}
+
+	if search.ExternalReference != "" {
+		queryValues.Add("external_reference", search.ExternalReference)
+	}
+
+	if search.Limit > 0 {
+		queryValues.Add("limit", strconv.Itoa(search.Limit))
+	}
+
+	queryValues.Add("offset", strconv.Itoa(search.Offset))
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s", g.baseURL(), "/merchant_orders/search?", queryParams), nil)
+	if err != nil {
+		return MerchantOrderSearchResult{}, err
+	}
+
+	var result MerchantOrderSearchResult
+	if err := g.do(req, &result); err != nil {
+		return MerchantOrderSearchResult{}, err
+	}
+
+	return result, nil
+}
+
+func (g *Gateway) CreatePreapprovalPlan(ctx context.Context, accessToken string, plan NewPreapprovalPlan) (PreapprovalPlan, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "CreatePreapprovalPlan")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	b, err := json.Marshal(plan)
+	if err != nil {
+		return PreapprovalPlan{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s%s%s", g.baseURL(), "/preapproval_plan?", queryParams), bytes.NewReader(b))
+	if err != nil {
+		return PreapprovalPlan{}, err
+	}
+
+	var created PreapprovalPlan
+	if err := g.do(req, &created); err != nil {
+		return PreapprovalPlan{}, err
+	}
+
+	return created, nil
+}
+
+func (g *Gateway) UpdatePreapprovalPlan(ctx context.Context, accessToken string, planID string, update PreapprovalPlanUpdate) (PreapprovalPlan, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "UpdatePreapprovalPlan")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	b, err := json.Marshal(update)
+	if err != nil {
+		return PreapprovalPlan{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%s%s%s?%s", g.baseURL(), "/preapproval_plan/", url.PathEscape(planID), queryParams), bytes.NewReader(b))
+	if err != nil {
+		return PreapprovalPlan{}, err
+	}
+
+	var plan PreapprovalPlan
+	if err := g.do(req, &plan); err != nil {
+		return PreapprovalPlan{}, err
+	}
+
+	return plan, nil
+}
+
+func (g *Gateway) CreatePreapproval(ctx context.Context, accessToken string, preapproval NewPreapproval) (Preapproval, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "CreatePreapproval")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	b, err := json.Marshal(preapproval)
+	if err != nil {
+		return Preapproval{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s%s%s", g.baseURL(), "/preapproval?", queryParams), bytes.NewReader(b))
+	if err != nil {
+		return Preapproval{}, err
+	}
+
+	var created Preapproval
+	if err := g.do(req, &created); err != nil {
+		return Preapproval{}, err
+	}
+
+	return created, nil
+}
+
+func (g *Gateway) GetPreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "GetPreapproval")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s?%s", g.baseURL(), "/preapproval/", url.PathEscape(preapprovalID), queryParams), nil)
+	if err != nil {
+		return Preapproval{}, err
+	}
+
+	var preapproval Preapproval
+	if err := g.do(req, &preapproval); err != nil {
+		return Preapproval{}, err
+	}
+
+	return preapproval, nil
+}
+
+func (g *Gateway) SearchPreapprovals(ctx context.Context, accessToken string, search PreapprovalSearch) (PreapprovalSearchResult, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "SearchPreapprovals")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	if search.PayerEmail != "" {
+		queryValues.Add("payer_email", search.PayerEmail)
+	}
+
+	if search.Status != "" {
+		queryValues.Add("status", search.Status)
+	}
+
+	if search.PreapprovalPlanID != "" {
+		queryValues.Add("preapproval_plan_id", search.PreapprovalPlanID)
+	}
+
+	if search.Limit > 0 {
+		queryValues.Add("limit", strconv.Itoa(search.Limit))
+	}
+
+	queryValues.Add("offset", strconv.Itoa(search.Offset))
+	queryParams := queryValues.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s%s", g.baseURL(), "/preapproval/search?", queryParams), nil)
+	if err != nil {
+		return PreapprovalSearchResult{}, err
+	}
+
+	var result PreapprovalSearchResult
+	if err := g.do(req, &result); err != nil {
+		return PreapprovalSearchResult{}, err
+	}
+
+	return result, nil
+}
+
+func (g *Gateway) UpdatePreapproval(ctx context.Context, accessToken string, preapprovalID string, update PreapprovalUpdate) (Preapproval, error) {
+	ctx, cancel := g.Timeouts.context(ctx, "UpdatePreapproval")
+	defer cancel()
+
+	queryValues := &url.Values{}
+	queryValues.Add("access_token", accessToken)
+	queryParams := queryValues.Encode()
+
+	b, err := json.Marshal(update)
+	if err != nil {
+		return Preapproval{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%s%s%s?%s", g.baseURL(), "/preapproval/", url.PathEscape(preapprovalID), queryParams), bytes.NewReader(b))
+	if err != nil {
+		return Preapproval{}, err
+	}
+
+	var preapproval Preapproval
+	if err := g.do(req, &preapproval); err != nil {
+		return Preapproval{}, err
+	}
+
+	return preapproval, nil
+}
+
+func (s PaymentSearch) queryValues() *url.Values {
+	queryValues := &url.Values{}
+	add := func(key string, value string) {
+		if value != "" {
+			queryValues.Add(key, value)
+		}
+	}
+
+	add("status", s.Status)
+	if s.BeginDate != "" || s.EndDate != "" {
+		dateRange := s.Range
+		if dateRange == "" {
+			dateRange = "date_created"
+		}
+
+		add("range", dateRange)
+		add("begin_date", s.BeginDate)
+		add("end_date", s.EndDate)
+	}
+
+	add("external_reference", s.ExternalReference)
+	add("payer.email", s.PayerEmail)
+	add("payment_method_id", s.PaymentMethodID)
+	add("sort", s.Sort)
+	add("criteria", s.Criteria)
+	if s.Limit > 0 {
+		add("limit", strconv.Itoa(s.Limit))
+	}
+
+	add("offset", strconv.Itoa(s.Offset))
+	return queryValues
+}
+
+func (g *Gateway) do(req *http.Request, v interface{}) error {
+	setIdempotencyKey(req)
 	resp, err := g.Client.Do(req)
 	if err != nil {
-		return 0, err
+		return transportError(req, err)
 	}
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return 0, err
+		return transportError(req, err)
 	}
 
 	if resp.StatusCode >= http.StatusBadRequest {
-		return 0, NewError(string(body), resp.StatusCode)
+		return upstreamError(resp.StatusCode, body)
 	}
 
-	var r struct {
-		Paging struct {
-			TotalPayments int `json:"total"`
-		} `json:"paging"`
+	if v == nil {
+		return nil
 	}
 
-	if err := json.Unmarshal(body, &r); err != nil {
-		return 0, err
+	return json.Unmarshal(body, v)
+}
+
+// transportError turns a call that couldn't reach Mercado Pago into a 502,
+// or a 504 when it ran out of time. Its message only names the method and
+// path: the URL http.Client reports carries the access token in its query.
+func transportError(req *http.Request, err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return NewError(fmt.Sprintf("mercado pago didn't answer %s %s in time", req.Method, req.URL.Path), http.StatusGatewayTimeout)
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("calling mercado pago %s %s: %w", req.Method, req.URL.Path, context.Canceled)
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return NewError(fmt.Sprintf("couldn't reach mercado pago %s %s: %v", req.Method, req.URL.Path, urlErr.Err), http.StatusBadGateway)
 	}
 
-	return r.Paging.TotalPayments, nil
+	return err
 }
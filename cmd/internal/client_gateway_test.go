@@ -2,19 +2,27 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/mateoferrari97/mercadopago/cmd/internal/fakemp"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type ClientStub struct {
+	req  *http.Request
 	resp *http.Response
 	err  error
 }
 
-func (c *ClientStub) Do(_ *http.Request) (*http.Response, error) {
+func (c *ClientStub) Do(req *http.Request) (*http.Response, error) {
+	c.req = req
 	if c.err != nil {
 		return &http.Response{}, c.err
 	}
@@ -22,7 +30,7 @@ func (c *ClientStub) Do(_ *http.Request) (*http.Response, error) {
 	return c.resp, nil
 }
 
-func TestGateway_GetAccessToken(t *testing.T) {
+func TestGateway_GetToken(t *testing.T) {
 	// Given
 	c := &ClientStub{}
 	g := &Gateway{Client: c}
@@ -32,17 +40,17 @@ func TestGateway_GetAccessToken(t *testing.T) {
 		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"access_token": "1234"}`))),
 	}
 	// When
-	accessToken, err := g.GetAccessToken(Credentials{
+	token, err := g.GetToken(context.Background(), Credentials{
 		ClientID:     "ABC123",
 		ClientSecret: "123ABC",
 	})
 
 	// Then
 	require.NoError(t, err)
-	require.Equal(t, accessToken, "1234")
+	require.Equal(t, "1234", token.AccessToken)
 }
 
-func TestGateway_GetAccessToken_MercadoPagoError(t *testing.T) {
+func TestGateway_GetToken_MercadoPagoError(t *testing.T) {
 	// Given
 	c := &ClientStub{}
 	g := &Gateway{Client: c}
@@ -52,17 +60,17 @@ func TestGateway_GetAccessToken_MercadoPagoError(t *testing.T) {
 		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "internal server error"}`))),
 	}
 	// When
-	_, err := g.GetAccessToken(Credentials{
+	_, err := g.GetToken(context.Background(), Credentials{
 		ClientID:     "ABC123",
 		ClientSecret: "123ABC",
 	})
 
 	// Then
 	require.Error(t, err)
-	require.EqualError(t, err, "{\"error\": \"internal server error\"}")
+	require.EqualError(t, err, "internal server error")
 }
 
-func TestGateway_GetAccessToken_UnmarshalError(t *testing.T) {
+func TestGateway_GetToken_UnmarshalError(t *testing.T) {
 	// Given
 	c := &ClientStub{}
 	g := &Gateway{Client: c}
@@ -72,23 +80,23 @@ func TestGateway_GetAccessToken_UnmarshalError(t *testing.T) {
 		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"access_token": 1123}`))),
 	}
 	// When
-	_, err := g.GetAccessToken(Credentials{
+	_, err := g.GetToken(context.Background(), Credentials{
 		ClientID:     "ABC123",
 		ClientSecret: "123ABC",
 	})
 
 	// Then
 	require.Error(t, err)
-	require.EqualError(t, err, "json: cannot unmarshal number into Go struct field .access_token of type string")
+	require.EqualError(t, err, "json: cannot unmarshal number into Go struct field OAuthToken.access_token of type string")
 }
 
-func TestGateway_GetAccessToken_DoError(t *testing.T) {
+func TestGateway_GetToken_DoError(t *testing.T) {
 	// Given
 	c := &ClientStub{}
 	g := &Gateway{Client: c}
 	c.err = errors.New("do error")
 	// When
-	_, err := g.GetAccessToken(Credentials{
+	_, err := g.GetToken(context.Background(), Credentials{
 		ClientID:     "ABC123",
 		ClientSecret: "123ABC",
 	})
@@ -98,6 +106,93 @@ func TestGateway_GetAccessToken_DoError(t *testing.T) {
 	require.EqualError(t, err, "do error")
 }
 
+func TestGateway_ExchangeAuthorizationCode(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"access_token": "APP_USR-1234", "refresh_token": "TG-1234", "expires_in": 15552000, "user_id": 987}`))),
+	}
+
+	// When
+	token, err := g.ExchangeAuthorizationCode(context.Background(), Credentials{
+		ClientID:     "ABC123",
+		ClientSecret: "123ABC",
+	}, "TG-CODE", "https://shop.com/oauth/callback", "MY_VERIFIER")
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "APP_USR-1234", token.AccessToken)
+	require.Equal(t, "TG-1234", token.RefreshToken)
+	require.Equal(t, int64(15552000), token.ExpiresIn)
+	require.Equal(t, int64(987), token.UserID)
+
+	var body map[string]string
+	b, err := ioutil.ReadAll(c.req.Body)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &body))
+	require.Equal(t, "/oauth/token", c.req.URL.Path)
+	require.Equal(t, map[string]string{
+		"client_id":     "ABC123",
+		"client_secret": "123ABC",
+		"grant_type":    "authorization_code",
+		"code":          "TG-CODE",
+		"redirect_uri":  "https://shop.com/oauth/callback",
+		"code_verifier": "MY_VERIFIER",
+	}, body)
+}
+
+func TestGateway_RefreshAccessToken(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"access_token": "APP_USR-5678", "refresh_token": "TG-5678", "user_id": 987}`))),
+	}
+
+	// When
+	token, err := g.RefreshAccessToken(context.Background(), Credentials{
+		ClientID:     "ABC123",
+		ClientSecret: "123ABC",
+	}, "TG-1234")
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "APP_USR-5678", token.AccessToken)
+
+	var body map[string]string
+	b, err := ioutil.ReadAll(c.req.Body)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &body))
+	require.Equal(t, "refresh_token", body["grant_type"])
+	require.Equal(t, "TG-1234", body["refresh_token"])
+}
+
+func TestGateway_ExchangeAuthorizationCode_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "400",
+		StatusCode: 400,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "invalid_grant"}`))),
+	}
+
+	// When
+	_, err := g.ExchangeAuthorizationCode(context.Background(), Credentials{
+		ClientID:     "ABC123",
+		ClientSecret: "123ABC",
+	}, "TG-CODE", "https://shop.com/oauth/callback", "")
+
+	// Then
+	require.EqualError(t, err, "invalid_grant")
+	require.Equal(t, http.StatusBadRequest, getStatusCodeFromError(err))
+}
+
 func TestGateway_CreatePreference(t *testing.T) {
 	// Given
 	c := &ClientStub{}
@@ -105,117 +200,1268 @@ func TestGateway_CreatePreference(t *testing.T) {
 	c.resp = &http.Response{
 		Status:     "200",
 		StatusCode: 200,
-		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"init_point": "https://mercadopago.com/checkout"}`))),
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "123-abc", "init_point": "https://mercadopago.com/checkout", "sandbox_init_point": "https://sandbox.mercadopago.com/checkout", "date_created": "2020-06-14T10:00:00.000-04:00"}`))),
+	}
+	// When
+	preference, err := g.CreatePreference(context.Background(), "", newPreference())
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, Preference{
+		ID:               "123-abc",
+		InitPoint:        "https://mercadopago.com/checkout",
+		SandboxInitPoint: "https://sandbox.mercadopago.com/checkout",
+		CheckoutURL:      "https://mercadopago.com/checkout",
+		CreatedAt:        "2020-06-14T10:00:00.000-04:00",
+	}, preference)
+}
+
+func TestGateway_CreatePreference_Sandbox(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c, Environment: Sandbox}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "123-abc", "init_point": "https://mercadopago.com/checkout", "sandbox_init_point": "https://sandbox.mercadopago.com/checkout"}`))),
+	}
+
+	// When
+	preference, err := g.CreatePreference(context.Background(), "", newPreference())
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "https://sandbox.mercadopago.com/checkout", preference.CheckoutURL)
+}
+
+func TestGateway_BaseURL(t *testing.T) {
+	// Given
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprintf(w, `{"id": "123-abc", "init_point": "https://mercadopago.com/checkout"}`)
+	}))
+	defer ts.Close()
+
+	g := NewClientGateway(&http.Client{})
+	g.BaseURL = ts.URL + "/"
+
+	// When
+	preference, err := g.GetPreference(context.Background(), "MY_ACCESS_TOKEN", "123-abc")
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "/checkout/preferences/123-abc", path)
+	require.Equal(t, "https://mercadopago.com/checkout", preference.CheckoutURL)
+}
+
+func TestParseEnvironment(t *testing.T) {
+	tt := []struct {
+		value   string
+		want    Environment
+		wantErr bool
+	}{
+		{value: "", want: Production},
+		{value: "production", want: Production},
+		{value: "sandbox", want: Sandbox},
+		{value: "staging", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.value, func(t *testing.T) {
+			// When
+			env, err := ParseEnvironment(tc.value)
+
+			// Then
+			if tc.wantErr {
+				require.EqualError(t, err, `unknown environment "staging": must be production or sandbox`)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.want, env)
+		})
+	}
+}
+
+func TestGateway_Timeout(t *testing.T) {
+	// Given
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	g := NewClientGateway(&http.Client{})
+	g.BaseURL = ts.URL
+	g.Timeouts = Timeouts{Default: time.Minute, Operations: map[string]time.Duration{"GetPayment": 10 * time.Millisecond}}
+
+	// When
+	_, err := g.GetPayment(context.Background(), "MY_ACCESS_TOKEN", 123)
+
+	// Then
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, http.StatusGatewayTimeout, e.StatusCode)
+	require.Equal(t, "mercado pago didn't answer GET /v1/payments/123 in time", e.Message)
+}
+
+func TestGateway_GetToken_Timeout(t *testing.T) {
+	// Given
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client is gone once the body is read.
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	g := NewClientGateway(&http.Client{})
+	g.BaseURL = ts.URL
+	g.Timeouts = Timeouts{Default: time.Minute, Operations: map[string]time.Duration{"Token": 10 * time.Millisecond}}
+
+	// When
+	_, err := g.GetToken(context.Background(), Credentials{ClientID: "MY_CLIENT_ID", ClientSecret: "MY_CLIENT_SECRET"})
+
+	// Then
+	require.Equal(t, http.StatusGatewayTimeout, getStatusCodeFromError(err))
+	require.EqualError(t, err, "mercado pago didn't answer POST /oauth/token in time")
+}
+
+func TestGateway_Unreachable(t *testing.T) {
+	// Given
+	g := NewClientGateway(&http.Client{})
+	g.BaseURL = "http://127.0.0.1:1"
+
+	// When
+	_, err := g.GetPayment(context.Background(), "SECRET_TOKEN_123", 123)
+
+	// Then
+	var e *Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, http.StatusBadGateway, e.StatusCode)
+	require.Contains(t, e.Message, "couldn't reach mercado pago GET /v1/payments/123: ")
+	require.NotContains(t, e.Message, "SECRET_TOKEN_123")
+}
+
+func TestGateway_Canceled(t *testing.T) {
+	// Given
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	g := NewClientGateway(&http.Client{})
+	g.BaseURL = ts.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	// When
+	_, err := g.GetPayment(ctx, "MY_ACCESS_TOKEN", 123)
+
+	// Then
+	require.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestParseTimeouts(t *testing.T) {
+	tt := []struct {
+		name       string
+		def        string
+		operations string
+		want       Timeouts
+		wantErr    string
+	}{
+		{
+			name: "defaults",
+			want: Timeouts{Default: _defaultTimeout, Operations: map[string]time.Duration{}},
+		},
+		{
+			name:       "overrides",
+			def:        "5s",
+			operations: "SearchPayments=30s, Token=2s",
+			want:       Timeouts{Default: 5 * time.Second, Operations: map[string]time.Duration{"SearchPayments": 30 * time.Second, "Token": 2 * time.Second}},
+		},
+		{
+			name:    "invalid default",
+			def:     "soon",
+			wantErr: `invalid default timeout "soon": time: invalid duration "soon"`,
+		},
+		{
+			name:       "missing duration",
+			operations: "SearchPayments",
+			wantErr:    `invalid timeout "SearchPayments": must be operation=duration`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			timeouts, err := ParseTimeouts(tc.def, tc.operations)
+
+			// Then
+			if tc.wantErr != "" {
+				require.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.want, timeouts)
+		})
+	}
+}
+
+func TestGateway_CreatePreference_Body(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"init_point": "https://mercadopago.com/checkout"}`))),
+	}
+
+	preference := newPreference()
+	preference.ExternalReference = "ORDER-1"
+	preference.Expires = true
+	preference.ExpirationDateTo = "2020-06-30T23:59:59.000-03:00"
+	preference.PaymentMethods = &PreferencePaymentMethods{
+		ExcludedPaymentTypes: []PaymentMethodRef{{ID: "ticket"}},
+		Installments:         6,
+	}
+
+	// When
+	_, err := g.CreatePreference(context.Background(), "", preference)
+	require.NoError(t, err)
+
+	b, err := ioutil.ReadAll(c.req.Body)
+	require.NoError(t, err)
+
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &body))
+
+	// Then
+	require.Equal(t, "http://baseurl.com/failure", body["back_urls"].(map[string]interface{})["failure"])
+	require.Equal(t, "ORDER-1", body["external_reference"])
+	require.Equal(t, true, body["expires"])
+	require.Equal(t, map[string]interface{}{
+		"excluded_payment_types": []interface{}{map[string]interface{}{"id": "ticket"}},
+		"installments":           float64(6),
+	}, body["payment_methods"])
+	require.NotContains(t, body, "shipments")
+	require.NotContains(t, body, "notification_url")
+}
+
+func TestGateway_CreatePreference_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "500",
+		StatusCode: 500,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "internal server error"}`))),
+	}
+	// When
+	_, err := g.CreatePreference(context.Background(), "", newPreference())
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "internal server error")
+}
+
+func TestGateway_CreatePreference_UnmarshalError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"init_point": 1234}`))),
+	}
+	// When
+	_, err := g.CreatePreference(context.Background(), "", newPreference())
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "json: cannot unmarshal number into Go struct field Preference.init_point of type string")
+}
+
+func TestGateway_CreatePreference_DoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.err = errors.New("do error")
+	// When
+	_, err := g.CreatePreference(context.Background(), "", newPreference())
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "do error")
+}
+
+func TestGateway_GetPreference(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "123-abc", "external_reference": "ORDER-1", "expires": true, "expiration_date_to": "2020-06-30T23:59:59.000-03:00"}`))),
+	}
+
+	// When
+	preference, err := g.GetPreference(context.Background(), "MY_ACCESS_TOKEN", "123-abc")
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "GET", c.req.Method)
+	require.Equal(t, "/checkout/preferences/123-abc", c.req.URL.Path)
+	require.Equal(t, "ORDER-1", preference.ExternalReference)
+	require.True(t, preference.Expires)
+	require.Equal(t, "2020-06-30T23:59:59.000-03:00", preference.ExpirationDateTo)
+}
+
+func TestGateway_UpdatePreference(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "123-abc", "expires": false}`))),
+	}
+
+	expires := false
+
+	// When
+	_, err := g.UpdatePreference(context.Background(), "MY_ACCESS_TOKEN", "123-abc", PreferenceUpdate{Expires: &expires})
+	require.NoError(t, err)
+
+	b, err := ioutil.ReadAll(c.req.Body)
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, "PUT", c.req.Method)
+	require.Equal(t, "/checkout/preferences/123-abc", c.req.URL.Path)
+	require.JSONEq(t, `{"expires": false}`, string(b))
+}
+
+func TestGateway_SearchPreferences(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"elements": [{"id": "123-abc", "external_reference": "ORDER-1"}], "total": 1, "next_offset": 1}`))),
+	}
+
+	// When
+	result, err := g.SearchPreferences(context.Background(), "MY_ACCESS_TOKEN", PreferenceSearch{ExternalReference: "ORDER-1", Limit: 10})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "/checkout/preferences/search", c.req.URL.Path)
+	require.Equal(t, "ORDER-1", c.req.URL.Query().Get("external_reference"))
+	require.Equal(t, "10", c.req.URL.Query().Get("limit"))
+	require.Equal(t, 1, result.Total)
+	require.Equal(t, "123-abc", result.Elements[0].ID)
+}
+
+func TestGateway_GetTotalPayments(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"paging": {"total": 100,"limit": 1,"offset": 0}}`))),
+	}
+	// When
+	totalPayments, err := g.GetTotalPayments(context.Background(), "MY_ACCESS_TOKEN", "approved")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, 100, totalPayments)
+}
+
+func TestGateway_GetTotalPayments_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "500",
+		StatusCode: 500,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "internal server error"}`))),
+	}
+	// When
+	totalPayments, err := g.GetTotalPayments(context.Background(), "MY_ACCESS_TOKEN", "approved")
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "internal server error")
+	require.Equal(t, 0, totalPayments)
+}
+
+func TestGateway_GetTotalPayments_UnmarshalError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"paging": 0}`))),
+	}
+	// When
+	totalPayments, err := g.GetTotalPayments(context.Background(), "MY_ACCESS_TOKEN", "approved")
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "json: cannot unmarshal number into Go struct field PaymentSearchResult.paging of type internal.Paging")
+	require.Equal(t, 0, totalPayments)
+}
+
+func TestGateway_GetPayment(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": 123, "status": "approved", "status_detail": "accredited", "transaction_amount": 150.7, "payment_method_id": "visa", "external_reference": "ORDER-1", "payer": {"email": "m@gmail.com"}}`))),
+	}
+	// When
+	payment, err := g.GetPayment(context.Background(), "MY_ACCESS_TOKEN", 123)
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, int64(123), payment.ID)
+	require.Equal(t, "approved", payment.Status)
+	require.Equal(t, "accredited", payment.StatusDetail)
+	require.Equal(t, 150.7, payment.TransactionAmount)
+	require.Equal(t, "visa", payment.PaymentMethodID)
+	require.Equal(t, "ORDER-1", payment.ExternalReference)
+	require.Equal(t, "m@gmail.com", payment.Payer.Email)
+}
+
+func TestGateway_GetPayment_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "404",
+		StatusCode: 404,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "not found"}`))),
+	}
+	// When
+	_, err := g.GetPayment(context.Background(), "MY_ACCESS_TOKEN", 123)
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "not found")
+}
+
+func TestGateway_GetPayment_UnmarshalError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"status": 1}`))),
+	}
+	// When
+	_, err := g.GetPayment(context.Background(), "MY_ACCESS_TOKEN", 123)
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "json: cannot unmarshal number into Go struct field Payment.status of type string")
+}
+
+func TestGateway_GetPayment_DoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.err = errors.New("do error")
+	// When
+	_, err := g.GetPayment(context.Background(), "MY_ACCESS_TOKEN", 123)
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "do error")
+}
+
+func TestGateway_SearchPayments(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"paging": {"total": 2, "limit": 10, "offset": 0}, "results": [{"id": 1, "status": "approved"}, {"id": 2, "status": "approved"}]}`))),
+	}
+	// When
+	result, err := g.SearchPayments(context.Background(), "MY_ACCESS_TOKEN", PaymentSearch{
+		Status:            "approved",
+		BeginDate:         "2020-06-01T00:00:00Z",
+		EndDate:           "2020-06-30T00:00:00Z",
+		ExternalReference: "ORDER-1",
+		PayerEmail:        "m@gmail.com",
+		Sort:              "date_created",
+		Criteria:          "desc",
+		Limit:             10,
+	})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, Paging{Total: 2, Limit: 10, Offset: 0}, result.Paging)
+	require.Len(t, result.Results, 2)
+	require.Equal(t, int64(2), result.Results[1].ID)
+
+	query := c.req.URL.Query()
+	require.Equal(t, "/v1/payments/search", c.req.URL.Path)
+	require.Equal(t, "approved", query.Get("status"))
+	require.Equal(t, "date_created", query.Get("range"))
+	require.Equal(t, "2020-06-01T00:00:00Z", query.Get("begin_date"))
+	require.Equal(t, "2020-06-30T00:00:00Z", query.Get("end_date"))
+	require.Equal(t, "ORDER-1", query.Get("external_reference"))
+	require.Equal(t, "m@gmail.com", query.Get("payer.email"))
+	require.Equal(t, "date_created", query.Get("sort"))
+	require.Equal(t, "desc", query.Get("criteria"))
+	require.Equal(t, "10", query.Get("limit"))
+	require.Equal(t, "0", query.Get("offset"))
+	require.Equal(t, "MY_ACCESS_TOKEN", query.Get("access_token"))
+}
+
+func TestGateway_SearchPayments_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "400",
+		StatusCode: 400,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "bad request"}`))),
+	}
+	// When
+	_, err := g.SearchPayments(context.Background(), "MY_ACCESS_TOKEN", PaymentSearch{})
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "bad request")
+}
+
+func TestGateway_SearchPayments_DoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.err = errors.New("do error")
+	// When
+	_, err := g.SearchPayments(context.Background(), "MY_ACCESS_TOKEN", PaymentSearch{})
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "do error")
+}
+
+func TestGateway_CreatePayment(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "201",
+		StatusCode: 201,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": 123, "status": "approved", "status_detail": "accredited"}`))),
+	}
+	// When
+	payment, err := g.CreatePayment(context.Background(), "MY_ACCESS_TOKEN", newPayment())
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, int64(123), payment.ID)
+	require.Equal(t, "approved", payment.Status)
+	require.Equal(t, "accredited", payment.StatusDetail)
+	require.Equal(t, "POST", c.req.Method)
+	require.Equal(t, "/v1/payments", c.req.URL.Path)
+}
+
+func TestGateway_CreatePayment_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "400",
+		StatusCode: 400,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "bad request"}`))),
+	}
+	// When
+	_, err := g.CreatePayment(context.Background(), "MY_ACCESS_TOKEN", newPayment())
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "bad request")
+}
+
+func TestGateway_CreatePayment_DoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.err = errors.New("do error")
+	// When
+	_, err := g.CreatePayment(context.Background(), "MY_ACCESS_TOKEN", newPayment())
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "do error")
+}
+
+func TestGateway_UpdatePayment(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": 123, "status": "approved", "transaction_amount": 80}`))),
+	}
+	// When
+	payment, err := g.UpdatePayment(context.Background(), "MY_ACCESS_TOKEN", 123, PaymentUpdate{Capture: true, TransactionAmount: 80})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "approved", payment.Status)
+	require.Equal(t, "PUT", c.req.Method)
+	require.Equal(t, "/v1/payments/123", c.req.URL.Path)
+
+	body, err := ioutil.ReadAll(c.req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, `{"capture":true,"transaction_amount":80}`, string(body))
+}
+
+func TestGateway_UpdatePayment_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "400",
+		StatusCode: 400,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "bad request"}`))),
+	}
+	// When
+	_, err := g.UpdatePayment(context.Background(), "MY_ACCESS_TOKEN", 123, PaymentUpdate{Status: "cancelled"})
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "bad request")
+}
+
+func TestGateway_CreateRefund(t *testing.T) {
+	tt := []struct{
+		name string
+		refund NewRefund
+		wantBody string
+	}{
+		{
+			name: "full refund",
+			refund: NewRefund{},
+			wantBody: `{}`,
+		},
+		{
+			name: "partial refund",
+			refund: NewRefund{Amount: 50.5},
+			wantBody: `{"amount":50.5}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			c := &ClientStub{}
+			g := &Gateway{Client: c}
+			c.resp = &http.Response{
+				Status:     "201",
+				StatusCode: 201,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": 1, "payment_id": 123, "amount": 50.5, "status": "approved"}`))),
+			}
+			// When
+			refund, err := g.CreateRefund(context.Background(), "MY_ACCESS_TOKEN", 123, tc.refund)
+
+			// Then
+			require.NoError(t, err)
+			require.Equal(t, Refund{ID: 1, PaymentID: 123, Amount: 50.5, Status: "approved"}, refund)
+			require.Equal(t, "POST", c.req.Method)
+			require.Equal(t, "/v1/payments/123/refunds", c.req.URL.Path)
+
+			body, err := ioutil.ReadAll(c.req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			require.Equal(t, tc.wantBody, string(body))
+		})
+	}
+}
+
+func TestGateway_CreateRefund_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "400",
+		StatusCode: 400,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "bad request"}`))),
+	}
+	// When
+	_, err := g.CreateRefund(context.Background(), "MY_ACCESS_TOKEN", 123, NewRefund{})
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "bad request")
+}
+
+func TestGateway_GetRefunds(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`[{"id": 1, "payment_id": 123, "amount": 10}, {"id": 2, "payment_id": 123, "amount": 20}]`))),
+	}
+	// When
+	refunds, err := g.GetRefunds(context.Background(), "MY_ACCESS_TOKEN", 123)
+
+	// Then
+	require.NoError(t, err)
+	require.Len(t, refunds, 2)
+	require.Equal(t, 20.0, refunds[1].Amount)
+	require.Equal(t, "GET", c.req.Method)
+	require.Equal(t, "/v1/payments/123/refunds", c.req.URL.Path)
+}
+
+func TestGateway_GetRefunds_DoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.err = errors.New("do error")
+	// When
+	_, err := g.GetRefunds(context.Background(), "MY_ACCESS_TOKEN", 123)
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "do error")
+}
+
+func TestGateway_CreateCustomer(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "201",
+		StatusCode: 201,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "123-abc", "email": "m@gmail.com", "phone": {"area_code": "11", "number": "12345"}}`))),
+	}
+	// When
+	customer, err := g.CreateCustomer(context.Background(), "MY_ACCESS_TOKEN", NewCustomer{
+		Email:   "m@gmail.com",
+		Phone:   &Phone{AreaCode: "11", Number: "12345"},
+		Address: &CustomerAddress{ZipCode: "1414", StreetName: "Av. Corrientes", StreetNumber: 1234},
+	})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "123-abc", customer.ID)
+	require.Equal(t, Phone{AreaCode: "11", Number: "12345"}, customer.Phone)
+	require.Equal(t, "POST", c.req.Method)
+	require.Equal(t, "/v1/customers", c.req.URL.Path)
+
+	body, err := ioutil.ReadAll(c.req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, `{"email":"m@gmail.com","phone":{"area_code":"11","number":"12345"},"address":{"zip_code":"1414","street_name":"Av. Corrientes","street_number":1234}}`, string(body))
+}
+
+func TestGateway_CreateCustomer_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "400",
+		StatusCode: 400,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "bad request"}`))),
+	}
+	// When
+	_, err := g.CreateCustomer(context.Background(), "MY_ACCESS_TOKEN", NewCustomer{Email: "m@gmail.com"})
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "bad request")
+}
+
+func TestGateway_SearchCustomers(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"paging": {"total": 1, "limit": 10, "offset": 0}, "results": [{"id": "123-abc", "email": "m@gmail.com"}]}`))),
 	}
 	// When
-	checkout, err := g.CreatePreference("", newPreference())
+	result, err := g.SearchCustomers(context.Background(), "MY_ACCESS_TOKEN", "m@gmail.com")
 
 	// Then
 	require.NoError(t, err)
-	require.Equal(t, checkout, "https://mercadopago.com/checkout")
+	require.Equal(t, 1, result.Paging.Total)
+	require.Equal(t, "123-abc", result.Results[0].ID)
+	require.Equal(t, "/v1/customers/search", c.req.URL.Path)
+	require.Equal(t, "m@gmail.com", c.req.URL.Query().Get("email"))
 }
 
-func TestGateway_CreatePreference_MercadoPagoError(t *testing.T) {
+func TestGateway_UpdateCustomer(t *testing.T) {
 	// Given
 	c := &ClientStub{}
 	g := &Gateway{Client: c}
 	c.resp = &http.Response{
-		Status:     "500",
-		StatusCode: 500,
-		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "internal server error"}`))),
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "123-abc", "default_card": "999", "address": {"id": "456", "zip_code": "1414", "street_name": "Av. Corrientes", "street_number": 1234}}`))),
 	}
 	// When
-	_, err := g.CreatePreference("", newPreference())
+	customer, err := g.UpdateCustomer(context.Background(), "MY_ACCESS_TOKEN", "123-abc", CustomerUpdate{
+		DefaultCard: "999",
+		Address:     &CustomerAddress{ZipCode: "1414"},
+	})
 
 	// Then
-	require.Error(t, err)
-	require.EqualError(t, err, "{\"error\": \"internal server error\"}")
+	require.NoError(t, err)
+	require.Equal(t, "999", customer.DefaultCard)
+	require.Equal(t, CustomerAddress{ID: "456", ZipCode: "1414", StreetName: "Av. Corrientes", StreetNumber: 1234}, customer.Address)
+	require.Equal(t, "PUT", c.req.Method)
+	require.Equal(t, "/v1/customers/123-abc", c.req.URL.Path)
+
+	body, err := ioutil.ReadAll(c.req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, `{"address":{"zip_code":"1414"},"default_card":"999"}`, string(body))
 }
 
-func TestGateway_CreatePreference_UnmarshalError(t *testing.T) {
+func TestGateway_DeleteCustomer(t *testing.T) {
 	// Given
 	c := &ClientStub{}
 	g := &Gateway{Client: c}
 	c.resp = &http.Response{
 		Status:     "200",
 		StatusCode: 200,
-		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"init_point": 1234}`))),
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "123-abc"}`))),
+	}
+	// When
+	err := g.DeleteCustomer(context.Background(), "MY_ACCESS_TOKEN", "123-abc")
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "DELETE", c.req.Method)
+	require.Equal(t, "/v1/customers/123-abc", c.req.URL.Path)
+}
+
+func TestGateway_DeleteCustomer_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "404",
+		StatusCode: 404,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "not found"}`))),
 	}
 	// When
-	_, err := g.CreatePreference("", newPreference())
+	err := g.DeleteCustomer(context.Background(), "MY_ACCESS_TOKEN", "123-abc")
 
 	// Then
 	require.Error(t, err)
-	require.EqualError(t, err, "json: cannot unmarshal number into Go struct field .init_point of type string")
+	require.EqualError(t, err, "not found")
 }
 
-func TestGateway_CreatePreference_DoError(t *testing.T) {
+func TestGateway_CreateCard(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "201",
+		StatusCode: 201,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "999", "customer_id": "123-abc", "last_four_digits": "4242", "payment_method": {"id": "visa"}, "issuer": {"id": 310, "name": "Visa"}}`))),
+	}
+	// When
+	card, err := g.CreateCard(context.Background(), "MY_ACCESS_TOKEN", "123-abc", NewCard{Token: "MY_CARD_TOKEN"})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "999", card.ID)
+	require.Equal(t, "4242", card.LastFourDigits)
+	require.Equal(t, CardIssuer{ID: 310, Name: "Visa"}, card.Issuer)
+	require.Equal(t, "/v1/customers/123-abc/cards", c.req.URL.Path)
+}
+
+func TestGateway_GetCards(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`[{"id": "999"}, {"id": "998"}]`))),
+	}
+	// When
+	cards, err := g.GetCards(context.Background(), "MY_ACCESS_TOKEN", "123-abc")
+
+	// Then
+	require.NoError(t, err)
+	require.Len(t, cards, 2)
+	require.Equal(t, "/v1/customers/123-abc/cards", c.req.URL.Path)
+}
+
+func TestGateway_DeleteCard_DoError(t *testing.T) {
 	// Given
 	c := &ClientStub{}
 	g := &Gateway{Client: c}
 	c.err = errors.New("do error")
 	// When
-	_, err := g.CreatePreference("", newPreference())
+	err := g.DeleteCard(context.Background(), "MY_ACCESS_TOKEN", "123-abc", "999")
 
 	// Then
 	require.Error(t, err)
 	require.EqualError(t, err, "do error")
+	require.Equal(t, "/v1/customers/123-abc/cards/999", c.req.URL.Path)
 }
 
-func TestGateway_GetTotalPayments(t *testing.T) {
+func TestGateway_GetPaymentMethods(t *testing.T) {
 	// Given
 	c := &ClientStub{}
 	g := &Gateway{Client: c}
 	c.resp = &http.Response{
 		Status:     "200",
 		StatusCode: 200,
-		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"paging": {"total": 100,"limit": 1,"offset": 0}}`))),
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`[{"id": "visa", "name": "Visa", "payment_type_id": "credit_card", "status": "active"}, {"id": "rapipago", "name": "Rapipago", "payment_type_id": "ticket", "status": "active"}]`))),
 	}
 	// When
-	totalPayments, err := g.GetTotalPayments("MY_ACCESS_TOKEN", "approved")
-	if err != nil {
-		t.Fatal(err)
+	paymentMethods, err := g.GetPaymentMethods(context.Background(), "MY_ACCESS_TOKEN")
+
+	// Then
+	require.NoError(t, err)
+	require.Len(t, paymentMethods, 2)
+	require.Equal(t, "credit_card", paymentMethods[0].PaymentTypeID)
+	require.Equal(t, "/v1/payment_methods", c.req.URL.Path)
+}
+
+func TestGateway_GetPaymentMethods_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "401",
+		StatusCode: 401,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "unauthorized"}`))),
+	}
+	// When
+	_, err := g.GetPaymentMethods(context.Background(), "MY_ACCESS_TOKEN")
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "unauthorized")
+}
+
+func TestGateway_GetCardIssuers(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`[{"id": "310", "name": "Visa Argentina"}]`))),
 	}
+	// When
+	issuers, err := g.GetCardIssuers(context.Background(), "MY_ACCESS_TOKEN", "visa")
 
 	// Then
 	require.NoError(t, err)
-	require.Equal(t, 100, totalPayments)
+	require.Equal(t, []Issuer{{ID: "310", Name: "Visa Argentina"}}, issuers)
+	require.Equal(t, "/v1/payment_methods/card_issuers", c.req.URL.Path)
+	require.Equal(t, "visa", c.req.URL.Query().Get("payment_method_id"))
 }
 
-func TestGateway_GetTotalPayments_MercadoPagoError(t *testing.T) {
+func TestGateway_GetInstallments(t *testing.T) {
 	// Given
 	c := &ClientStub{}
 	g := &Gateway{Client: c}
 	c.resp = &http.Response{
-		Status:     "500",
-		StatusCode: 500,
-		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "internal server error"}`))),
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`[{"payment_method_id": "visa", "payment_type_id": "credit_card", "issuer": {"id": "310"}, "payer_costs": [{"installments": 1, "installment_amount": 150.7, "total_amount": 150.7}, {"installments": 3, "installment_rate": 10, "installment_amount": 55.26, "total_amount": 165.77}]}]`))),
 	}
 	// When
-	totalPayments, err := g.GetTotalPayments("MY_ACCESS_TOKEN", "approved")
+	installments, err := g.GetInstallments(context.Background(), "MY_ACCESS_TOKEN", InstallmentsSearch{Amount: 150.7, Bin: "450995", IssuerID: "310"})
+
+	// Then
+	require.NoError(t, err)
+	require.Len(t, installments, 1)
+	require.Len(t, installments[0].PayerCosts, 2)
+	require.Equal(t, 165.77, installments[0].PayerCosts[1].TotalAmount)
+
+	query := c.req.URL.Query()
+	require.Equal(t, "/v1/payment_methods/installments", c.req.URL.Path)
+	require.Equal(t, "150.7", query.Get("amount"))
+	require.Equal(t, "450995", query.Get("bin"))
+	require.Equal(t, "310", query.Get("issuer.id"))
+	require.Empty(t, query.Get("payment_method_id"))
+}
+
+func TestGateway_GetInstallments_DoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.err = errors.New("do error")
+	// When
+	_, err := g.GetInstallments(context.Background(), "MY_ACCESS_TOKEN", InstallmentsSearch{Amount: 150.7})
 
 	// Then
 	require.Error(t, err)
-	require.EqualError(t, err, "{\"error\": \"internal server error\"}")
-	require.Equal(t, 0, totalPayments)
+	require.EqualError(t, err, "do error")
 }
 
-func TestGateway_GetTotalPayments_UnmarshalError(t *testing.T) {
+func TestGateway_GetMerchantOrder(t *testing.T) {
 	// Given
 	c := &ClientStub{}
 	g := &Gateway{Client: c}
 	c.resp = &http.Response{
 		Status:     "200",
 		StatusCode: 200,
-		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"paging": 0}`))),
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": 456, "preference_id": "123-abc", "status": "closed", "order_status": "paid", "total_amount": 150.7, "paid_amount": 150.7, "payments": [{"id": 1, "status": "approved", "total_paid_amount": 150.7}], "shipments": [{"id": 9, "status": "ready_to_ship"}]}`))),
+	}
+	// When
+	merchantOrder, err := g.GetMerchantOrder(context.Background(), "MY_ACCESS_TOKEN", 456)
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, int64(456), merchantOrder.ID)
+	require.Equal(t, "123-abc", merchantOrder.PreferenceID)
+	require.Equal(t, "paid", merchantOrder.OrderStatus)
+	require.Len(t, merchantOrder.Payments, 1)
+	require.Len(t, merchantOrder.Shipments, 1)
+	require.True(t, merchantOrder.IsPaid())
+	require.Equal(t, "/merchant_orders/456", c.req.URL.Path)
+}
+
+func TestGateway_GetMerchantOrder_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "404",
+		StatusCode: 404,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "not found"}`))),
 	}
 	// When
-	totalPayments, err := g.GetTotalPayments("MY_ACCESS_TOKEN", "approved")
+	_, err := g.GetMerchantOrder(context.Background(), "MY_ACCESS_TOKEN", 456)
 
 	// Then
 	require.Error(t, err)
-	require.EqualError(t, err, "json: cannot unmarshal number into Go struct field .paging of type struct { TotalPayments int \"json:\\\"total\\\"\" }")
-	require.Equal(t, 0, totalPayments)
+	require.EqualError(t, err, "not found")
+}
+
+func TestGateway_SearchMerchantOrders(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"elements": [{"id": 456, "total_amount": 150.7, "paid_amount": 50}], "total": 1, "next_offset": 1}`))),
+	}
+	// When
+	result, err := g.SearchMerchantOrders(context.Background(), "MY_ACCESS_TOKEN", MerchantOrderSearch{ExternalReference: "ORDER-1"})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, 1, result.Total)
+	require.False(t, result.Elements[0].IsPaid())
+	require.Equal(t, "/merchant_orders/search", c.req.URL.Path)
+	require.Equal(t, "ORDER-1", c.req.URL.Query().Get("external_reference"))
+	require.Empty(t, c.req.URL.Query().Get("preference_id"))
+}
+
+func TestGateway_CreatePreapprovalPlan(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "201",
+		StatusCode: 201,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "plan-1", "reason": "Monthly plan", "status": "active", "init_point": "https://mercadopago.com/subscriptions/plan-1"}`))),
+	}
+	// When
+	plan, err := g.CreatePreapprovalPlan(context.Background(), "MY_ACCESS_TOKEN", newPreapprovalPlan())
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "plan-1", plan.ID)
+	require.Equal(t, "active", plan.Status)
+	require.Equal(t, "POST", c.req.Method)
+	require.Equal(t, "/preapproval_plan", c.req.URL.Path)
+}
+
+func TestGateway_UpdatePreapprovalPlan(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "plan-1", "reason": "Yearly plan"}`))),
+	}
+	// When
+	plan, err := g.UpdatePreapprovalPlan(context.Background(), "MY_ACCESS_TOKEN", "plan-1", PreapprovalPlanUpdate{Reason: "Yearly plan"})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "Yearly plan", plan.Reason)
+	require.Equal(t, "PUT", c.req.Method)
+	require.Equal(t, "/preapproval_plan/plan-1", c.req.URL.Path)
+}
+
+func TestGateway_CreatePreapproval(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "201",
+		StatusCode: 201,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "sub-1", "preapproval_plan_id": "plan-1", "status": "authorized"}`))),
+	}
+	// When
+	preapproval, err := g.CreatePreapproval(context.Background(), "MY_ACCESS_TOKEN", NewPreapproval{PreapprovalPlanID: "plan-1", PayerEmail: "m@gmail.com", CardTokenID: "MY_CARD_TOKEN"})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "sub-1", preapproval.ID)
+	require.Equal(t, "authorized", preapproval.Status)
+	require.Equal(t, "/preapproval", c.req.URL.Path)
+
+	body, err := ioutil.ReadAll(c.req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, `{"preapproval_plan_id":"plan-1","payer_email":"m@gmail.com","card_token_id":"MY_CARD_TOKEN"}`, string(body))
+}
+
+func TestGateway_GetPreapproval_MercadoPagoError(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "404",
+		StatusCode: 404,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"error": "not found"}`))),
+	}
+	// When
+	_, err := g.GetPreapproval(context.Background(), "MY_ACCESS_TOKEN", "sub-1")
+
+	// Then
+	require.Error(t, err)
+	require.EqualError(t, err, "not found")
+	require.Equal(t, "/preapproval/sub-1", c.req.URL.Path)
+}
+
+func TestGateway_SearchPreapprovals(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"paging": {"total": 1, "limit": 10, "offset": 0}, "results": [{"id": "sub-1", "status": "paused"}]}`))),
+	}
+	// When
+	result, err := g.SearchPreapprovals(context.Background(), "MY_ACCESS_TOKEN", PreapprovalSearch{PayerEmail: "m@gmail.com", Status: "paused"})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "sub-1", result.Results[0].ID)
+	require.Equal(t, "/preapproval/search", c.req.URL.Path)
+	require.Equal(t, "m@gmail.com", c.req.URL.Query().Get("payer_email"))
+	require.Equal(t, "paused", c.req.URL.Query().Get("status"))
+}
+
+func TestGateway_UpdatePreapproval(t *testing.T) {
+	// Given
+	c := &ClientStub{}
+	g := &Gateway{Client: c}
+	c.resp = &http.Response{
+		Status:     "200",
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"id": "sub-1", "status": "paused"}`))),
+	}
+	// When
+	preapproval, err := g.UpdatePreapproval(context.Background(), "MY_ACCESS_TOKEN", "sub-1", PreapprovalUpdate{Status: "paused"})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "paused", preapproval.Status)
+	require.Equal(t, "PUT", c.req.Method)
+	require.Equal(t, "/preapproval/sub-1", c.req.URL.Path)
+}
+
+func TestGateway_FakeServer(t *testing.T) {
+	// Given
+	fake := fakemp.NewServer()
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	g := NewClientGateway(&http.Client{})
+	g.Environment = Sandbox
+	g.BaseURL = ts.URL
+
+	// When
+	token, err := g.GetToken(context.Background(), Credentials{ClientID: "ABC123", ClientSecret: "123ABC"})
+	require.NoError(t, err)
+
+	preference, err := g.CreatePreference(context.Background(), token.AccessToken, newPreference())
+	require.NoError(t, err)
+
+	payment := newPayment()
+	payment.Token = "CONT-1234"
+	pending, err := g.CreatePayment(context.Background(), token.AccessToken, payment)
+	require.NoError(t, err)
+
+	payment.Token = "APRO-1234"
+	approved, err := g.CreatePayment(context.Background(), token.AccessToken, payment)
+	require.NoError(t, err)
+
+	_, err = g.CreateRefund(context.Background(), token.AccessToken, approved.ID, NewRefund{Amount: 50})
+	require.NoError(t, err)
+	refunds, err := g.GetRefunds(context.Background(), token.AccessToken, approved.ID)
+	require.NoError(t, err)
+
+	fake.Inject(fakemp.Fault{Method: "GET", Path: "/v1/payments", Status: http.StatusServiceUnavailable, Times: 1})
+	_, faultErr := g.GetPayment(context.Background(), token.AccessToken, approved.ID)
+	got, err := g.GetPayment(context.Background(), token.AccessToken, approved.ID)
+	require.NoError(t, err)
+
+	// Then
+	require.NotEmpty(t, token.AccessToken)
+	require.Equal(t, preference.SandboxInitPoint, preference.CheckoutURL)
+	require.Contains(t, preference.CheckoutURL, preference.ID)
+	require.Equal(t, "in_process", pending.Status)
+	require.Equal(t, "approved", approved.Status)
+	require.Len(t, refunds, 1)
+	require.Equal(t, http.StatusServiceUnavailable, getStatusCodeFromError(faultErr))
+	require.Equal(t, 50.0, got.TransactionAmountRefunded)
 }
 
 func newPreference() NewPreference {
@@ -247,8 +1493,38 @@ func newPreference() NewPreference {
 		Redirect: Redirect{
 			Success: "http://baseurl.com/success",
 			Pending: "http://baseurl.com/pending",
-			failure: "http://baseurl.com/failure",
+			Failure: "http://baseurl.com/failure",
 		},
 		AutoReturn: true,
 	}
 }
+
+func newPayment() NewPayment {
+	return NewPayment{
+		TransactionAmount: 150.7,
+		Token:             "ff8080814c11e237014c1ff593b57b4d",
+		Description:       "sherlock",
+		Installments:      1,
+		PaymentMethodID:   "visa",
+		Payer: NewPaymentPayer{
+			Email: "m@gmail.com",
+			Identification: Identification{
+				Type:   "DNI",
+				Number: "12345678",
+			},
+		},
+	}
+}
+
+func newPreapprovalPlan() NewPreapprovalPlan {
+	return NewPreapprovalPlan{
+		Reason: "Monthly plan",
+		AutoRecurring: AutoRecurring{
+			Frequency:         1,
+			FrequencyType:     "months",
+			TransactionAmount: 500,
+			CurrencyID:        "ARS",
+		},
+		BackURL: "http://baseurl.com/subscriptions",
+	}
+}
@@ -1,32 +1,582 @@
 package internal
 
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const _lookupCacheTTL = 10 * time.Minute
+
 type ClientGateway interface {
-	GetAccessToken(credentials Credentials) (string, error)
-	CreatePreference(accessToken string, preference NewPreference) (string, error)
-	GetTotalPayments(accessToken string, status string) (int, error)
+	GetToken(ctx context.Context, credentials Credentials) (OAuthToken, error)
+	ExchangeAuthorizationCode(ctx context.Context, credentials Credentials, code string, redirectURI string, codeVerifier string) (OAuthToken, error)
+	RefreshAccessToken(ctx context.Context, credentials Credentials, refreshToken string) (OAuthToken, error)
+	CreatePreference(ctx context.Context, accessToken string, preference NewPreference) (Preference, error)
+	GetPreference(ctx context.Context, accessToken string, preferenceID string) (Preference, error)
+	UpdatePreference(ctx context.Context, accessToken string, preferenceID string, update PreferenceUpdate) (Preference, error)
+	SearchPreferences(ctx context.Context, accessToken string, search PreferenceSearch) (PreferenceSearchResult, error)
+	GetTotalPayments(ctx context.Context, accessToken string, status string) (int, error)
+	GetPayment(ctx context.Context, accessToken string, paymentID int64) (Payment, error)
+	CreatePayment(ctx context.Context, accessToken string, payment NewPayment) (Payment, error)
+	SearchPayments(ctx context.Context, accessToken string, search PaymentSearch) (PaymentSearchResult, error)
+	CreateRefund(ctx context.Context, accessToken string, paymentID int64, refund NewRefund) (Refund, error)
+	GetRefunds(ctx context.Context, accessToken string, paymentID int64) ([]Refund, error)
+	UpdatePayment(ctx context.Context, accessToken string, paymentID int64, update PaymentUpdate) (Payment, error)
+	CreateCustomer(ctx context.Context, accessToken string, customer NewCustomer) (Customer, error)
+	GetCustomer(ctx context.Context, accessToken string, customerID string) (Customer, error)
+	SearchCustomers(ctx context.Context, accessToken string, email string) (CustomerSearchResult, error)
+	UpdateCustomer(ctx context.Context, accessToken string, customerID string, update CustomerUpdate) (Customer, error)
+	DeleteCustomer(ctx context.Context, accessToken string, customerID string) error
+	CreateCard(ctx context.Context, accessToken string, customerID string, card NewCard) (Card, error)
+	GetCards(ctx context.Context, accessToken string, customerID string) ([]Card, error)
+	DeleteCard(ctx context.Context, accessToken string, customerID string, cardID string) error
+	GetPaymentMethods(ctx context.Context, accessToken string) ([]PaymentMethod, error)
+	GetCardIssuers(ctx context.Context, accessToken string, paymentMethodID string) ([]Issuer, error)
+	GetInstallments(ctx context.Context, accessToken string, search InstallmentsSearch) ([]Installments, error)
+	GetMerchantOrder(ctx context.Context, accessToken string, merchantOrderID int64) (MerchantOrder, error)
+	SearchMerchantOrders(ctx context.Context, accessToken string, search MerchantOrderSearch) (MerchantOrderSearchResult, error)
+	CreatePreapprovalPlan(ctx context.Context, accessToken string, plan NewPreapprovalPlan) (PreapprovalPlan, error)
+	UpdatePreapprovalPlan(ctx context.Context, accessToken string, planID string, update PreapprovalPlanUpdate) (PreapprovalPlan, error)
+	CreatePreapproval(ctx context.Context, accessToken string, preapproval NewPreapproval) (Preapproval, error)
+	GetPreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error)
+	SearchPreapprovals(ctx context.Context, accessToken string, search PreapprovalSearch) (PreapprovalSearchResult, error)
+	UpdatePreapproval(ctx context.Context, accessToken string, preapprovalID string, update PreapprovalUpdate) (Preapproval, error)
+}
+
+// _cancellableStatuses are the payment statuses Mercado Pago lets us move to
+// cancelled. Only authorized payments can be captured.
+var _cancellableStatuses = map[string]bool{
+	"pending":    true,
+	"in_process": true,
+	"authorized": true,
+}
+
+// _preapprovalTransitions maps a target subscription status to the statuses a
+// subscription can be moved from.
+var _preapprovalTransitions = map[string][]string{
+	"paused":     {"authorized"},
+	"authorized": {"paused"},
+	"cancelled":  {"pending", "authorized", "paused"},
 }
 
 type Controller struct {
 	Client ClientGateway
+	// Tenants and Tokens let requests name a tenant instead of sending an
+	// access token. Both are optional.
+	Tenants *TenantVault
+	Tokens  *TokenSource
+	cache   *ttlCache
 }
 
 func NewController(client ClientGateway) *Controller {
 	return &Controller{
 		Client: client,
+		cache:  newTTLCache(_lookupCacheTTL),
 	}
 }
 
-func (s *Controller) GetAccessToken(clientID string, clientSecret string) (string, error) {
-	return s.Client.GetAccessToken(Credentials{
+// GetAccessToken gets a token for the given credentials, through the token
+// cache when there's one, so every client_credentials request goes the same
+// way.
+func (s *Controller) GetAccessToken(ctx context.Context, clientID string, clientSecret string) (string, error) {
+	credentials := Credentials{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
+	}
+
+	if s.Tokens != nil {
+		return s.Tokens.AccessToken(ctx, credentials)
+	}
+
+	token, err := s.Client.GetToken(ctx, credentials)
+	if err != nil {
+		return "", err
+	}
+
+	return token.AccessToken, nil
+}
+
+// AuthenticateTenant checks apiKey is the API key of the tenant.
+func (s *Controller) AuthenticateTenant(_ context.Context, tenantID string, apiKey string) error {
+	if s.Tenants == nil {
+		return NewError("tenants aren't configured", http.StatusNotFound)
+	}
+
+	return s.Tenants.Authenticate(tenantID, apiKey)
+}
+
+// GetTenantAccessToken resolves a tenant's access token from the vault, so its
+// credentials never travel with the request. Refreshed tokens are saved back.
+func (s *Controller) GetTenantAccessToken(ctx context.Context, tenantID string) (string, error) {
+	if s.Tenants == nil || s.Tokens == nil {
+		return "", NewError("tenants aren't configured", http.StatusNotFound)
+	}
+
+	tenant, err := s.Tenants.Get(tenantID)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("tenant:%s:%d", tenant.ID, tenant.Version)
+	s.Tokens.seed(key, tenant.Token, tenant.TokenObtainedAt)
+
+	// A seller's credentials are the marketplace's, only the refresh token
+	// gets a token for the seller.
+	var options TokenOptions
+	if _, ok := sellerIDFromTenantID(tenant.ID); ok {
+		options.NoClientCredentials = true
+	}
+
+	token, err := s.Tokens.Token(ctx, key, tenant.Credentials, options)
+	if err != nil {
+		return "", err
+	}
+
+	if token != tenant.Token {
+		if err := s.Tenants.SaveToken(tenant.ID, tenant.Version, token); err != nil {
+			log.Printf("couldn't save token of tenant %s: %v", tenant.ID, err)
+		}
+	}
+
+	return token.AccessToken, nil
+}
+
+// GetSellerAccessToken resolves the OAuth token of a seller that connected
+// their account to the marketplace.
+func (s *Controller) GetSellerAccessToken(ctx context.Context, sellerID string) (string, error) {
+	id, err := strconv.ParseInt(sellerID, 10, 64)
+	if err != nil {
+		return "", NewError(fmt.Sprintf("invalid seller id: %s", sellerID), http.StatusBadRequest)
+	}
+
+	return s.GetTenantAccessToken(ctx, sellerTenantID(id))
+}
+
+// GetMarketplaceFees adds up the fee the marketplace kept on every approved
+// payment of each connected seller created within the search dates. Payments
+// without an application fee were made on the seller's own, not through the
+// marketplace, so they're left out.
+func (s *Controller) GetMarketplaceFees(ctx context.Context, search MarketplaceFeeSearch) (MarketplaceFeeReport, error) {
+	if s.Tenants == nil {
+		return MarketplaceFeeReport{}, NewError("tenants aren't configured", http.StatusNotFound)
+	}
+
+	tenants, err := s.Tenants.List()
+	if err != nil {
+		return MarketplaceFeeReport{}, err
+	}
+
+	report := MarketplaceFeeReport{
+		BeginDate: search.BeginDate,
+		EndDate:   search.EndDate,
+		Sellers:   []SellerFees{},
+	}
+
+	var total int64
+	for _, t := range tenants {
+		sellerID, ok := sellerIDFromTenantID(t.ID)
+		if !ok || t.RevokedAt != nil {
+			continue
+		}
+
+		// A seller we can't get a token for is reported as such, it shouldn't
+		// hide what the others earned.
+		accessToken, err := s.GetTenantAccessToken(ctx, t.ID)
+		if err != nil {
+			report.Sellers = append(report.Sellers, SellerFees{
+				SellerID:          sellerID,
+				Error:             fmt.Sprintf("couldn't get token of seller %d: %v", sellerID, err),
+				ReconnectRequired: getErrorCode(err) == "reconnect_required",
+			})
+			continue
+		}
+
+		it := NewPaymentIterator(ctx, s, accessToken, PaymentSearch{
+			Status:    "approved",
+			Range:     "date_created",
+			BeginDate: search.BeginDate,
+			EndDate:   search.EndDate,
+			Sort:      "date_created",
+			Criteria:  "asc",
+		})
+
+		fees := SellerFees{SellerID: sellerID}
+		var gross, fee int64
+		for it.Next() {
+			p := it.Payment()
+			applicationFee, ok := getApplicationFee(p)
+			if !ok {
+				continue
+			}
+
+			fees.Payments++
+			gross += toCents(p.TransactionAmount)
+			fee += applicationFee
+		}
+
+		if err := it.Err(); err != nil {
+			return MarketplaceFeeReport{}, fmt.Errorf("couldn't search payments of seller %d: %w", sellerID, err)
+		}
+
+		fees.GrossAmount = float64(gross) / 100
+		fees.MarketplaceFee = float64(fee) / 100
+		total += fee
+		report.Sellers = append(report.Sellers, fees)
+	}
+
+	report.TotalFee = float64(total) / 100
+	return report, nil
+}
+
+// getApplicationFee returns the fee the marketplace kept on p in cents, and
+// whether p was made through the marketplace at all.
+func getApplicationFee(p Payment) (int64, bool) {
+	var fee int64
+	var ok bool
+	for _, d := range p.FeeDetails {
+		if d.Type == "application_fee" {
+			fee += toCents(d.Amount)
+			ok = true
+		}
+	}
+
+	return fee, ok
+}
+
+func (s *Controller) ExchangeAuthorizationCode(ctx context.Context, credentials Credentials, code string, redirectURI string, codeVerifier string) (OAuthToken, error) {
+	return s.Client.ExchangeAuthorizationCode(ctx, credentials, code, redirectURI, codeVerifier)
+}
+
+func (s *Controller) CreatePreference(ctx context.Context, accessToken string, preference NewPreference) (Preference, error) {
+	if err := validatePreference(preference); err != nil {
+		return Preference{}, err
+	}
+
+	if preference.MarketplaceFee > 0 {
+		var total int64
+		for _, i := range preference.Items {
+			total += toCents(i.UnitPrice) * int64(i.Quantity)
+		}
+
+		if toCents(preference.MarketplaceFee) > total {
+			return Preference{}, NewError(fmt.Sprintf("marketplace fee %.2f exceeds the preference total %.2f", preference.MarketplaceFee, float64(total)/100), http.StatusBadRequest)
+		}
+	}
+
+	return s.Client.CreatePreference(ctx, accessToken, preference)
+}
+
+func (s *Controller) GetPreference(ctx context.Context, accessToken string, preferenceID string) (Preference, error) {
+	return s.Client.GetPreference(ctx, accessToken, preferenceID)
+}
+
+func (s *Controller) UpdatePreference(ctx context.Context, accessToken string, preferenceID string, update PreferenceUpdate) (Preference, error) {
+	if err := validateExpiration(update.ExpirationDateFrom, update.ExpirationDateTo); err != nil {
+		return Preference{}, err
+	}
+
+	if err := validateItemCurrencies(update.Items); err != nil {
+		return Preference{}, err
+	}
+
+	return s.Client.UpdatePreference(ctx, accessToken, preferenceID, update)
+}
+
+func (s *Controller) SearchPreferences(ctx context.Context, accessToken string, search PreferenceSearch) (PreferenceSearchResult, error) {
+	return s.Client.SearchPreferences(ctx, accessToken, search)
+}
+
+func (s *Controller) GetTotalPayments(ctx context.Context, accessToken string, status string) (int, error) {
+	return s.Client.GetTotalPayments(ctx, accessToken, status)
+}
+
+func (s *Controller) GetPayment(ctx context.Context, accessToken string, paymentID int64) (Payment, error) {
+	return s.Client.GetPayment(ctx, accessToken, paymentID)
+}
+
+func (s *Controller) CreatePayment(ctx context.Context, accessToken string, payment NewPayment) (Payment, error) {
+	if toCents(payment.ApplicationFee) > toCents(payment.TransactionAmount) {
+		return Payment{}, NewError(fmt.Sprintf("application fee %.2f exceeds the transaction amount %.2f", payment.ApplicationFee, payment.TransactionAmount), http.StatusBadRequest)
+	}
+
+	return s.Client.CreatePayment(ctx, accessToken, payment)
+}
+
+func (s *Controller) SearchPayments(ctx context.Context, accessToken string, search PaymentSearch) (PaymentSearchResult, error) {
+	return s.Client.SearchPayments(ctx, accessToken, search)
+}
+
+// CreateRefund refunds the whole payment when refund.Amount is zero, otherwise
+// it checks the amount against what is left to refund before calling upstream.
+func (s *Controller) CreateRefund(ctx context.Context, accessToken string, paymentID int64, refund NewRefund) (Refund, error) {
+	payment, err := s.Client.GetPayment(ctx, accessToken, paymentID)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	remaining := toCents(payment.TransactionAmount) - toCents(payment.TransactionAmountRefunded)
+	if remaining <= 0 {
+		return Refund{}, NewError(fmt.Sprintf("payment %d has already been fully refunded", paymentID), http.StatusConflict)
+	}
+
+	if toCents(refund.Amount) > remaining {
+		return Refund{}, NewError(fmt.Sprintf("refund amount %.2f exceeds the %.2f left to refund", refund.Amount, float64(remaining)/100), http.StatusBadRequest)
+	}
+
+	return s.Client.CreateRefund(ctx, accessToken, paymentID, refund)
+}
+
+func (s *Controller) GetRefunds(ctx context.Context, accessToken string, paymentID int64) ([]Refund, error) {
+	return s.Client.GetRefunds(ctx, accessToken, paymentID)
+}
+
+// CapturePayment captures an authorized payment. A zero amount captures the
+// whole authorization, otherwise only amount is captured.
+func (s *Controller) CapturePayment(ctx context.Context, accessToken string, paymentID int64, amount float64) (Payment, error) {
+	payment, err := s.Client.GetPayment(ctx, accessToken, paymentID)
+	if err != nil {
+		return Payment{}, err
+	}
+
+	if payment.Status != "authorized" {
+		return Payment{}, NewError(fmt.Sprintf("can't capture payment %d with status %s", paymentID, payment.Status), http.StatusConflict)
+	}
+
+	if toCents(amount) > toCents(payment.TransactionAmount) {
+		return Payment{}, NewError(fmt.Sprintf("capture amount %.2f exceeds the authorized %.2f", amount, payment.TransactionAmount), http.StatusBadRequest)
+	}
+
+	return s.Client.UpdatePayment(ctx, accessToken, paymentID, PaymentUpdate{
+		Capture:           true,
+		TransactionAmount: amount,
 	})
 }
 
-func (s *Controller) CreatePreference(accessToken string, preference NewPreference) (string, error) {
-	return s.Client.CreatePreference(accessToken, preference)
+func (s *Controller) CancelPayment(ctx context.Context, accessToken string, paymentID int64) (Payment, error) {
+	payment, err := s.Client.GetPayment(ctx, accessToken, paymentID)
+	if err != nil {
+		return Payment{}, err
+	}
+
+	if !_cancellableStatuses[payment.Status] {
+		return Payment{}, NewError(fmt.Sprintf("can't cancel payment %d with status %s", paymentID, payment.Status), http.StatusConflict)
+	}
+
+	return s.Client.UpdatePayment(ctx, accessToken, paymentID, PaymentUpdate{
+		Status: "cancelled",
+	})
+}
+
+func (s *Controller) CreateCustomer(ctx context.Context, accessToken string, customer NewCustomer) (Customer, error) {
+	return s.Client.CreateCustomer(ctx, accessToken, customer)
 }
 
-func (s *Controller) GetTotalPayments(accessToken string, status string) (int, error) {
-	return s.Client.GetTotalPayments(accessToken, status)
-}
\ No newline at end of file
+func (s *Controller) GetCustomer(ctx context.Context, accessToken string, customerID string) (Customer, error) {
+	return s.Client.GetCustomer(ctx, accessToken, customerID)
+}
+
+func (s *Controller) SearchCustomers(ctx context.Context, accessToken string, email string) (CustomerSearchResult, error) {
+	return s.Client.SearchCustomers(ctx, accessToken, email)
+}
+
+func (s *Controller) UpdateCustomer(ctx context.Context, accessToken string, customerID string, update CustomerUpdate) (Customer, error) {
+	return s.Client.UpdateCustomer(ctx, accessToken, customerID, update)
+}
+
+func (s *Controller) DeleteCustomer(ctx context.Context, accessToken string, customerID string) error {
+	return s.Client.DeleteCustomer(ctx, accessToken, customerID)
+}
+
+func (s *Controller) CreateCard(ctx context.Context, accessToken string, customerID string, card NewCard) (Card, error) {
+	return s.Client.CreateCard(ctx, accessToken, customerID, card)
+}
+
+func (s *Controller) GetCards(ctx context.Context, accessToken string, customerID string) ([]Card, error) {
+	return s.Client.GetCards(ctx, accessToken, customerID)
+}
+
+func (s *Controller) DeleteCard(ctx context.Context, accessToken string, customerID string, cardID string) error {
+	return s.Client.DeleteCard(ctx, accessToken, customerID, cardID)
+}
+
+func (s *Controller) GetPaymentMethods(ctx context.Context, accessToken string) ([]PaymentMethod, error) {
+	key := fmt.Sprintf("payment_methods:%s", accessToken)
+	if cached, ok := s.cache.Get(key); ok {
+		return cached.([]PaymentMethod), nil
+	}
+
+	paymentMethods, err := s.Client.GetPaymentMethods(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.Set(key, paymentMethods)
+	return paymentMethods, nil
+}
+
+func (s *Controller) GetCardIssuers(ctx context.Context, accessToken string, paymentMethodID string) ([]Issuer, error) {
+	key := fmt.Sprintf("card_issuers:%s:%s", accessToken, paymentMethodID)
+	if cached, ok := s.cache.Get(key); ok {
+		return cached.([]Issuer), nil
+	}
+
+	issuers, err := s.Client.GetCardIssuers(ctx, accessToken, paymentMethodID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.Set(key, issuers)
+	return issuers, nil
+}
+
+func (s *Controller) GetInstallments(ctx context.Context, accessToken string, search InstallmentsSearch) ([]Installments, error) {
+	key := fmt.Sprintf("installments:%s:%v", accessToken, search)
+	if cached, ok := s.cache.Get(key); ok {
+		return cached.([]Installments), nil
+	}
+
+	installments, err := s.Client.GetInstallments(ctx, accessToken, search)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cache.Set(key, installments)
+	return installments, nil
+}
+
+func (s *Controller) GetMerchantOrder(ctx context.Context, accessToken string, merchantOrderID int64) (MerchantOrder, error) {
+	return s.Client.GetMerchantOrder(ctx, accessToken, merchantOrderID)
+}
+
+func (s *Controller) SearchMerchantOrders(ctx context.Context, accessToken string, search MerchantOrderSearch) (MerchantOrderSearchResult, error) {
+	return s.Client.SearchMerchantOrders(ctx, accessToken, search)
+}
+
+func (s *Controller) CreatePreapprovalPlan(ctx context.Context, accessToken string, plan NewPreapprovalPlan) (PreapprovalPlan, error) {
+	return s.Client.CreatePreapprovalPlan(ctx, accessToken, plan)
+}
+
+func (s *Controller) UpdatePreapprovalPlan(ctx context.Context, accessToken string, planID string, update PreapprovalPlanUpdate) (PreapprovalPlan, error) {
+	return s.Client.UpdatePreapprovalPlan(ctx, accessToken, planID, update)
+}
+
+func (s *Controller) CreatePreapproval(ctx context.Context, accessToken string, preapproval NewPreapproval) (Preapproval, error) {
+	return s.Client.CreatePreapproval(ctx, accessToken, preapproval)
+}
+
+func (s *Controller) GetPreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error) {
+	return s.Client.GetPreapproval(ctx, accessToken, preapprovalID)
+}
+
+func (s *Controller) SearchPreapprovals(ctx context.Context, accessToken string, search PreapprovalSearch) (PreapprovalSearchResult, error) {
+	return s.Client.SearchPreapprovals(ctx, accessToken, search)
+}
+
+func (s *Controller) PausePreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error) {
+	return s.updatePreapprovalStatus(ctx, accessToken, preapprovalID, "pause", "paused")
+}
+
+func (s *Controller) ResumePreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error) {
+	return s.updatePreapprovalStatus(ctx, accessToken, preapprovalID, "resume", "authorized")
+}
+
+func (s *Controller) CancelPreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error) {
+	return s.updatePreapprovalStatus(ctx, accessToken, preapprovalID, "cancel", "cancelled")
+}
+
+func (s *Controller) updatePreapprovalStatus(ctx context.Context, accessToken string, preapprovalID string, action string, status string) (Preapproval, error) {
+	preapproval, err := s.Client.GetPreapproval(ctx, accessToken, preapprovalID)
+	if err != nil {
+		return Preapproval{}, err
+	}
+
+	allowed := false
+	for _, from := range _preapprovalTransitions[status] {
+		if preapproval.Status == from {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		return Preapproval{}, NewError(fmt.Sprintf("can't %s subscription %s with status %s", action, preapprovalID, preapproval.Status), http.StatusConflict)
+	}
+
+	return s.Client.UpdatePreapproval(ctx, accessToken, preapprovalID, PreapprovalUpdate{
+		Status: status,
+	})
+}
+
+// validatePreference checks the rules between preference fields that struct
+// tags can't express.
+func validatePreference(p NewPreference) error {
+	if err := validateExpiration(p.ExpirationDateFrom, p.ExpirationDateTo); err != nil {
+		return err
+	}
+
+	if err := validateItemCurrencies(p.Items); err != nil {
+		return err
+	}
+
+	if m := p.PaymentMethods; m != nil {
+		if m.Installments > 0 && m.DefaultInstallments > m.Installments {
+			return NewError(fmt.Sprintf("default_installments %d exceeds installments %d", m.DefaultInstallments, m.Installments), http.StatusBadRequest)
+		}
+
+		for _, excluded := range m.ExcludedPaymentMethods {
+			if excluded.ID == m.DefaultPaymentMethodID {
+				return NewError(fmt.Sprintf("default payment method %s is excluded", m.DefaultPaymentMethodID), http.StatusBadRequest)
+			}
+		}
+	}
+
+	return nil
+}
+
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+func validateExpiration(from string, to string) error {
+	if from == "" || to == "" {
+		return nil
+	}
+
+	fromDate, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return NewError(fmt.Sprintf("invalid expiration_date_from: %s", from), http.StatusBadRequest)
+	}
+
+	toDate, err := time.Parse(time.RFC3339, to)
+	if err != nil {
+		return NewError(fmt.Sprintf("invalid expiration_date_to: %s", to), http.StatusBadRequest)
+	}
+
+	if !toDate.After(fromDate) {
+		return NewError("expiration_date_to must be after expiration_date_from", http.StatusBadRequest)
+	}
+
+	return nil
+}
+
+func validateItemCurrencies(items []Item) error {
+	var currencyID string
+	for _, i := range items {
+		if i.CurrencyID == "" {
+			continue
+		}
+
+		if currencyID != "" && i.CurrencyID != currencyID {
+			return NewError(fmt.Sprintf("items can't mix currencies: %s and %s", currencyID, i.CurrencyID), http.StatusBadRequest)
+		}
+
+		currencyID = i.CurrencyID
+	}
+
+	return nil
+}
@@ -0,0 +1,611 @@
+package internal
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ClientGatewayStub embeds ClientGateway so each test only stubs the calls
+// it exercises; anything else panics on the nil interface.
+type ClientGatewayStub struct {
+	ClientGateway
+	payment   Payment
+	refund    Refund
+	update    PaymentUpdate
+	methods   []PaymentMethod
+	sub       Preapproval
+	subUpdate PreapprovalUpdate
+	// searchResults are the payments of each access token.
+	searchResults map[string]PaymentSearchResult
+	err           error
+	calls         []string
+}
+
+func (c *ClientGatewayStub) CreatePreference(_ context.Context, _ string, _ NewPreference) (Preference, error) {
+	c.calls = append(c.calls, "CreatePreference")
+	return Preference{ID: "123-abc", InitPoint: "https://checkout"}, c.err
+}
+
+func (c *ClientGatewayStub) UpdatePreference(_ context.Context, _ string, _ string, _ PreferenceUpdate) (Preference, error) {
+	c.calls = append(c.calls, "UpdatePreference")
+	return Preference{ID: "123-abc"}, c.err
+}
+
+func (c *ClientGatewayStub) CreatePayment(_ context.Context, _ string, _ NewPayment) (Payment, error) {
+	c.calls = append(c.calls, "CreatePayment")
+	return c.payment, c.err
+}
+
+func (c *ClientGatewayStub) SearchPayments(_ context.Context, accessToken string, _ PaymentSearch) (PaymentSearchResult, error) {
+	c.calls = append(c.calls, "SearchPayments")
+	return c.searchResults[accessToken], c.err
+}
+
+func (c *ClientGatewayStub) GetPayment(_ context.Context, _ string, _ int64) (Payment, error) {
+	c.calls = append(c.calls, "GetPayment")
+	return c.payment, c.err
+}
+
+func (c *ClientGatewayStub) CreateRefund(_ context.Context, _ string, _ int64, _ NewRefund) (Refund, error) {
+	c.calls = append(c.calls, "CreateRefund")
+	return c.refund, c.err
+}
+
+func (c *ClientGatewayStub) UpdatePayment(_ context.Context, _ string, _ int64, update PaymentUpdate) (Payment, error) {
+	c.calls = append(c.calls, "UpdatePayment")
+	c.update = update
+	return c.payment, c.err
+}
+
+func (c *ClientGatewayStub) GetPaymentMethods(_ context.Context, _ string) ([]PaymentMethod, error) {
+	c.calls = append(c.calls, "GetPaymentMethods")
+	return c.methods, c.err
+}
+
+func (c *ClientGatewayStub) GetPreapproval(_ context.Context, _ string, _ string) (Preapproval, error) {
+	c.calls = append(c.calls, "GetPreapproval")
+	return c.sub, c.err
+}
+
+func (c *ClientGatewayStub) UpdatePreapproval(_ context.Context, _ string, _ string, update PreapprovalUpdate) (Preapproval, error) {
+	c.calls = append(c.calls, "UpdatePreapproval")
+	c.subUpdate = update
+	return c.sub, c.err
+}
+
+func TestController_GetAccessToken_Cached(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	g := &TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "FIRST", ExpiresIn: 21600}, {AccessToken: "SECOND", ExpiresIn: 21600}}}
+	s := NewController(&ClientGatewayStub{})
+	s.Tokens = newTestTokenSource(g, &now)
+
+	// When
+	first, err := s.GetAccessToken(context.Background(), "ABC123", "123ABC")
+	require.NoError(t, err)
+	second, err := s.GetAccessToken(context.Background(), "ABC123", "123ABC")
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, "FIRST", first)
+	require.Equal(t, "FIRST", second)
+	require.Equal(t, 1, g.calls)
+}
+
+func TestController_CreateRefund(t *testing.T) {
+	tt := []struct{
+		name string
+		payment Payment
+		refund NewRefund
+	}{
+		{
+			name: "full refund",
+			payment: Payment{TransactionAmount: 100},
+			refund: NewRefund{},
+		},
+		{
+			name: "partial refund",
+			payment: Payment{TransactionAmount: 100, TransactionAmountRefunded: 40},
+			refund: NewRefund{Amount: 60},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			c := &ClientGatewayStub{
+				payment: tc.payment,
+				refund:  Refund{ID: 1},
+			}
+			s := NewController(c)
+
+			// When
+			refund, err := s.CreateRefund(context.Background(), "MY_ACCESS_TOKEN", 123, tc.refund)
+
+			// Then
+			require.NoError(t, err)
+			require.Equal(t, Refund{ID: 1}, refund)
+			require.Equal(t, []string{"GetPayment", "CreateRefund"}, c.calls)
+		})
+	}
+}
+
+func TestController_CreateRefund_Error(t *testing.T) {
+	tt := []struct{
+		name string
+		payment Payment
+		refund NewRefund
+		wantError string
+		wantErrorStatusCode int
+	}{
+		{
+			name: "amount exceeds what is left to refund",
+			payment: Payment{TransactionAmount: 100, TransactionAmountRefunded: 40},
+			refund: NewRefund{Amount: 60.01},
+			wantError: "refund amount 60.01 exceeds the 60.00 left to refund",
+			wantErrorStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "payment already fully refunded",
+			payment: Payment{TransactionAmount: 100, TransactionAmountRefunded: 100},
+			refund: NewRefund{},
+			wantError: "payment 123 has already been fully refunded",
+			wantErrorStatusCode: http.StatusConflict,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			c := &ClientGatewayStub{payment: tc.payment}
+			s := NewController(c)
+
+			// When
+			_, err := s.CreateRefund(context.Background(), "MY_ACCESS_TOKEN", 123, tc.refund)
+
+			// Then
+			require.EqualError(t, err, tc.wantError)
+			require.Equal(t, tc.wantErrorStatusCode, getStatusCodeFromError(err))
+			require.Equal(t, []string{"GetPayment"}, c.calls)
+		})
+	}
+}
+
+func TestController_CapturePayment(t *testing.T) {
+	// Given
+	c := &ClientGatewayStub{payment: Payment{Status: "authorized", TransactionAmount: 100}}
+	s := NewController(c)
+
+	// When
+	_, err := s.CapturePayment(context.Background(), "MY_ACCESS_TOKEN", 123, 80)
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, PaymentUpdate{Capture: true, TransactionAmount: 80}, c.update)
+	require.Equal(t, []string{"GetPayment", "UpdatePayment"}, c.calls)
+}
+
+func TestController_CapturePayment_Error(t *testing.T) {
+	tt := []struct{
+		name string
+		payment Payment
+		amount float64
+		wantError string
+		wantErrorStatusCode int
+	}{
+		{
+			name: "payment is not authorized",
+			payment: Payment{Status: "approved", TransactionAmount: 100},
+			wantError: "can't capture payment 123 with status approved",
+			wantErrorStatusCode: http.StatusConflict,
+		},
+		{
+			name: "amount exceeds the authorization",
+			payment: Payment{Status: "authorized", TransactionAmount: 100},
+			amount: 150,
+			wantError: "capture amount 150.00 exceeds the authorized 100.00",
+			wantErrorStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			c := &ClientGatewayStub{payment: tc.payment}
+			s := NewController(c)
+
+			// When
+			_, err := s.CapturePayment(context.Background(), "MY_ACCESS_TOKEN", 123, tc.amount)
+
+			// Then
+			require.EqualError(t, err, tc.wantError)
+			require.Equal(t, tc.wantErrorStatusCode, getStatusCodeFromError(err))
+			require.Equal(t, []string{"GetPayment"}, c.calls)
+		})
+	}
+}
+
+func TestController_CancelPayment(t *testing.T) {
+	for _, status := range []string{"pending", "in_process", "authorized"} {
+		t.Run(status, func(t *testing.T) {
+			// Given
+			c := &ClientGatewayStub{payment: Payment{Status: status}}
+			s := NewController(c)
+
+			// When
+			_, err := s.CancelPayment(context.Background(), "MY_ACCESS_TOKEN", 123)
+
+			// Then
+			require.NoError(t, err)
+			require.Equal(t, PaymentUpdate{Status: "cancelled"}, c.update)
+		})
+	}
+}
+
+func TestController_CancelPayment_Error(t *testing.T) {
+	for _, status := range []string{"approved", "rejected", "cancelled", "refunded"} {
+		t.Run(status, func(t *testing.T) {
+			// Given
+			c := &ClientGatewayStub{payment: Payment{Status: status}}
+			s := NewController(c)
+
+			// When
+			_, err := s.CancelPayment(context.Background(), "MY_ACCESS_TOKEN", 123)
+
+			// Then
+			require.EqualError(t, err, "can't cancel payment 123 with status "+status)
+			require.Equal(t, http.StatusConflict, getStatusCodeFromError(err))
+			require.Equal(t, []string{"GetPayment"}, c.calls)
+		})
+	}
+}
+
+func TestController_GetPaymentMethods_Cached(t *testing.T) {
+	// Given
+	c := &ClientGatewayStub{methods: []PaymentMethod{{ID: "visa"}}}
+	s := NewController(c)
+
+	// When
+	first, err := s.GetPaymentMethods(context.Background(), "MY_ACCESS_TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := s.GetPaymentMethods(context.Background(), "MY_ACCESS_TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.GetPaymentMethods(context.Background(), "OTHER_ACCESS_TOKEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, first, second)
+	require.Equal(t, []string{"GetPaymentMethods", "GetPaymentMethods"}, c.calls)
+}
+
+func TestController_GetPaymentMethods_ErrorNotCached(t *testing.T) {
+	// Given
+	c := &ClientGatewayStub{err: NewError("internal server error", http.StatusInternalServerError)}
+	s := NewController(c)
+
+	// When
+	_, err := s.GetPaymentMethods(context.Background(), "MY_ACCESS_TOKEN")
+	require.Error(t, err)
+
+	c.err = nil
+	c.methods = []PaymentMethod{{ID: "visa"}}
+	methods, err := s.GetPaymentMethods(context.Background(), "MY_ACCESS_TOKEN")
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, []PaymentMethod{{ID: "visa"}}, methods)
+	require.Equal(t, []string{"GetPaymentMethods", "GetPaymentMethods"}, c.calls)
+}
+
+func TestController_UpdatePreapprovalStatus(t *testing.T) {
+	tt := []struct {
+		name       string
+		status     string
+		update     func(s *Controller) (Preapproval, error)
+		wantStatus string
+	}{
+		{
+			name:       "pause authorized subscription",
+			status:     "authorized",
+			update:     func(s *Controller) (Preapproval, error) { return s.PausePreapproval(context.Background(), "MY_ACCESS_TOKEN", "sub-1") },
+			wantStatus: "paused",
+		},
+		{
+			name:       "resume paused subscription",
+			status:     "paused",
+			update:     func(s *Controller) (Preapproval, error) { return s.ResumePreapproval(context.Background(), "MY_ACCESS_TOKEN", "sub-1") },
+			wantStatus: "authorized",
+		},
+		{
+			name:       "cancel paused subscription",
+			status:     "paused",
+			update:     func(s *Controller) (Preapproval, error) { return s.CancelPreapproval(context.Background(), "MY_ACCESS_TOKEN", "sub-1") },
+			wantStatus: "cancelled",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			c := &ClientGatewayStub{sub: Preapproval{ID: "sub-1", Status: tc.status}}
+			s := NewController(c)
+
+			// When
+			_, err := tc.update(s)
+
+			// Then
+			require.NoError(t, err)
+			require.Equal(t, PreapprovalUpdate{Status: tc.wantStatus}, c.subUpdate)
+			require.Equal(t, []string{"GetPreapproval", "UpdatePreapproval"}, c.calls)
+		})
+	}
+}
+
+func TestController_UpdatePreapprovalStatus_Error(t *testing.T) {
+	tt := []struct {
+		name      string
+		status    string
+		update    func(s *Controller) (Preapproval, error)
+		wantError string
+	}{
+		{
+			name:      "pause cancelled subscription",
+			status:    "cancelled",
+			update:    func(s *Controller) (Preapproval, error) { return s.PausePreapproval(context.Background(), "MY_ACCESS_TOKEN", "sub-1") },
+			wantError: "can't pause subscription sub-1 with status cancelled",
+		},
+		{
+			name:      "resume authorized subscription",
+			status:    "authorized",
+			update:    func(s *Controller) (Preapproval, error) { return s.ResumePreapproval(context.Background(), "MY_ACCESS_TOKEN", "sub-1") },
+			wantError: "can't resume subscription sub-1 with status authorized",
+		},
+		{
+			name:      "cancel cancelled subscription",
+			status:    "cancelled",
+			update:    func(s *Controller) (Preapproval, error) { return s.CancelPreapproval(context.Background(), "MY_ACCESS_TOKEN", "sub-1") },
+			wantError: "can't cancel subscription sub-1 with status cancelled",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			c := &ClientGatewayStub{sub: Preapproval{ID: "sub-1", Status: tc.status}}
+			s := NewController(c)
+
+			// When
+			_, err := tc.update(s)
+
+			// Then
+			require.EqualError(t, err, tc.wantError)
+			require.Equal(t, http.StatusConflict, getStatusCodeFromError(err))
+			require.Equal(t, []string{"GetPreapproval"}, c.calls)
+		})
+	}
+}
+
+func TestController_CreatePreference_MarketplaceFee(t *testing.T) {
+	tt := []struct {
+		name      string
+		fee       float64
+		wantError string
+	}{
+		{name: "fee within total", fee: 30},
+		{name: "fee equal to total", fee: 300},
+		{name: "fee over total", fee: 300.01, wantError: "marketplace fee 300.01 exceeds the preference total 300.00"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			c := &ClientGatewayStub{}
+			s := NewController(c)
+
+			// When
+			_, err := s.CreatePreference(context.Background(), "SELLER_TOKEN", NewPreference{
+				Items:          []Item{{Title: "Mug", Quantity: 3, UnitPrice: 100}},
+				MarketplaceFee: tc.fee,
+			})
+
+			// Then
+			if tc.wantError == "" {
+				require.NoError(t, err)
+				require.Equal(t, []string{"CreatePreference"}, c.calls)
+				return
+			}
+
+			require.EqualError(t, err, tc.wantError)
+			require.Equal(t, http.StatusBadRequest, getStatusCodeFromError(err))
+			require.Empty(t, c.calls)
+		})
+	}
+}
+
+func TestController_CreatePayment_ApplicationFeeError(t *testing.T) {
+	// Given
+	c := &ClientGatewayStub{}
+	s := NewController(c)
+
+	// When
+	_, err := s.CreatePayment(context.Background(), "SELLER_TOKEN", NewPayment{TransactionAmount: 100, ApplicationFee: 150})
+
+	// Then
+	require.EqualError(t, err, "application fee 150.00 exceeds the transaction amount 100.00")
+	require.Equal(t, http.StatusBadRequest, getStatusCodeFromError(err))
+	require.Empty(t, c.calls)
+}
+
+func TestController_GetMarketplaceFees(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	_, err := v.ConnectSeller(_testCredentials, OAuthToken{AccessToken: "SELLER_1", UserID: 1, ExpiresIn: 21600})
+	require.NoError(t, err)
+	_, err = v.ConnectSeller(_testCredentials, OAuthToken{AccessToken: "SELLER_2", UserID: 2, ExpiresIn: 21600})
+	require.NoError(t, err)
+	_, err = v.Register(NewTenant{ID: "shop1", Name: "Not a seller", ClientID: "DEF456", ClientSecret: "456DEF"})
+	require.NoError(t, err)
+
+	c := &ClientGatewayStub{searchResults: map[string]PaymentSearchResult{
+		"SELLER_1": {
+			Results: []Payment{
+				{ID: 1, TransactionAmount: 100, FeeDetails: []FeeDetail{{Type: "application_fee", Amount: 10.1}, {Type: "mercadopago_fee", Amount: 5}}},
+				{ID: 2, TransactionAmount: 50.5, FeeDetails: []FeeDetail{{Type: "application_fee", Amount: 5.2}}},
+				{ID: 3, TransactionAmount: 80, FeeDetails: []FeeDetail{{Type: "mercadopago_fee", Amount: 4}}},
+			},
+			Paging: Paging{Total: 3},
+		},
+	}}
+	s := NewController(c)
+	s.Tenants = v
+	s.Tokens = newTestTokenSource(&TokenGatewayStub{}, &now)
+
+	// When
+	report, err := s.GetMarketplaceFees(context.Background(), MarketplaceFeeSearch{BeginDate: "2020-06-01T00:00:00Z", EndDate: "2020-06-30T23:59:59Z"})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, MarketplaceFeeReport{
+		BeginDate: "2020-06-01T00:00:00Z",
+		EndDate:   "2020-06-30T23:59:59Z",
+		Sellers: []SellerFees{
+			{SellerID: 1, Payments: 2, GrossAmount: 150.5, MarketplaceFee: 15.3},
+			{SellerID: 2},
+		},
+		TotalFee: 15.3,
+	}, report)
+}
+
+func TestController_GetMarketplaceFees_ReconnectRequired(t *testing.T) {
+	// Given
+	now := time.Now().Add(24 * time.Hour)
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	_, err := v.ConnectSeller(_testCredentials, OAuthToken{AccessToken: "SELLER_1", UserID: 1, ExpiresIn: 7 * 86400})
+	require.NoError(t, err)
+	_, err = v.ConnectSeller(_testCredentials, OAuthToken{AccessToken: "SELLER_2", UserID: 2, ExpiresIn: 21600})
+	require.NoError(t, err)
+
+	c := &ClientGatewayStub{searchResults: map[string]PaymentSearchResult{
+		"SELLER_1": {
+			Results: []Payment{{ID: 1, TransactionAmount: 100, FeeDetails: []FeeDetail{{Type: "application_fee", Amount: 10}}}},
+			Paging:  Paging{Total: 1},
+		},
+	}}
+	s := NewController(c)
+	s.Tenants = v
+	s.Tokens = newTestTokenSource(&TokenGatewayStub{}, &now)
+
+	// When
+	report, err := s.GetMarketplaceFees(context.Background(), MarketplaceFeeSearch{BeginDate: "2020-06-01T00:00:00Z", EndDate: "2020-06-30T23:59:59Z"})
+
+	// Then
+	require.NoError(t, err)
+	require.Len(t, report.Sellers, 2)
+	require.Equal(t, SellerFees{SellerID: 1, Payments: 1, GrossAmount: 100, MarketplaceFee: 10}, report.Sellers[0])
+	require.Equal(t, int64(2), report.Sellers[1].SellerID)
+	require.True(t, report.Sellers[1].ReconnectRequired)
+	require.Contains(t, report.Sellers[1].Error, "couldn't get token of seller 2")
+	require.Equal(t, 10.0, report.TotalFee)
+}
+
+func TestController_CreatePreference_ValidationError(t *testing.T) {
+	tt := []struct {
+		name      string
+		modify    func(p *NewPreference)
+		wantError string
+	}{
+		{
+			name: "expiration dates reversed",
+			modify: func(p *NewPreference) {
+				p.ExpirationDateFrom = "2020-06-30T00:00:00Z"
+				p.ExpirationDateTo = "2020-06-01T00:00:00Z"
+			},
+			wantError: "expiration_date_to must be after expiration_date_from",
+		},
+		{
+			name: "mixed currencies",
+			modify: func(p *NewPreference) {
+				p.Items = []Item{{Title: "Mug", Quantity: 1, UnitPrice: 100, CurrencyID: "ARS"}, {Title: "Cup", Quantity: 1, UnitPrice: 10, CurrencyID: "USD"}}
+			},
+			wantError: "items can't mix currencies: ARS and USD",
+		},
+		{
+			name: "default installments over installments",
+			modify: func(p *NewPreference) {
+				p.PaymentMethods = &PreferencePaymentMethods{Installments: 3, DefaultInstallments: 6}
+			},
+			wantError: "default_installments 6 exceeds installments 3",
+		},
+		{
+			name: "default payment method excluded",
+			modify: func(p *NewPreference) {
+				p.PaymentMethods = &PreferencePaymentMethods{DefaultPaymentMethodID: "visa", ExcludedPaymentMethods: []PaymentMethodRef{{ID: "visa"}}}
+			},
+			wantError: "default payment method visa is excluded",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			c := &ClientGatewayStub{}
+			s := NewController(c)
+			p := newPreference()
+			tc.modify(&p)
+
+			// When
+			_, err := s.CreatePreference(context.Background(), "MY_ACCESS_TOKEN", p)
+
+			// Then
+			require.EqualError(t, err, tc.wantError)
+			require.Equal(t, http.StatusBadRequest, getStatusCodeFromError(err))
+			require.Empty(t, c.calls)
+		})
+	}
+}
+
+func TestController_UpdatePreference_ValidationError(t *testing.T) {
+	// Given
+	c := &ClientGatewayStub{}
+	s := NewController(c)
+
+	// When
+	_, err := s.UpdatePreference(context.Background(), "MY_ACCESS_TOKEN", "123-abc", PreferenceUpdate{
+		ExpirationDateFrom: "2020-06-30T00:00:00Z",
+		ExpirationDateTo:   "2020-06-01T00:00:00Z",
+	})
+
+	// Then
+	require.EqualError(t, err, "expiration_date_to must be after expiration_date_from")
+	require.Equal(t, http.StatusBadRequest, getStatusCodeFromError(err))
+	require.Empty(t, c.calls)
+}
+
+func TestController_UpdatePreference(t *testing.T) {
+	// Given
+	c := &ClientGatewayStub{}
+	s := NewController(c)
+
+	// When
+	preference, err := s.UpdatePreference(context.Background(), "MY_ACCESS_TOKEN", "123-abc", PreferenceUpdate{
+		Items: []Item{{Title: "Mug", Quantity: 1, UnitPrice: 100, CurrencyID: "ARS"}},
+	})
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "123-abc", preference.ID)
+	require.Equal(t, []string{"UpdatePreference"}, c.calls)
+}
@@ -1,10 +1,31 @@
 package internal
 
-import "fmt"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const _maxUpstreamBody = 256
 
 type Error struct {
 	Message string
 	StatusCode int
+	// RetryAfter is how long the client should wait before trying again,
+	// zero if we don't know.
+	RetryAfter time.Duration
+	// Code names the error for clients, e.g. "validation_error". When empty
+	// it's derived from StatusCode.
+	Code string
+	// Fields says what's wrong with each invalid field of the request.
+	Fields []FieldError
+	// Cause is what Mercado Pago answered, when the error came from there.
+	Cause *UpstreamError
 }
 
 func NewError(message string, statusCode int) *Error {
@@ -17,3 +38,213 @@ func NewError(message string, statusCode int) *Error {
 func (e *Error) Error() string {
 	return fmt.Sprintf("%s", e.Message)
 }
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
+}
+
+// UpstreamError is an error body from Mercado Pago.
+type UpstreamError struct {
+	Status  int             `json:"status"`
+	Code    string          `json:"error,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Causes  []UpstreamCause `json:"causes,omitempty"`
+}
+
+type UpstreamCause struct {
+	Code        string `json:"code,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ErrorResponse is the body of every error the API answers with.
+type ErrorResponse struct {
+	Code      string         `json:"code"`
+	Message   string         `json:"message"`
+	Fields    []FieldError   `json:"fields,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+	Cause     *UpstreamError `json:"cause,omitempty"`
+}
+
+// upstreamError reads an error body from Mercado Pago. The API answers
+// {"message", "error", "status", "cause"}, where cause is a list of
+// {"code", "description"} and sometimes a single one, and /oauth/token
+// answers {"error", "error_description"}. Bodies that aren't JSON, like a
+// proxy's error page, are kept as the message, cut short.
+func upstreamError(status int, body []byte) *Error {
+	var raw struct {
+		Message     string          `json:"message"`
+		Error       string          `json:"error"`
+		Description string          `json:"error_description"`
+		Cause       json.RawMessage `json:"cause"`
+	}
+
+	cause := &UpstreamError{Status: status}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		cause.Message = strings.TrimSpace(string(body))
+		if len(cause.Message) > _maxUpstreamBody {
+			cause.Message = cause.Message[:_maxUpstreamBody]
+		}
+	} else {
+		cause.Code = raw.Error
+		cause.Message = raw.Message
+		if cause.Message == "" {
+			cause.Message = raw.Description
+		}
+
+		cause.Causes = upstreamCauses(raw.Cause)
+	}
+
+	message := cause.Message
+	if message == "" {
+		message = cause.Code
+	}
+
+	if message == "" {
+		message = http.StatusText(status)
+	}
+
+	err := NewError(message, status)
+	err.Cause = cause
+	return err
+}
+
+func upstreamCauses(raw json.RawMessage) []UpstreamCause {
+	type rawCause struct {
+		Code        json.RawMessage `json:"code"`
+		Description string          `json:"description"`
+	}
+
+	var list []rawCause
+	if err := json.Unmarshal(raw, &list); err != nil {
+		var one rawCause
+		if err := json.Unmarshal(raw, &one); err != nil {
+			return nil
+		}
+
+		list = []rawCause{one}
+	}
+
+	var causes []UpstreamCause
+	for _, c := range list {
+		// Codes come as numbers or strings depending on the endpoint.
+		code := strings.Trim(string(c.Code), `"`)
+		if code == "null" {
+			code = ""
+		}
+
+		if code == "" && c.Description == "" {
+			continue
+		}
+
+		causes = append(causes, UpstreamCause{Code: code, Description: c.Description})
+	}
+
+	return causes
+}
+
+// decodeError is a request body that couldn't be decoded. A value of the
+// wrong type is reported on its field.
+func decodeError(err error) *Error {
+	e := NewError(fmt.Sprintf("couldn't decode body: %v", err), http.StatusUnprocessableEntity)
+	e.Code = "invalid_body"
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		e.Fields = []FieldError{{Field: typeErr.Field, Rule: "type", Message: fmt.Sprintf("must be %s", typeErr.Type)}}
+	}
+
+	return e
+}
+
+// validationError reports what failed validating v, naming each field as it
+// is in the request body.
+func validationError(v interface{}, err error) *Error {
+	e := NewError(fmt.Sprintf("validation error: %v", err), http.StatusBadRequest)
+	e.Code = "validation_error"
+
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		return e
+	}
+
+	for _, fe := range errs {
+		e.Fields = append(e.Fields, FieldError{
+			Field:   jsonPath(reflect.TypeOf(v), fe.StructNamespace()),
+			Rule:    fe.Tag(),
+			Message: ruleMessage(fe),
+		})
+	}
+
+	return e
+}
+
+// jsonPath turns a validator namespace such as "NewPreference.Items[0].Quantity"
+// into the path of the field in the request body, "items[0].quantity".
+func jsonPath(t reflect.Type, namespace string) string {
+	parts := strings.Split(namespace, ".")
+	path := make([]string, 0, len(parts))
+	for _, part := range parts[1:] {
+		name, index := part, ""
+		if i := strings.Index(part, "["); i >= 0 {
+			name, index = part[:i], part[i:]
+		}
+
+		for t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		if t == nil || t.Kind() != reflect.Struct {
+			path = append(path, part)
+			t = nil
+			continue
+		}
+
+		f, ok := t.FieldByName(name)
+		if !ok {
+			path = append(path, part)
+			t = nil
+			continue
+		}
+
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+			name = tag
+		}
+
+		path = append(path, name+index)
+		t = f.Type
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		if index != "" && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map) {
+			t = t.Elem()
+		}
+	}
+
+	return strings.Join(path, ".")
+}
+
+func ruleMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min", "gte":
+		return fmt.Sprintf("must be at least %s", fe.Param())
+	case "max", "lte":
+		return fmt.Sprintf("must be at most %s", fe.Param())
+	case "gt":
+		return fmt.Sprintf("must be greater than %s", fe.Param())
+	case "lt":
+		return fmt.Sprintf("must be less than %s", fe.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of %s", fe.Param())
+	case "email":
+		return "must be an email address"
+	case "url":
+		return "must be a URL"
+	default:
+		return fmt.Sprintf("failed the %s rule", fe.Tag())
+	}
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamError(t *testing.T) {
+	tt := []struct {
+		name        string
+		status      int
+		body        string
+		wantMessage string
+		wantCause   *UpstreamError
+	}{
+		{
+			name:        "api error",
+			status:      http.StatusBadRequest,
+			body:        `{"message": "invalid parameters", "error": "bad_request", "status": 400, "cause": [{"code": 2067, "description": "Invalid user identification number"}, {"code": "4020", "description": "notification_url must be a valid url"}]}`,
+			wantMessage: "invalid parameters",
+			wantCause: &UpstreamError{
+				Status:  http.StatusBadRequest,
+				Code:    "bad_request",
+				Message: "invalid parameters",
+				Causes: []UpstreamCause{
+					{Code: "2067", Description: "Invalid user identification number"},
+					{Code: "4020", Description: "notification_url must be a valid url"},
+				},
+			},
+		},
+		{
+			name:        "single cause",
+			status:      http.StatusNotFound,
+			body:        `{"message": "Payment not found", "error": "not_found", "status": 404, "cause": {"code": null, "description": "resource not found"}}`,
+			wantMessage: "Payment not found",
+			wantCause: &UpstreamError{
+				Status:  http.StatusNotFound,
+				Code:    "not_found",
+				Message: "Payment not found",
+				Causes:  []UpstreamCause{{Description: "resource not found"}},
+			},
+		},
+		{
+			name:        "oauth error",
+			status:      http.StatusBadRequest,
+			body:        `{"error": "invalid_grant", "error_description": "invalid client_id or client_secret"}`,
+			wantMessage: "invalid client_id or client_secret",
+			wantCause:   &UpstreamError{Status: http.StatusBadRequest, Code: "invalid_grant", Message: "invalid client_id or client_secret"},
+		},
+		{
+			name:        "only error",
+			status:      http.StatusUnauthorized,
+			body:        `{"error": "unauthorized", "cause": []}`,
+			wantMessage: "unauthorized",
+			wantCause:   &UpstreamError{Status: http.StatusUnauthorized, Code: "unauthorized"},
+		},
+		{
+			name:        "not json",
+			status:      http.StatusBadGateway,
+			body:        "<html>" + strings.Repeat("x", 300) + "</html>",
+			wantMessage: "<html>" + strings.Repeat("x", _maxUpstreamBody-len("<html>")),
+			wantCause:   &UpstreamError{Status: http.StatusBadGateway, Message: "<html>" + strings.Repeat("x", _maxUpstreamBody-len("<html>"))},
+		},
+		{
+			name:        "empty",
+			status:      http.StatusServiceUnavailable,
+			wantMessage: "Service Unavailable",
+			wantCause:   &UpstreamError{Status: http.StatusServiceUnavailable},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			err := upstreamError(tc.status, []byte(tc.body))
+
+			// Then
+			require.Equal(t, tc.status, err.StatusCode)
+			require.Equal(t, tc.wantMessage, err.Message)
+			require.Equal(t, tc.wantCause, err.Cause)
+		})
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	// Given
+	preference := newPreference()
+	preference.Payer.Name = ""
+	preference.Payer.CreatedAt = "2020-06-14T00:00:00.000-03:00"
+	preference.NotificationURL = "not a url"
+	update := PreferenceUpdate{Items: []Item{{Quantity: 1, UnitPrice: 10}}}
+
+	// When
+	preferenceErr := validationError(preference, _v.Struct(preference))
+	updateErr := validationError(update, _v.Struct(update))
+	otherErr := validationError(preference, errors.New("random error"))
+
+	// Then
+	require.Equal(t, http.StatusBadRequest, preferenceErr.StatusCode)
+	require.Equal(t, "validation_error", preferenceErr.Code)
+	require.Equal(t, []FieldError{
+		{Field: "payer.name", Rule: "required", Message: "is required"},
+		{Field: "notification_url", Rule: "url", Message: "must be a URL"},
+	}, preferenceErr.Fields)
+	require.Equal(t, []FieldError{{Field: "items[0].title", Rule: "required", Message: "is required"}}, updateErr.Fields)
+	require.Equal(t, "validation error: random error", otherErr.Message)
+	require.Empty(t, otherErr.Fields)
+}
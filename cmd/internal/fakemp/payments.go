@@ -0,0 +1,505 @@
+package fakemp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type identification struct {
+	Type   string `json:"type"`
+	Number string `json:"number"`
+}
+
+type payer struct {
+	ID             string         `json:"id"`
+	Email          string         `json:"email"`
+	FirstName      string         `json:"first_name"`
+	LastName       string         `json:"last_name"`
+	Identification identification `json:"identification"`
+}
+
+type feeDetail struct {
+	Type     string  `json:"type"`
+	Amount   float64 `json:"amount"`
+	FeePayer string  `json:"fee_payer"`
+}
+
+type payment struct {
+	ID                        int64       `json:"id"`
+	Status                    string      `json:"status"`
+	StatusDetail              string      `json:"status_detail"`
+	Description               string      `json:"description"`
+	ExternalReference         string      `json:"external_reference"`
+	CurrencyID                string      `json:"currency_id"`
+	TransactionAmount         float64     `json:"transaction_amount"`
+	TransactionAmountRefunded float64     `json:"transaction_amount_refunded"`
+	Installments              int         `json:"installments"`
+	PaymentMethodID           string      `json:"payment_method_id"`
+	PaymentTypeID             string      `json:"payment_type_id"`
+	Captured                  bool        `json:"captured"`
+	Payer                     payer       `json:"payer"`
+	CollectorID               int64       `json:"collector_id"`
+	FeeDetails                []feeDetail `json:"fee_details"`
+	CreatedAt                 string      `json:"date_created"`
+	ApprovedAt                string      `json:"date_approved"`
+	LastUpdatedAt             string      `json:"date_last_updated"`
+	// preferenceID ties a checkout payment to its merchant order.
+	preferenceID string
+}
+
+type refund struct {
+	ID        int64   `json:"id"`
+	PaymentID int64   `json:"payment_id"`
+	Amount    float64 `json:"amount"`
+	Status    string  `json:"status"`
+	CreatedAt string  `json:"date_created"`
+}
+
+type newPayment struct {
+	TransactionAmount float64 `json:"transaction_amount"`
+	Token             string  `json:"token"`
+	Description       string  `json:"description"`
+	Installments      int     `json:"installments"`
+	PaymentMethodID   string  `json:"payment_method_id"`
+	ExternalReference string  `json:"external_reference"`
+	Capture           *bool   `json:"capture"`
+	ApplicationFee    float64 `json:"application_fee"`
+	Payer             payer   `json:"payer"`
+}
+
+// _testCards are the card token prefixes with the outcome Mercado Pago gives
+// its test cards holder names.
+var _testCards = map[string][2]string{
+	"APRO": {"approved", "accredited"},
+	"CONT": {"in_process", "pending_contingency"},
+	"OTHE": {"rejected", "cc_rejected_other_reason"},
+	"FUND": {"rejected", "cc_rejected_insufficient_amount"},
+	"SECU": {"rejected", "cc_rejected_bad_filled_security_code"},
+}
+
+func cardOutcome(token string) (string, string) {
+	for prefix, outcome := range _testCards {
+		if strings.HasPrefix(strings.ToUpper(token), prefix) {
+			return outcome[0], outcome[1]
+		}
+	}
+
+	return "approved", "accredited"
+}
+
+// _paymentTransitions maps a status to the ones a payment can move to from
+// PUT /v1/payments/{id} or the fake status route.
+var _paymentTransitions = map[string][]string{
+	"pending":      {"approved", "rejected", "cancelled"},
+	"in_process":   {"approved", "rejected", "cancelled"},
+	"authorized":   {"approved", "cancelled"},
+	"approved":     {"refunded", "charged_back", "in_mediation"},
+	"in_mediation": {"approved", "refunded", "charged_back"},
+}
+
+func (s *Server) createPayment(w http.ResponseWriter, r *http.Request) {
+	var np newPayment
+	if err := json.NewDecoder(r.Body).Decode(&np); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("couldn't decode body: %v", err))
+		return
+	}
+
+	switch {
+	case np.TransactionAmount <= 0:
+		writeError(w, http.StatusBadRequest, "transaction_amount must be positive")
+		return
+	case np.Token == "":
+		writeError(w, http.StatusBadRequest, "token is required")
+		return
+	case np.PaymentMethodID == "":
+		writeError(w, http.StatusBadRequest, "payment_method_id is required")
+		return
+	case np.Payer.Email == "":
+		writeError(w, http.StatusBadRequest, "payer.email is required")
+		return
+	case np.ApplicationFee > np.TransactionAmount:
+		writeError(w, http.StatusBadRequest, "application_fee can't exceed transaction_amount")
+		return
+	}
+
+	status, detail := cardOutcome(np.Token)
+	if status == "approved" && np.Capture != nil && !*np.Capture {
+		status, detail = "authorized", "pending_capture"
+	}
+
+	if np.Installments == 0 {
+		np.Installments = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := r.Header.Get("X-Idempotency-Key")
+	if id, ok := s.idempotencyKeys[key]; ok && key != "" {
+		writeJSON(w, http.StatusCreated, s.payments[id])
+		return
+	}
+
+	p := &payment{
+		ID:                s.newID(),
+		Status:            status,
+		StatusDetail:      detail,
+		Description:       np.Description,
+		ExternalReference: np.ExternalReference,
+		CurrencyID:        "ARS",
+		TransactionAmount: np.TransactionAmount,
+		Installments:      np.Installments,
+		PaymentMethodID:   np.PaymentMethodID,
+		PaymentTypeID:     "credit_card",
+		Captured:          status == "approved",
+		Payer:             np.Payer,
+		CollectorID:       s.CollectorID,
+		FeeDetails:        []feeDetail{},
+		CreatedAt:         s.timestamp(),
+		LastUpdatedAt:     s.timestamp(),
+	}
+
+	if np.ApplicationFee > 0 {
+		p.FeeDetails = append(p.FeeDetails, feeDetail{Type: "application_fee", Amount: np.ApplicationFee, FeePayer: "collector"})
+	}
+
+	if status == "approved" {
+		p.ApprovedAt = p.CreatedAt
+	}
+
+	s.payments[p.ID] = p
+	if key != "" {
+		s.idempotencyKeys[key] = p.ID
+	}
+
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func (s *Server) getPayment(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payment(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) searchPayments(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, offset, ok := paging(w, query, 30)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]*payment, 0)
+	for _, p := range s.payments {
+		if v := query.Get("status"); v != "" && p.Status != v {
+			continue
+		}
+
+		if v := query.Get("external_reference"); v != "" && p.ExternalReference != v {
+			continue
+		}
+
+		if v := query.Get("payer.email"); v != "" && p.Payer.Email != v {
+			continue
+		}
+
+		if v := query.Get("payment_method_id"); v != "" && p.PaymentMethodID != v {
+			continue
+		}
+
+		if !inRange(p, query.Get("range"), query.Get("begin_date"), query.Get("end_date")) {
+			continue
+		}
+
+		results = append(results, p)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if query.Get("criteria") == "desc" {
+			return results[i].ID > results[j].ID
+		}
+
+		return results[i].ID < results[j].ID
+	})
+
+	total := len(results)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"results": window(results, limit, offset),
+		"paging":  map[string]int{"total": total, "limit": limit, "offset": offset},
+	})
+}
+
+// updatePayment captures or cancels a payment, the two updates our Gateway
+// sends.
+func (s *Server) updatePayment(w http.ResponseWriter, r *http.Request) {
+	var update struct {
+		Capture           bool    `json:"capture"`
+		TransactionAmount float64 `json:"transaction_amount"`
+		Status            string  `json:"status"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("couldn't decode body: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payment(w, r)
+	if !ok {
+		return
+	}
+
+	switch {
+	case update.Capture:
+		if p.Status != "authorized" {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("payment %d with status %s can't be captured", p.ID, p.Status))
+			return
+		}
+
+		if update.TransactionAmount > p.TransactionAmount {
+			writeError(w, http.StatusBadRequest, "transaction_amount can't exceed the authorized amount")
+			return
+		}
+
+		if update.TransactionAmount > 0 {
+			p.TransactionAmount = update.TransactionAmount
+		}
+
+		p.Captured = true
+		s.transition(p, "approved", "accredited")
+	case update.Status == "cancelled":
+		if !s.transition(p, "cancelled", "by_collector") {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("payment %d with status %s can't be cancelled", p.ID, p.Status))
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "only capture and cancellation are supported")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) setPaymentStatus(w http.ResponseWriter, r *http.Request) {
+	var update struct {
+		Status       string `json:"status"`
+		StatusDetail string `json:"status_detail"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("couldn't decode body: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payment(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.transition(p, update.Status, update.StatusDetail) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("payment %d can't move from %s to %s", p.ID, p.Status, update.Status))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) createRefund(w http.ResponseWriter, r *http.Request) {
+	var nr struct {
+		Amount float64 `json:"amount"`
+	}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&nr); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("couldn't decode body: %v", err))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payment(w, r)
+	if !ok {
+		return
+	}
+
+	if p.Status != "approved" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("payment %d with status %s can't be refunded", p.ID, p.Status))
+		return
+	}
+
+	left := cents(p.TransactionAmount) - cents(p.TransactionAmountRefunded)
+	amount := cents(nr.Amount)
+	if amount == 0 {
+		amount = left
+	}
+
+	if amount > left {
+		writeError(w, http.StatusBadRequest, "amount exceeds what is left to refund")
+		return
+	}
+
+	rf := refund{
+		ID:        s.newID(),
+		PaymentID: p.ID,
+		Amount:    float64(amount) / 100,
+		Status:    "approved",
+		CreatedAt: s.timestamp(),
+	}
+
+	s.refunds[p.ID] = append(s.refunds[p.ID], rf)
+	p.TransactionAmountRefunded = float64(cents(p.TransactionAmountRefunded)+amount) / 100
+	if amount == left {
+		s.transition(p, "refunded", "refunded")
+	} else {
+		p.StatusDetail = "partially_refunded"
+		p.LastUpdatedAt = s.timestamp()
+	}
+
+	if o := s.merchantOrderOf(p.preferenceID); o != nil {
+		o.RefundedAmount = float64(cents(o.RefundedAmount)+amount) / 100
+		o.update(p)
+	}
+
+	writeJSON(w, http.StatusCreated, rf)
+}
+
+func (s *Server) getRefunds(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payment(w, r)
+	if !ok {
+		return
+	}
+
+	refunds := s.refunds[p.ID]
+	if refunds == nil {
+		refunds = []refund{}
+	}
+
+	writeJSON(w, http.StatusOK, refunds)
+}
+
+// payment looks up the payment in the route. s.mu must be held.
+func (s *Server) payment(w http.ResponseWriter, r *http.Request) (*payment, bool) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	p, ok := s.payments[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Payment not found")
+		return nil, false
+	}
+
+	return p, true
+}
+
+// transition moves p to status if Mercado Pago allows it. s.mu must be held.
+func (s *Server) transition(p *payment, status string, detail string) bool {
+	allowed := false
+	for _, to := range _paymentTransitions[p.Status] {
+		allowed = allowed || to == status
+	}
+
+	if !allowed {
+		return false
+	}
+
+	p.Status = status
+	p.StatusDetail = detail
+	p.LastUpdatedAt = s.timestamp()
+	if status == "approved" {
+		p.ApprovedAt = p.LastUpdatedAt
+	}
+
+	if o := s.merchantOrderOf(p.preferenceID); o != nil {
+		o.update(p)
+	}
+
+	return true
+}
+
+// inRange reports whether the date field of p named by dateRange is between
+// begin and end. Unparseable or missing dates don't filter.
+func inRange(p *payment, dateRange string, begin string, end string) bool {
+	value := p.CreatedAt
+	switch dateRange {
+	case "date_approved":
+		value = p.ApprovedAt
+	case "date_last_updated":
+		value = p.LastUpdatedAt
+	}
+
+	date, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return begin == "" && end == ""
+	}
+
+	if from, err := time.Parse(time.RFC3339, begin); err == nil && date.Before(from) {
+		return false
+	}
+
+	if to, err := time.Parse(time.RFC3339, end); err == nil && date.After(to) {
+		return false
+	}
+
+	return true
+}
+
+func paging(w http.ResponseWriter, query url.Values, defaultLimit int) (int, int, bool) {
+	limit, offset := defaultLimit, 0
+	for key, field := range map[string]*int{"limit": &limit, "offset": &offset} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", key, value))
+			return 0, 0, false
+		}
+
+		*field = n
+	}
+
+	return limit, offset, true
+}
+
+func window(payments []*payment, limit int, offset int) []*payment {
+	if offset >= len(payments) {
+		return []*payment{}
+	}
+
+	end := offset + limit
+	if end > len(payments) {
+		end = len(payments)
+	}
+
+	return payments[offset:end]
+}
+
+func cents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
@@ -0,0 +1,404 @@
+package fakemp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+type merchantOrderItem struct {
+	ID         string  `json:"id"`
+	Title      string  `json:"title"`
+	Quantity   int     `json:"quantity"`
+	UnitPrice  float64 `json:"unit_price"`
+	CurrencyID string  `json:"currency_id"`
+}
+
+type merchantOrderPayment struct {
+	ID                int64   `json:"id"`
+	Status            string  `json:"status"`
+	StatusDetail      string  `json:"status_detail"`
+	TransactionAmount float64 `json:"transaction_amount"`
+	TotalPaidAmount   float64 `json:"total_paid_amount"`
+	ApprovedAt        string  `json:"date_approved"`
+}
+
+type merchantOrder struct {
+	ID                int64                  `json:"id"`
+	PreferenceID      string                 `json:"preference_id"`
+	ExternalReference string                 `json:"external_reference"`
+	Status            string                 `json:"status"`
+	OrderStatus       string                 `json:"order_status"`
+	TotalAmount       float64                `json:"total_amount"`
+	PaidAmount        float64                `json:"paid_amount"`
+	RefundedAmount    float64                `json:"refunded_amount"`
+	ShippingCost      float64                `json:"shipping_cost"`
+	Items             []merchantOrderItem    `json:"items"`
+	Payments          []merchantOrderPayment `json:"payments"`
+	Shipments         []interface{}          `json:"shipments"`
+	CreatedAt         string                 `json:"date_created"`
+	LastUpdatedAt     string                 `json:"last_updated"`
+}
+
+// update records p on the order and recomputes what was paid, closing the
+// order once approved payments cover it.
+func (o *merchantOrder) update(p *payment) {
+	found := false
+	for i := range o.Payments {
+		if o.Payments[i].ID == p.ID {
+			o.Payments[i] = orderPayment(p)
+			found = true
+		}
+	}
+
+	if !found {
+		o.Payments = append(o.Payments, orderPayment(p))
+	}
+
+	var paid int64
+	for _, op := range o.Payments {
+		if op.Status == "approved" {
+			paid += cents(op.TotalPaidAmount)
+		}
+	}
+
+	o.PaidAmount = float64(paid) / 100
+	o.LastUpdatedAt = p.LastUpdatedAt
+	switch {
+	case paid == 0:
+		o.Status, o.OrderStatus = "opened", "payment_required"
+	case paid < cents(o.TotalAmount):
+		o.Status, o.OrderStatus = "opened", "partially_paid"
+	default:
+		o.Status, o.OrderStatus = "closed", "paid"
+	}
+
+	if cents(o.RefundedAmount) > 0 && cents(o.RefundedAmount) >= cents(o.TotalAmount) {
+		o.OrderStatus = "reverted"
+	}
+}
+
+func orderPayment(p *payment) merchantOrderPayment {
+	return merchantOrderPayment{
+		ID:                p.ID,
+		Status:            p.Status,
+		StatusDetail:      p.StatusDetail,
+		TransactionAmount: p.TransactionAmount,
+		TotalPaidAmount:   p.TransactionAmount,
+		ApprovedAt:        p.ApprovedAt,
+	}
+}
+
+// createPreference keeps the preference as it was sent and opens its merchant
+// order, as Mercado Pago does once the buyer reaches the checkout.
+func (s *Server) createPreference(w http.ResponseWriter, r *http.Request) {
+	var preference map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&preference); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("couldn't decode body: %v", err))
+		return
+	}
+
+	var items []merchantOrderItem
+	b, _ := json.Marshal(preference["items"])
+	if err := json.Unmarshal(b, &items); err != nil || len(items) == 0 {
+		writeError(w, http.StatusBadRequest, "items are required")
+		return
+	}
+
+	normalizeAutoReturn(preference)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := fmt.Sprintf("%d-%s", s.CollectorID, randomHex(16))
+	now := s.timestamp()
+	preference["id"] = id
+	preference["collector_id"] = s.CollectorID
+	preference["init_point"] = fmt.Sprintf("%s?pref_id=%s", _checkoutURL, id)
+	preference["sandbox_init_point"] = fmt.Sprintf("%s?pref_id=%s", _sandboxCheckoutURL, id)
+	preference["date_created"] = now
+	preference["last_updated"] = now
+	s.preferences[id] = preference
+
+	var total int64
+	for i := range items {
+		if items[i].CurrencyID == "" {
+			items[i].CurrencyID = "ARS"
+		}
+
+		total += cents(items[i].UnitPrice) * int64(items[i].Quantity)
+	}
+
+	externalReference, _ := preference["external_reference"].(string)
+	orderID := s.newID()
+	s.merchantOrders[orderID] = &merchantOrder{
+		ID:                orderID,
+		PreferenceID:      id,
+		ExternalReference: externalReference,
+		Status:            "opened",
+		OrderStatus:       "payment_required",
+		TotalAmount:       float64(total) / 100,
+		Items:             items,
+		Payments:          []merchantOrderPayment{},
+		Shipments:         []interface{}{},
+		CreatedAt:         now,
+		LastUpdatedAt:     now,
+	}
+
+	writeJSON(w, http.StatusCreated, preference)
+}
+
+func (s *Server) getPreference(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	preference, ok := s.preference(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, preference)
+}
+
+// updatePreference replaces the fields that were sent, keeping the rest.
+func (s *Server) updatePreference(w http.ResponseWriter, r *http.Request) {
+	var update map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("couldn't decode body: %v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	preference, ok := s.preference(w, r)
+	if !ok {
+		return
+	}
+
+	for k, v := range update {
+		switch k {
+		case "id", "collector_id", "init_point", "sandbox_init_point", "date_created":
+			continue
+		}
+
+		preference[k] = v
+	}
+
+	normalizeAutoReturn(preference)
+	preference["last_updated"] = s.timestamp()
+	writeJSON(w, http.StatusOK, preference)
+}
+
+func (s *Server) searchPreferences(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, offset, ok := paging(w, query, 30)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elements := make([]map[string]interface{}, 0)
+	for _, p := range s.preferences {
+		if v := query.Get("external_reference"); v != "" && p["external_reference"] != v {
+			continue
+		}
+
+		elements = append(elements, p)
+	}
+
+	sort.Slice(elements, func(i, j int) bool {
+		return elements[i]["date_created"].(string) < elements[j]["date_created"].(string)
+	})
+
+	total := len(elements)
+	if offset > total {
+		offset = total
+	}
+
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"elements":    elements[offset:end],
+		"total":       total,
+		"next_offset": end,
+	})
+}
+
+// payPreference is the buyer going through the checkout: it creates the
+// payment for the preference's merchant order. The body is optional and can
+// set the card token, which decides the outcome, and the amount.
+func (s *Server) payPreference(w http.ResponseWriter, r *http.Request) {
+	var pay struct {
+		Token  string  `json:"token"`
+		Amount float64 `json:"amount"`
+		Email  string  `json:"email"`
+	}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&pay); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("couldn't decode body: %v", err))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	preference, ok := s.preference(w, r)
+	if !ok {
+		return
+	}
+
+	id := preference["id"].(string)
+	o := s.merchantOrderOf(id)
+	if pay.Amount == 0 {
+		pay.Amount = float64(cents(o.TotalAmount)-cents(o.PaidAmount)) / 100
+	}
+
+	if pay.Email == "" {
+		pay.Email = "test_user@testuser.com"
+	}
+
+	if pay.Amount <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("preference %s is already paid", id))
+		return
+	}
+
+	status, detail := cardOutcome(pay.Token)
+
+	externalReference, _ := preference["external_reference"].(string)
+	p := &payment{
+		ID:                s.newID(),
+		Status:            status,
+		StatusDetail:      detail,
+		ExternalReference: externalReference,
+		CurrencyID:        o.Items[0].CurrencyID,
+		TransactionAmount: pay.Amount,
+		Installments:      1,
+		PaymentMethodID:   "visa",
+		PaymentTypeID:     "credit_card",
+		Captured:          status == "approved",
+		Payer:             payer{Email: pay.Email},
+		CollectorID:       s.CollectorID,
+		FeeDetails:        []feeDetail{},
+		CreatedAt:         s.timestamp(),
+		LastUpdatedAt:     s.timestamp(),
+		preferenceID:      id,
+	}
+
+	if fee, ok := preference["marketplace_fee"].(float64); ok && fee > 0 {
+		p.FeeDetails = append(p.FeeDetails, feeDetail{Type: "application_fee", Amount: fee, FeePayer: "collector"})
+	}
+
+	if status == "approved" {
+		p.ApprovedAt = p.CreatedAt
+	}
+
+	s.payments[p.ID] = p
+	o.update(p)
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func (s *Server) getMerchantOrder(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.merchantOrders[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Merchant order not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, o)
+}
+
+func (s *Server) searchMerchantOrders(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, offset, ok := paging(w, query, 30)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elements := make([]*merchantOrder, 0)
+	for _, o := range s.merchantOrders {
+		if v := query.Get("preference_id"); v != "" && o.PreferenceID != v {
+			continue
+		}
+
+		if v := query.Get("external_reference"); v != "" && o.ExternalReference != v {
+			continue
+		}
+
+		elements = append(elements, o)
+	}
+
+	sort.Slice(elements, func(i, j int) bool { return elements[i].ID < elements[j].ID })
+
+	total := len(elements)
+	if offset > total {
+		offset = total
+	}
+
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"elements":    elements[offset:end],
+		"total":       total,
+		"next_offset": end,
+	})
+}
+
+// normalizeAutoReturn turns a boolean auto_return into the string Mercado Pago
+// answers with.
+func normalizeAutoReturn(preference map[string]interface{}) {
+	if v, ok := preference["auto_return"].(bool); ok {
+		preference["auto_return"] = ""
+		if v {
+			preference["auto_return"] = "approved"
+		}
+	}
+}
+
+// preference looks up the preference in the route. s.mu must be held.
+func (s *Server) preference(w http.ResponseWriter, r *http.Request) (map[string]interface{}, bool) {
+	preference, ok := s.preferences[mux.Vars(r)["id"]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Preference not found")
+		return nil, false
+	}
+
+	return preference, true
+}
+
+// merchantOrderOf returns the order of a preference, nil if it has none. s.mu
+// must be held.
+func (s *Server) merchantOrderOf(preferenceID string) *merchantOrder {
+	if preferenceID == "" {
+		return nil
+	}
+
+	for _, o := range s.merchantOrders {
+		if o.PreferenceID == preferenceID {
+			return o
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+// Package fakemp is an in-memory stand-in for the Mercado Pago API. It speaks
+// the same JSON as api.mercadopago.com for oauth/token, checkout/preferences,
+// v1/payments and merchant_orders, so a Gateway pointed at it behaves as it
+// would against the real thing. Payments created twice with the same
+// X-Idempotency-Key are only created once.
+//
+// Card payments resolve like Mercado Pago's test cards do, by the prefix of
+// the card token: APRO is approved, CONT is left in_process, OTHE, FUND and
+// SECU are rejected. Any other token is approved.
+//
+// Besides the API, the server has a few routes under /fake to drive it:
+// POST /fake/preferences/{id}/pay pays a preference as a buyer would,
+// PUT /fake/payments/{id}/status moves a payment to another status and
+// POST /fake/faults (or Inject) makes the next requests fail.
+package fakemp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_collectorID        = 123456789
+	_tokenExpiresIn     = 21600
+	_checkoutURL        = "https://www.mercadopago.com/checkout/v1/redirect"
+	_sandboxCheckoutURL = "https://sandbox.mercadopago.com/checkout/v1/redirect"
+)
+
+// Fault makes requests whose method and path match fail with Status and
+// Body. Path matches as a prefix and an empty Method matches any. Times is how
+// many requests fail; zero means until the fault is cleared.
+type Fault struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+	Times  int    `json:"times"`
+}
+
+type Server struct {
+	// CollectorID is the account every payment and preference belongs to.
+	CollectorID int64
+	now         func() time.Time
+	router      *mux.Router
+
+	mu             sync.Mutex
+	nextID         int64
+	faults         []*Fault
+	preferences    map[string]map[string]interface{}
+	payments       map[int64]*payment
+	refunds        map[int64][]refund
+	merchantOrders map[int64]*merchantOrder
+	// idempotencyKeys maps the X-Idempotency-Key of each created payment to
+	// its id, so a repeated request gets the same payment back.
+	idempotencyKeys map[string]int64
+}
+
+func NewServer() *Server {
+	s := &Server{
+		CollectorID:     _collectorID,
+		now:             time.Now,
+		nextID:          1000000,
+		preferences:     make(map[string]map[string]interface{}),
+		payments:        make(map[int64]*payment),
+		refunds:         make(map[int64][]refund),
+		merchantOrders:  make(map[int64]*merchantOrder),
+		idempotencyKeys: make(map[string]int64),
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/oauth/token", s.token).Methods("POST")
+	r.HandleFunc("/checkout/preferences", s.authorized(s.createPreference)).Methods("POST")
+	r.HandleFunc("/checkout/preferences/search", s.authorized(s.searchPreferences)).Methods("GET")
+	r.HandleFunc("/checkout/preferences/{id}", s.authorized(s.getPreference)).Methods("GET")
+	r.HandleFunc("/checkout/preferences/{id}", s.authorized(s.updatePreference)).Methods("PUT")
+	r.HandleFunc("/v1/payments", s.authorized(s.createPayment)).Methods("POST")
+	r.HandleFunc("/v1/payments/search", s.authorized(s.searchPayments)).Methods("GET")
+	r.HandleFunc("/v1/payments/{id:[0-9]+}", s.authorized(s.getPayment)).Methods("GET")
+	r.HandleFunc("/v1/payments/{id:[0-9]+}", s.authorized(s.updatePayment)).Methods("PUT")
+	r.HandleFunc("/v1/payments/{id:[0-9]+}/refunds", s.authorized(s.createRefund)).Methods("POST")
+	r.HandleFunc("/v1/payments/{id:[0-9]+}/refunds", s.authorized(s.getRefunds)).Methods("GET")
+	r.HandleFunc("/merchant_orders/search", s.authorized(s.searchMerchantOrders)).Methods("GET")
+	r.HandleFunc("/merchant_orders/{id:[0-9]+}", s.authorized(s.getMerchantOrder)).Methods("GET")
+	r.HandleFunc("/fake/preferences/{id}/pay", s.payPreference).Methods("POST")
+	r.HandleFunc("/fake/payments/{id:[0-9]+}/status", s.setPaymentStatus).Methods("PUT")
+	r.HandleFunc("/fake/faults", s.injectFault).Methods("POST")
+	r.HandleFunc("/fake/faults", s.clearFaults).Methods("DELETE")
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "resource not found")
+	})
+
+	s.router = r
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f, ok := s.fault(r); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(f.Status)
+		fmt.Fprint(w, f.Body)
+		return
+	}
+
+	s.router.ServeHTTP(w, r)
+}
+
+// Inject makes the requests matching f fail until it runs out or Clear is
+// called.
+func (s *Server) Inject(f Fault) {
+	if f.Status == 0 {
+		f.Status = http.StatusInternalServerError
+	}
+
+	if f.Body == "" {
+		f.Body = errorBody(f.Status, http.StatusText(f.Status))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, &f)
+}
+
+func (s *Server) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+}
+
+func (s *Server) fault(r *http.Request) (Fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, f := range s.faults {
+		if f.Method != "" && f.Method != r.Method {
+			continue
+		}
+
+		if !strings.HasPrefix(r.URL.Path, f.Path) {
+			continue
+		}
+
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+
+		return *f, true
+	}
+
+	return Fault{}, false
+}
+
+func (s *Server) injectFault(w http.ResponseWriter, r *http.Request) {
+	var f Fault
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("couldn't decode body: %v", err))
+		return
+	}
+
+	s.Inject(f)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) clearFaults(w http.ResponseWriter, _ *http.Request) {
+	s.Clear()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// token issues tokens for any non-empty client id and secret, taking the
+// parameters from the query string or a JSON body as Mercado Pago does.
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	params := make(map[string]string)
+	for k := range r.URL.Query() {
+		params[k] = r.URL.Query().Get(k)
+	}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("couldn't decode body: %v", err))
+			return
+		}
+	}
+
+	if params["client_id"] == "" || params["client_secret"] == "" {
+		writeError(w, http.StatusBadRequest, "invalid client_id or client_secret")
+		return
+	}
+
+	switch params["grant_type"] {
+	case "client_credentials":
+	case "authorization_code":
+		if params["code"] == "" {
+			writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	case "refresh_token":
+		if params["refresh_token"] == "" {
+			writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported grant_type %q", params["grant_type"]))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  "APP_USR-" + randomHex(16),
+		"token_type":    "bearer",
+		"expires_in":    _tokenExpiresIn,
+		"scope":         "offline_access read write",
+		"user_id":       s.CollectorID,
+		"refresh_token": "TG-" + randomHex(16),
+		"public_key":    "APP_USR-" + randomHex(8),
+		"live_mode":     false,
+	})
+}
+
+// authorized rejects requests without an access token. Any token is accepted.
+func (s *Server) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("access_token") == "" && !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			writeError(w, http.StatusUnauthorized, "invalid access token")
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func (s *Server) newID() int64 {
+	s.nextID++
+	return s.nextID
+}
+
+func (s *Server) timestamp() string {
+	return s.now().Format("2006-01-02T15:04:05.000-07:00")
+}
+
+// errorBody is Mercado Pago's error format.
+func errorBody(status int, message string) string {
+	b, _ := json.Marshal(map[string]interface{}{
+		"message": message,
+		"error":   strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"),
+		"status":  status,
+		"cause":   []interface{}{},
+	})
+
+	return string(b)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprint(w, errorBody(status, message))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("couldn't read random bytes: %v", err))
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,260 @@
+package fakemp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	s := NewServer()
+	s.now = func() time.Time { return time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC) }
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func call(t *testing.T, ts *httptest.Server, method string, path string, body string, v interface{}) int {
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+
+	return resp.StatusCode
+}
+
+func TestServer_Token(t *testing.T) {
+	// Given
+	_, ts := newTestServer(t)
+	var token map[string]interface{}
+
+	// When
+	status := call(t, ts, "POST", "/oauth/token", `{"client_id": "ABC123", "client_secret": "123ABC", "grant_type": "client_credentials"}`, &token)
+	invalidStatus := call(t, ts, "POST", "/oauth/token?grant_type=client_credentials", "", nil)
+
+	// Then
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, token["access_token"], "APP_USR-")
+	require.Equal(t, float64(_tokenExpiresIn), token["expires_in"])
+	require.Equal(t, http.StatusBadRequest, invalidStatus)
+}
+
+func TestServer_Unauthorized(t *testing.T) {
+	// Given
+	_, ts := newTestServer(t)
+
+	// When
+	status := call(t, ts, "GET", "/v1/payments/1", "", nil)
+
+	// Then
+	require.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestServer_CreatePayment(t *testing.T) {
+	tt := []struct {
+		token            string
+		capture          string
+		wantStatus       string
+		wantStatusDetail string
+	}{
+		{token: "APRO-1234", capture: "true", wantStatus: "approved", wantStatusDetail: "accredited"},
+		{token: "APRO-1234", capture: "false", wantStatus: "authorized", wantStatusDetail: "pending_capture"},
+		{token: "CONT-1234", capture: "true", wantStatus: "in_process", wantStatusDetail: "pending_contingency"},
+		{token: "FUND-1234", capture: "true", wantStatus: "rejected", wantStatusDetail: "cc_rejected_insufficient_amount"},
+		{token: "ff8080814c11e237014c1ff593b57b4d", capture: "true", wantStatus: "approved", wantStatusDetail: "accredited"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.token+"/"+tc.capture, func(t *testing.T) {
+			// Given
+			_, ts := newTestServer(t)
+			var p payment
+
+			// When
+			status := call(t, ts, "POST", "/v1/payments?access_token=TEST", fmt.Sprintf(`{"transaction_amount": 100, "token": %q, "installments": 1, "payment_method_id": "visa", "capture": %s, "payer": {"email": "test@test.com"}}`, tc.token, tc.capture), &p)
+
+			// Then
+			require.Equal(t, http.StatusCreated, status)
+			require.Equal(t, tc.wantStatus, p.Status)
+			require.Equal(t, tc.wantStatusDetail, p.StatusDetail)
+		})
+	}
+}
+
+func TestServer_CaptureAndRefund(t *testing.T) {
+	// Given
+	_, ts := newTestServer(t)
+	var p payment
+	call(t, ts, "POST", "/v1/payments?access_token=TEST", `{"transaction_amount": 100, "token": "APRO", "installments": 1, "payment_method_id": "visa", "capture": false, "payer": {"email": "test@test.com"}}`, &p)
+	path := fmt.Sprintf("/v1/payments/%d", p.ID)
+
+	// When
+	refundBeforeCapture := call(t, ts, "POST", path+"/refunds?access_token=TEST", "", nil)
+	call(t, ts, "PUT", path+"?access_token=TEST", `{"capture": true, "transaction_amount": 80}`, &p)
+	partial := call(t, ts, "POST", path+"/refunds?access_token=TEST", `{"amount": 30}`, nil)
+	tooMuch := call(t, ts, "POST", path+"/refunds?access_token=TEST", `{"amount": 60}`, nil)
+	full := call(t, ts, "POST", path+"/refunds?access_token=TEST", "", nil)
+	cancel := call(t, ts, "PUT", path+"?access_token=TEST", `{"status": "cancelled"}`, nil)
+
+	var refunded payment
+	call(t, ts, "GET", path+"?access_token=TEST", "", &refunded)
+
+	var refunds []refund
+	call(t, ts, "GET", path+"/refunds?access_token=TEST", "", &refunds)
+
+	// Then
+	require.Equal(t, http.StatusBadRequest, refundBeforeCapture)
+	require.Equal(t, "approved", p.Status)
+	require.Equal(t, 80.0, p.TransactionAmount)
+	require.Equal(t, http.StatusCreated, partial)
+	require.Equal(t, http.StatusBadRequest, tooMuch)
+	require.Equal(t, http.StatusCreated, full)
+	require.Equal(t, http.StatusBadRequest, cancel)
+	require.Equal(t, "refunded", refunded.Status)
+	require.Equal(t, 80.0, refunded.TransactionAmountRefunded)
+	require.Len(t, refunds, 2)
+	require.Equal(t, 50.0, refunds[1].Amount)
+}
+
+func TestServer_SearchPayments(t *testing.T) {
+	// Given
+	_, ts := newTestServer(t)
+	for _, token := range []string{"APRO", "OTHE", "APRO"} {
+		call(t, ts, "POST", "/v1/payments?access_token=TEST", fmt.Sprintf(`{"transaction_amount": 100, "token": %q, "installments": 1, "payment_method_id": "visa", "external_reference": "ORDER-1", "payer": {"email": "test@test.com"}}`, token), nil)
+	}
+
+	var result struct {
+		Results []payment      `json:"results"`
+		Paging  map[string]int `json:"paging"`
+	}
+
+	// When
+	status := call(t, ts, "GET", "/v1/payments/search?access_token=TEST&status=approved&external_reference=ORDER-1&limit=1", "", &result)
+
+	// Then
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, result.Results, 1)
+	require.Equal(t, 2, result.Paging["total"])
+}
+
+func TestServer_PayPreference(t *testing.T) {
+	// Given
+	_, ts := newTestServer(t)
+	var preference map[string]interface{}
+	call(t, ts, "POST", "/checkout/preferences?access_token=TEST", `{"items": [{"title": "Mug", "quantity": 2, "unit_price": 50}], "external_reference": "ORDER-1", "auto_return": true}`, &preference)
+	id := preference["id"].(string)
+
+	var orders struct {
+		Elements []merchantOrder `json:"elements"`
+		Total    int             `json:"total"`
+	}
+
+	// When
+	partial := call(t, ts, "POST", fmt.Sprintf("/fake/preferences/%s/pay", id), `{"amount": 40}`, nil)
+	rejected := call(t, ts, "POST", fmt.Sprintf("/fake/preferences/%s/pay", id), `{"token": "OTHE"}`, nil)
+	rest := call(t, ts, "POST", fmt.Sprintf("/fake/preferences/%s/pay", id), "", nil)
+	paid := call(t, ts, "POST", fmt.Sprintf("/fake/preferences/%s/pay", id), "", nil)
+	call(t, ts, "GET", "/merchant_orders/search?access_token=TEST&external_reference=ORDER-1", "", &orders)
+
+	// Then
+	require.Equal(t, "approved", preference["auto_return"])
+	require.Contains(t, preference["sandbox_init_point"], id)
+	require.Equal(t, http.StatusCreated, partial)
+	require.Equal(t, http.StatusCreated, rejected)
+	require.Equal(t, http.StatusCreated, rest)
+	require.Equal(t, http.StatusBadRequest, paid)
+	require.Equal(t, 1, orders.Total)
+	require.Equal(t, "closed", orders.Elements[0].Status)
+	require.Equal(t, "paid", orders.Elements[0].OrderStatus)
+	require.Equal(t, 100.0, orders.Elements[0].PaidAmount)
+	require.Len(t, orders.Elements[0].Payments, 3)
+}
+
+func TestServer_SetPaymentStatus(t *testing.T) {
+	// Given
+	_, ts := newTestServer(t)
+	var p payment
+	call(t, ts, "POST", "/v1/payments?access_token=TEST", `{"transaction_amount": 100, "token": "CONT", "installments": 1, "payment_method_id": "visa", "payer": {"email": "test@test.com"}}`, &p)
+	path := fmt.Sprintf("/fake/payments/%d/status", p.ID)
+
+	// When
+	approved := call(t, ts, "PUT", path, `{"status": "approved", "status_detail": "accredited"}`, &p)
+	invalid := call(t, ts, "PUT", path, `{"status": "pending"}`, nil)
+
+	// Then
+	require.Equal(t, http.StatusOK, approved)
+	require.Equal(t, "approved", p.Status)
+	require.NotEmpty(t, p.ApprovedAt)
+	require.Equal(t, http.StatusConflict, invalid)
+}
+
+func TestServer_Inject(t *testing.T) {
+	// Given
+	s, ts := newTestServer(t)
+	s.Inject(Fault{Method: "POST", Path: "/v1/payments", Status: http.StatusServiceUnavailable, Times: 1})
+	body := `{"transaction_amount": 100, "token": "APRO", "installments": 1, "payment_method_id": "visa", "payer": {"email": "test@test.com"}}`
+
+	// When
+	failed := call(t, ts, "POST", "/v1/payments?access_token=TEST", body, nil)
+	succeeded := call(t, ts, "POST", "/v1/payments?access_token=TEST", body, nil)
+
+	call(t, ts, "POST", "/fake/faults", `{"path": "/oauth/token", "status": 500}`, nil)
+	first := call(t, ts, "POST", "/oauth/token?client_id=A&client_secret=B&grant_type=client_credentials", "", nil)
+	second := call(t, ts, "POST", "/oauth/token?client_id=A&client_secret=B&grant_type=client_credentials", "", nil)
+	call(t, ts, "DELETE", "/fake/faults", "", nil)
+	cleared := call(t, ts, "POST", "/oauth/token?client_id=A&client_secret=B&grant_type=client_credentials", "", nil)
+
+	// Then
+	require.Equal(t, http.StatusServiceUnavailable, failed)
+	require.Equal(t, http.StatusCreated, succeeded)
+	require.Equal(t, http.StatusInternalServerError, first)
+	require.Equal(t, http.StatusInternalServerError, second)
+	require.Equal(t, http.StatusOK, cleared)
+}
+
+func TestServer_CreatePayment_IdempotencyKey(t *testing.T) {
+	// Given
+	_, ts := newTestServer(t)
+	body := `{"transaction_amount": 100, "token": "APRO", "installments": 1, "payment_method_id": "visa", "payer": {"email": "test@test.com"}}`
+	create := func(key string) payment {
+		req, err := http.NewRequest("POST", ts.URL+"/v1/payments?access_token=TEST", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("X-Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var p payment
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+		return p
+	}
+
+	// When
+	first := create("KEY-1")
+	repeated := create("KEY-1")
+	other := create("KEY-2")
+
+	// Then
+	require.Equal(t, first.ID, repeated.ID)
+	require.NotEqual(t, first.ID, other.ID)
+}
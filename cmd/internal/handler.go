@@ -1,22 +1,91 @@
 package internal
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"io"
+	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	_requestIDHeader    = "X-Request-Id"
+	_maxRequestIDLength = 128
+
+	_maxIdempotencyKeyLength = 128
+
+	// _statusClientClosedRequest is nginx's status for a client that went
+	// away before the answer, there's no standard one.
+	_statusClientClosedRequest = 499
 )
 
 var _v = validator.New()
 
 type Service interface {
-	GetAccessToken(clientID string, clientSecret string) (string, error)
-	CreatePreference(accessToken string, preference NewPreference) (string, error)
-	GetTotalPayments(accessToken string, status string) (int, error)
+	GetAccessToken(ctx context.Context, clientID string, clientSecret string) (string, error)
+	AuthenticateTenant(ctx context.Context, tenantID string, apiKey string) error
+	GetTenantAccessToken(ctx context.Context, tenantID string) (string, error)
+	GetSellerAccessToken(ctx context.Context, sellerID string) (string, error)
+	GetMarketplaceFees(ctx context.Context, search MarketplaceFeeSearch) (MarketplaceFeeReport, error)
+	CreatePreference(ctx context.Context, accessToken string, preference NewPreference) (Preference, error)
+	GetPreference(ctx context.Context, accessToken string, preferenceID string) (Preference, error)
+	UpdatePreference(ctx context.Context, accessToken string, preferenceID string, update PreferenceUpdate) (Preference, error)
+	SearchPreferences(ctx context.Context, accessToken string, search PreferenceSearch) (PreferenceSearchResult, error)
+	GetTotalPayments(ctx context.Context, accessToken string, status string) (int, error)
+	GetPayment(ctx context.Context, accessToken string, paymentID int64) (Payment, error)
+	CreatePayment(ctx context.Context, accessToken string, payment NewPayment) (Payment, error)
+	SearchPayments(ctx context.Context, accessToken string, search PaymentSearch) (PaymentSearchResult, error)
+	CreateRefund(ctx context.Context, accessToken string, paymentID int64, refund NewRefund) (Refund, error)
+	GetRefunds(ctx context.Context, accessToken string, paymentID int64) ([]Refund, error)
+	CapturePayment(ctx context.Context, accessToken string, paymentID int64, amount float64) (Payment, error)
+	CancelPayment(ctx context.Context, accessToken string, paymentID int64) (Payment, error)
+	CreateCustomer(ctx context.Context, accessToken string, customer NewCustomer) (Customer, error)
+	GetCustomer(ctx context.Context, accessToken string, customerID string) (Customer, error)
+	SearchCustomers(ctx context.Context, accessToken string, email string) (CustomerSearchResult, error)
+	UpdateCustomer(ctx context.Context, accessToken string, customerID string, update CustomerUpdate) (Customer, error)
+	DeleteCustomer(ctx context.Context, accessToken string, customerID string) error
+	CreateCard(ctx context.Context, accessToken string, customerID string, card NewCard) (Card, error)
+	GetCards(ctx context.Context, accessToken string, customerID string) ([]Card, error)
+	DeleteCard(ctx context.Context, accessToken string, customerID string, cardID string) error
+	GetPaymentMethods(ctx context.Context, accessToken string) ([]PaymentMethod, error)
+	GetCardIssuers(ctx context.Context, accessToken string, paymentMethodID string) ([]Issuer, error)
+	GetInstallments(ctx context.Context, accessToken string, search InstallmentsSearch) ([]Installments, error)
+	GetMerchantOrder(ctx context.Context, accessToken string, merchantOrderID int64) (MerchantOrder, error)
+	SearchMerchantOrders(ctx context.Context, accessToken string, search MerchantOrderSearch) (MerchantOrderSearchResult, error)
+	CreatePreapprovalPlan(ctx context.Context, accessToken string, plan NewPreapprovalPlan) (PreapprovalPlan, error)
+	UpdatePreapprovalPlan(ctx context.Context, accessToken string, planID string, update PreapprovalPlanUpdate) (PreapprovalPlan, error)
+	CreatePreapproval(ctx context.Context, accessToken string, preapproval NewPreapproval) (Preapproval, error)
+	GetPreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error)
+	SearchPreapprovals(ctx context.Context, accessToken string, search PreapprovalSearch) (PreapprovalSearchResult, error)
+	PausePreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error)
+	ResumePreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error)
+	CancelPreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error)
+}
+
+type merchantOrderResponse struct {
+	MerchantOrder
+	FullyPaid bool `json:"fully_paid"`
 }
 
 type Handler struct {
 	Service Service
+	// Token is used by requests that don't send an access_token header, as
+	// long as they send the admin token or ShareToken is set.
+	Token *ConfiguredToken
+	// ShareToken lets any request act with Token, without the admin token.
+	ShareToken bool
+	// AdminToken lets the platform act for connected sellers, and for any
+	// tenant without its API key.
+	AdminToken string
 }
 
 func NewHandler(service Service) *Handler{
@@ -26,116 +95,1149 @@ func NewHandler(service Service) *Handler{
 }
 
 func (h *Handler) Ping(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "pong")
+	writeText(w, http.StatusOK, "pong")
 }
 
 func (h *Handler) GetAccessToken(w http.ResponseWriter, r *http.Request) {
 	clientID := r.URL.Query().Get("client_id")
 	if clientID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "client id is required")
+		writeError(w, r, NewError("client id is required", http.StatusBadRequest))
 		return
 	}
 
 	clientSecret := r.URL.Query().Get("client_secret")
 	if clientSecret == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "client secret is required")
+		writeError(w, r, NewError("client secret is required", http.StatusBadRequest))
 		return
 	}
 
-	accessToken, err := h.Service.GetAccessToken(clientID, clientSecret)
+	accessToken, err := h.Service.GetAccessToken(r.Context(), clientID, clientSecret)
 	if err != nil {
-		w.WriteHeader(getStatusCodeFromError(err))
-		fmt.Fprintf(w, "couldn't get access token: %v", err)
+		writeError(w, r, fmt.Errorf("couldn't get access token: %w", err))
+		return
+	}
+
+	if isLegacy(r) {
+		writeText(w, http.StatusOK, accessToken)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "%s", accessToken)
+	writeJSON(w, http.StatusOK, AccessToken{AccessToken: accessToken})
 }
 
 func (h *Handler) CreatePreference(w http.ResponseWriter, r *http.Request) {
 	var preference NewPreference
 	if err := json.NewDecoder(r.Body).Decode(&preference); err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		fmt.Fprintf(w, "couldn't decode body: %v", err)
+		writeError(w, r, decodeError(err))
 		return
 	}
 
 	if err := _v.Struct(preference); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, fmt.Sprintf("validation error: %v", err))
+		writeError(w, r, validationError(preference, err))
 		return
 	}
 
 	for _, i := range preference.Items {
 		if err := _v.Struct(i); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, fmt.Sprintf("validation error: %v", err))
+			writeError(w, r, validationError(i, err))
 			return
 		}
 	}
 
 
-	accessToken := r.Header.Get("access_token")
-	if accessToken == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, fmt.Sprintf("access token is required"))
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := h.Service.CreatePreference(r.Context(), accessToken, preference)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't create checkout: %w", err))
+		return
+	}
+
+	if created.ID != "" {
+		w.Header().Set("Location", fmt.Sprintf("%s/%s", r.URL.Path, url.PathEscape(created.ID)))
+	}
+
+	// Legacy consumers only get the checkout URL; the preference itself can
+	// be fetched from Location.
+	if isLegacy(r) {
+		writeText(w, http.StatusOK, created.CheckoutURL)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (h *Handler) GetPreference(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	preference, err := h.Service.GetPreference(r.Context(), accessToken, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get preference: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, preference)
+}
+
+func (h *Handler) UpdatePreference(w http.ResponseWriter, r *http.Request) {
+	var update PreferenceUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(update); err != nil {
+		writeError(w, r, validationError(update, err))
+		return
+	}
+
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	preference, err := h.Service.UpdatePreference(r.Context(), accessToken, mux.Vars(r)["id"], update)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't update preference: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, preference)
+}
+
+func (h *Handler) SearchPreferences(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	search := PreferenceSearch{
+		ExternalReference: query.Get("external_reference"),
+	}
+
+	if err := parsePaging(query, &search.Limit, &search.Offset); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := _v.Struct(search); err != nil {
+		writeError(w, r, validationError(search, err))
 		return
 	}
 
-	checkoutURL, err := h.Service.CreatePreference(accessToken, preference)
+	result, err := h.Service.SearchPreferences(r.Context(), accessToken, search)
 	if err != nil {
-		w.WriteHeader(getStatusCodeFromError(err))
-		fmt.Fprintf(w, "couldn't create checkout: %v", err)
+		writeError(w, r, fmt.Errorf("couldn't search preferences: %w", err))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, fmt.Sprintf("%s", checkoutURL))
+	writeJSON(w, http.StatusOK, result)
 }
 
 func (h *Handler) GetTotalPayments(w http.ResponseWriter, r *http.Request) {
-	accessToken := r.Header.Get("access_token")
-	if accessToken == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, fmt.Sprintf("access token is required"))
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	status := r.URL.Query().Get("status")
 	if status == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, fmt.Sprintf("status is required"))
+		writeError(w, r, NewError("status is required", http.StatusBadRequest))
 		return
 	}
 
 	if status != "approved" && status != "rejected" && status != "pending" {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, fmt.Sprintf("invalid status: got: %s, want: approved, rejected or pending", status))
+		writeError(w, r, NewError(fmt.Sprintf("invalid status: got: %s, want: approved, rejected or pending", status), http.StatusBadRequest))
 		return
 	}
 
-	total, err := h.Service.GetTotalPayments(accessToken, status)
+	total, err := h.Service.GetTotalPayments(r.Context(), accessToken, status)
 	if err != nil {
-		w.WriteHeader(getStatusCodeFromError(err))
-		fmt.Fprintf(w, fmt.Sprintf("couldn't get total payments: %v", err))
+		writeError(w, r, fmt.Errorf("couldn't get total payments: %w", err))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, fmt.Sprintf("total payments: %d", total))
+	if isLegacy(r) {
+		writeText(w, http.StatusOK, fmt.Sprintf("total payments: %d", total))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TotalPayments{Status: status, Total: total})
 }
 
-func getStatusCodeFromError(err error) int {
-	e, ok := err.(*Error)
-	if !ok {
-		return http.StatusInternalServerError
+func (h *Handler) GetPayment(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
-	
-	return e.StatusCode
+
+	paymentID, err := getPaymentIDFromRequest(r)
+	if err != nil {
+		writeError(w, r, NewError(err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	payment, err := h.Service.GetPayment(r.Context(), accessToken, paymentID)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get payment: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, payment)
+}
+
+func (h *Handler) CreatePayment(w http.ResponseWriter, r *http.Request) {
+	var payment NewPayment
+	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(payment); err != nil {
+		writeError(w, r, validationError(payment, err))
+		return
+	}
+
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := h.Service.CreatePayment(r.Context(), accessToken, payment)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't create payment: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, struct {
+		ID           int64  `json:"id"`
+		Status       string `json:"status"`
+		StatusDetail string `json:"status_detail"`
+	}{
+		ID:           created.ID,
+		Status:       created.Status,
+		StatusDetail: created.StatusDetail,
+	})
+}
+
+func (h *Handler) SearchPayments(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	search := PaymentSearch{
+		Status:            query.Get("status"),
+		Range:             query.Get("range"),
+		BeginDate:         query.Get("begin_date"),
+		EndDate:           query.Get("end_date"),
+		ExternalReference: query.Get("external_reference"),
+		PayerEmail:        query.Get("payer_email"),
+		PaymentMethodID:   query.Get("payment_method_id"),
+		Sort:              query.Get("sort"),
+		Criteria:          query.Get("criteria"),
+	}
+
+	if err := parsePaging(query, &search.Limit, &search.Offset); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := _v.Struct(search); err != nil {
+		writeError(w, r, validationError(search, err))
+		return
+	}
+
+	result, err := h.Service.SearchPayments(r.Context(), accessToken, search)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't search payments: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) CreateRefund(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	paymentID, err := getPaymentIDFromRequest(r)
+	if err != nil {
+		writeError(w, r, NewError(err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	var refund NewRefund
+	if err := json.NewDecoder(r.Body).Decode(&refund); err != nil && err != io.EOF {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(refund); err != nil {
+		writeError(w, r, validationError(refund, err))
+		return
+	}
+
+	created, err := h.Service.CreateRefund(r.Context(), accessToken, paymentID, refund)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't create refund: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (h *Handler) GetRefunds(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	paymentID, err := getPaymentIDFromRequest(r)
+	if err != nil {
+		writeError(w, r, NewError(err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	refunds, err := h.Service.GetRefunds(r.Context(), accessToken, paymentID)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get refunds: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, refunds)
+}
+
+func (h *Handler) CapturePayment(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	paymentID, err := getPaymentIDFromRequest(r)
+	if err != nil {
+		writeError(w, r, NewError(err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	var capture NewCapture
+	if err := json.NewDecoder(r.Body).Decode(&capture); err != nil && err != io.EOF {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(capture); err != nil {
+		writeError(w, r, validationError(capture, err))
+		return
+	}
+
+	payment, err := h.Service.CapturePayment(r.Context(), accessToken, paymentID, capture.Amount)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't capture payment: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, payment)
+}
+
+func (h *Handler) CancelPayment(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	paymentID, err := getPaymentIDFromRequest(r)
+	if err != nil {
+		writeError(w, r, NewError(err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	payment, err := h.Service.CancelPayment(r.Context(), accessToken, paymentID)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't cancel payment: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, payment)
+}
+
+func (h *Handler) CreateCustomer(w http.ResponseWriter, r *http.Request) {
+	var customer NewCustomer
+	if err := json.NewDecoder(r.Body).Decode(&customer); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(customer); err != nil {
+		writeError(w, r, validationError(customer, err))
+		return
+	}
+
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := h.Service.CreateCustomer(r.Context(), accessToken, customer)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't create customer: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (h *Handler) GetCustomer(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	customer, err := h.Service.GetCustomer(r.Context(), accessToken, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get customer: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, customer)
+}
+
+func (h *Handler) SearchCustomers(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		writeError(w, r, NewError("email is required", http.StatusBadRequest))
+		return
+	}
+
+	result, err := h.Service.SearchCustomers(r.Context(), accessToken, email)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't search customers: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) UpdateCustomer(w http.ResponseWriter, r *http.Request) {
+	var update CustomerUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(update); err != nil {
+		writeError(w, r, validationError(update, err))
+		return
+	}
+
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	customer, err := h.Service.UpdateCustomer(r.Context(), accessToken, mux.Vars(r)["id"], update)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't update customer: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, customer)
+}
+
+func (h *Handler) DeleteCustomer(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := h.Service.DeleteCustomer(r.Context(), accessToken, mux.Vars(r)["id"]); err != nil {
+		writeError(w, r, fmt.Errorf("couldn't delete customer: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) CreateCard(w http.ResponseWriter, r *http.Request) {
+	var card NewCard
+	if err := json.NewDecoder(r.Body).Decode(&card); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(card); err != nil {
+		writeError(w, r, validationError(card, err))
+		return
+	}
+
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := h.Service.CreateCard(r.Context(), accessToken, mux.Vars(r)["id"], card)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't create card: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (h *Handler) GetCards(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	cards, err := h.Service.GetCards(r.Context(), accessToken, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get cards: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, cards)
+}
+
+func (h *Handler) DeleteCard(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	vars := mux.Vars(r)
+	if err := h.Service.DeleteCard(r.Context(), accessToken, vars["id"], vars["card_id"]); err != nil {
+		writeError(w, r, fmt.Errorf("couldn't delete card: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) GetPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	paymentMethods, err := h.Service.GetPaymentMethods(r.Context(), accessToken)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get payment methods: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, paymentMethods)
+}
+
+func (h *Handler) GetCardIssuers(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	paymentMethodID := r.URL.Query().Get("payment_method_id")
+	if paymentMethodID == "" {
+		writeError(w, r, NewError("payment method id is required", http.StatusBadRequest))
+		return
+	}
+
+	issuers, err := h.Service.GetCardIssuers(r.Context(), accessToken, paymentMethodID)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get card issuers: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, issuers)
+}
+
+func (h *Handler) GetInstallments(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	amount, err := strconv.ParseFloat(query.Get("amount"), 64)
+	if err != nil {
+		writeError(w, r, NewError(fmt.Sprintf("invalid amount: %s", query.Get("amount")), http.StatusBadRequest))
+		return
+	}
+
+	search := InstallmentsSearch{
+		Amount:          amount,
+		Bin:             query.Get("bin"),
+		PaymentMethodID: query.Get("payment_method_id"),
+		IssuerID:        query.Get("issuer_id"),
+	}
+
+	if err := _v.Struct(search); err != nil {
+		writeError(w, r, validationError(search, err))
+		return
+	}
+
+	installments, err := h.Service.GetInstallments(r.Context(), accessToken, search)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get installments: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, installments)
+}
+
+func (h *Handler) GetMerchantOrder(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	merchantOrderID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeError(w, r, NewError(fmt.Sprintf("invalid merchant order id: %s", id), http.StatusBadRequest))
+		return
+	}
+
+	merchantOrder, err := h.Service.GetMerchantOrder(r.Context(), accessToken, merchantOrderID)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get merchant order: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, merchantOrderResponse{
+		MerchantOrder: merchantOrder,
+		FullyPaid:     merchantOrder.IsPaid(),
+	})
+}
+
+func (h *Handler) SearchMerchantOrders(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	search := MerchantOrderSearch{
+		PreferenceID:      query.Get("preference_id"),
+		ExternalReference: query.Get("external_reference"),
+	}
+
+	if err := parsePaging(query, &search.Limit, &search.Offset); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := _v.Struct(search); err != nil {
+		writeError(w, r, validationError(search, err))
+		return
+	}
+
+	result, err := h.Service.SearchMerchantOrders(r.Context(), accessToken, search)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't search merchant orders: %w", err))
+		return
+	}
+
+	orders := make([]merchantOrderResponse, 0, len(result.Elements))
+	for _, merchantOrder := range result.Elements {
+		orders = append(orders, merchantOrderResponse{
+			MerchantOrder: merchantOrder,
+			FullyPaid:     merchantOrder.IsPaid(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Elements   []merchantOrderResponse `json:"elements"`
+		Total      int                     `json:"total"`
+		NextOffset int                     `json:"next_offset"`
+	}{
+		Elements:   orders,
+		Total:      result.Total,
+		NextOffset: result.NextOffset,
+	})
+}
+
+func (h *Handler) CreatePreapprovalPlan(w http.ResponseWriter, r *http.Request) {
+	var plan NewPreapprovalPlan
+	if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(plan); err != nil {
+		writeError(w, r, validationError(plan, err))
+		return
+	}
+
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := h.Service.CreatePreapprovalPlan(r.Context(), accessToken, plan)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't create subscription plan: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (h *Handler) UpdatePreapprovalPlan(w http.ResponseWriter, r *http.Request) {
+	var update PreapprovalPlanUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(update); err != nil {
+		writeError(w, r, validationError(update, err))
+		return
+	}
+
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	plan, err := h.Service.UpdatePreapprovalPlan(r.Context(), accessToken, mux.Vars(r)["id"], update)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't update subscription plan: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func (h *Handler) CreatePreapproval(w http.ResponseWriter, r *http.Request) {
+	var preapproval NewPreapproval
+	if err := json.NewDecoder(r.Body).Decode(&preapproval); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(preapproval); err != nil {
+		writeError(w, r, validationError(preapproval, err))
+		return
+	}
+
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	created, err := h.Service.CreatePreapproval(r.Context(), accessToken, preapproval)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't create subscription: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (h *Handler) GetPreapproval(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	preapproval, err := h.Service.GetPreapproval(r.Context(), accessToken, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get subscription: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, preapproval)
+}
+
+func (h *Handler) SearchPreapprovals(w http.ResponseWriter, r *http.Request) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	search := PreapprovalSearch{
+		PayerEmail:        query.Get("payer_email"),
+		Status:            query.Get("status"),
+		PreapprovalPlanID: query.Get("preapproval_plan_id"),
+	}
+
+	if err := parsePaging(query, &search.Limit, &search.Offset); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := _v.Struct(search); err != nil {
+		writeError(w, r, validationError(search, err))
+		return
+	}
+
+	result, err := h.Service.SearchPreapprovals(r.Context(), accessToken, search)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't search subscriptions: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (h *Handler) PausePreapproval(w http.ResponseWriter, r *http.Request) {
+	h.updatePreapprovalStatus(w, r, "pause", h.Service.PausePreapproval)
+}
+
+func (h *Handler) ResumePreapproval(w http.ResponseWriter, r *http.Request) {
+	h.updatePreapprovalStatus(w, r, "resume", h.Service.ResumePreapproval)
+}
+
+func (h *Handler) CancelPreapproval(w http.ResponseWriter, r *http.Request) {
+	h.updatePreapprovalStatus(w, r, "cancel", h.Service.CancelPreapproval)
+}
+
+func (h *Handler) updatePreapprovalStatus(w http.ResponseWriter, r *http.Request, action string, update func(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error)) {
+	accessToken, err := h.getAccessToken(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	preapproval, err := update(r.Context(), accessToken, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't %s subscription: %w", action, err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, preapproval)
+}
+
+func getPaymentIDFromRequest(r *http.Request) (int64, error) {
+	id := mux.Vars(r)["id"]
+	paymentID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid payment id: %s", id)
+	}
+
+	return paymentID, nil
+}
+
+func (h *Handler) GetMarketplaceFees(w http.ResponseWriter, r *http.Request) {
+	search := MarketplaceFeeSearch{
+		BeginDate: r.URL.Query().Get("begin_date"),
+		EndDate:   r.URL.Query().Get("end_date"),
+	}
+
+	if err := _v.Struct(search); err != nil {
+		writeError(w, r, validationError(search, err))
+		return
+	}
+
+	report, err := h.Service.GetMarketplaceFees(r.Context(), search)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't get marketplace fees: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// RequireAdminToken only lets requests through when their admin_token header
+// matches token. An empty token locks the route.
+func RequireAdminToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasAdminToken(r, token) {
+			writeError(w, r, NewError("admin token is required", http.StatusUnauthorized))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func hasAdminToken(r *http.Request, token string) bool {
+	given := r.Header.Get("admin_token")
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+type requestIDKey struct{}
+
+// WithRequestID gives every request an id, the X-Request-Id the client sent
+// if it's usable, and echoes it on the response. Error responses carry it too,
+// so clients can point us at the request that failed.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(_requestIDHeader)
+		if id == "" || len(id) > _maxRequestIDLength {
+			id = randomID(16)
+		}
+
+		w.Header().Set(_requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// WithIdempotencyKey passes the X-Idempotency-Key a client sent with a POST
+// on to the POSTs we make to Mercado Pago for it, so retrying after a timeout
+// doesn't repeat them.
+func WithIdempotencyKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(_idempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > _maxIdempotencyKeyLength {
+			writeError(w, r, NewError(fmt.Sprintf("idempotency key can't be longer than %d characters", _maxIdempotencyKeyLength), http.StatusBadRequest))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withIdempotencyKey(r.Context(), key)))
+	})
+}
+
+type legacyKey struct{}
+
+// Legacy serves next in the plain-text format the API answered with before
+// it moved to JSON, so consumers that haven't migrated keep working: a few
+// success bodies are bare strings and errors are just their message.
+func Legacy(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(context.WithValue(r.Context(), legacyKey{}, true)))
+	}
+}
+
+// NotFound answers requests no route matches like any other error, in the
+// legacy format under /v0.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, withLegacyPath(r), NewError(fmt.Sprintf("%s not found", r.URL.Path), http.StatusNotFound))
+}
+
+// MethodNotAllowed answers requests to a route that doesn't take their
+// method like any other error, in the legacy format under /v0.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, withLegacyPath(r), NewError(fmt.Sprintf("%s doesn't allow %s", r.URL.Path, r.Method), http.StatusMethodNotAllowed))
+}
+
+// withLegacyPath marks r as legacy if its path is under /v0, for the handlers
+// that run without a route, so without Legacy around them.
+func withLegacyPath(r *http.Request) *http.Request {
+	if r.URL.Path != "/v0" && !strings.HasPrefix(r.URL.Path, "/v0/") {
+		return r
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), legacyKey{}, true))
+}
+
+func isLegacy(r *http.Request) bool {
+	legacy, _ := r.Context().Value(legacyKey{}).(bool)
+	return legacy
+}
+
+func getRequestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+
+	return r.Header.Get(_requestIDHeader)
+}
+
+// getAccessToken prefers the access_token header, then the seller or tenant
+// named by the route or the seller_id and tenant_id headers, and falls back to
+// the configured credentials for the platform itself.
+func (h *Handler) getAccessToken(r *http.Request) (string, error) {
+	if accessToken := r.Header.Get("access_token"); accessToken != "" {
+		return accessToken, nil
+	}
+
+	sellerID := mux.Vars(r)["seller_id"]
+	if sellerID == "" {
+		sellerID = r.Header.Get("seller_id")
+	}
+
+	// Seller ids are public Mercado Pago user ids, only the platform itself
+	// may act for a seller.
+	if sellerID != "" {
+		if !hasAdminToken(r, h.AdminToken) {
+			return "", NewError("admin token is required", http.StatusUnauthorized)
+		}
+
+		return h.Service.GetSellerAccessToken(r.Context(), sellerID)
+	}
+
+	tenantID := mux.Vars(r)["tenant_id"]
+	if tenantID == "" {
+		tenantID = r.Header.Get("tenant_id")
+	}
+
+	if tenantID != "" {
+		if err := h.authenticateTenant(r, tenantID); err != nil {
+			return "", err
+		}
+
+		return h.Service.GetTenantAccessToken(r.Context(), tenantID)
+	}
+
+	// The configured credentials are the platform's own account.
+	if !h.ShareToken && !hasAdminToken(r, h.AdminToken) {
+		return "", NewError("access token is required", http.StatusUnauthorized)
+	}
+
+	return h.Token.AccessToken(r.Context())
+}
+
+// authenticateTenant lets a request act for a tenant if it sends the
+// tenant's api_key header, or the admin token.
+func (h *Handler) authenticateTenant(r *http.Request, tenantID string) error {
+	if hasAdminToken(r, h.AdminToken) {
+		return nil
+	}
+
+	apiKey := r.Header.Get("api_key")
+	if apiKey == "" {
+		return NewError("api key is required", http.StatusUnauthorized)
+	}
+
+	return h.Service.AuthenticateTenant(r.Context(), tenantID, apiKey)
+}
+
+// parsePaging reads the limit and offset query parameters into limit and
+// offset, leaving them alone when they aren't sent.
+func parsePaging(query url.Values, limit *int, offset *int) error {
+	for key, field := range map[string]*int{"limit": limit, "offset": offset} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return NewError(fmt.Sprintf("invalid %s: %s", key, value), http.StatusBadRequest)
+		}
+
+		*field = n
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeText(w http.ResponseWriter, statusCode int, s string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(statusCode)
+	io.WriteString(w, s)
+}
+
+func getStatusCodeFromError(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return _statusClientClosedRequest
+	}
+
+	var e *Error
+	if !errors.As(err, &e) {
+		return http.StatusInternalServerError
+	}
+	
+	return e.StatusCode
+}
+
+// getErrorCode is the code clients see for err: its own, or one named after
+// its status, e.g. "not_found".
+func getErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) && e.Code != "" {
+		return e.Code
+	}
+
+	if getStatusCodeFromError(err) == _statusClientClosedRequest {
+		return "client_closed_request"
+	}
+
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(getStatusCodeFromError(err))), " ", "_")
+}
+
+// writeError answers with err as an ErrorResponse, or only its message on
+// legacy routes, along with a Retry-After header when err says when to come
+// back. A server error we didn't build an *Error for is only logged, as its
+// message can say anything, and the client gets the status text instead.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	statusCode := getStatusCodeFromError(err)
+	response := ErrorResponse{
+		Code:      getErrorCode(err),
+		Message:   err.Error(),
+		RequestID: getRequestID(r),
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		response.Fields = e.Fields
+		response.Cause = e.Cause
+		if e.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+		}
+	} else if statusCode >= http.StatusInternalServerError {
+		log.Printf("request %s failed: %v", response.RequestID, err)
+		response.Message = strings.ToLower(http.StatusText(statusCode))
+	}
+
+	if isLegacy(r) {
+		writeText(w, statusCode, response.Message)
+		return
+	}
+
+	writeJSON(w, statusCode, response)
 }
 
 
@@ -2,34 +2,231 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 type ServiceStub struct {
 	accessToken string
-	checkout string
+	preference Preference
+	preferenceUpdate PreferenceUpdate
+	preferenceSearch PreferenceSearch
+	preferenceSearchResult PreferenceSearchResult
 	totalPayments int
+	payment Payment
+	searchResult PaymentSearchResult
+	search PaymentSearch
+	refund Refund
+	newRefund NewRefund
+	refunds []Refund
+	captureAmount float64
+	newPayment NewPayment
+	customer Customer
+	newCustomer NewCustomer
+	customerSearchResult CustomerSearchResult
+	card Card
+	cards []Card
+	deleted []string
+	installments []Installments
+	installmentsSearch InstallmentsSearch
+	merchantOrder MerchantOrder
+	merchantOrderSearch MerchantOrderSearch
+	merchantOrderSearchResult MerchantOrderSearchResult
+	preapprovalPlan PreapprovalPlan
+	preapproval Preapproval
+	preapprovalSearch PreapprovalSearch
+	preapprovalSearchResult PreapprovalSearchResult
+	marketplaceFeeSearch MarketplaceFeeSearch
+	marketplaceFeeReport MarketplaceFeeReport
 	err error
 }
 
-func (s *ServiceStub) GetAccessToken(_ string, _ string) (string, error) {
+func (s *ServiceStub) GetAccessToken(_ context.Context, _ string, _ string) (string, error) {
 	return s.accessToken, s.err
 }
 
-func (s *ServiceStub) CreatePreference(_ string, _ NewPreference) (string, error) {
-	return s.checkout, s.err
+func (s *ServiceStub) AuthenticateTenant(_ context.Context, _ string, apiKey string) error {
+	if apiKey != "MY_API_KEY" {
+		return NewError("invalid api key", http.StatusUnauthorized)
+	}
+
+	return nil
+}
+
+func (s *ServiceStub) GetTenantAccessToken(_ context.Context, _ string) (string, error) {
+	return s.accessToken, s.err
+}
+
+func (s *ServiceStub) GetSellerAccessToken(_ context.Context, _ string) (string, error) {
+	return s.accessToken, s.err
+}
+
+func (s *ServiceStub) GetMarketplaceFees(_ context.Context, search MarketplaceFeeSearch) (MarketplaceFeeReport, error) {
+	s.marketplaceFeeSearch = search
+	return s.marketplaceFeeReport, s.err
+}
+
+func (s *ServiceStub) CreatePreference(_ context.Context, _ string, _ NewPreference) (Preference, error) {
+	return s.preference, s.err
+}
+
+func (s *ServiceStub) GetPreference(_ context.Context, _ string, _ string) (Preference, error) {
+	return s.preference, s.err
+}
+
+func (s *ServiceStub) UpdatePreference(_ context.Context, _ string, _ string, update PreferenceUpdate) (Preference, error) {
+	s.preferenceUpdate = update
+	return s.preference, s.err
 }
 
-func (s *ServiceStub) GetTotalPayments(_ string, _ string) (int, error) {
+func (s *ServiceStub) SearchPreferences(_ context.Context, _ string, search PreferenceSearch) (PreferenceSearchResult, error) {
+	s.preferenceSearch = search
+	return s.preferenceSearchResult, s.err
+}
+
+func (s *ServiceStub) GetTotalPayments(_ context.Context, _ string, _ string) (int, error) {
 	return s.totalPayments, s.err
 }
 
+func (s *ServiceStub) GetPayment(_ context.Context, _ string, _ int64) (Payment, error) {
+	return s.payment, s.err
+}
+
+func (s *ServiceStub) SearchPayments(_ context.Context, _ string, search PaymentSearch) (PaymentSearchResult, error) {
+	s.search = search
+	return s.searchResult, s.err
+}
+
+func (s *ServiceStub) CreateRefund(_ context.Context, _ string, _ int64, refund NewRefund) (Refund, error) {
+	s.newRefund = refund
+	return s.refund, s.err
+}
+
+func (s *ServiceStub) GetRefunds(_ context.Context, _ string, _ int64) ([]Refund, error) {
+	return s.refunds, s.err
+}
+
+func (s *ServiceStub) CapturePayment(_ context.Context, _ string, _ int64, amount float64) (Payment, error) {
+	s.captureAmount = amount
+	return s.payment, s.err
+}
+
+func (s *ServiceStub) CancelPayment(_ context.Context, _ string, _ int64) (Payment, error) {
+	return s.payment, s.err
+}
+
+func (s *ServiceStub) CreatePayment(_ context.Context, _ string, payment NewPayment) (Payment, error) {
+	s.newPayment = payment
+	return s.payment, s.err
+}
+
+func (s *ServiceStub) CreateCustomer(_ context.Context, _ string, customer NewCustomer) (Customer, error) {
+	s.newCustomer = customer
+	return s.customer, s.err
+}
+
+func (s *ServiceStub) GetCustomer(_ context.Context, _ string, _ string) (Customer, error) {
+	return s.customer, s.err
+}
+
+func (s *ServiceStub) SearchCustomers(_ context.Context, _ string, _ string) (CustomerSearchResult, error) {
+	return s.customerSearchResult, s.err
+}
+
+func (s *ServiceStub) UpdateCustomer(_ context.Context, _ string, _ string, _ CustomerUpdate) (Customer, error) {
+	return s.customer, s.err
+}
+
+func (s *ServiceStub) DeleteCustomer(_ context.Context, _ string, customerID string) error {
+	s.deleted = append(s.deleted, customerID)
+	return s.err
+}
+
+func (s *ServiceStub) CreateCard(_ context.Context, _ string, _ string, _ NewCard) (Card, error) {
+	return s.card, s.err
+}
+
+func (s *ServiceStub) GetCards(_ context.Context, _ string, _ string) ([]Card, error) {
+	return s.cards, s.err
+}
+
+func (s *ServiceStub) DeleteCard(_ context.Context, _ string, customerID string, cardID string) error {
+	s.deleted = append(s.deleted, customerID, cardID)
+	return s.err
+}
+
+func (s *ServiceStub) GetPaymentMethods(_ context.Context, _ string) ([]PaymentMethod, error) {
+	return nil, s.err
+}
+
+func (s *ServiceStub) GetCardIssuers(_ context.Context, _ string, _ string) ([]Issuer, error) {
+	return nil, s.err
+}
+
+func (s *ServiceStub) GetInstallments(_ context.Context, _ string, search InstallmentsSearch) ([]Installments, error) {
+	s.installmentsSearch = search
+	return s.installments, s.err
+}
+
+func (s *ServiceStub) GetMerchantOrder(_ context.Context, _ string, _ int64) (MerchantOrder, error) {
+	return s.merchantOrder, s.err
+}
+
+func (s *ServiceStub) SearchMerchantOrders(_ context.Context, _ string, search MerchantOrderSearch) (MerchantOrderSearchResult, error) {
+	s.merchantOrderSearch = search
+	return s.merchantOrderSearchResult, s.err
+}
+
+func (s *ServiceStub) CreatePreapprovalPlan(_ context.Context, _ string, _ NewPreapprovalPlan) (PreapprovalPlan, error) {
+	return s.preapprovalPlan, s.err
+}
+
+func (s *ServiceStub) UpdatePreapprovalPlan(_ context.Context, _ string, _ string, _ PreapprovalPlanUpdate) (PreapprovalPlan, error) {
+	return s.preapprovalPlan, s.err
+}
+
+func (s *ServiceStub) CreatePreapproval(_ context.Context, _ string, _ NewPreapproval) (Preapproval, error) {
+	return s.preapproval, s.err
+}
+
+func (s *ServiceStub) GetPreapproval(_ context.Context, _ string, _ string) (Preapproval, error) {
+	return s.preapproval, s.err
+}
+
+func (s *ServiceStub) SearchPreapprovals(_ context.Context, _ string, search PreapprovalSearch) (PreapprovalSearchResult, error) {
+	s.preapprovalSearch = search
+	return s.preapprovalSearchResult, s.err
+}
+
+func (s *ServiceStub) PausePreapproval(_ context.Context, _ string, _ string) (Preapproval, error) {
+	return s.preapproval, s.err
+}
+
+func (s *ServiceStub) ResumePreapproval(_ context.Context, _ string, _ string) (Preapproval, error) {
+	return s.preapproval, s.err
+}
+
+func (s *ServiceStub) CancelPreapproval(_ context.Context, _ string, _ string) (Preapproval, error) {
+	return s.preapproval, s.err
+}
+
+// errorResponse decodes the error body the API answers with.
+func errorResponse(t *testing.T, b []byte) ErrorResponse {
+	var e ErrorResponse
+	require.NoError(t, json.Unmarshal(b, &e))
+	return e
+}
+
 func TestHandler_GetAccessToken(t *testing.T) {
 	// Given
 	h := NewHandler(&ServiceStub{
@@ -55,8 +252,12 @@ func TestHandler_GetAccessToken(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	var token AccessToken
+	require.NoError(t, json.Unmarshal(b, &token))
+
 	// Then
-	require.Equal(t, "MY_ACCESS_TOKEN", string(b))
+	require.Equal(t, "MY_ACCESS_TOKEN", token.AccessToken)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
@@ -106,7 +307,7 @@ func TestHandler_GetAccessToken_BadRequest_Error(t *testing.T) {
 			}
 
 			// Then
-			require.Equal(t, tc.wantError, string(errorMessage))
+			require.Equal(t, tc.wantError, errorResponse(t, errorMessage).Message)
 			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
 		})
 	}
@@ -166,7 +367,7 @@ func TestHandler_GetAccessToken_Error(t *testing.T) {
 			}
 
 			// Then
-			require.Equal(t, tc.wantError, string(errorMessage))
+			require.Equal(t, tc.wantError, errorResponse(t, errorMessage).Message)
 			require.Equal(t, tc.wantErrorStatusCode, resp.StatusCode)
 		})
 	}
@@ -175,7 +376,12 @@ func TestHandler_GetAccessToken_Error(t *testing.T) {
 func TestHandler_CreatePreference(t *testing.T) {
 	// Given
 	h := NewHandler(&ServiceStub{
-		checkout: "https://mercadopago.com/MY_CHECKOUT_PATH",
+		preference: Preference{
+			ID:               "123-abc",
+			InitPoint:        "https://mercadopago.com/MY_CHECKOUT_PATH",
+			SandboxInitPoint: "https://sandbox.mercadopago.com/MY_CHECKOUT_PATH",
+			CheckoutURL:      "https://mercadopago.com/MY_CHECKOUT_PATH",
+		},
 	})
 	body := []byte(`{
 		"items": [
@@ -222,15 +428,22 @@ func TestHandler_CreatePreference(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	var preference Preference
+	require.NoError(t, json.Unmarshal(b, &preference))
+
 	// Then
-	require.Equal(t, "https://mercadopago.com/MY_CHECKOUT_PATH", string(b))
-	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "123-abc", preference.ID)
+	require.Equal(t, "https://mercadopago.com/MY_CHECKOUT_PATH", preference.InitPoint)
+	require.Equal(t, "https://sandbox.mercadopago.com/MY_CHECKOUT_PATH", preference.SandboxInitPoint)
+	require.Equal(t, "/preferences/123-abc", resp.Header.Get("Location"))
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
 }
 
 func TestHandler_CreatePreference_UnprocessableEntity_Error(t *testing.T) {
 	// Given
 	h := NewHandler(&ServiceStub{
-		checkout: "https://mercadopago.com/MY_CHECKOUT_PATH",
+		preference: Preference{CheckoutURL: "https://mercadopago.com/MY_CHECKOUT_PATH"},
 	})
 	body := []byte(`{
 		"items": [
@@ -278,7 +491,10 @@ func TestHandler_CreatePreference_UnprocessableEntity_Error(t *testing.T) {
 	}
 
 	// Then
-	require.Equal(t, "couldn't decode body: json: cannot unmarshal string into Go struct field Item.items.quantity of type int", string(b))
+	e := errorResponse(t, b)
+	require.Equal(t, "invalid_body", e.Code)
+	require.Contains(t, e.Message, "couldn't decode body: json: cannot unmarshal string into Go struct field")
+	require.Equal(t, []FieldError{{Field: "items.0.quantity", Rule: "type", Message: "must be int"}}, e.Fields)
 	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
 }
 
@@ -419,7 +635,7 @@ func TestHandler_CreatePreference_BadRequest_Error(t *testing.T) {
 			}
 
 			// Then
-			require.Equal(t, tc.wantError, string(b))
+			require.Equal(t, tc.wantError, errorResponse(t, b).Message)
 			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
 		})
 	}
@@ -473,7 +689,7 @@ func TestHandler_CreatePreference_Unauthorized_Error(t *testing.T) {
 	}
 
 	// Then
-	require.Equal(t, "access token is required", string(b))
+	require.Equal(t, "access token is required", errorResponse(t, b).Message)
 	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 }
 
@@ -505,7 +721,7 @@ func TestHandler_CreatePreference_ClientError(t *testing.T) {
 		{
 			name: "couldn't cast error",
 			err: errors.New("random error"),
-			wantError: "couldn't create checkout: random error",
+			wantError: "internal server error",
 			wantErrorStatusCode: http.StatusInternalServerError,
 		},
 	}
@@ -562,7 +778,7 @@ func TestHandler_CreatePreference_ClientError(t *testing.T) {
 			}
 
 			// Then
-			require.Equal(t, tc.wantError, string(b))
+			require.Equal(t, tc.wantError, errorResponse(t, b).Message)
 			require.Equal(t, tc.wantErrorStatusCode, resp.StatusCode)
 		})
 	}
@@ -595,11 +811,179 @@ func TestHandler_GetTotalPayments(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	var total TotalPayments
+	require.NoError(t, json.Unmarshal(b, &total))
+
 	// Then
-	require.Equal(t, "total payments: 100", string(b))
+	require.Equal(t, TotalPayments{Status: "approved", Total: 100}, total)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
 	require.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
+func TestHandler_Legacy(t *testing.T) {
+	h := NewHandler(&ServiceStub{
+		accessToken:   "MY_ACCESS_TOKEN",
+		preference:    Preference{ID: "123-abc", CheckoutURL: "https://mercadopago.com/MY_CHECKOUT_PATH"},
+		totalPayments: 100,
+	})
+	body := `{"items": [{"title": "Libro", "quantity": 1, "unit_price": 150.70}], "payer": {"name": "Mateo", "email": "mateo.ferrari@gmail.com", "phone": {"number": "11111111"}, "address": {"street": "posta", "number": 4789}, "date_created": "14-06-2020"}}`
+
+	tt := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "access token",
+			method:     http.MethodGet,
+			path:       "/v0/access_token?client_id=MY_CLIENT_ID&client_secret=MY_CLIENT_SECRET",
+			handler:    h.GetAccessToken,
+			wantStatus: http.StatusOK,
+			wantBody:   "MY_ACCESS_TOKEN",
+		},
+		{
+			name:       "create preference",
+			method:     http.MethodPost,
+			path:       "/v0/preferences",
+			body:       body,
+			handler:    h.CreatePreference,
+			wantStatus: http.StatusOK,
+			wantBody:   "https://mercadopago.com/MY_CHECKOUT_PATH",
+		},
+		{
+			name:       "total payments",
+			method:     http.MethodGet,
+			path:       "/v0/total_payments?status=approved",
+			handler:    h.GetTotalPayments,
+			wantStatus: http.StatusOK,
+			wantBody:   "total payments: 100",
+		},
+		{
+			name:       "error",
+			method:     http.MethodGet,
+			path:       "/v0/total_payments?status=unknown",
+			handler:    h.GetTotalPayments,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "invalid status: got: unknown, want: approved, rejected or pending",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			ts := httptest.NewServer(Legacy(tc.handler))
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(tc.method, ts.URL+tc.path, bytes.NewReader([]byte(tc.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, tc.wantStatus, resp.StatusCode)
+			require.Equal(t, tc.wantBody, string(b))
+			require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		})
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	tt := []struct {
+		name            string
+		method          string
+		path            string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "not found",
+			method:          http.MethodGet,
+			path:            "/unknown",
+			wantStatus:      http.StatusNotFound,
+			wantContentType: "application/json",
+			wantBody:        `{"code":"not_found","message":"/unknown not found"}`,
+		},
+		{
+			name:            "method not allowed",
+			method:          http.MethodDelete,
+			path:            "/preferences",
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantContentType: "application/json",
+			wantBody:        `{"code":"method_not_allowed","message":"/preferences doesn't allow DELETE"}`,
+		},
+		{
+			name:            "legacy not found",
+			method:          http.MethodGet,
+			path:            "/v0/unknown",
+			wantStatus:      http.StatusNotFound,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "/v0/unknown not found",
+		},
+		{
+			name:            "legacy method not allowed",
+			method:          http.MethodDelete,
+			path:            "/v0/preferences",
+			wantStatus:      http.StatusMethodNotAllowed,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "/v0/preferences doesn't allow DELETE",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			router := mux.NewRouter()
+			router.HandleFunc("/preferences", func(w http.ResponseWriter, r *http.Request) {}).Methods(http.MethodPost)
+			router.HandleFunc("/v0/preferences", func(w http.ResponseWriter, r *http.Request) {}).Methods(http.MethodPost)
+			router.NotFoundHandler = http.HandlerFunc(NotFound)
+			router.MethodNotAllowedHandler = http.HandlerFunc(MethodNotAllowed)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(tc.method, ts.URL+tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, tc.wantStatus, resp.StatusCode)
+			require.Equal(t, tc.wantContentType, resp.Header.Get("Content-Type"))
+			require.Equal(t, tc.wantBody, strings.TrimSpace(string(b)))
+		})
+	}
+}
+
 func TestHandler_GetTotalPayments_Unauthorized_Error(t *testing.T) {
 	// Given
 	h := NewHandler(&ServiceStub{
@@ -626,7 +1010,7 @@ func TestHandler_GetTotalPayments_Unauthorized_Error(t *testing.T) {
 	}
 
 	// Then
-	require.Equal(t, "access token is required", string(b))
+	require.Equal(t, "access token is required", errorResponse(t, b).Message)
 	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 }
 
@@ -658,6 +1042,1677 @@ func TestHandler_GetTotalPayments_BadRequest_Error(t *testing.T) {
 	}
 
 	// Then
-	require.Equal(t, "invalid status: got: random, want: approved, rejected or pending", string(b))
+	require.Equal(t, "invalid status: got: random, want: approved, rejected or pending", errorResponse(t, b).Message)
 	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
 }
+
+func TestHandler_GetPayment(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{
+		payment: Payment{
+			ID:                123,
+			Status:            "approved",
+			StatusDetail:      "accredited",
+			TransactionAmount: 150.7,
+			PaymentMethodID:   "visa",
+			ExternalReference: "ORDER-1",
+			Payer:             PaymentPayer{Email: "mateo.ferrari@gmail.com"},
+		},
+	})
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", h.GetPayment)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/payments/123", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var payment Payment
+	if err := json.NewDecoder(resp.Body).Decode(&payment); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.Equal(t, int64(123), payment.ID)
+	require.Equal(t, "approved", payment.Status)
+	require.Equal(t, "accredited", payment.StatusDetail)
+	require.Equal(t, "ORDER-1", payment.ExternalReference)
+	require.Equal(t, "mateo.ferrari@gmail.com", payment.Payer.Email)
+}
+
+func TestHandler_GetPayment_ErrorResponse(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{
+		err: upstreamError(http.StatusNotFound, []byte(`{"message": "Payment not found", "error": "not_found", "status": 404, "cause": [{"code": 2000, "description": "Payment not found"}]}`)),
+	})
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", h.GetPayment)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/payments/123", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+	req.Header.Add("X-Request-Id", "req-123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.JSONEq(t, `{
+		"code": "not_found",
+		"message": "couldn't get payment: Payment not found",
+		"request_id": "req-123",
+		"cause": {
+			"status": 404,
+			"error": "not_found",
+			"message": "Payment not found",
+			"causes": [{"code": "2000", "description": "Payment not found"}]
+		}
+	}`, string(b))
+}
+
+func TestHandler_GetPayment_RetryAfter(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{
+		err: unavailable("mercado pago payments is failing, calls are suspended", 1500*time.Millisecond),
+	})
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}", h.GetPayment)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/payments/123", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "2", resp.Header.Get("Retry-After"))
+	require.Equal(t, "upstream_unavailable", errorResponse(t, b).Code)
+}
+
+func TestHandler_GetPayment_Error(t *testing.T) {
+	tt := []struct{
+		name string
+		path string
+		accessToken string
+		err error
+		wantError string
+		wantErrorStatusCode int
+	}{
+		{
+			name: "missing access token",
+			path: "/payments/123",
+			wantError: "access token is required",
+			wantErrorStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "invalid payment id",
+			path: "/payments/abc",
+			accessToken: "MY_ACCESS_TOKEN",
+			wantError: "invalid payment id: abc",
+			wantErrorStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "not found from server",
+			path: "/payments/123",
+			accessToken: "MY_ACCESS_TOKEN",
+			err: NewError("not found", http.StatusNotFound),
+			wantError: "couldn't get payment: not found",
+			wantErrorStatusCode: http.StatusNotFound,
+		},
+		{
+			name: "deadline exceeded",
+			path: "/payments/123",
+			accessToken: "MY_ACCESS_TOKEN",
+			err: fmt.Errorf("couldn't reach mercado pago: %w", context.DeadlineExceeded),
+			wantError: "gateway timeout",
+			wantErrorStatusCode: http.StatusGatewayTimeout,
+		},
+		{
+			name: "client closed request",
+			path: "/payments/123",
+			accessToken: "MY_ACCESS_TOKEN",
+			err: fmt.Errorf("calling mercado pago GET /v1/payments/123: %w", context.Canceled),
+			wantError: "couldn't get payment: calling mercado pago GET /v1/payments/123: context canceled",
+			wantErrorStatusCode: 499,
+		},
+		{
+			name: "couldn't cast error",
+			path: "/payments/123",
+			accessToken: "MY_ACCESS_TOKEN",
+			err: errors.New("random error"),
+			wantError: "internal server error",
+			wantErrorStatusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{
+				err: tc.err,
+			})
+			router := mux.NewRouter()
+			router.HandleFunc("/payments/{id}", h.GetPayment)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s", ts.URL, tc.path), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.accessToken != "" {
+				req.Header.Add("access_token", tc.accessToken)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			errorMessage, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, tc.wantError, errorResponse(t, errorMessage).Message)
+			require.Equal(t, tc.wantErrorStatusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_SearchPayments(t *testing.T) {
+	// Given
+	s := &ServiceStub{
+		searchResult: PaymentSearchResult{
+			Results: []Payment{{ID: 1, Status: "approved"}},
+			Paging:  Paging{Total: 1, Limit: 10, Offset: 0},
+		},
+	}
+	h := NewHandler(s)
+	ts := httptest.NewServer(http.HandlerFunc(h.SearchPayments))
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/payments/search?status=approved&begin_date=2020-06-01T00:00:00Z&end_date=2020-06-30T00:00:00Z&payer_email=m@gmail.com&sort=date_created&criteria=desc&limit=10&offset=20", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result PaymentSearchResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, s.searchResult, result)
+	require.Equal(t, PaymentSearch{
+		Status:     "approved",
+		BeginDate:  "2020-06-01T00:00:00Z",
+		EndDate:    "2020-06-30T00:00:00Z",
+		PayerEmail: "m@gmail.com",
+		Sort:       "date_created",
+		Criteria:   "desc",
+		Limit:      10,
+		Offset:     20,
+	}, s.search)
+}
+
+func TestHandler_SearchPayments_BadRequest_Error(t *testing.T) {
+	tt := []struct{
+		name string
+		query string
+		wantError string
+	}{
+		{
+			name: "invalid limit",
+			query: "limit=ten",
+			wantError: "invalid limit: ten",
+		},
+		{
+			name: "invalid status",
+			query: "status=paid",
+			wantError: "validation error: Key: 'PaymentSearch.Status' Error:Field validation for 'Status' failed on the 'oneof' tag",
+		},
+		{
+			name: "invalid begin date",
+			query: "begin_date=01-06-2020",
+			wantError: "validation error: Key: 'PaymentSearch.BeginDate' Error:Field validation for 'BeginDate' failed on the 'datetime' tag",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{})
+			ts := httptest.NewServer(http.HandlerFunc(h.SearchPayments))
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/payments/search?%s", ts.URL, tc.query), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			errorMessage, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, tc.wantError, errorResponse(t, errorMessage).Message)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_CreateRefund(t *testing.T) {
+	tt := []struct{
+		name string
+		body string
+		wantRefund NewRefund
+	}{
+		{
+			name: "full refund without body",
+			body: "",
+			wantRefund: NewRefund{},
+		},
+		{
+			name: "partial refund",
+			body: `{"amount": 50.5}`,
+			wantRefund: NewRefund{Amount: 50.5},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			s := &ServiceStub{
+				refund: Refund{ID: 1, PaymentID: 123, Amount: 50.5, Status: "approved"},
+			}
+			h := NewHandler(s)
+			router := mux.NewRouter()
+			router.HandleFunc("/payments/{id}/refunds", h.CreateRefund)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/payments/123/refunds", ts.URL), bytes.NewReader([]byte(tc.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var refund Refund
+			if err := json.NewDecoder(resp.Body).Decode(&refund); err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			require.Equal(t, s.refund, refund)
+			require.Equal(t, tc.wantRefund, s.newRefund)
+		})
+	}
+}
+
+func TestHandler_CreateRefund_Error(t *testing.T) {
+	tt := []struct{
+		name string
+		body string
+		err error
+		wantError string
+		wantErrorStatusCode int
+	}{
+		{
+			name: "negative amount",
+			body: `{"amount": -1}`,
+			wantError: "validation error: Key: 'NewRefund.Amount' Error:Field validation for 'Amount' failed on the 'gte' tag",
+			wantErrorStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "amount exceeds what is left to refund",
+			body: `{"amount": 500}`,
+			err: NewError("refund amount 500.00 exceeds the 100.00 left to refund", http.StatusBadRequest),
+			wantError: "couldn't create refund: refund amount 500.00 exceeds the 100.00 left to refund",
+			wantErrorStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{
+				err: tc.err,
+			})
+			router := mux.NewRouter()
+			router.HandleFunc("/payments/{id}/refunds", h.CreateRefund)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/payments/123/refunds", ts.URL), bytes.NewReader([]byte(tc.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			errorMessage, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, tc.wantError, errorResponse(t, errorMessage).Message)
+			require.Equal(t, tc.wantErrorStatusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_CreateRefund_ConfiguredToken(t *testing.T) {
+	tt := []struct {
+		name           string
+		adminToken     string
+		shareToken     bool
+		wantStatusCode int
+		wantCalls      int
+	}{
+		{
+			name:           "without the admin token",
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:           "wrong admin token",
+			adminToken:     "OTHER_TOKEN",
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:           "admin token",
+			adminToken:     "ADMIN_TOKEN",
+			wantStatusCode: http.StatusCreated,
+			wantCalls:      1,
+		},
+		{
+			name:           "shared token",
+			shareToken:     true,
+			wantStatusCode: http.StatusCreated,
+			wantCalls:      1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			g := &TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "APP_USR-1234", ExpiresIn: 21600}}}
+			h := NewHandler(&ServiceStub{refund: Refund{ID: 1, PaymentID: 123}})
+			h.Token = &ConfiguredToken{Tokens: NewTokenSource(g), Credentials: _testCredentials}
+			h.ShareToken = tc.shareToken
+			h.AdminToken = "ADMIN_TOKEN"
+			router := mux.NewRouter()
+			router.HandleFunc("/payments/{id}/refunds", h.CreateRefund)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/payments/123/refunds", ts.URL), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.adminToken != "" {
+				req.Header.Add("admin_token", tc.adminToken)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// Then
+			require.Equal(t, tc.wantStatusCode, resp.StatusCode)
+			require.Equal(t, tc.wantCalls, g.calls)
+		})
+	}
+}
+
+func TestHandler_GetRefunds(t *testing.T) {
+	// Given
+	s := &ServiceStub{
+		refunds: []Refund{{ID: 1, PaymentID: 123, Amount: 10}, {ID: 2, PaymentID: 123, Amount: 20}},
+	}
+	h := NewHandler(s)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}/refunds", h.GetRefunds)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/payments/123/refunds", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var refunds []Refund
+	if err := json.NewDecoder(resp.Body).Decode(&refunds); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, s.refunds, refunds)
+}
+
+func TestHandler_CapturePayment(t *testing.T) {
+	// Given
+	s := &ServiceStub{
+		payment: Payment{ID: 123, Status: "approved", TransactionAmount: 80},
+	}
+	h := NewHandler(s)
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}/capture", h.CapturePayment)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/payments/123/capture", ts.URL), bytes.NewReader([]byte(`{"amount": 80}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var payment Payment
+	if err := json.NewDecoder(resp.Body).Decode(&payment); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, s.payment, payment)
+	require.Equal(t, 80.0, s.captureAmount)
+}
+
+func TestHandler_CancelPayment_Error(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{
+		err: NewError("can't cancel payment 123 with status approved", http.StatusConflict),
+	})
+	router := mux.NewRouter()
+	router.HandleFunc("/payments/{id}/cancel", h.CancelPayment)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/payments/123/cancel", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	errorMessage, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, "couldn't cancel payment: can't cancel payment 123 with status approved", errorResponse(t, errorMessage).Message)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestHandler_CreatePayment(t *testing.T) {
+	// Given
+	s := &ServiceStub{
+		payment: Payment{ID: 123, Status: "approved", StatusDetail: "accredited", TransactionAmount: 150.7},
+	}
+	h := NewHandler(s)
+	body := []byte(`{
+		"transaction_amount": 150.7,
+		"token": "ff8080814c11e237014c1ff593b57b4d",
+		"description": "Libro Sherlock Holmes 1era edicion",
+		"installments": 3,
+		"payment_method_id": "visa",
+		"issuer_id": "310",
+		"payer": {
+			"email": "mateo.ferrari@gmail.com",
+			"identification": {
+				"type": "DNI",
+				"number": "12345678"
+			}
+		}
+	}`)
+	ts := httptest.NewServer(http.HandlerFunc(h.CreatePayment))
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/payments", ts.URL), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.JSONEq(t, `{"id": 123, "status": "approved", "status_detail": "accredited"}`, string(b))
+	require.Equal(t, 3, s.newPayment.Installments)
+	require.Equal(t, "310", s.newPayment.IssuerID)
+	require.Equal(t, "12345678", s.newPayment.Payer.Identification.Number)
+}
+
+func TestHandler_CreatePayment_BadRequest_Error(t *testing.T) {
+	tt := []struct{
+		name string
+		body []byte
+		wantError string
+	}{
+		{
+			name: "missing token",
+			body: []byte(`{
+				"transaction_amount": 150.7,
+				"installments": 1,
+				"payment_method_id": "visa",
+				"payer": {"email": "mateo.ferrari@gmail.com", "identification": {"type": "DNI", "number": "12345678"}}
+			}`),
+			wantError: "validation error: Key: 'NewPayment.Token' Error:Field validation for 'Token' failed on the 'required' tag",
+		},
+		{
+			name: "invalid payer email",
+			body: []byte(`{
+				"transaction_amount": 150.7,
+				"token": "ff8080814c11e237014c1ff593b57b4d",
+				"installments": 1,
+				"payment_method_id": "visa",
+				"payer": {"email": "mateo", "identification": {"type": "DNI", "number": "12345678"}}
+			}`),
+			wantError: "validation error: Key: 'NewPayment.Payer.Email' Error:Field validation for 'Email' failed on the 'email' tag",
+		},
+		{
+			name: "missing payer identification",
+			body: []byte(`{
+				"transaction_amount": 150.7,
+				"token": "ff8080814c11e237014c1ff593b57b4d",
+				"installments": 1,
+				"payment_method_id": "visa",
+				"payer": {"email": "mateo.ferrari@gmail.com"}
+			}`),
+			wantError: "validation error: Key: 'NewPayment.Payer.Identification.Type' Error:Field validation for 'Type' failed on the 'required' tag\nKey: 'NewPayment.Payer.Identification.Number' Error:Field validation for 'Number' failed on the 'required' tag",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{})
+			ts := httptest.NewServer(http.HandlerFunc(h.CreatePayment))
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/payments", ts.URL), bytes.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, tc.wantError, errorResponse(t, b).Message)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_CreateCustomer(t *testing.T) {
+	// Given
+	s := &ServiceStub{
+		customer: Customer{ID: "123-abc", Email: "mateo.ferrari@gmail.com"},
+	}
+	h := NewHandler(s)
+	body := []byte(`{
+		"email": "mateo.ferrari@gmail.com",
+		"first_name": "Mateo",
+		"phone": {
+			"area_code": "11",
+			"number": "11111111"
+		},
+		"address": {
+			"zip_code": "1414",
+			"street_name": "posta",
+			"street_number": 4789
+		}
+	}`)
+	ts := httptest.NewServer(http.HandlerFunc(h.CreateCustomer))
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/customers", ts.URL), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var customer Customer
+	if err := json.NewDecoder(resp.Body).Decode(&customer); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "123-abc", customer.ID)
+	require.Equal(t, &Phone{AreaCode: "11", Number: "11111111"}, s.newCustomer.Phone)
+	require.Equal(t, &CustomerAddress{ZipCode: "1414", StreetName: "posta", StreetNumber: 4789}, s.newCustomer.Address)
+	require.Nil(t, s.newCustomer.Identification)
+}
+
+func TestHandler_CreateCustomer_BadRequest_Error(t *testing.T) {
+	tt := []struct{
+		name string
+		body []byte
+		wantError string
+	}{
+		{
+			name: "missing email",
+			body: []byte(`{"first_name": "Mateo"}`),
+			wantError: "validation error: Key: 'NewCustomer.Email' Error:Field validation for 'Email' failed on the 'required' tag",
+		},
+		{
+			name: "phone without number",
+			body: []byte(`{"email": "mateo.ferrari@gmail.com", "phone": {"area_code": "11"}}`),
+			wantError: "validation error: Key: 'NewCustomer.Phone.Number' Error:Field validation for 'Number' failed on the 'required' tag",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{})
+			ts := httptest.NewServer(http.HandlerFunc(h.CreateCustomer))
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/customers", ts.URL), bytes.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, tc.wantError, errorResponse(t, b).Message)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_SearchCustomers_BadRequest_Error(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{})
+	ts := httptest.NewServer(http.HandlerFunc(h.SearchCustomers))
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/customers/search", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, "email is required", errorResponse(t, b).Message)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHandler_DeleteCard(t *testing.T) {
+	// Given
+	s := &ServiceStub{}
+	h := NewHandler(s)
+	router := mux.NewRouter()
+	router.HandleFunc("/customers/{id}/cards/{card_id}", h.DeleteCard)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/customers/123-abc/cards/999", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Then
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, []string{"123-abc", "999"}, s.deleted)
+}
+
+func TestHandler_GetInstallments(t *testing.T) {
+	// Given
+	s := &ServiceStub{
+		installments: []Installments{
+			{
+				PaymentMethodID: "visa",
+				PayerCosts:      []PayerCost{{Installments: 1, TotalAmount: 150.7}, {Installments: 3, TotalAmount: 165.77}},
+			},
+		},
+	}
+	h := NewHandler(s)
+	ts := httptest.NewServer(http.HandlerFunc(h.GetInstallments))
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/payment_methods/installments?amount=150.7&bin=450995", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var installments []Installments
+	if err := json.NewDecoder(resp.Body).Decode(&installments); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, s.installments, installments)
+	require.Equal(t, InstallmentsSearch{Amount: 150.7, Bin: "450995"}, s.installmentsSearch)
+}
+
+func TestHandler_GetInstallments_BadRequest_Error(t *testing.T) {
+	tt := []struct{
+		name string
+		query string
+		wantError string
+	}{
+		{
+			name: "missing amount",
+			query: "bin=450995",
+			wantError: "invalid amount: ",
+		},
+		{
+			name: "negative amount",
+			query: "amount=-10",
+			wantError: "validation error: Key: 'InstallmentsSearch.Amount' Error:Field validation for 'Amount' failed on the 'gt' tag",
+		},
+		{
+			name: "invalid bin",
+			query: "amount=10&bin=45a",
+			wantError: "validation error: Key: 'InstallmentsSearch.Bin' Error:Field validation for 'Bin' failed on the 'numeric' tag",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{})
+			ts := httptest.NewServer(http.HandlerFunc(h.GetInstallments))
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/payment_methods/installments?%s", ts.URL, tc.query), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, tc.wantError, errorResponse(t, b).Message)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_GetMerchantOrder(t *testing.T) {
+	tt := []struct{
+		name string
+		merchantOrder MerchantOrder
+		wantFullyPaid bool
+	}{
+		{
+			name: "fully paid order",
+			merchantOrder: MerchantOrder{ID: 456, TotalAmount: 150.7, PaidAmount: 150.7},
+			wantFullyPaid: true,
+		},
+		{
+			name: "partially paid order",
+			merchantOrder: MerchantOrder{ID: 456, TotalAmount: 150.7, PaidAmount: 50},
+			wantFullyPaid: false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{
+				merchantOrder: tc.merchantOrder,
+			})
+			router := mux.NewRouter()
+			router.HandleFunc("/merchant_orders/{id}", h.GetMerchantOrder)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/merchant_orders/456", ts.URL), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var merchantOrder struct {
+				ID        int64 `json:"id"`
+				FullyPaid bool  `json:"fully_paid"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&merchantOrder); err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, int64(456), merchantOrder.ID)
+			require.Equal(t, tc.wantFullyPaid, merchantOrder.FullyPaid)
+		})
+	}
+}
+
+func TestHandler_SearchMerchantOrders_Paging(t *testing.T) {
+	tt := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantSearch MerchantOrderSearch
+	}{
+		{
+			name:       "limit and offset",
+			query:      "preference_id=123-abc&limit=10&offset=20",
+			wantStatus: http.StatusOK,
+			wantSearch: MerchantOrderSearch{PreferenceID: "123-abc", Limit: 10, Offset: 20},
+		},
+		{
+			name:       "invalid limit",
+			query:      "preference_id=123-abc&limit=ten",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "negative offset",
+			query:      "preference_id=123-abc&offset=-1",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "limit above the maximum",
+			query:      "preference_id=123-abc&limit=1001",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			s := &ServiceStub{}
+			h := NewHandler(s)
+			ts := httptest.NewServer(http.HandlerFunc(h.SearchMerchantOrders))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/merchant_orders/search?%s", ts.URL, tc.query), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			// When
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// Then
+			require.Equal(t, tc.wantStatus, resp.StatusCode)
+			require.Equal(t, tc.wantSearch, s.merchantOrderSearch)
+		})
+	}
+}
+
+func TestHandler_SearchMerchantOrders_BadRequest_Error(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{})
+	ts := httptest.NewServer(http.HandlerFunc(h.SearchMerchantOrders))
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/merchant_orders/search", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, "validation error: Key: 'MerchantOrderSearch.PreferenceID' Error:Field validation for 'PreferenceID' failed on the 'required_without' tag\nKey: 'MerchantOrderSearch.ExternalReference' Error:Field validation for 'ExternalReference' failed on the 'required_without' tag", errorResponse(t, b).Message)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHandler_SearchPreapprovals_Paging(t *testing.T) {
+	tt := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantSearch PreapprovalSearch
+	}{
+		{
+			name:       "limit and offset",
+			query:      "status=authorized&limit=10&offset=20",
+			wantStatus: http.StatusOK,
+			wantSearch: PreapprovalSearch{Status: "authorized", Limit: 10, Offset: 20},
+		},
+		{
+			name:       "invalid offset",
+			query:      "status=authorized&offset=twenty",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "negative limit",
+			query:      "status=authorized&limit=-1",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "limit above the maximum",
+			query:      "status=authorized&limit=1001",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			s := &ServiceStub{}
+			h := NewHandler(s)
+			ts := httptest.NewServer(http.HandlerFunc(h.SearchPreapprovals))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/preapproval/search?%s", ts.URL, tc.query), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			// When
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// Then
+			require.Equal(t, tc.wantStatus, resp.StatusCode)
+			require.Equal(t, tc.wantSearch, s.preapprovalSearch)
+		})
+	}
+}
+
+func TestHandler_CreatePreapprovalPlan(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{
+		preapprovalPlan: PreapprovalPlan{ID: "plan-1", Status: "active"},
+	})
+	body := []byte(`{
+		"reason": "Monthly plan",
+		"auto_recurring": {
+			"frequency": 1,
+			"frequency_type": "months",
+			"transaction_amount": 500,
+			"currency_id": "ARS",
+			"free_trial": {
+				"frequency": 7,
+				"frequency_type": "days"
+			}
+		},
+		"back_url": "https://mercadopago.com/subscriptions"
+	}`)
+	ts := httptest.NewServer(http.HandlerFunc(h.CreatePreapprovalPlan))
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/preapproval_plans", ts.URL), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var plan PreapprovalPlan
+	if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "plan-1", plan.ID)
+}
+
+func TestHandler_CreatePreapproval_BadRequest_Error(t *testing.T) {
+	tt := []struct{
+		name string
+		body []byte
+		wantError string
+	}{
+		{
+			name: "missing payer email",
+			body: []byte(`{"preapproval_plan_id": "plan-1"}`),
+			wantError: "validation error: Key: 'NewPreapproval.PayerEmail' Error:Field validation for 'PayerEmail' failed on the 'required' tag",
+		},
+		{
+			name: "no plan and no recurrence",
+			body: []byte(`{"reason": "Monthly plan", "payer_email": "mateo.ferrari@gmail.com"}`),
+			wantError: "validation error: Key: 'NewPreapproval.AutoRecurring' Error:Field validation for 'AutoRecurring' failed on the 'required_without' tag",
+		},
+		{
+			name: "invalid frequency type",
+			body: []byte(`{"reason": "Monthly plan", "payer_email": "mateo.ferrari@gmail.com", "auto_recurring": {"frequency": 1, "frequency_type": "weeks", "transaction_amount": 500, "currency_id": "ARS"}}`),
+			wantError: "validation error: Key: 'NewPreapproval.AutoRecurring.FrequencyType' Error:Field validation for 'FrequencyType' failed on the 'oneof' tag",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{})
+			ts := httptest.NewServer(http.HandlerFunc(h.CreatePreapproval))
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/preapprovals", ts.URL), bytes.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, tc.wantError, errorResponse(t, b).Message)
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_PausePreapproval_Error(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{
+		err: NewError("can't pause subscription sub-1 with status cancelled", http.StatusConflict),
+	})
+	router := mux.NewRouter()
+	router.HandleFunc("/preapprovals/{id}/pause", h.PausePreapproval)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/preapprovals/sub-1/pause", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, "couldn't pause subscription: can't pause subscription sub-1 with status cancelled", errorResponse(t, b).Message)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestHandler_GetMarketplaceFees(t *testing.T) {
+	// Given
+	s := &ServiceStub{marketplaceFeeReport: MarketplaceFeeReport{TotalFee: 15.3}}
+	ts := httptest.NewServer(http.HandlerFunc(NewHandler(s).GetMarketplaceFees))
+	defer ts.Close()
+
+	// When
+	resp, err := http.Get(fmt.Sprintf("%s/admin/marketplace/fees?begin_date=2020-06-01T00:00:00Z&end_date=2020-06-30T23:59:59Z", ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var report MarketplaceFeeReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 15.3, report.TotalFee)
+	require.Equal(t, MarketplaceFeeSearch{BeginDate: "2020-06-01T00:00:00Z", EndDate: "2020-06-30T23:59:59Z"}, s.marketplaceFeeSearch)
+}
+
+func TestHandler_GetMarketplaceFees_ValidationError(t *testing.T) {
+	// Given
+	ts := httptest.NewServer(http.HandlerFunc(NewHandler(&ServiceStub{}).GetMarketplaceFees))
+	defer ts.Close()
+
+	// When
+	resp, err := http.Get(fmt.Sprintf("%s/admin/marketplace/fees?begin_date=yesterday", ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Then
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestNewPreference_Validation(t *testing.T) {
+	tt := []struct {
+		name    string
+		modify  func(p *NewPreference)
+		wantErr bool
+	}{
+		{name: "complete", modify: func(p *NewPreference) {
+			p.ExternalReference = "ORDER-1"
+			p.NotificationURL = "https://shop.com/notifications"
+			p.StatementDescriptor = "MYSHOP"
+			p.Expires = true
+			p.ExpirationDateFrom = "2020-06-01T00:00:00.000-03:00"
+			p.ExpirationDateTo = "2020-06-30T23:59:59.000-03:00"
+			p.PaymentMethods = &PreferencePaymentMethods{
+				ExcludedPaymentMethods: []PaymentMethodRef{{ID: "amex"}},
+				ExcludedPaymentTypes:   []PaymentMethodRef{{ID: "ticket"}},
+				Installments:           12,
+				DefaultInstallments:    3,
+			}
+			p.BinaryMode = true
+			p.Shipments = &PreferenceShipments{
+				Mode: "custom",
+				Cost: 100,
+				ReceiverAddress: &ReceiverAddress{
+					ZipCode:      "1414",
+					StreetName:   "Corrientes",
+					StreetNumber: 1234,
+				},
+			}
+		}},
+		{name: "invalid notification url", wantErr: true, modify: func(p *NewPreference) { p.NotificationURL = "not a url" }},
+		{name: "statement descriptor too long", wantErr: true, modify: func(p *NewPreference) { p.StatementDescriptor = "A VERY LONG STATEMENT DESCRIPTOR" }},
+		{name: "expires without date", wantErr: true, modify: func(p *NewPreference) { p.Expires = true }},
+		{name: "invalid expiration date", wantErr: true, modify: func(p *NewPreference) { p.ExpirationDateFrom = "01/06/2020" }},
+		{name: "too many installments", wantErr: true, modify: func(p *NewPreference) { p.PaymentMethods = &PreferencePaymentMethods{Installments: 48} }},
+		{name: "excluded method without id", wantErr: true, modify: func(p *NewPreference) {
+			p.PaymentMethods = &PreferencePaymentMethods{ExcludedPaymentMethods: []PaymentMethodRef{{}}}
+		}},
+		{name: "invalid shipment mode", wantErr: true, modify: func(p *NewPreference) { p.Shipments = &PreferenceShipments{Mode: "drone"} }},
+		{name: "negative shipment cost", wantErr: true, modify: func(p *NewPreference) { p.Shipments = &PreferenceShipments{Cost: -1} }},
+		{name: "incomplete receiver address", wantErr: true, modify: func(p *NewPreference) {
+			p.Shipments = &PreferenceShipments{ReceiverAddress: &ReceiverAddress{ZipCode: "1414"}}
+		}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			p := newPreference()
+			p.Payer.CreatedAt = "2020-06-14T00:00:00.000-03:00"
+			tc.modify(&p)
+
+			// When
+			err := _v.Struct(p)
+
+			// Then
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestItem_Validation(t *testing.T) {
+	// Given
+	item := Item{Title: "Mug", Quantity: 1, UnitPrice: 100, CurrencyID: "ARS", CategoryID: "home"}
+	invalid := item
+	invalid.CurrencyID = "ars"
+
+	// When
+	err := _v.Struct(item)
+	invalidErr := _v.Struct(invalid)
+
+	// Then
+	require.NoError(t, err)
+	require.Error(t, invalidErr)
+}
+
+func TestHandler_CreatePreference_Location(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{
+		accessToken: "APP_USR-1234",
+		preference:  Preference{ID: "123-abc", InitPoint: "https://mercadopago.com/MY_CHECKOUT_PATH"},
+	})
+	p := newPreference()
+	p.Payer.CreatedAt = "14-06-2020"
+	body, err := json.Marshal(p)
+	require.NoError(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/tenants/{tenant_id}/preferences", h.CreatePreference)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/tenants/shop1/preferences", ts.URL), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("api_key", "MY_API_KEY")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Then
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "/tenants/shop1/preferences/123-abc", resp.Header.Get("Location"))
+}
+
+func TestHandler_GetPreference(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{preference: Preference{ID: "123-abc", InitPoint: "https://mercadopago.com/checkout"}})
+	router := mux.NewRouter()
+	router.HandleFunc("/preferences/{id}", h.GetPreference)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/preferences/123-abc", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	// When
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var preference Preference
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&preference))
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "123-abc", preference.ID)
+	require.Equal(t, "https://mercadopago.com/checkout", preference.InitPoint)
+}
+
+func TestHandler_UpdatePreference(t *testing.T) {
+	tt := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "items", body: `{"items": [{"title": "Mug", "quantity": 2, "unit_price": 100}]}`, wantStatus: http.StatusOK},
+		{name: "back urls", body: `{"back_urls": {"success": "https://shop.com/success"}}`, wantStatus: http.StatusOK},
+		{name: "invalid item", body: `{"items": [{"title": "Mug"}]}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid expiration", body: `{"expiration_date_to": "30/06/2020"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid body", body: `{"items": "Mug"}`, wantStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			s := &ServiceStub{preference: Preference{ID: "123-abc"}}
+			h := NewHandler(s)
+			router := mux.NewRouter()
+			router.HandleFunc("/preferences/{id}", h.UpdatePreference)
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/preferences/123-abc", ts.URL), bytes.NewReader([]byte(tc.body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+			// When
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// Then
+			require.Equal(t, tc.wantStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_SearchPreferences(t *testing.T) {
+	// Given
+	s := &ServiceStub{preferenceSearchResult: PreferenceSearchResult{Elements: []Preference{{ID: "123-abc"}}, Total: 1}}
+	h := NewHandler(s)
+	ts := httptest.NewServer(http.HandlerFunc(h.SearchPreferences))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s?external_reference=ORDER-1&limit=5", ts.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	// When
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result PreferenceSearchResult
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, PreferenceSearch{ExternalReference: "ORDER-1", Limit: 5}, s.preferenceSearch)
+	require.Equal(t, 1, result.Total)
+}
+
+func TestHandler_SearchPreferences_ValidationError(t *testing.T) {
+	// Given
+	h := NewHandler(&ServiceStub{})
+	ts := httptest.NewServer(http.HandlerFunc(h.SearchPreferences))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("access_token", "MY_ACCESS_TOKEN")
+
+	// When
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Then
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWithRequestID(t *testing.T) {
+	tt := []struct {
+		name   string
+		sent   string
+		wantID func(t *testing.T, id string)
+	}{
+		{
+			name: "kept",
+			sent: "req-123",
+			wantID: func(t *testing.T, id string) {
+				require.Equal(t, "req-123", id)
+			},
+		},
+		{
+			name: "generated",
+			wantID: func(t *testing.T, id string) {
+				require.Len(t, id, 32)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{})
+			ts := httptest.NewServer(WithRequestID(http.HandlerFunc(h.GetAccessToken)))
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.sent != "" {
+				req.Header.Add("X-Request-Id", tc.sent)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			id := resp.Header.Get("X-Request-Id")
+			tc.wantID(t, id)
+			require.Equal(t, id, errorResponse(t, b).RequestID)
+		})
+	}
+}
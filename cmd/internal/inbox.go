@@ -0,0 +1,463 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	InboxStatusPending   = "pending"
+	InboxStatusProcessed = "processed"
+	InboxStatusFailed    = "failed"
+	InboxStatusDead      = "dead"
+
+	_inboxMaxAttempts = 8
+	_inboxBaseBackoff = 30 * time.Second
+	_inboxMaxBackoff  = time.Hour
+	// _inboxProcessedRetention is how long a processed event is kept. It
+	// still dedupes the notification until then, so it has to outlast the
+	// time Mercado Pago keeps resending it.
+	_inboxProcessedRetention = 30 * 24 * time.Hour
+)
+
+type InboxEvent struct {
+	ID            string       `json:"id"`
+	Notification  Notification `json:"notification"`
+	DataID        string       `json:"data_id"`
+	Status        string       `json:"status"`
+	Attempts      int          `json:"attempts"`
+	LastError     string       `json:"last_error,omitempty"`
+	ReceivedAt    time.Time    `json:"received_at"`
+	ProcessedAt   time.Time    `json:"processed_at"`
+	NextAttemptAt time.Time    `json:"next_attempt_at"`
+}
+
+type InboxFilter struct {
+	Status string
+	From   time.Time
+	To     time.Time
+}
+
+func (f InboxFilter) matches(e InboxEvent) bool {
+	if f.Status != "" && e.Status != f.Status {
+		return false
+	}
+
+	if !f.From.IsZero() && e.ReceivedAt.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && e.ReceivedAt.After(f.To) {
+		return false
+	}
+
+	return true
+}
+
+// Inbox keeps every notification we accepted on disk, so a failure in the
+// downstream handler never loses an event. Failed events are retried with
+// exponential backoff until they succeed or run out of attempts.
+type Inbox struct {
+	store       *fileStore
+	process     func(ctx context.Context, n Notification, dataID string) error
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	retention   time.Duration
+	now         func() time.Time
+	done        chan struct{}
+	stopOnce    sync.Once
+	wg          sync.WaitGroup
+
+	mu         sync.Mutex
+	processing map[string]bool
+}
+
+func OpenInbox(path string, process func(ctx context.Context, n Notification, dataID string) error) (*Inbox, error) {
+	store, err := openFileStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Inbox{
+		store:       store,
+		process:     process,
+		maxAttempts: _inboxMaxAttempts,
+		baseBackoff: _inboxBaseBackoff,
+		maxBackoff:  _inboxMaxBackoff,
+		retention:   _inboxProcessedRetention,
+		now:         time.Now,
+		done:        make(chan struct{}),
+		processing:  make(map[string]bool),
+	}, nil
+}
+
+// Receive stores a notification unless one with the same id was already
+// received, in which case it returns the stored event and true.
+func (i *Inbox) Receive(n Notification, dataID string) (InboxEvent, bool, error) {
+	id := strconv.FormatInt(n.ID, 10)
+	if n.ID == 0 {
+		id = fmt.Sprintf("%s:%s:%s", n.Type, dataID, n.Action)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var stored InboxEvent
+	ok, err := i.store.Get(id, &stored)
+	if err != nil {
+		return InboxEvent{}, false, err
+	}
+
+	if ok {
+		return stored, true, nil
+	}
+
+	event := InboxEvent{
+		ID:           id,
+		Notification: n,
+		DataID:       dataID,
+		Status:       InboxStatusPending,
+		ReceivedAt:   i.now(),
+	}
+
+	if err := i.store.Put(id, event); err != nil {
+		return InboxEvent{}, false, err
+	}
+
+	return event, false, nil
+}
+
+// Process runs the handler for a stored event and records the outcome. The
+// returned error is about the inbox itself, a handler failure is recorded on
+// the event instead.
+func (i *Inbox) Process(ctx context.Context, id string) (InboxEvent, error) {
+	event, err := i.begin(id)
+	if err != nil {
+		return InboxEvent{}, err
+	}
+	defer i.end(id)
+
+	processErr := i.process(ctx, event.Notification, event.DataID)
+
+	now := i.now()
+	event.Attempts++
+	if processErr == nil {
+		event.Status = InboxStatusProcessed
+		event.LastError = ""
+		event.ProcessedAt = now
+		event.NextAttemptAt = time.Time{}
+	} else if event.Attempts >= i.maxAttempts {
+		event.Status = InboxStatusDead
+		event.LastError = processErr.Error()
+		event.NextAttemptAt = time.Time{}
+	} else {
+		event.Status = InboxStatusFailed
+		event.LastError = processErr.Error()
+		event.NextAttemptAt = now.Add(backoff(i.baseBackoff, i.maxBackoff, event.Attempts))
+	}
+
+	if err := i.store.Put(id, event); err != nil {
+		return InboxEvent{}, err
+	}
+
+	return event, nil
+}
+
+// Replay processes an event again whatever its status, giving dead events a
+// fresh set of attempts.
+func (i *Inbox) Replay(ctx context.Context, id string) (InboxEvent, error) {
+	i.mu.Lock()
+	var event InboxEvent
+	ok, err := i.store.Get(id, &event)
+	if err == nil && ok && event.Status == InboxStatusDead {
+		event.Attempts = 0
+		err = i.store.Put(id, event)
+	}
+	i.mu.Unlock()
+
+	if err != nil {
+		return InboxEvent{}, err
+	}
+
+	if !ok {
+		return InboxEvent{}, NewError(fmt.Sprintf("notification %s not found", id), http.StatusNotFound)
+	}
+
+	return i.Process(ctx, id)
+}
+
+// ReplayRange replays the events received between from and to. Events
+// already being processed are skipped, their run is as good as a replay.
+func (i *Inbox) ReplayRange(ctx context.Context, from time.Time, to time.Time) ([]InboxEvent, error) {
+	events, err := i.List(InboxFilter{From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+
+	replayed := make([]InboxEvent, 0, len(events))
+	for _, e := range events {
+		event, err := i.Replay(ctx, e.ID)
+		if isBusy(err) {
+			continue
+		}
+
+		if err != nil {
+			return replayed, err
+		}
+
+		replayed = append(replayed, event)
+	}
+
+	return replayed, nil
+}
+
+// RetryDue processes every pending or failed event whose backoff elapsed.
+func (i *Inbox) RetryDue(ctx context.Context) error {
+	events, err := i.List(InboxFilter{})
+	if err != nil {
+		return err
+	}
+
+	now := i.now()
+	for _, e := range events {
+		if e.Status != InboxStatusPending && e.Status != InboxStatusFailed {
+			continue
+		}
+
+		if e.NextAttemptAt.After(now) {
+			continue
+		}
+
+		if _, err := i.Process(ctx, e.ID); err != nil && !isBusy(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Prune deletes the events processed longer than retention ago.
+func (i *Inbox) Prune() error {
+	events, err := i.List(InboxFilter{Status: InboxStatusProcessed})
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	cutoff := i.now().Add(-i.retention)
+	for _, e := range events {
+		if i.processing[e.ID] {
+			continue
+		}
+
+		// The event may have been replayed since it was listed.
+		var stored InboxEvent
+		ok, err := i.store.Get(e.ID, &stored)
+		if err != nil {
+			return err
+		}
+
+		if !ok || stored.Status != InboxStatusProcessed || !stored.ProcessedAt.Before(cutoff) {
+			continue
+		}
+
+		if err := i.store.Delete(e.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Start retries due events and prunes old ones every interval until Stop is
+// called.
+func (i *Inbox) Start(interval time.Duration) {
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-i.done:
+				return
+			case <-ticker.C:
+				if err := i.RetryDue(context.Background()); err != nil {
+					log.Printf("couldn't retry notifications: %v", err)
+				}
+
+				if err := i.Prune(); err != nil {
+					log.Printf("couldn't prune notifications: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the retries started by Start, waiting for the one running, so the
+// store can be closed after it.
+func (i *Inbox) Stop() {
+	i.stopOnce.Do(func() {
+		close(i.done)
+	})
+	i.wg.Wait()
+}
+
+// List returns the events matching filter, oldest first.
+func (i *Inbox) List(filter InboxFilter) ([]InboxEvent, error) {
+	var events []InboxEvent
+	err := i.store.Each(func(_ string, value json.RawMessage) error {
+		var e InboxEvent
+		if err := json.Unmarshal(value, &e); err != nil {
+			return err
+		}
+
+		if filter.matches(e) {
+			events = append(events, e)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(a, b int) bool {
+		return events[a].ReceivedAt.Before(events[b].ReceivedAt)
+	})
+
+	return events, nil
+}
+
+func (i *Inbox) Close() error {
+	return i.store.Close()
+}
+
+func (i *Inbox) begin(id string) (InboxEvent, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.processing[id] {
+		return InboxEvent{}, NewError(fmt.Sprintf("notification %s is already being processed", id), http.StatusConflict)
+	}
+
+	var event InboxEvent
+	ok, err := i.store.Get(id, &event)
+	if err != nil {
+		return InboxEvent{}, err
+	}
+
+	if !ok {
+		return InboxEvent{}, NewError(fmt.Sprintf("notification %s not found", id), http.StatusNotFound)
+	}
+
+	i.processing[id] = true
+	return event, nil
+}
+
+func (i *Inbox) end(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.processing, id)
+}
+
+func isBusy(err error) bool {
+	return getStatusCodeFromError(err) == http.StatusConflict
+}
+
+type InboxHandler struct {
+	Inbox *Inbox
+}
+
+func NewInboxHandler(inbox *Inbox) *InboxHandler {
+	return &InboxHandler{
+		Inbox: inbox,
+	}
+}
+
+func (h *InboxHandler) ListEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := getInboxFilterFromRequest(r)
+	if err != nil {
+		writeError(w, r, NewError(err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	events, err := h.Inbox.List(filter)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't list notifications: %w", err))
+		return
+	}
+
+	if events == nil {
+		events = []InboxEvent{}
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (h *InboxHandler) ReplayEvent(w http.ResponseWriter, r *http.Request) {
+	event, err := h.Inbox.Replay(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't replay notification: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, event)
+}
+
+func (h *InboxHandler) ReplayEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := getInboxFilterFromRequest(r)
+	if err != nil {
+		writeError(w, r, NewError(err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	if filter.From.IsZero() || filter.To.IsZero() {
+		writeError(w, r, NewError("from and to are required", http.StatusBadRequest))
+		return
+	}
+
+	events, err := h.Inbox.ReplayRange(r.Context(), filter.From, filter.To)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't replay notifications: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+func getInboxFilterFromRequest(r *http.Request) (InboxFilter, error) {
+	query := r.URL.Query()
+	filter := InboxFilter{
+		Status: query.Get("status"),
+	}
+
+	for key, field := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return InboxFilter{}, fmt.Errorf("invalid %s: %s", key, value)
+		}
+
+		*field = t
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type processStub struct {
+	calls int
+	err   error
+}
+
+func (p *processStub) process(_ context.Context, _ Notification, _ string) error {
+	p.calls++
+	return p.err
+}
+
+func newTestInbox(t *testing.T, p *processStub, now *time.Time) *Inbox {
+	inbox, err := OpenInbox(filepath.Join(t.TempDir(), "inbox.jsonl"), p.process)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inbox.now = func() time.Time { return *now }
+	t.Cleanup(func() { inbox.Close() })
+	return inbox
+}
+
+func newTestNotification(id int64) Notification {
+	n := Notification{ID: id, Type: "payment", Action: "payment.updated"}
+	n.Data.ID = "123"
+	return n
+}
+
+func TestInbox_Receive_Dedupe(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	inbox := newTestInbox(t, &processStub{}, &now)
+
+	// When
+	first, firstDuplicate, err := inbox.Receive(newTestNotification(1), "123")
+	require.NoError(t, err)
+	second, secondDuplicate, err := inbox.Receive(newTestNotification(1), "123")
+	require.NoError(t, err)
+
+	// Then
+	require.False(t, firstDuplicate)
+	require.True(t, secondDuplicate)
+	require.Equal(t, first.ID, second.ID)
+	require.Equal(t, InboxStatusPending, second.Status)
+}
+
+func TestInbox_Process_Backoff(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	p := &processStub{err: errors.New("downstream error")}
+	inbox := newTestInbox(t, p, &now)
+	inbox.maxAttempts = 3
+
+	event, _, err := inbox.Receive(newTestNotification(1), "123")
+	require.NoError(t, err)
+
+	// When
+	var events []InboxEvent
+	for i := 0; i < 3; i++ {
+		e, err := inbox.Process(context.Background(), event.ID)
+		require.NoError(t, err)
+		events = append(events, e)
+	}
+
+	// Then
+	require.Equal(t, InboxStatusFailed, events[0].Status)
+	require.Equal(t, now.Add(30*time.Second), events[0].NextAttemptAt)
+	require.Equal(t, now.Add(time.Minute), events[1].NextAttemptAt)
+	require.Equal(t, InboxStatusDead, events[2].Status)
+	require.Equal(t, 3, events[2].Attempts)
+	require.Equal(t, "downstream error", events[2].LastError)
+}
+
+func TestInbox_RetryDue(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	p := &processStub{err: errors.New("downstream error")}
+	inbox := newTestInbox(t, p, &now)
+
+	event, _, err := inbox.Receive(newTestNotification(1), "123")
+	require.NoError(t, err)
+	_, err = inbox.Process(context.Background(), event.ID)
+	require.NoError(t, err)
+
+	// When
+	p.err = nil
+	require.NoError(t, inbox.RetryDue(context.Background()))
+	callsBeforeBackoff := p.calls
+
+	now = now.Add(time.Minute)
+	require.NoError(t, inbox.RetryDue(context.Background()))
+
+	events, err := inbox.List(InboxFilter{Status: InboxStatusProcessed})
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, 1, callsBeforeBackoff)
+	require.Equal(t, 2, p.calls)
+	require.Len(t, events, 1)
+}
+
+func TestInbox_Replay(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	p := &processStub{err: errors.New("downstream error")}
+	inbox := newTestInbox(t, p, &now)
+	inbox.maxAttempts = 1
+
+	event, _, err := inbox.Receive(newTestNotification(1), "123")
+	require.NoError(t, err)
+	dead, err := inbox.Process(context.Background(), event.ID)
+	require.NoError(t, err)
+
+	// When
+	p.err = nil
+	replayed, err := inbox.Replay(context.Background(), event.ID)
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, InboxStatusDead, dead.Status)
+	require.Equal(t, InboxStatusProcessed, replayed.Status)
+	require.Equal(t, 1, replayed.Attempts)
+}
+
+func TestInbox_Replay_NotFound(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	inbox := newTestInbox(t, &processStub{}, &now)
+
+	// When
+	_, err := inbox.Replay(context.Background(), "999")
+
+	// Then
+	require.Equal(t, http.StatusNotFound, getStatusCodeFromError(err))
+}
+
+func TestInbox_ReplayRange(t *testing.T) {
+	// Given
+	start := time.Unix(1592092800, 0)
+	now := start
+	p := &processStub{}
+	inbox := newTestInbox(t, p, &now)
+
+	for i := int64(1); i <= 3; i++ {
+		_, _, err := inbox.Receive(newTestNotification(i), "123")
+		require.NoError(t, err)
+		now = now.Add(time.Hour)
+	}
+
+	// When
+	replayed, err := inbox.ReplayRange(context.Background(), start.Add(30*time.Minute), start.Add(3*time.Hour))
+	require.NoError(t, err)
+
+	// Then
+	require.Len(t, replayed, 2)
+	require.Equal(t, "2", replayed[0].ID)
+	require.Equal(t, "3", replayed[1].ID)
+	require.Equal(t, 2, p.calls)
+}
+
+func TestInbox_ReplayRange_Busy(t *testing.T) {
+	// Given
+	start := time.Unix(1592092800, 0)
+	now := start
+	p := &processStub{}
+	inbox := newTestInbox(t, p, &now)
+
+	for i := int64(1); i <= 3; i++ {
+		_, _, err := inbox.Receive(newTestNotification(i), "123")
+		require.NoError(t, err)
+		now = now.Add(time.Hour)
+	}
+
+	_, err := inbox.begin("2")
+	require.NoError(t, err)
+
+	// When
+	replayed, err := inbox.ReplayRange(context.Background(), start, now)
+	require.NoError(t, err)
+
+	// Then
+	require.Len(t, replayed, 2)
+	require.Equal(t, "1", replayed[0].ID)
+	require.Equal(t, "3", replayed[1].ID)
+	require.Equal(t, 2, p.calls)
+}
+
+func TestInbox_Prune(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	inbox := newTestInbox(t, &processStub{}, &now)
+	inbox.retention = 24 * time.Hour
+
+	old, _, err := inbox.Receive(newTestNotification(1), "123")
+	require.NoError(t, err)
+	_, err = inbox.Process(context.Background(), old.ID)
+	require.NoError(t, err)
+	pending, _, err := inbox.Receive(newTestNotification(2), "123")
+	require.NoError(t, err)
+
+	now = now.Add(12 * time.Hour)
+	recent, _, err := inbox.Receive(newTestNotification(3), "123")
+	require.NoError(t, err)
+	_, err = inbox.Process(context.Background(), recent.ID)
+	require.NoError(t, err)
+
+	now = now.Add(13 * time.Hour)
+
+	// When
+	err = inbox.Prune()
+	events, listErr := inbox.List(InboxFilter{})
+	require.NoError(t, listErr)
+
+	// Then
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, pending.ID, events[0].ID)
+	require.Equal(t, recent.ID, events[1].ID)
+}
+
+func TestInbox_Reopen(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "inbox.jsonl")
+	p := &processStub{}
+	inbox, err := OpenInbox(path, p.process)
+	require.NoError(t, err)
+
+	_, _, err = inbox.Receive(newTestNotification(1), "123")
+	require.NoError(t, err)
+	require.NoError(t, inbox.Close())
+
+	// When
+	inbox, err = OpenInbox(path, p.process)
+	require.NoError(t, err)
+	defer inbox.Close()
+
+	_, duplicate, err := inbox.Receive(newTestNotification(1), "123")
+	require.NoError(t, err)
+
+	// Then
+	require.True(t, duplicate)
+}
+
+func TestInboxHandler_ListEvents(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	inbox := newTestInbox(t, &processStub{}, &now)
+	_, _, err := inbox.Receive(newTestNotification(1), "123")
+	require.NoError(t, err)
+
+	h := NewInboxHandler(inbox)
+	ts := httptest.NewServer(http.HandlerFunc(h.ListEvents))
+	defer ts.Close()
+
+	// When
+	resp, err := http.Get(fmt.Sprintf("%s/admin/notifications?status=pending", ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var events []InboxEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, events, 1)
+	require.Equal(t, "1", events[0].ID)
+}
+
+func TestInboxHandler_ReplayEvent(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	p := &processStub{}
+	inbox := newTestInbox(t, p, &now)
+	_, _, err := inbox.Receive(newTestNotification(1), "123")
+	require.NoError(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/notifications/{id}/replay", NewInboxHandler(inbox).ReplayEvent)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	resp, err := http.Post(fmt.Sprintf("%s/admin/notifications/1/replay", ts.URL), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var event InboxEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&event))
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, InboxStatusProcessed, event.Status)
+	require.Equal(t, 1, p.calls)
+}
+
+func TestInboxHandler_ReplayEvents_MissingRange(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	inbox := newTestInbox(t, &processStub{}, &now)
+	ts := httptest.NewServer(http.HandlerFunc(NewInboxHandler(inbox).ReplayEvents))
+	defer ts.Close()
+
+	// When
+	resp, err := http.Post(fmt.Sprintf("%s/admin/notifications/replay?from=2020-06-14T00:00:00Z", ts.URL), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Then
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	tt := []struct {
+		name       string
+		token      string
+		header     string
+		wantStatus int
+	}{
+		{name: "valid token", token: "secret", header: "secret", wantStatus: http.StatusOK},
+		{name: "wrong token", token: "secret", header: "other", wantStatus: http.StatusUnauthorized},
+		{name: "no configured token", token: "", header: "", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := RequireAdminToken(tc.token, func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			ts := httptest.NewServer(h)
+			defer ts.Close()
+
+			// When
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Add("admin_token", tc.header)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// Then
+			require.Equal(t, tc.wantStatus, resp.StatusCode)
+		})
+	}
+}
@@ -5,10 +5,39 @@ type Credentials struct {
 	ClientSecret string
 }
 
+// AccessToken is the body of GET /access_token.
+type AccessToken struct {
+	AccessToken string `json:"access_token"`
+}
+
+// OAuthToken is what Mercado Pago answers on /oauth/token. UserID is the
+// account the token acts for, the seller's when it came from the
+// authorization_code flow.
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+	UserID       int64  `json:"user_id"`
+	RefreshToken string `json:"refresh_token"`
+	PublicKey    string `json:"public_key"`
+	LiveMode     bool   `json:"live_mode"`
+}
+
+// ConnectedSeller is what the OAuth callback answers once a seller granted
+// access. The seller's tokens stay with us.
+type ConnectedSeller struct {
+	UserID    int64  `json:"user_id"`
+	PublicKey string `json:"public_key"`
+	LiveMode  bool   `json:"live_mode"`
+}
+
 type Item struct {
 	Title       string  `json:"title" validate:"required"`
 	Description string  `json:"description"`
 	PictureURL  string  `json:"picture_url"`
+	CategoryID  string  `json:"category_id,omitempty" validate:"omitempty,max=256"`
+	CurrencyID  string  `json:"currency_id,omitempty" validate:"omitempty,oneof=ARS BRL CLP COP MXN PEN UYU VES USD"`
 	Quantity    int     `json:"quantity" validate:"required"`
 	UnitPrice   float64 `json:"unit_price" validate:"required"`
 }
@@ -36,7 +65,38 @@ type Address struct {
 type Redirect struct {
 	Success string `json:"success"`
 	Pending string `json:"pending"`
-	failure string `json:"failure"`
+	Failure string `json:"failure"`
+}
+
+// PaymentMethodRef points to a payment method or payment type by id.
+type PaymentMethodRef struct {
+	ID string `json:"id" validate:"required"`
+}
+
+// PreferencePaymentMethods restricts how a preference can be paid.
+// Installments is the most the buyer can choose.
+type PreferencePaymentMethods struct {
+	ExcludedPaymentMethods []PaymentMethodRef `json:"excluded_payment_methods,omitempty" validate:"omitempty,dive"`
+	ExcludedPaymentTypes   []PaymentMethodRef `json:"excluded_payment_types,omitempty" validate:"omitempty,dive"`
+	DefaultPaymentMethodID string             `json:"default_payment_method_id,omitempty"`
+	Installments           int                `json:"installments,omitempty" validate:"omitempty,min=1,max=36"`
+	DefaultInstallments    int                `json:"default_installments,omitempty" validate:"omitempty,min=1,max=36"`
+}
+
+type ReceiverAddress struct {
+	ZipCode      string `json:"zip_code" validate:"required"`
+	StreetName   string `json:"street_name" validate:"required"`
+	StreetNumber int    `json:"street_number" validate:"required"`
+	Floor        string `json:"floor,omitempty"`
+	Apartment    string `json:"apartment,omitempty"`
+}
+
+type PreferenceShipments struct {
+	Mode            string           `json:"mode,omitempty" validate:"omitempty,oneof=custom me2 not_specified"`
+	Cost            float64          `json:"cost,omitempty" validate:"gte=0"`
+	FreeShipping    bool             `json:"free_shipping,omitempty"`
+	LocalPickup     bool             `json:"local_pickup,omitempty"`
+	ReceiverAddress *ReceiverAddress `json:"receiver_address,omitempty"`
 }
 
 type NewPreference struct {
@@ -44,5 +104,461 @@ type NewPreference struct {
 	Payer Payer `json:"payer" validate:"required"`
 	Redirect Redirect `json:"back_urls"`
 	AutoReturn bool `json:"auto_return"`
+	Marketplace string `json:"marketplace,omitempty"`
+	MarketplaceFee float64 `json:"marketplace_fee,omitempty" validate:"gte=0"`
+	ExternalReference string `json:"external_reference,omitempty" validate:"omitempty,max=256"`
+	NotificationURL string `json:"notification_url,omitempty" validate:"omitempty,url"`
+	StatementDescriptor string `json:"statement_descriptor,omitempty" validate:"omitempty,max=22"`
+	Expires bool `json:"expires,omitempty"`
+	ExpirationDateFrom string `json:"expiration_date_from,omitempty" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	ExpirationDateTo string `json:"expiration_date_to,omitempty" validate:"required_with=Expires,omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	PaymentMethods *PreferencePaymentMethods `json:"payment_methods,omitempty"`
+	BinaryMode bool `json:"binary_mode,omitempty"`
+	Shipments *PreferenceShipments `json:"shipments,omitempty"`
+}
+
+// Preference is a preference as Mercado Pago stores it. CheckoutURL is
+// InitPoint or SandboxInitPoint, whichever fits the Gateway's environment.
+type Preference struct {
+	ID                  string                    `json:"id"`
+	InitPoint           string                    `json:"init_point"`
+	SandboxInitPoint    string                    `json:"sandbox_init_point"`
+	CheckoutURL         string                    `json:"checkout_url"`
+	CollectorID         int64                     `json:"collector_id"`
+	Items               []Item                    `json:"items"`
+	Redirect            Redirect                  `json:"back_urls"`
+	AutoReturn          string                    `json:"auto_return"`
+	ExternalReference   string                    `json:"external_reference"`
+	NotificationURL     string                    `json:"notification_url"`
+	StatementDescriptor string                    `json:"statement_descriptor"`
+	Marketplace         string                    `json:"marketplace"`
+	MarketplaceFee      float64                   `json:"marketplace_fee"`
+	Expires             bool                      `json:"expires"`
+	ExpirationDateFrom  string                    `json:"expiration_date_from"`
+	ExpirationDateTo    string                    `json:"expiration_date_to"`
+	PaymentMethods      *PreferencePaymentMethods `json:"payment_methods,omitempty"`
+	BinaryMode          bool                      `json:"binary_mode"`
+	CreatedAt           string                    `json:"date_created"`
+	LastUpdatedAt       string                    `json:"last_updated"`
+}
+
+// PreferenceUpdate only sends the fields that are set. Expires is a pointer so
+// an expiration can be turned off.
+type PreferenceUpdate struct {
+	Items              []Item    `json:"items,omitempty" validate:"omitempty,min=1,dive"`
+	Redirect           *Redirect `json:"back_urls,omitempty"`
+	Expires            *bool     `json:"expires,omitempty"`
+	ExpirationDateFrom string    `json:"expiration_date_from,omitempty" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	ExpirationDateTo   string    `json:"expiration_date_to,omitempty" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+}
+
+type PreferenceSearch struct {
+	ExternalReference string `validate:"required"`
+	Limit             int    `validate:"gte=0,lte=1000"`
+	Offset            int    `validate:"gte=0"`
+}
+
+type PreferenceSearchResult struct {
+	Elements   []Preference `json:"elements"`
+	Total      int          `json:"total"`
+	NextOffset int          `json:"next_offset"`
+}
+
+
+type Identification struct {
+	Type   string `json:"type" validate:"required"`
+	Number string `json:"number" validate:"required"`
+}
+
+type PaymentPayer struct {
+	ID             string         `json:"id"`
+	Email          string         `json:"email"`
+	FirstName      string         `json:"first_name"`
+	LastName       string         `json:"last_name"`
+	Identification Identification `json:"identification"`
+}
+
+type Payment struct {
+	ID                        int64        `json:"id"`
+	Status                    string       `json:"status"`
+	StatusDetail              string       `json:"status_detail"`
+	Description               string       `json:"description"`
+	ExternalReference         string       `json:"external_reference"`
+	CurrencyID                string       `json:"currency_id"`
+	TransactionAmount         float64      `json:"transaction_amount"`
+	TransactionAmountRefunded float64      `json:"transaction_amount_refunded"`
+	Installments              int          `json:"installments"`
+	PaymentMethodID           string       `json:"payment_method_id"`
+	PaymentTypeID             string       `json:"payment_type_id"`
+	Payer                     PaymentPayer `json:"payer"`
+	CollectorID               int64        `json:"collector_id"`
+	FeeDetails                []FeeDetail  `json:"fee_details"`
+	CreatedAt                 string       `json:"date_created"`
+	ApprovedAt                string       `json:"date_approved"`
+	LastUpdatedAt             string       `json:"date_last_updated"`
+}
+
+type FeeDetail struct {
+	Type     string  `json:"type"`
+	Amount   float64 `json:"amount"`
+	FeePayer string  `json:"fee_payer"`
+}
+
+type PaymentSearch struct {
+	Status            string `validate:"omitempty,oneof=pending approved authorized in_process in_mediation rejected cancelled refunded charged_back"`
+	Range             string `validate:"omitempty,oneof=date_created date_approved date_last_updated money_release_date"`
+	BeginDate         string `validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	EndDate           string `validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	ExternalReference string
+	PayerEmail        string `validate:"omitempty,email"`
+	PaymentMethodID   string
+	Sort              string `validate:"omitempty,oneof=date_approved date_created date_last_updated id money_release_date"`
+	Criteria          string `validate:"omitempty,oneof=asc desc"`
+	Limit             int    `validate:"gte=0,lte=1000"`
+	Offset            int    `validate:"gte=0"`
+}
+
+type Paging struct {
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+type PaymentSearchResult struct {
+	Results []Payment `json:"results"`
+	Paging  Paging    `json:"paging"`
+}
+
+// TotalPayments is the body of GET /total_payments: how many payments are
+// in Status.
+type TotalPayments struct {
+	Status string `json:"status"`
+	Total  int    `json:"total"`
+}
+
+type NewRefund struct {
+	Amount float64 `json:"amount,omitempty" validate:"gte=0"`
+}
+
+type Refund struct {
+	ID        int64   `json:"id"`
+	PaymentID int64   `json:"payment_id"`
+	Amount    float64 `json:"amount"`
+	Status    string  `json:"status"`
+	CreatedAt string  `json:"date_created"`
+}
+
+type NewCapture struct {
+	Amount float64 `json:"amount,omitempty" validate:"gte=0"`
+}
+
+type PaymentUpdate struct {
+	Capture           bool    `json:"capture,omitempty"`
+	TransactionAmount float64 `json:"transaction_amount,omitempty"`
+	Status            string  `json:"status,omitempty"`
+}
+
+type NewPaymentPayer struct {
+	Email          string         `json:"email" validate:"required,email"`
+	Identification Identification `json:"identification" validate:"required"`
+}
+
+type NewPayment struct {
+	TransactionAmount float64         `json:"transaction_amount" validate:"required,gt=0"`
+	Token             string          `json:"token" validate:"required"`
+	Description       string          `json:"description"`
+	Installments      int             `json:"installments" validate:"required,min=1"`
+	PaymentMethodID   string          `json:"payment_method_id" validate:"required"`
+	IssuerID          string          `json:"issuer_id,omitempty"`
+	ExternalReference string          `json:"external_reference,omitempty"`
+	Capture           *bool           `json:"capture,omitempty"`
+	ApplicationFee    float64         `json:"application_fee,omitempty" validate:"gte=0"`
+	Payer             NewPaymentPayer `json:"payer" validate:"required"`
+}
+
+type NewCustomer struct {
+	Email          string           `json:"email" validate:"required,email"`
+	FirstName      string           `json:"first_name,omitempty"`
+	LastName       string           `json:"last_name,omitempty"`
+	Phone          *Phone           `json:"phone,omitempty"`
+	Identification *Identification  `json:"identification,omitempty"`
+	Address        *CustomerAddress `json:"address,omitempty"`
+	Description    string           `json:"description,omitempty"`
+}
+
+// CustomerAddress is the address Mercado Pago keeps on a customer. Unlike a
+// payer's, none of its fields is required, so an update can change only some.
+type CustomerAddress struct {
+	ID           string `json:"id,omitempty"`
+	ZipCode      string `json:"zip_code,omitempty"`
+	StreetName   string `json:"street_name,omitempty"`
+	StreetNumber int    `json:"street_number,omitempty"`
+}
+
+type CustomerUpdate struct {
+	FirstName      string           `json:"first_name,omitempty"`
+	LastName       string           `json:"last_name,omitempty"`
+	Phone          *Phone           `json:"phone,omitempty"`
+	Identification *Identification  `json:"identification,omitempty"`
+	Address        *CustomerAddress `json:"address,omitempty"`
+	Description    string           `json:"description,omitempty"`
+	DefaultCard    string           `json:"default_card,omitempty"`
+}
+
+type Customer struct {
+	ID             string          `json:"id"`
+	Email          string          `json:"email"`
+	FirstName      string          `json:"first_name"`
+	LastName       string          `json:"last_name"`
+	Phone          Phone           `json:"phone"`
+	Identification Identification  `json:"identification"`
+	Address        CustomerAddress `json:"address"`
+	Description    string          `json:"description"`
+	DefaultCard    string          `json:"default_card"`
+	Cards          []Card          `json:"cards"`
+	CreatedAt      string          `json:"date_created"`
+}
+
+type CustomerSearchResult struct {
+	Results []Customer `json:"results"`
+	Paging  Paging     `json:"paging"`
+}
+
+type NewCard struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type CardPaymentMethod struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type CardIssuer struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type Cardholder struct {
+	Name           string         `json:"name"`
+	Identification Identification `json:"identification"`
+}
+
+type Card struct {
+	ID              string            `json:"id"`
+	CustomerID      string            `json:"customer_id"`
+	ExpirationMonth int               `json:"expiration_month"`
+	ExpirationYear  int               `json:"expiration_year"`
+	FirstSixDigits  string            `json:"first_six_digits"`
+	LastFourDigits  string            `json:"last_four_digits"`
+	PaymentMethod   CardPaymentMethod `json:"payment_method"`
+	Issuer          CardIssuer        `json:"issuer"`
+	Cardholder      Cardholder        `json:"cardholder"`
+	CreatedAt       string            `json:"date_created"`
+}
+
+type PaymentMethod struct {
+	ID               string  `json:"id"`
+	Name             string  `json:"name"`
+	PaymentTypeID    string  `json:"payment_type_id"`
+	Status           string  `json:"status"`
+	Thumbnail        string  `json:"secure_thumbnail"`
+	MinAllowedAmount float64 `json:"min_allowed_amount"`
+	MaxAllowedAmount float64 `json:"max_allowed_amount"`
+}
+
+type Issuer struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Thumbnail string `json:"secure_thumbnail"`
+}
+
+type InstallmentsSearch struct {
+	Amount          float64 `validate:"required,gt=0"`
+	Bin             string  `validate:"omitempty,numeric,min=6,max=8"`
+	PaymentMethodID string
+	IssuerID        string
+}
+
+type PayerCost struct {
+	Installments       int     `json:"installments"`
+	InstallmentRate    float64 `json:"installment_rate"`
+	InstallmentAmount  float64 `json:"installment_amount"`
+	TotalAmount        float64 `json:"total_amount"`
+	RecommendedMessage string  `json:"recommended_message"`
+}
+
+type Installments struct {
+	PaymentMethodID string      `json:"payment_method_id"`
+	PaymentTypeID   string      `json:"payment_type_id"`
+	Issuer          Issuer      `json:"issuer"`
+	PayerCosts      []PayerCost `json:"payer_costs"`
+}
+
+type MerchantOrderItem struct {
+	ID         string  `json:"id"`
+	Title      string  `json:"title"`
+	Quantity   int     `json:"quantity"`
+	UnitPrice  float64 `json:"unit_price"`
+	CurrencyID string  `json:"currency_id"`
+}
+
+type MerchantOrderPayment struct {
+	ID                int64   `json:"id"`
+	Status            string  `json:"status"`
+	StatusDetail      string  `json:"status_detail"`
+	TransactionAmount float64 `json:"transaction_amount"`
+	TotalPaidAmount   float64 `json:"total_paid_amount"`
+	ApprovedAt        string  `json:"date_approved"`
+}
+
+type Shipment struct {
+	ID           int64  `json:"id"`
+	ShipmentType string `json:"shipment_type"`
+	ShippingMode string `json:"shipping_mode"`
+	Status       string `json:"status"`
+	CreatedAt    string `json:"date_created"`
+}
+
+type MerchantOrder struct {
+	ID                int64                  `json:"id"`
+	PreferenceID      string                 `json:"preference_id"`
+	ExternalReference string                 `json:"external_reference"`
+	Status            string                 `json:"status"`
+	OrderStatus       string                 `json:"order_status"`
+	TotalAmount       float64                `json:"total_amount"`
+	PaidAmount        float64                `json:"paid_amount"`
+	RefundedAmount    float64                `json:"refunded_amount"`
+	ShippingCost      float64                `json:"shipping_cost"`
+	Items             []MerchantOrderItem    `json:"items"`
+	Payments          []MerchantOrderPayment `json:"payments"`
+	Shipments         []Shipment             `json:"shipments"`
+	CreatedAt         string                 `json:"date_created"`
+	LastUpdatedAt     string                 `json:"last_updated"`
+}
+
+// IsPaid reports whether the approved payments cover the whole order.
+func (o MerchantOrder) IsPaid() bool {
+	return o.TotalAmount > 0 && toCents(o.PaidAmount) >= toCents(o.TotalAmount)
+}
+
+type MerchantOrderSearch struct {
+	PreferenceID      string `validate:"required_without=ExternalReference"`
+	ExternalReference string `validate:"required_without=PreferenceID"`
+	Limit             int    `validate:"gte=0,lte=1000"`
+	Offset            int    `validate:"gte=0"`
+}
+
+type MerchantOrderSearchResult struct {
+	Elements   []MerchantOrder `json:"elements"`
+	Total      int             `json:"total"`
+	NextOffset int             `json:"next_offset"`
+}
+
+type FreeTrial struct {
+	Frequency     int    `json:"frequency" validate:"required,min=1"`
+	FrequencyType string `json:"frequency_type" validate:"required,oneof=days months"`
+}
+
+type AutoRecurring struct {
+	Frequency         int        `json:"frequency" validate:"required,min=1"`
+	FrequencyType     string     `json:"frequency_type" validate:"required,oneof=days months"`
+	TransactionAmount float64    `json:"transaction_amount" validate:"required,gt=0"`
+	CurrencyID        string     `json:"currency_id" validate:"required,len=3"`
+	Repetitions       int        `json:"repetitions,omitempty" validate:"gte=0"`
+	BillingDay        int        `json:"billing_day,omitempty" validate:"gte=0,lte=28"`
+	StartDate         string     `json:"start_date,omitempty" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	EndDate           string     `json:"end_date,omitempty" validate:"omitempty,datetime=2006-01-02T15:04:05Z07:00"`
+	FreeTrial         *FreeTrial `json:"free_trial,omitempty"`
+}
+
+type NewPreapprovalPlan struct {
+	Reason        string        `json:"reason" validate:"required"`
+	AutoRecurring AutoRecurring `json:"auto_recurring" validate:"required"`
+	BackURL       string        `json:"back_url" validate:"required,url"`
+}
+
+type PreapprovalPlanUpdate struct {
+	Reason        string         `json:"reason,omitempty"`
+	AutoRecurring *AutoRecurring `json:"auto_recurring,omitempty"`
+	BackURL       string         `json:"back_url,omitempty" validate:"omitempty,url"`
+	Status        string         `json:"status,omitempty" validate:"omitempty,oneof=active cancelled"`
+}
+
+type PreapprovalPlan struct {
+	ID            string        `json:"id"`
+	Reason        string        `json:"reason"`
+	Status        string        `json:"status"`
+	AutoRecurring AutoRecurring `json:"auto_recurring"`
+	BackURL       string        `json:"back_url"`
+	InitPoint     string        `json:"init_point"`
+	CreatedAt     string        `json:"date_created"`
+	LastModified  string        `json:"last_modified"`
 }
 
+type NewPreapproval struct {
+	PreapprovalPlanID string         `json:"preapproval_plan_id,omitempty"`
+	Reason            string         `json:"reason,omitempty" validate:"required_without=PreapprovalPlanID"`
+	PayerEmail        string         `json:"payer_email" validate:"required,email"`
+	CardTokenID       string         `json:"card_token_id,omitempty"`
+	AutoRecurring     *AutoRecurring `json:"auto_recurring,omitempty" validate:"required_without=PreapprovalPlanID"`
+	BackURL           string         `json:"back_url,omitempty" validate:"omitempty,url"`
+	ExternalReference string         `json:"external_reference,omitempty"`
+	Status            string         `json:"status,omitempty" validate:"omitempty,oneof=pending authorized"`
+}
+
+type PreapprovalUpdate struct {
+	Status string `json:"status"`
+}
+
+type Preapproval struct {
+	ID                string        `json:"id"`
+	PreapprovalPlanID string        `json:"preapproval_plan_id"`
+	PayerID           int64         `json:"payer_id"`
+	PayerEmail        string        `json:"payer_email"`
+	Reason            string        `json:"reason"`
+	ExternalReference string        `json:"external_reference"`
+	Status            string        `json:"status"`
+	AutoRecurring     AutoRecurring `json:"auto_recurring"`
+	BackURL           string        `json:"back_url"`
+	InitPoint         string        `json:"init_point"`
+	NextPaymentDate   string        `json:"next_payment_date"`
+	CreatedAt         string        `json:"date_created"`
+	LastModified      string        `json:"last_modified"`
+}
+
+type PreapprovalSearch struct {
+	PayerEmail        string `validate:"omitempty,email"`
+	Status            string `validate:"omitempty,oneof=pending authorized paused cancelled"`
+	PreapprovalPlanID string
+	Limit             int `validate:"gte=0,lte=1000"`
+	Offset            int `validate:"gte=0"`
+}
+
+type PreapprovalSearchResult struct {
+	Results []Preapproval `json:"results"`
+	Paging  Paging        `json:"paging"`
+}
+
+type MarketplaceFeeSearch struct {
+	BeginDate string `validate:"required,datetime=2006-01-02T15:04:05Z07:00"`
+	EndDate   string `validate:"required,datetime=2006-01-02T15:04:05Z07:00"`
+}
+
+// SellerFees is what the marketplace earned on a connected seller's approved
+// payments. Error says why they couldn't be added up, in which case the seller
+// counts for nothing in the report.
+type SellerFees struct {
+	SellerID          int64   `json:"seller_id"`
+	Payments          int     `json:"payments"`
+	GrossAmount       float64 `json:"gross_amount"`
+	MarketplaceFee    float64 `json:"marketplace_fee"`
+	Error             string  `json:"error,omitempty"`
+	ReconnectRequired bool    `json:"reconnect_required,omitempty"`
+}
+
+type MarketplaceFeeReport struct {
+	BeginDate string       `json:"begin_date"`
+	EndDate   string       `json:"end_date"`
+	Sellers   []SellerFees `json:"sellers"`
+	TotalFee  float64      `json:"total_fee"`
+}
@@ -0,0 +1,332 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const _signatureTolerance = 5 * time.Minute
+
+var (
+	ErrInvalidSignature  = errors.New("invalid signature")
+	ErrExpiredSignature  = errors.New("signature timestamp outside tolerance")
+	ErrReplayedSignature = errors.New("notification already received")
+	ErrNoWebhookSecret   = errors.New("webhook secret isn't configured")
+)
+
+type Notification struct {
+	ID         int64  `json:"id"`
+	LiveMode   bool   `json:"live_mode"`
+	Type       string `json:"type"`
+	Action     string `json:"action"`
+	UserID     int64  `json:"user_id"`
+	APIVersion string `json:"api_version"`
+	CreatedAt  string `json:"date_created"`
+	Data       struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// Event is a notification together with the resource it refers to, fetched
+// from Mercado Pago. Only the field matching Type is set.
+type Event struct {
+	ID            int64
+	Type          string
+	Action        string
+	Payment       *Payment
+	MerchantOrder *MerchantOrder
+	Preapproval   *Preapproval
+}
+
+type EventHandler interface {
+	HandleEvent(event Event) error
+}
+
+type NotificationService interface {
+	GetPayment(ctx context.Context, accessToken string, paymentID int64) (Payment, error)
+	GetMerchantOrder(ctx context.Context, accessToken string, merchantOrderID int64) (MerchantOrder, error)
+	GetPreapproval(ctx context.Context, accessToken string, preapprovalID string) (Preapproval, error)
+}
+
+// LogEventHandler is the default EventHandler, it only logs what arrived.
+type LogEventHandler struct{}
+
+func (LogEventHandler) HandleEvent(event Event) error {
+	log.Printf("received %s notification %d: %s", event.Type, event.ID, event.Action)
+	return nil
+}
+
+type NotificationHandler struct {
+	Service NotificationService
+	Events  EventHandler
+	Inbox   *Inbox
+	// Token gets the access token resources are fetched with when the
+	// handler wasn't given one.
+	Token       *ConfiguredToken
+	secret      string
+	accessToken string
+	tolerance   time.Duration
+	now         func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewNotificationHandler(service NotificationService, events EventHandler, secret string, accessToken string) *NotificationHandler {
+	return &NotificationHandler{
+		Service:     service,
+		Events:      events,
+		secret:      secret,
+		accessToken: accessToken,
+		tolerance:   _signatureTolerance,
+		now:         time.Now,
+		seen:        make(map[string]time.Time),
+	}
+}
+
+func (h *NotificationHandler) ReceiveNotification(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, NewError(fmt.Sprintf("couldn't read body: %v", err), http.StatusBadRequest))
+		return
+	}
+
+	var n Notification
+	if err := json.Unmarshal(body, &n); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	dataID := r.URL.Query().Get("data.id")
+	if dataID == "" {
+		dataID = n.Data.ID
+	}
+
+	signature, err := h.verifySignature(r.Header.Get("x-signature"), r.Header.Get("x-request-id"), dataID)
+	if err != nil {
+		writeError(w, r, NewError(err.Error(), http.StatusUnauthorized))
+		return
+	}
+
+	if h.Inbox == nil {
+		if err := h.Handle(r.Context(), n, dataID); err != nil {
+			h.forget(signature)
+			writeError(w, r, fmt.Errorf("couldn't handle notification: %w", err))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Once the notification is in the inbox it is ours to retry, so Mercado
+	// Pago gets a 200 even if this first attempt fails.
+	event, duplicate, err := h.Inbox.Receive(n, dataID)
+	if err != nil {
+		h.forget(signature)
+		writeError(w, r, NewError(fmt.Sprintf("couldn't store notification: %v", err), http.StatusInternalServerError))
+		return
+	}
+
+	if !duplicate {
+		if _, err := h.Inbox.Process(r.Context(), event.ID); err != nil {
+			log.Printf("couldn't process notification %s: %v", event.ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Handle fetches the resource a notification refers to and hands the event to
+// Events. Notification types we don't know about are acknowledged and dropped.
+func (h *NotificationHandler) Handle(ctx context.Context, n Notification, dataID string) error {
+	event, ok, err := h.resolve(ctx, n, dataID)
+	if err != nil {
+		return fmt.Errorf("couldn't get %s %s: %w", n.Type, dataID, err)
+	}
+
+	if !ok {
+		return nil
+	}
+
+	return h.Events.HandleEvent(event)
+}
+
+// verifySignature checks the x-signature header Mercado Pago sends with every
+// notification: "ts=<timestamp>,v1=<hex hmac-sha256>" over the manifest
+// "id:<data.id>;request-id:<x-request-id>;ts:<timestamp>;". A valid signature
+// is marked as seen right away, so a replay racing it is rejected too; it
+// returns the v1 hash so the caller can forget it if handling fails.
+// Without a secret anyone could sign, so nothing is accepted.
+func (h *NotificationHandler) verifySignature(header string, requestID string, dataID string) (string, error) {
+	if h.secret == "" {
+		return "", ErrNoWebhookSecret
+	}
+
+	var ts, v1 string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "ts":
+			ts = kv[1]
+		case "v1":
+			v1 = kv[1]
+		}
+	}
+
+	if ts == "" || v1 == "" {
+		return "", ErrInvalidSignature
+	}
+
+	var manifest strings.Builder
+	if dataID != "" {
+		fmt.Fprintf(&manifest, "id:%s;", strings.ToLower(dataID))
+	}
+
+	if requestID != "" {
+		fmt.Fprintf(&manifest, "request-id:%s;", requestID)
+	}
+
+	fmt.Fprintf(&manifest, "ts:%s;", ts)
+
+	mac := hmac.New(sha256.New, []byte(h.secret))
+	mac.Write([]byte(manifest.String()))
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(strings.ToLower(v1))) {
+		return "", ErrInvalidSignature
+	}
+
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	// Mercado Pago documents ts in seconds but has sent milliseconds too.
+	signedAt := time.Unix(timestamp, 0)
+	if timestamp > 1e12 {
+		signedAt = time.Unix(0, timestamp*int64(time.Millisecond))
+	}
+
+	now := h.now()
+	if now.Sub(signedAt) > h.tolerance || signedAt.Sub(now) > h.tolerance {
+		return "", ErrExpiredSignature
+	}
+
+	if h.seenOrMark(v1) {
+		return "", ErrReplayedSignature
+	}
+
+	return v1, nil
+}
+
+// seenOrMark reports whether signature was seen already, marking it as seen
+// if it wasn't, under one lock.
+func (h *NotificationHandler) seenOrMark(signature string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	for s, at := range h.seen {
+		if now.Sub(at) > 2*h.tolerance {
+			delete(h.seen, s)
+		}
+	}
+
+	if _, ok := h.seen[signature]; ok {
+		return true
+	}
+
+	h.seen[signature] = now
+	return false
+}
+
+// forget lets a signature in again, for a notification we failed to handle
+// and Mercado Pago will resend.
+func (h *NotificationHandler) forget(signature string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.seen, signature)
+}
+
+// resolve fetches the resource a notification points to. It reports false for
+// notification types we don't handle.
+func (h *NotificationHandler) resolve(ctx context.Context, n Notification, dataID string) (Event, bool, error) {
+	event := Event{
+		ID:     n.ID,
+		Type:   n.Type,
+		Action: n.Action,
+	}
+
+	switch n.Type {
+	case "payment", "merchant_order", "topic_merchant_order_wh", "subscription_preapproval":
+	default:
+		return Event{}, false, nil
+	}
+
+	accessToken, err := h.getAccessToken(ctx)
+	if err != nil {
+		return Event{}, false, err
+	}
+
+	switch n.Type {
+	case "payment":
+		paymentID, err := strconv.ParseInt(dataID, 10, 64)
+		if err != nil {
+			return Event{}, false, NewError(fmt.Sprintf("invalid payment id: %s", dataID), http.StatusBadRequest)
+		}
+
+		payment, err := h.Service.GetPayment(ctx, accessToken, paymentID)
+		if err != nil {
+			return Event{}, false, err
+		}
+
+		event.Payment = &payment
+	case "merchant_order", "topic_merchant_order_wh":
+		merchantOrderID, err := strconv.ParseInt(dataID, 10, 64)
+		if err != nil {
+			return Event{}, false, NewError(fmt.Sprintf("invalid merchant order id: %s", dataID), http.StatusBadRequest)
+		}
+
+		merchantOrder, err := h.Service.GetMerchantOrder(ctx, accessToken, merchantOrderID)
+		if err != nil {
+			return Event{}, false, err
+		}
+
+		event.MerchantOrder = &merchantOrder
+	case "subscription_preapproval":
+		preapproval, err := h.Service.GetPreapproval(ctx, accessToken, dataID)
+		if err != nil {
+			return Event{}, false, err
+		}
+
+		event.Preapproval = &preapproval
+	}
+
+	return event, true, nil
+}
+
+// getAccessToken prefers the access token the handler was given and falls
+// back to Token, so a cached token that expired gets refreshed.
+func (h *NotificationHandler) getAccessToken(ctx context.Context) (string, error) {
+	if h.accessToken != "" {
+		return h.accessToken, nil
+	}
+
+	return h.Token.AccessToken(ctx)
+}
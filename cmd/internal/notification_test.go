@@ -0,0 +1,433 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const _testWebhookSecret = "MY_WEBHOOK_SECRET"
+
+type EventHandlerStub struct {
+	events []Event
+	err    error
+}
+
+func (e *EventHandlerStub) HandleEvent(event Event) error {
+	e.events = append(e.events, event)
+	return e.err
+}
+
+func sign(secret string, dataID string, requestID string, ts int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("id:%s;request-id:%s;ts:%d;", dataID, requestID, ts)))
+	return fmt.Sprintf("ts=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func newNotificationRequest(t *testing.T, url string, body string, signature string) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("x-signature", signature)
+	req.Header.Add("x-request-id", "MY_REQUEST_ID")
+	return req
+}
+
+func TestNotificationHandler_ReceiveNotification(t *testing.T) {
+	tt := []struct {
+		name  string
+		body  string
+		check func(t *testing.T, event Event)
+	}{
+		{
+			name: "payment",
+			body: `{"id": 1, "type": "payment", "action": "payment.updated", "data": {"id": "123"}}`,
+			check: func(t *testing.T, event Event) {
+				require.Equal(t, int64(123), event.Payment.ID)
+				require.Nil(t, event.MerchantOrder)
+			},
+		},
+		{
+			name: "merchant order",
+			body: `{"id": 2, "type": "topic_merchant_order_wh", "action": "update", "data": {"id": "123"}}`,
+			check: func(t *testing.T, event Event) {
+				require.Equal(t, int64(456), event.MerchantOrder.ID)
+				require.Nil(t, event.Payment)
+			},
+		},
+		{
+			name: "subscription",
+			body: `{"id": 3, "type": "subscription_preapproval", "action": "updated", "data": {"id": "123"}}`,
+			check: func(t *testing.T, event Event) {
+				require.Equal(t, "sub-1", event.Preapproval.ID)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			now := time.Unix(1592092800, 0)
+			events := &EventHandlerStub{}
+			h := NewNotificationHandler(&ServiceStub{
+				payment:       Payment{ID: 123, Status: "approved"},
+				merchantOrder: MerchantOrder{ID: 456},
+				preapproval:   Preapproval{ID: "sub-1"},
+			}, events, _testWebhookSecret, "MY_ACCESS_TOKEN")
+			h.now = func() time.Time { return now }
+			ts := httptest.NewServer(http.HandlerFunc(h.ReceiveNotification))
+			defer ts.Close()
+
+			// When
+			req := newNotificationRequest(t, fmt.Sprintf("%s/notifications?data.id=123", ts.URL), tc.body, sign(_testWebhookSecret, "123", "MY_REQUEST_ID", now.Unix()))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// Then
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Len(t, events.events, 1)
+			tc.check(t, events.events[0])
+		})
+	}
+}
+
+func TestNotificationHandler_ReceiveNotification_UnknownType(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	events := &EventHandlerStub{}
+	h := NewNotificationHandler(&ServiceStub{}, events, _testWebhookSecret, "MY_ACCESS_TOKEN")
+	h.now = func() time.Time { return now }
+	ts := httptest.NewServer(http.HandlerFunc(h.ReceiveNotification))
+	defer ts.Close()
+
+	// When
+	req := newNotificationRequest(t, fmt.Sprintf("%s/notifications", ts.URL), `{"id": 1, "type": "point_integration_wh", "data": {"id": "abc"}}`, sign(_testWebhookSecret, "abc", "MY_REQUEST_ID", now.Unix()))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, events.events)
+}
+
+func TestNotificationHandler_ReceiveNotification_SignatureError(t *testing.T) {
+	now := time.Unix(1592092800, 0)
+	tt := []struct {
+		name      string
+		noSecret  bool
+		signature string
+		wantError string
+	}{
+		{
+			name:      "no secret configured",
+			noSecret:  true,
+			signature: sign("", "123", "MY_REQUEST_ID", now.Unix()),
+			wantError: "webhook secret isn't configured",
+		},
+		{
+			name:      "missing signature",
+			signature: "",
+			wantError: "invalid signature",
+		},
+		{
+			name:      "wrong secret",
+			signature: sign("OTHER_SECRET", "123", "MY_REQUEST_ID", now.Unix()),
+			wantError: "invalid signature",
+		},
+		{
+			name:      "signed for another resource",
+			signature: sign(_testWebhookSecret, "999", "MY_REQUEST_ID", now.Unix()),
+			wantError: "invalid signature",
+		},
+		{
+			name:      "expired timestamp",
+			signature: sign(_testWebhookSecret, "123", "MY_REQUEST_ID", now.Add(-10*time.Minute).Unix()),
+			wantError: "signature timestamp outside tolerance",
+		},
+		{
+			name:      "timestamp in milliseconds",
+			signature: sign(_testWebhookSecret, "123", "MY_REQUEST_ID", now.Add(-10*time.Minute).UnixNano()/int64(time.Millisecond)),
+			wantError: "signature timestamp outside tolerance",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			secret := _testWebhookSecret
+			if tc.noSecret {
+				secret = ""
+			}
+
+			events := &EventHandlerStub{}
+			h := NewNotificationHandler(&ServiceStub{}, events, secret, "MY_ACCESS_TOKEN")
+			h.now = func() time.Time { return now }
+			ts := httptest.NewServer(http.HandlerFunc(h.ReceiveNotification))
+			defer ts.Close()
+
+			// When
+			req := newNotificationRequest(t, fmt.Sprintf("%s/notifications?data.id=123", ts.URL), `{"id": 1, "type": "payment", "data": {"id": "123"}}`, tc.signature)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, tc.wantError, errorResponse(t, b).Message)
+			require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+			require.Empty(t, events.events)
+		})
+	}
+}
+
+func TestNotificationHandler_ReceiveNotification_Replayed(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	events := &EventHandlerStub{}
+	h := NewNotificationHandler(&ServiceStub{payment: Payment{ID: 123}}, events, _testWebhookSecret, "MY_ACCESS_TOKEN")
+	h.now = func() time.Time { return now }
+	ts := httptest.NewServer(http.HandlerFunc(h.ReceiveNotification))
+	defer ts.Close()
+
+	signature := sign(_testWebhookSecret, "123", "MY_REQUEST_ID", now.Unix())
+	body := `{"id": 1, "type": "payment", "data": {"id": "123"}}`
+
+	// When
+	var statusCodes []int
+	for i := 0; i < 2; i++ {
+		resp, err := http.DefaultClient.Do(newNotificationRequest(t, fmt.Sprintf("%s/notifications?data.id=123", ts.URL), body, signature))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		statusCodes = append(statusCodes, resp.StatusCode)
+	}
+
+	// Then
+	require.Equal(t, []int{http.StatusOK, http.StatusUnauthorized}, statusCodes)
+	require.Len(t, events.events, 1)
+}
+
+func TestNotificationHandler_ReceiveNotification_Replayed_Concurrent(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	events := &EventHandlerStub{}
+	h := NewNotificationHandler(&ServiceStub{payment: Payment{ID: 123}}, events, _testWebhookSecret, "MY_ACCESS_TOKEN")
+	h.now = func() time.Time { return now }
+	ts := httptest.NewServer(http.HandlerFunc(h.ReceiveNotification))
+	defer ts.Close()
+
+	signature := sign(_testWebhookSecret, "123", "MY_REQUEST_ID", now.Unix())
+	body := `{"id": 1, "type": "payment", "data": {"id": "123"}}`
+
+	// When
+	var wg sync.WaitGroup
+	statusCodes := make([]int, 10)
+	for i := range statusCodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.DefaultClient.Do(newNotificationRequest(t, fmt.Sprintf("%s/notifications?data.id=123", ts.URL), body, signature))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statusCodes[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+
+	// Then
+	accepted := 0
+	for _, statusCode := range statusCodes {
+		if statusCode == http.StatusOK {
+			accepted++
+			continue
+		}
+
+		require.Equal(t, http.StatusUnauthorized, statusCode)
+	}
+
+	require.Equal(t, 1, accepted)
+	require.Len(t, events.events, 1)
+}
+
+func TestNotificationHandler_ReceiveNotification_HandlerError(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	events := &EventHandlerStub{err: errors.New("downstream error")}
+	h := NewNotificationHandler(&ServiceStub{payment: Payment{ID: 123}}, events, _testWebhookSecret, "MY_ACCESS_TOKEN")
+	h.now = func() time.Time { return now }
+	ts := httptest.NewServer(http.HandlerFunc(h.ReceiveNotification))
+	defer ts.Close()
+
+	signature := sign(_testWebhookSecret, "123", "MY_REQUEST_ID", now.Unix())
+	body := `{"id": 1, "type": "payment", "data": {"id": "123"}}`
+
+	// When
+	resp, err := http.DefaultClient.Do(newNotificationRequest(t, fmt.Sprintf("%s/notifications?data.id=123", ts.URL), body, signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed delivery must not burn the signature, Mercado Pago retries it.
+	events.err = nil
+	retry, err := http.DefaultClient.Do(newNotificationRequest(t, fmt.Sprintf("%s/notifications?data.id=123", ts.URL), body, signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer retry.Body.Close()
+
+	// Then
+	require.Equal(t, "internal server error", errorResponse(t, b).Message)
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, http.StatusOK, retry.StatusCode)
+}
+
+func TestNotificationHandler_ReceiveNotification_ResourceError(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	events := &EventHandlerStub{}
+	h := NewNotificationHandler(&ServiceStub{err: NewError("not found", http.StatusNotFound)}, events, _testWebhookSecret, "MY_ACCESS_TOKEN")
+	h.now = func() time.Time { return now }
+	ts := httptest.NewServer(http.HandlerFunc(h.ReceiveNotification))
+	defer ts.Close()
+
+	// When
+	req := newNotificationRequest(t, fmt.Sprintf("%s/notifications?data.id=123", ts.URL), `{"id": 1, "type": "payment", "data": {"id": "123"}}`, sign(_testWebhookSecret, "123", "MY_REQUEST_ID", now.Unix()))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, "couldn't handle notification: couldn't get payment 123: not found", errorResponse(t, b).Message)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Empty(t, events.events)
+}
+
+func TestNotificationHandler_ReceiveNotification_Inbox(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	events := &EventHandlerStub{err: errors.New("downstream error")}
+	h := NewNotificationHandler(&ServiceStub{payment: Payment{ID: 123}}, events, _testWebhookSecret, "MY_ACCESS_TOKEN")
+	h.now = func() time.Time { return now }
+
+	inbox, err := OpenInbox(filepath.Join(t.TempDir(), "inbox.jsonl"), h.Handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inbox.Close()
+
+	h.Inbox = inbox
+	ts := httptest.NewServer(http.HandlerFunc(h.ReceiveNotification))
+	defer ts.Close()
+
+	body := `{"id": 1, "type": "payment", "data": {"id": "123"}}`
+
+	// When
+	var statusCodes []int
+	for i := 0; i < 2; i++ {
+		// Mercado Pago retries with a fresh signature each time.
+		signature := sign(_testWebhookSecret, "123", "MY_REQUEST_ID", now.Unix()+int64(i))
+		resp, err := http.DefaultClient.Do(newNotificationRequest(t, fmt.Sprintf("%s/notifications?data.id=123", ts.URL), body, signature))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		statusCodes = append(statusCodes, resp.StatusCode)
+	}
+
+	stored, err := inbox.List(InboxFilter{})
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, []int{http.StatusOK, http.StatusOK}, statusCodes)
+	require.Len(t, events.events, 1)
+	require.Len(t, stored, 1)
+	require.Equal(t, InboxStatusFailed, stored[0].Status)
+	require.Equal(t, "downstream error", stored[0].LastError)
+}
+
+// accessTokenServiceStub remembers the access token each payment was fetched
+// with.
+type accessTokenServiceStub struct {
+	*ServiceStub
+	accessTokens []string
+}
+
+func (s *accessTokenServiceStub) GetPayment(ctx context.Context, accessToken string, paymentID int64) (Payment, error) {
+	s.accessTokens = append(s.accessTokens, accessToken)
+	return s.ServiceStub.GetPayment(ctx, accessToken, paymentID)
+}
+
+func TestNotificationHandler_Handle_ConfiguredToken(t *testing.T) {
+	// Given
+	service := &accessTokenServiceStub{ServiceStub: &ServiceStub{payment: Payment{ID: 123}}}
+	events := &EventHandlerStub{}
+	h := NewNotificationHandler(service, events, _testWebhookSecret, "")
+	h.Token = &ConfiguredToken{
+		Tokens:      NewTokenSource(&TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "APP_USR-1", ExpiresIn: 21600}}}),
+		Credentials: _testCredentials,
+	}
+
+	// When
+	err := h.Handle(context.Background(), Notification{ID: 1, Type: "payment"}, "123")
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, []string{"APP_USR-1"}, service.accessTokens)
+	require.Len(t, events.events, 1)
+}
+
+func TestNotificationHandler_Handle_NoAccessToken_Error(t *testing.T) {
+	// Given
+	events := &EventHandlerStub{}
+	h := NewNotificationHandler(&ServiceStub{payment: Payment{ID: 123}}, events, _testWebhookSecret, "")
+
+	// When
+	err := h.Handle(context.Background(), Notification{ID: 1, Type: "payment"}, "123")
+
+	// Then
+	require.EqualError(t, err, "couldn't get payment 123: access token is required")
+	require.Empty(t, events.events)
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	_authorizationURL = "https://auth.mercadopago.com/authorization"
+	_oauthStateTTL    = 10 * time.Minute
+	_oauthMaxStates   = 10000
+)
+
+// OAuthConfig is the marketplace application sellers connect their accounts
+// to. RedirectURI must match the one registered on the application.
+type OAuthConfig struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+}
+
+type OAuthService interface {
+	ExchangeAuthorizationCode(ctx context.Context, credentials Credentials, code string, redirectURI string, codeVerifier string) (OAuthToken, error)
+}
+
+// oauthStates remembers the PKCE verifier of every authorization we started,
+// keyed by its state. A state can only be used once, and at most max of them
+// are kept at a time.
+type oauthStates struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	max       int
+	now       func() time.Time
+	verifiers map[string]oauthState
+	// order holds the states in the order they were added, which is the
+	// order they expire in as they all live for ttl.
+	order []oauthStateEntry
+}
+
+type oauthState struct {
+	verifier  string
+	expiresAt time.Time
+}
+
+type oauthStateEntry struct {
+	state     string
+	expiresAt time.Time
+}
+
+func newOAuthStates(ttl time.Duration, max int) *oauthStates {
+	return &oauthStates{
+		ttl:       ttl,
+		max:       max,
+		now:       time.Now,
+		verifiers: make(map[string]oauthState),
+	}
+}
+
+// add keeps the verifier of a new state. It returns false if there are
+// already max states pending.
+func (s *oauthStates) add(state string, verifier string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	expired := 0
+	for _, e := range s.order {
+		if !now.After(e.expiresAt) {
+			break
+		}
+
+		delete(s.verifiers, e.state)
+		expired++
+	}
+	s.order = s.order[expired:]
+
+	if len(s.order) >= s.max {
+		return false
+	}
+
+	expiresAt := now.Add(s.ttl)
+	s.verifiers[state] = oauthState{verifier: verifier, expiresAt: expiresAt}
+	s.order = append(s.order, oauthStateEntry{state: state, expiresAt: expiresAt})
+	return true
+}
+
+func (s *oauthStates) take(state string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.verifiers[state]
+	if !ok {
+		return "", false
+	}
+
+	delete(s.verifiers, state)
+	if s.now().After(v.expiresAt) {
+		return "", false
+	}
+
+	return v.verifier, true
+}
+
+type OAuthHandler struct {
+	Service          OAuthService
+	Config           OAuthConfig
+	AuthorizationURL string
+	// Sellers keeps the token of every seller that connects so the
+	// marketplace can act on their behalf later. Without it sellers can't
+	// connect.
+	Sellers *TenantVault
+	states  *oauthStates
+}
+
+func NewOAuthHandler(service OAuthService, config OAuthConfig) *OAuthHandler {
+	return &OAuthHandler{
+		Service:          service,
+		Config:           config,
+		AuthorizationURL: _authorizationURL,
+		states:           newOAuthStates(_oauthStateTTL, _oauthMaxStates),
+	}
+}
+
+// Authorize sends the seller to Mercado Pago to grant our application access
+// to their account. Mercado Pago redirects back to Callback.
+func (h *OAuthHandler) Authorize(w http.ResponseWriter, r *http.Request) {
+	state := randomID(16)
+	verifier := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	if !h.states.add(state, verifier) {
+		writeError(w, r, NewError("too many pending authorizations, try again later", http.StatusServiceUnavailable))
+		return
+	}
+
+	query := url.Values{}
+	query.Add("client_id", h.Config.ClientID)
+	query.Add("response_type", "code")
+	query.Add("platform_id", "mp")
+	query.Add("state", state)
+	query.Add("redirect_uri", h.Config.RedirectURI)
+	query.Add("code_challenge", codeChallenge(verifier))
+	query.Add("code_challenge_method", "S256")
+
+	http.Redirect(w, r, fmt.Sprintf("%s?%s", h.AuthorizationURL, query.Encode()), http.StatusFound)
+}
+
+func (h *OAuthHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		writeError(w, r, NewError(fmt.Sprintf("authorization denied: %s", e), http.StatusBadRequest))
+		return
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		writeError(w, r, NewError("code is required", http.StatusBadRequest))
+		return
+	}
+
+	// The tokens aren't handed back to the seller, so without somewhere to
+	// keep them they would be lost. The state is left for when there is.
+	if h.Sellers == nil {
+		writeError(w, r, NewError("seller vault isn't configured", http.StatusServiceUnavailable))
+		return
+	}
+
+	verifier, ok := h.states.take(query.Get("state"))
+	if !ok {
+		writeError(w, r, NewError("invalid or expired state", http.StatusBadRequest))
+		return
+	}
+
+	credentials := Credentials{
+		ClientID:     h.Config.ClientID,
+		ClientSecret: h.Config.ClientSecret,
+	}
+
+	token, err := h.Service.ExchangeAuthorizationCode(r.Context(), credentials, code, h.Config.RedirectURI, verifier)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't exchange authorization code: %w", err))
+		return
+	}
+
+	if _, err := h.Sellers.ConnectSeller(credentials, token); err != nil {
+		writeError(w, r, fmt.Errorf("couldn't connect seller %d: %w", token.UserID, err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ConnectedSeller{
+		UserID:    token.UserID,
+		PublicKey: token.PublicKey,
+		LiveMode:  token.LiveMode,
+	})
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("couldn't read random bytes: %v", err))
+	}
+
+	return b
+}
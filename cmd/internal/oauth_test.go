@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type OAuthServiceStub struct {
+	credentials  Credentials
+	code         string
+	redirectURI  string
+	codeVerifier string
+	token        OAuthToken
+	err          error
+}
+
+func (s *OAuthServiceStub) ExchangeAuthorizationCode(_ context.Context, credentials Credentials, code string, redirectURI string, codeVerifier string) (OAuthToken, error) {
+	s.credentials = credentials
+	s.code = code
+	s.redirectURI = redirectURI
+	s.codeVerifier = codeVerifier
+	return s.token, s.err
+}
+
+var _testOAuthConfig = OAuthConfig{
+	ClientID:     "ABC123",
+	ClientSecret: "123ABC",
+	RedirectURI:  "https://shop.com/oauth/callback",
+}
+
+func newOAuthServer(h *OAuthHandler) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/authorize", h.Authorize)
+	mux.HandleFunc("/oauth/callback", h.Callback)
+	return httptest.NewServer(mux)
+}
+
+// authorize starts an authorization and returns the query of the URL the
+// seller is sent to.
+func authorize(t *testing.T, ts *httptest.Server) url.Values {
+	client := &http.Client{
+		CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(fmt.Sprintf("%s/oauth/authorize", ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "auth.mercadopago.com", location.Host)
+	return location.Query()
+}
+
+func TestOAuthHandler_Authorize(t *testing.T) {
+	// Given
+	ts := newOAuthServer(NewOAuthHandler(&OAuthServiceStub{}, _testOAuthConfig))
+	defer ts.Close()
+
+	// When
+	query := authorize(t, ts)
+
+	// Then
+	require.Equal(t, "ABC123", query.Get("client_id"))
+	require.Equal(t, "code", query.Get("response_type"))
+	require.Equal(t, "https://shop.com/oauth/callback", query.Get("redirect_uri"))
+	require.Equal(t, "S256", query.Get("code_challenge_method"))
+	require.NotEmpty(t, query.Get("state"))
+	require.NotEmpty(t, query.Get("code_challenge"))
+}
+
+func TestOAuthHandler_Authorize_TooManyStates(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	h := NewOAuthHandler(&OAuthServiceStub{}, _testOAuthConfig)
+	h.states.now = func() time.Time { return now }
+	h.states.max = 1
+	ts := newOAuthServer(h)
+	defer ts.Close()
+
+	authorize(t, ts)
+
+	// When
+	resp, err := http.Get(fmt.Sprintf("%s/oauth/authorize", ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(_oauthStateTTL + time.Second)
+
+	// Then
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "too many pending authorizations, try again later", errorResponse(t, b).Message)
+	require.NotEmpty(t, authorize(t, ts).Get("state"))
+	require.Len(t, h.states.verifiers, 1)
+}
+
+func TestOAuthHandler_Callback(t *testing.T) {
+	// Given
+	service := &OAuthServiceStub{token: OAuthToken{AccessToken: "APP_USR-1234", RefreshToken: "TG-1234", UserID: 987, PublicKey: "APP_USR-PUBLIC", LiveMode: true}}
+	h := NewOAuthHandler(service, _testOAuthConfig)
+	h.Sellers = newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	ts := newOAuthServer(h)
+	defer ts.Close()
+
+	query := authorize(t, ts)
+
+	// When
+	resp, err := http.Get(fmt.Sprintf("%s/oauth/callback?code=TG-CODE&state=%s", ts.URL, query.Get("state")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seller ConnectedSeller
+	require.NoError(t, json.Unmarshal(b, &seller))
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, ConnectedSeller{UserID: 987, PublicKey: "APP_USR-PUBLIC", LiveMode: true}, seller)
+	require.NotContains(t, string(b), "APP_USR-1234")
+	require.NotContains(t, string(b), "TG-1234")
+	require.Equal(t, "TG-CODE", service.code)
+	require.Equal(t, "123ABC", service.credentials.ClientSecret)
+	require.Equal(t, "https://shop.com/oauth/callback", service.redirectURI)
+	require.Equal(t, query.Get("code_challenge"), codeChallenge(service.codeVerifier))
+}
+
+func TestOAuthHandler_Callback_StateError(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	h := NewOAuthHandler(&OAuthServiceStub{}, _testOAuthConfig)
+	h.states.now = func() time.Time { return now }
+	h.Sellers = newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	ts := newOAuthServer(h)
+	defer ts.Close()
+
+	used := authorize(t, ts).Get("state")
+	resp, err := http.Get(fmt.Sprintf("%s/oauth/callback?code=TG-CODE&state=%s", ts.URL, used))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	expired := authorize(t, ts).Get("state")
+	now = now.Add(_oauthStateTTL + time.Second)
+
+	tt := []struct {
+		name  string
+		state string
+	}{
+		{name: "unknown", state: "OTHER_STATE"},
+		{name: "already used", state: used},
+		{name: "expired", state: expired},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// When
+			resp, err := http.Get(fmt.Sprintf("%s/oauth/callback?code=TG-CODE&state=%s", ts.URL, tc.state))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Then
+			require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+			require.Equal(t, "invalid or expired state", errorResponse(t, b).Message)
+		})
+	}
+}
+
+func TestOAuthHandler_Callback_Denied(t *testing.T) {
+	// Given
+	service := &OAuthServiceStub{}
+	ts := newOAuthServer(NewOAuthHandler(service, _testOAuthConfig))
+	defer ts.Close()
+
+	// When
+	resp, err := http.Get(fmt.Sprintf("%s/oauth/callback?error=access_denied&state=%s", ts.URL, authorize(t, ts).Get("state")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "authorization denied: access_denied", errorResponse(t, b).Message)
+	require.Empty(t, service.code)
+}
+
+func TestOAuthHandler_Callback_ExchangeError(t *testing.T) {
+	// Given
+	service := &OAuthServiceStub{err: upstreamError(http.StatusBadRequest, []byte(`{"error": "invalid_grant", "error_description": "invalid authorization code"}`))}
+	h := NewOAuthHandler(service, _testOAuthConfig)
+	h.Sellers = newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	ts := newOAuthServer(h)
+	defer ts.Close()
+
+	// When
+	resp, err := http.Get(fmt.Sprintf("%s/oauth/callback?code=TG-CODE&state=%s", ts.URL, authorize(t, ts).Get("state")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	e := errorResponse(t, b)
+	require.Equal(t, "bad_request", e.Code)
+	require.Equal(t, "couldn't exchange authorization code: invalid authorization code", e.Message)
+	require.Equal(t, &UpstreamError{Status: http.StatusBadRequest, Code: "invalid_grant", Message: "invalid authorization code"}, e.Cause)
+}
+
+func TestOAuthHandler_Callback_ConnectSeller(t *testing.T) {
+	// Given
+	service := &OAuthServiceStub{token: OAuthToken{AccessToken: "APP_USR-1234", RefreshToken: "TG-1234", UserID: 987}}
+	h := NewOAuthHandler(service, _testOAuthConfig)
+	h.Sellers = newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	ts := newOAuthServer(h)
+	defer ts.Close()
+
+	// When
+	resp, err := http.Get(fmt.Sprintf("%s/oauth/callback?code=TG-CODE&state=%s", ts.URL, authorize(t, ts).Get("state")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	seller, err := h.Sellers.Get("seller987")
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "APP_USR-1234", seller.Token.AccessToken)
+	require.Equal(t, Credentials{ClientID: "ABC123", ClientSecret: "123ABC"}, seller.Credentials)
+}
+
+func TestOAuthHandler_Callback_NoVault_Error(t *testing.T) {
+	// Given
+	service := &OAuthServiceStub{token: OAuthToken{AccessToken: "APP_USR-1234", RefreshToken: "TG-1234", UserID: 987}}
+	h := NewOAuthHandler(service, _testOAuthConfig)
+	ts := newOAuthServer(h)
+	defer ts.Close()
+
+	state := authorize(t, ts).Get("state")
+
+	// When
+	resp, err := http.Get(fmt.Sprintf("%s/oauth/callback?code=TG-CODE&state=%s", ts.URL, state))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Then
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "seller vault isn't configured", errorResponse(t, b).Message)
+	require.Empty(t, service.code)
+	require.Contains(t, h.states.verifiers, state)
+}
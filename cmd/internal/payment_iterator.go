@@ -0,0 +1,77 @@
+package internal
+
+import "context"
+
+const _defaultSearchLimit = 50
+
+type PaymentSearcher interface {
+	SearchPayments(ctx context.Context, accessToken string, search PaymentSearch) (PaymentSearchResult, error)
+}
+
+// PaymentIterator walks every page of a payment search, fetching the next
+// page only once the current one has been consumed.
+type PaymentIterator struct {
+	ctx         context.Context
+	searcher    PaymentSearcher
+	accessToken string
+	search      PaymentSearch
+	page        []Payment
+	current     Payment
+	done        bool
+	err         error
+}
+
+func NewPaymentIterator(ctx context.Context, searcher PaymentSearcher, accessToken string, search PaymentSearch) *PaymentIterator {
+	if search.Limit == 0 {
+		search.Limit = _defaultSearchLimit
+	}
+
+	return &PaymentIterator{
+		ctx:         ctx,
+		searcher:    searcher,
+		accessToken: accessToken,
+		search:      search,
+	}
+}
+
+// Next advances the iterator. It returns false when there are no more
+// payments or when a search failed, in which case Err reports the error.
+func (it *PaymentIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if len(it.page) == 0 {
+		if it.done {
+			return false
+		}
+
+		result, err := it.searcher.SearchPayments(it.ctx, it.accessToken, it.search)
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.page = result.Results
+		it.search.Offset += len(result.Results)
+		if len(result.Results) == 0 || it.search.Offset >= result.Paging.Total {
+			it.done = true
+		}
+
+		if len(it.page) == 0 {
+			return false
+		}
+	}
+
+	it.current = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+func (it *PaymentIterator) Payment() Payment {
+	return it.current
+}
+
+func (it *PaymentIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type PaymentSearcherStub struct {
+	pages    [][]Payment
+	total    int
+	err      error
+	searches []PaymentSearch
+}
+
+func (s *PaymentSearcherStub) SearchPayments(_ context.Context, _ string, search PaymentSearch) (PaymentSearchResult, error) {
+	s.searches = append(s.searches, search)
+	if s.err != nil {
+		return PaymentSearchResult{}, s.err
+	}
+
+	page := len(s.searches) - 1
+	if page >= len(s.pages) {
+		return PaymentSearchResult{Paging: Paging{Total: s.total}}, nil
+	}
+
+	return PaymentSearchResult{
+		Results: s.pages[page],
+		Paging:  Paging{Total: s.total, Limit: search.Limit, Offset: search.Offset},
+	}, nil
+}
+
+func TestPaymentIterator(t *testing.T) {
+	// Given
+	s := &PaymentSearcherStub{
+		pages: [][]Payment{
+			{{ID: 1}, {ID: 2}},
+			{{ID: 3}, {ID: 4}},
+			{{ID: 5}},
+		},
+		total: 5,
+	}
+	it := NewPaymentIterator(context.Background(), s, "MY_ACCESS_TOKEN", PaymentSearch{Status: "approved", Limit: 2})
+
+	// When
+	var ids []int64
+	for it.Next() {
+		ids = append(ids, it.Payment().ID)
+	}
+
+	// Then
+	require.NoError(t, it.Err())
+	require.Equal(t, []int64{1, 2, 3, 4, 5}, ids)
+	require.Len(t, s.searches, 3)
+	require.Equal(t, 0, s.searches[0].Offset)
+	require.Equal(t, 2, s.searches[1].Offset)
+	require.Equal(t, 4, s.searches[2].Offset)
+	require.Equal(t, "approved", s.searches[2].Status)
+}
+
+func TestPaymentIterator_DefaultLimit(t *testing.T) {
+	// Given
+	s := &PaymentSearcherStub{}
+	it := NewPaymentIterator(context.Background(), s, "MY_ACCESS_TOKEN", PaymentSearch{})
+
+	// When
+	next := it.Next()
+
+	// Then
+	require.False(t, next)
+	require.NoError(t, it.Err())
+	require.Equal(t, _defaultSearchLimit, s.searches[0].Limit)
+}
+
+func TestPaymentIterator_SearchError(t *testing.T) {
+	// Given
+	s := &PaymentSearcherStub{err: errors.New("search error")}
+	it := NewPaymentIterator(context.Background(), s, "MY_ACCESS_TOKEN", PaymentSearch{})
+
+	// When
+	next := it.Next()
+
+	// Then
+	require.False(t, next)
+	require.EqualError(t, it.Err(), "search error")
+}
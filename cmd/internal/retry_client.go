@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	_retryMaxAttempts     = 3
+	_retryBaseBackoff     = 200 * time.Millisecond
+	_retryMaxBackoff      = 5 * time.Second
+	_idempotencyKeyHeader = "X-Idempotency-Key"
+)
+
+// RetryClient retries the calls to Mercado Pago that failed on the way or got
+// a 429 or 5xx back, waiting a jittered exponential backoff or whatever
+// Retry-After asks for in between. Only requests that are safe to repeat are
+// retried: GET, HEAD, OPTIONS, PUT and DELETE, and POSTs carrying an
+// X-Idempotency-Key, which Mercado Pago uses to process them only once.
+// Errors of our own making, like a BreakerClient refusing the call, aren't
+// retried.
+type RetryClient struct {
+	Client      Client
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	jitter      func(d time.Duration) time.Duration
+	sleep       func(ctx context.Context, d time.Duration) error
+}
+
+func NewRetryClient(client Client) *RetryClient {
+	return &RetryClient{
+		Client:      client,
+		maxAttempts: _retryMaxAttempts,
+		baseBackoff: _retryBaseBackoff,
+		maxBackoff:  _retryMaxBackoff,
+		jitter:      jitter,
+		sleep:       sleep,
+	}
+}
+
+func (c *RetryClient) Do(req *http.Request) (*http.Response, error) {
+	retryable := isRetryable(req)
+	for attempt := 1; ; attempt++ {
+		resp, err := c.Client.Do(req)
+		if !retryable || attempt >= c.maxAttempts || req.Context().Err() != nil || isOwnError(err) {
+			return resp, err
+		}
+
+		wait := c.jitter(backoff(c.baseBackoff, c.maxBackoff, attempt))
+		if err == nil {
+			if !shouldRetryStatus(resp.StatusCode) {
+				return resp, nil
+			}
+
+			if d, ok := retryAfter(resp, time.Now()); ok {
+				if d > c.maxBackoff {
+					return resp, nil
+				}
+
+				wait = d
+			}
+
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		if err := c.sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func isOwnError(err error) bool {
+	var e *Error
+	return errors.As(err, &e)
+}
+
+func isRetryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return req.Header.Get(_idempotencyKeyHeader) != ""
+	default:
+		return false
+	}
+}
+
+func shouldRetryStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter reads the Retry-After header, given either in seconds or as an
+// HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	at, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+
+	if d := at.Sub(now); d > 0 {
+		return d, true
+	}
+
+	return 0, true
+}
+
+// rewind copies req with a fresh body so it can be sent again.
+func rewind(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.GetBody == nil {
+		return r, nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body = body
+	return r, nil
+}
+
+// jitter picks a random duration between d/2 and d, so clients that failed
+// together don't all come back at once.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type idempotencyKey struct{}
+
+// withIdempotencyKey makes the POSTs to Mercado Pago made with ctx use key,
+// so a caller that retries its own request gets the first result back
+// instead of, say, paying twice.
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// setIdempotencyKey gives a POST its own X-Idempotency-Key unless it already
+// has one. The key goes with every retry of the request. A key from the
+// context is mixed with the path, so the different POSTs one request makes
+// don't share it.
+func setIdempotencyKey(req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get(_idempotencyKeyHeader) != "" {
+		return
+	}
+
+	key, ok := req.Context().Value(idempotencyKey{}).(string)
+	if !ok {
+		req.Header.Set(_idempotencyKeyHeader, randomID(16))
+		return
+	}
+
+	sum := sha256.Sum256([]byte(key + " " + req.URL.Path))
+	req.Header.Set(_idempotencyKeyHeader, hex.EncodeToString(sum[:16]))
+}
@@ -0,0 +1,339 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mateoferrari97/mercadopago/cmd/internal/fakemp"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type SequenceClientStub struct {
+	reqs   []*http.Request
+	bodies []string
+	resps  []*http.Response
+	errs   []error
+}
+
+func (c *SequenceClientStub) Do(req *http.Request) (*http.Response, error) {
+	n := len(c.reqs)
+	c.reqs = append(c.reqs, req)
+	if req.Body != nil {
+		b, _ := ioutil.ReadAll(req.Body)
+		c.bodies = append(c.bodies, string(b))
+	}
+
+	if n < len(c.errs) && c.errs[n] != nil {
+		return nil, c.errs[n]
+	}
+
+	return c.resps[n], nil
+}
+
+func newResponse(status int, header http.Header) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{}`))),
+	}
+}
+
+func newTestRetryClient(c Client, waits *[]time.Duration) *RetryClient {
+	r := NewRetryClient(c)
+	r.jitter = func(d time.Duration) time.Duration { return d }
+	r.sleep = func(_ context.Context, d time.Duration) error {
+		*waits = append(*waits, d)
+		return nil
+	}
+
+	return r
+}
+
+func TestRetryClient_Do(t *testing.T) {
+	tt := []struct {
+		name         string
+		method       string
+		key          string
+		resps        []*http.Response
+		errs         []error
+		wantStatus   int
+		wantAttempts int
+		wantWaits    []time.Duration
+	}{
+		{
+			name:         "get retried until it succeeds",
+			method:       http.MethodGet,
+			resps:        []*http.Response{newResponse(503, nil), newResponse(502, nil), newResponse(200, nil)},
+			wantStatus:   http.StatusOK,
+			wantAttempts: 3,
+			wantWaits:    []time.Duration{_retryBaseBackoff, 2 * _retryBaseBackoff},
+		},
+		{
+			name:         "get retried after a network error",
+			method:       http.MethodGet,
+			resps:        []*http.Response{nil, newResponse(200, nil)},
+			errs:         []error{errors.New("connection reset by peer")},
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+			wantWaits:    []time.Duration{_retryBaseBackoff},
+		},
+		{
+			name:         "gives up after the last attempt",
+			method:       http.MethodGet,
+			resps:        []*http.Response{newResponse(500, nil), newResponse(500, nil), newResponse(500, nil)},
+			wantStatus:   http.StatusInternalServerError,
+			wantAttempts: 3,
+			wantWaits:    []time.Duration{_retryBaseBackoff, 2 * _retryBaseBackoff},
+		},
+		{
+			name:         "client errors are not retried",
+			method:       http.MethodGet,
+			resps:        []*http.Response{newResponse(404, nil)},
+			wantStatus:   http.StatusNotFound,
+			wantAttempts: 1,
+		},
+		{
+			name:         "post without idempotency key is not retried",
+			method:       http.MethodPost,
+			resps:        []*http.Response{newResponse(503, nil)},
+			wantStatus:   http.StatusServiceUnavailable,
+			wantAttempts: 1,
+		},
+		{
+			name:         "post with idempotency key is retried",
+			method:       http.MethodPost,
+			key:          "MY_KEY",
+			resps:        []*http.Response{newResponse(503, nil), newResponse(201, nil)},
+			wantStatus:   http.StatusCreated,
+			wantAttempts: 2,
+			wantWaits:    []time.Duration{_retryBaseBackoff},
+		},
+		{
+			name:         "retry after in seconds",
+			method:       http.MethodGet,
+			resps:        []*http.Response{newResponse(429, http.Header{"Retry-After": []string{"2"}}), newResponse(200, nil)},
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+			wantWaits:    []time.Duration{2 * time.Second},
+		},
+		{
+			name:         "retry after longer than we wait",
+			method:       http.MethodGet,
+			resps:        []*http.Response{newResponse(429, http.Header{"Retry-After": []string{"120"}})},
+			wantStatus:   http.StatusTooManyRequests,
+			wantAttempts: 1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			c := &SequenceClientStub{resps: tc.resps, errs: tc.errs}
+			var waits []time.Duration
+			r := newTestRetryClient(c, &waits)
+
+			req, err := http.NewRequestWithContext(context.Background(), tc.method, "https://api.mercadopago.com/v1/payments", bytes.NewReader([]byte(`{"transaction_amount": 100}`)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.key != "" {
+				req.Header.Set(_idempotencyKeyHeader, tc.key)
+			}
+
+			// When
+			resp, err := r.Do(req)
+
+			// Then
+			require.NoError(t, err)
+			require.Equal(t, tc.wantStatus, resp.StatusCode)
+			require.Len(t, c.reqs, tc.wantAttempts)
+			require.Equal(t, tc.wantWaits, waits)
+			for i := range c.reqs {
+				require.Equal(t, `{"transaction_amount": 100}`, c.bodies[i])
+				require.Equal(t, tc.key, c.reqs[i].Header.Get(_idempotencyKeyHeader))
+			}
+		})
+	}
+}
+
+func TestRetryClient_Do_Canceled(t *testing.T) {
+	// Given
+	c := &SequenceClientStub{resps: []*http.Response{newResponse(503, nil), newResponse(200, nil)}}
+	r := NewRetryClient(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	r.sleep = func(ctx context.Context, _ time.Duration) error {
+		cancel()
+		return ctx.Err()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.mercadopago.com/v1/payments/123", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// When
+	_, err = r.Do(req)
+
+	// Then
+	require.True(t, errors.Is(err, context.Canceled))
+	require.Len(t, c.reqs, 1)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 6, 14, 10, 0, 0, 0, time.UTC)
+	tt := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: ""},
+		{value: "3", want: 3 * time.Second, wantOK: true},
+		{value: "Sun, 14 Jun 2020 10:00:30 GMT", want: 30 * time.Second, wantOK: true},
+		{value: "Sun, 14 Jun 2020 09:00:00 GMT", want: 0, wantOK: true},
+		{value: "soon"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.value, func(t *testing.T) {
+			// When
+			d, ok := retryAfter(newResponse(503, http.Header{"Retry-After": []string{tc.value}}), now)
+
+			// Then
+			require.Equal(t, tc.wantOK, ok)
+			require.Equal(t, tc.want, d)
+		})
+	}
+}
+
+func TestGateway_IdempotencyKey(t *testing.T) {
+	// Given
+	c := &SequenceClientStub{resps: []*http.Response{newResponse(201, nil), newResponse(201, nil), newResponse(200, nil)}}
+	g := &Gateway{Client: c}
+
+	// When
+	_, err := g.CreatePayment(context.Background(), "MY_ACCESS_TOKEN", NewPayment{})
+	require.NoError(t, err)
+	_, err = g.CreatePayment(context.Background(), "MY_ACCESS_TOKEN", NewPayment{})
+	require.NoError(t, err)
+	_, err = g.GetPayment(context.Background(), "MY_ACCESS_TOKEN", 123)
+	require.NoError(t, err)
+
+	// Then
+	first := c.reqs[0].Header.Get(_idempotencyKeyHeader)
+	require.Len(t, first, 32)
+	require.NotEqual(t, first, c.reqs[1].Header.Get(_idempotencyKeyHeader))
+	require.Empty(t, c.reqs[2].Header.Get(_idempotencyKeyHeader))
+}
+
+func TestGateway_IdempotencyKey_FromContext(t *testing.T) {
+	// Given
+	c := &SequenceClientStub{resps: []*http.Response{newResponse(201, nil), newResponse(201, nil), newResponse(201, nil), newResponse(201, nil)}}
+	g := &Gateway{Client: c}
+	ctx := withIdempotencyKey(context.Background(), "ORDER-1")
+
+	// When
+	_, err := g.CreatePayment(ctx, "MY_ACCESS_TOKEN", NewPayment{})
+	require.NoError(t, err)
+	_, err = g.CreatePayment(ctx, "MY_ACCESS_TOKEN", NewPayment{})
+	require.NoError(t, err)
+	_, err = g.CreateRefund(ctx, "MY_ACCESS_TOKEN", 123, NewRefund{})
+	require.NoError(t, err)
+	_, err = g.CreatePayment(withIdempotencyKey(context.Background(), "ORDER-2"), "MY_ACCESS_TOKEN", NewPayment{})
+	require.NoError(t, err)
+
+	// Then
+	first := c.reqs[0].Header.Get(_idempotencyKeyHeader)
+	require.Len(t, first, 32)
+	require.Equal(t, first, c.reqs[1].Header.Get(_idempotencyKeyHeader))
+	require.NotEqual(t, first, c.reqs[2].Header.Get(_idempotencyKeyHeader))
+	require.NotEqual(t, first, c.reqs[3].Header.Get(_idempotencyKeyHeader))
+}
+
+func TestWithIdempotencyKey_FakeServer(t *testing.T) {
+	// Given
+	fake := fakemp.NewServer()
+	upstream := httptest.NewServer(fake)
+	defer upstream.Close()
+
+	g := NewClientGateway(NewRetryClient(&http.Client{}))
+	g.BaseURL = upstream.URL
+	token, err := g.GetToken(context.Background(), Credentials{ClientID: "ABC123", ClientSecret: "123ABC"})
+	require.NoError(t, err)
+
+	h := NewHandler(NewController(g))
+	ts := httptest.NewServer(WithIdempotencyKey(http.HandlerFunc(h.CreatePayment)))
+	defer ts.Close()
+
+	body, err := json.Marshal(newPayment())
+	require.NoError(t, err)
+
+	create := func(key string) int64 {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/payments", ts.URL), bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Add("access_token", token.AccessToken)
+		req.Header.Add(_idempotencyKeyHeader, key)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var payment Payment
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&payment))
+		return payment.ID
+	}
+
+	// When
+	first := create("ORDER-1")
+	retried := create("ORDER-1")
+	other := create("ORDER-2")
+
+	// Then
+	require.Equal(t, first, retried)
+	require.NotEqual(t, first, other)
+}
+
+func TestRetryClient_FakeServer(t *testing.T) {
+	// Given
+	fake := fakemp.NewServer()
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	retry := NewRetryClient(&http.Client{})
+	retry.sleep = func(_ context.Context, _ time.Duration) error { return nil }
+	g := NewClientGateway(retry)
+	g.BaseURL = ts.URL
+
+	token, err := g.GetToken(context.Background(), Credentials{ClientID: "ABC123", ClientSecret: "123ABC"})
+	require.NoError(t, err)
+
+	// When
+	fake.Inject(fakemp.Fault{Method: "POST", Path: "/v1/payments", Status: http.StatusServiceUnavailable, Times: 2})
+	created, err := g.CreatePayment(context.Background(), token.AccessToken, newPayment())
+	require.NoError(t, err)
+
+	fake.Inject(fakemp.Fault{Method: "GET", Path: "/v1/payments", Status: http.StatusBadGateway, Times: 1})
+	got, err := g.GetPayment(context.Background(), token.AccessToken, created.ID)
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, "approved", created.Status)
+	require.Equal(t, created.ID, got.ID)
+}
@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// _storeCompactAfter is how many records get appended before the file is
+// compacted again, unless it holds more live records than that.
+const _storeCompactAfter = 1000
+
+type storeRecord struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+// fileStore is an embedded key/value store backed by an append-only JSON
+// lines file. Every write is appended and synced before it is visible, and
+// the file is compacted down to the live records each time it is opened and
+// once enough records were appended since.
+type fileStore struct {
+	mu           sync.Mutex
+	path         string
+	file         *os.File
+	records      map[string]json.RawMessage
+	appended     int
+	compactAfter int
+}
+
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{
+		path:         path,
+		records:      make(map[string]json.RawMessage),
+		compactAfter: _storeCompactAfter,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var torn error
+	for line := 1; scanner.Scan(); line++ {
+		// A crash mid-append can only tear the last line, anything before
+		// it was synced and is still good.
+		if torn != nil {
+			return torn
+		}
+
+		var r storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			torn = fmt.Errorf("couldn't read %s line %d: %v", s.path, line, err)
+			continue
+		}
+
+		if r.Deleted {
+			delete(s.records, r.Key)
+			continue
+		}
+
+		s.records[r.Key] = r.Value
+	}
+
+	return scanner.Err()
+}
+
+// compact rewrites the file with only the live records and keeps appending
+// to the new one.
+func (s *fileStore) compact() error {
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, key := range s.keys() {
+		if err := writeRecord(w, storeRecord{Key: key, Value: s.records[key]}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		return err
+	}
+
+	// f is the file at path now, so nothing appended from here on goes to
+	// the one it replaced. Reopening it by path only makes errors name the
+	// right file.
+	if reopened, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600); err == nil {
+		f.Close()
+		f = reopened
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+
+	s.file = f
+	s.appended = 0
+	return nil
+}
+
+// maybeCompact compacts the file once more records were appended than the
+// store holds, and at least compactAfter of them. The records are already
+// safe in the current file, so a failure only gets logged.
+func (s *fileStore) maybeCompact() {
+	if s.appended < s.compactAfter || s.appended < len(s.records) {
+		return
+	}
+
+	if err := s.compact(); err != nil {
+		log.Printf("couldn't compact %s: %v", s.path, err)
+	}
+}
+
+func (s *fileStore) Put(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.append(storeRecord{Key: key, Value: b}); err != nil {
+		return err
+	}
+
+	s.records[key] = b
+	s.maybeCompact()
+	return nil
+}
+
+// Get decodes the record stored under key into v and reports whether it
+// existed.
+func (s *fileStore) Get(key string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	b, ok := s.records[key]
+	s.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(b, v)
+}
+
+func (s *fileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[key]; !ok {
+		return nil
+	}
+
+	if err := s.append(storeRecord{Key: key, Deleted: true}); err != nil {
+		return err
+	}
+
+	delete(s.records, key)
+	s.maybeCompact()
+	return nil
+}
+
+// Each calls fn with every record in key order, stopping at the first error.
+func (s *fileStore) Each(fn func(key string, value json.RawMessage) error) error {
+	s.mu.Lock()
+	keys := s.keys()
+	values := make([]json.RawMessage, len(keys))
+	for i, key := range keys {
+		values[i] = s.records[key]
+	}
+	s.mu.Unlock()
+
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+func (s *fileStore) append(r storeRecord) error {
+	w := bufio.NewWriter(s.file)
+	if err := writeRecord(w, r); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	s.appended++
+	return nil
+}
+
+func (s *fileStore) keys() []string {
+	keys := make([]string, 0, len(s.records))
+	for key := range s.records {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func writeRecord(w *bufio.Writer, r storeRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+
+	return w.WriteByte('\n')
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore_Reopen(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	s, err := openFileStore(path)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Put("a", Item{Title: "first"}))
+	require.NoError(t, s.Put("b", Item{Title: "second"}))
+	require.NoError(t, s.Put("a", Item{Title: "updated"}))
+	require.NoError(t, s.Delete("b"))
+	require.NoError(t, s.Close())
+
+	// When
+	s, err = openFileStore(path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var a, b Item
+	okA, errA := s.Get("a", &a)
+	okB, errB := s.Get("b", &b)
+
+	// Then
+	require.NoError(t, errA)
+	require.NoError(t, errB)
+	require.True(t, okA)
+	require.False(t, okB)
+	require.Equal(t, "updated", a.Title)
+}
+
+func TestFileStore_TornLastLine(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	content := `{"key":"a","value":{"title":"first"}}` + "\n" + `{"key":"b","val`
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+	// When
+	s, err := openFileStore(path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var keys []string
+	require.NoError(t, s.Each(func(key string, _ json.RawMessage) error {
+		keys = append(keys, key)
+		return nil
+	}))
+
+	// Then
+	require.Equal(t, []string{"a"}, keys)
+}
+
+func TestFileStore_CorruptedLine(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	content := `{"key":"a","val` + "\n" + `{"key":"b","value":{"title":"second"}}` + "\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+	// When
+	_, err := openFileStore(path)
+
+	// Then
+	require.Error(t, err)
+	_, statErr := os.Stat(path)
+	require.NoError(t, statErr)
+}
+
+func TestFileStore_CompactsWhileOpen(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "store.jsonl")
+	s, err := openFileStore(path)
+	require.NoError(t, err)
+
+	s.compactAfter = 10
+
+	// When
+	for i := 0; i < 25; i++ {
+		require.NoError(t, s.Put("a", Item{Quantity: i}))
+	}
+	require.NoError(t, s.Put("b", Item{Title: "second"}))
+	require.NoError(t, s.Close())
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	s, err = openFileStore(path)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var a Item
+	ok, err := s.Get("a", &a)
+
+	// Then
+	require.LessOrEqual(t, bytes.Count(b, []byte("\n")), 10)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, 24, a.Quantity)
+}
@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const _tokenRefreshSkew = 5 * time.Minute
+
+// TokenOptions says how Token may get a new token.
+type TokenOptions struct {
+	// NoClientCredentials keeps Token from asking for a client_credentials
+	// token once there is no refresh token. That token is the one of whoever
+	// owns the credentials, which for a connected seller is the marketplace,
+	// not the seller.
+	NoClientCredentials bool
+}
+
+type TokenGateway interface {
+	GetToken(ctx context.Context, credentials Credentials) (OAuthToken, error)
+	RefreshAccessToken(ctx context.Context, credentials Credentials, refreshToken string) (OAuthToken, error)
+}
+
+// TokenSource caches an access token per credential set and gets a new one
+// shortly before it expires, using the refresh token when Mercado Pago gave
+// us one. Concurrent callers share a single in-flight request, which isn't
+// tied to any of them: a caller that goes away stops waiting, the rest still
+// get the token.
+type TokenSource struct {
+	Gateway TokenGateway
+	skew    time.Duration
+	now     func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+type cachedToken struct {
+	token     OAuthToken
+	expiresAt time.Time
+	// refreshing is closed once the in-flight request is done, it is nil
+	// when there is none.
+	refreshing chan struct{}
+	err        error
+}
+
+func (c *cachedToken) valid(now time.Time) bool {
+	return c.token.AccessToken != "" && now.Before(c.expiresAt)
+}
+
+func NewTokenSource(gateway TokenGateway) *TokenSource {
+	return &TokenSource{
+		Gateway: gateway,
+		skew:    _tokenRefreshSkew,
+		now:     time.Now,
+		tokens:  make(map[string]*cachedToken),
+	}
+}
+
+// Put seeds the cache with a token obtained elsewhere, like the one returned
+// by the authorization_code flow, so it gets refreshed with the rest.
+func (s *TokenSource) Put(credentials Credentials, token OAuthToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.entry(credentialsKey(credentials))
+	c.token = token
+	c.expiresAt = expiresAt(token, s.now())
+}
+
+// seed is Put for a token obtained at obtainedAt that we may already hold a
+// fresher copy of.
+func (s *TokenSource) seed(key string, token OAuthToken, obtainedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.entry(key)
+	if c.token.AccessToken != "" || token.AccessToken == "" {
+		return
+	}
+
+	c.token = token
+	c.expiresAt = expiresAt(token, obtainedAt)
+}
+
+func (s *TokenSource) AccessToken(ctx context.Context, credentials Credentials) (string, error) {
+	token, err := s.Token(ctx, credentialsKey(credentials), credentials, TokenOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	return token.AccessToken, nil
+}
+
+// Token returns the token cached under key, getting a new one with
+// credentials when needed. Tokens for the same credentials that must not be
+// shared, like each seller's, are kept under different keys.
+func (s *TokenSource) Token(ctx context.Context, key string, credentials Credentials, options TokenOptions) (OAuthToken, error) {
+	s.mu.Lock()
+	c := s.entry(key)
+	now := s.now()
+
+	if c.valid(now.Add(s.skew)) {
+		token := c.token
+		s.mu.Unlock()
+		return token, nil
+	}
+
+	if c.refreshing != nil && c.valid(now) {
+		// Somebody is already refreshing. A token that didn't expire yet is
+		// still good for this call.
+		token := c.token
+		s.mu.Unlock()
+		return token, nil
+	}
+
+	if c.refreshing == nil {
+		c.refreshing = make(chan struct{})
+		go s.refresh(c, credentials, c.token, options)
+	}
+
+	refreshing := c.refreshing
+	s.mu.Unlock()
+
+	select {
+	case <-refreshing:
+	case <-ctx.Done():
+		return OAuthToken{}, ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.err != nil && !c.valid(s.now()) {
+		return OAuthToken{}, c.err
+	}
+
+	return c.token, nil
+}
+
+// refresh gets a new token for c, keeping the current one if that fails. It
+// runs on a context of its own, which the gateway bounds with the Token
+// timeout.
+func (s *TokenSource) refresh(c *cachedToken, credentials Credentials, current OAuthToken, options TokenOptions) {
+	token, err := s.fetch(context.Background(), credentials, current, options)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.err = err
+	if err == nil {
+		c.token = token
+		c.expiresAt = expiresAt(token, s.now())
+	} else if c.valid(s.now()) {
+		log.Printf("couldn't refresh access token, using the current one: %v", err)
+	}
+
+	close(c.refreshing)
+	c.refreshing = nil
+}
+
+func (s *TokenSource) fetch(ctx context.Context, credentials Credentials, current OAuthToken, options TokenOptions) (OAuthToken, error) {
+	if current.RefreshToken == "" {
+		if options.NoClientCredentials {
+			return OAuthToken{}, &Error{
+				Message:    "the token can't be refreshed, the account must be reconnected",
+				StatusCode: http.StatusUnauthorized,
+				Code:       "reconnect_required",
+			}
+		}
+
+		return s.Gateway.GetToken(ctx, credentials)
+	}
+
+	token, err := s.Gateway.RefreshAccessToken(ctx, credentials, current.RefreshToken)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+
+	if token.RefreshToken == "" {
+		token.RefreshToken = current.RefreshToken
+	}
+
+	return token, nil
+}
+
+func (s *TokenSource) entry(key string) *cachedToken {
+	c, ok := s.tokens[key]
+	if !ok {
+		c = &cachedToken{}
+		s.tokens[key] = c
+	}
+
+	return c
+}
+
+func credentialsKey(credentials Credentials) string {
+	return fmt.Sprintf("credentials:%s:%s", credentials.ClientID, credentials.ClientSecret)
+}
+
+// expiresAt is when a token obtained at obtainedAt stops being usable. Tokens
+// without expires_in are kept for an hour.
+func expiresAt(token OAuthToken, obtainedAt time.Time) time.Time {
+	if token.ExpiresIn <= 0 {
+		return obtainedAt.Add(time.Hour)
+	}
+
+	return obtainedAt.Add(time.Duration(token.ExpiresIn) * time.Second)
+}
+
+// ConfiguredToken gets access tokens for the credentials the service was
+// started with, for requests that don't bring their own.
+type ConfiguredToken struct {
+	Tokens      *TokenSource
+	Credentials Credentials
+}
+
+func (c *ConfiguredToken) AccessToken(ctx context.Context) (string, error) {
+	if c == nil || c.Tokens == nil || c.Credentials.ClientID == "" {
+		return "", NewError("access token is required", http.StatusUnauthorized)
+	}
+
+	return c.Tokens.AccessToken(ctx, c.Credentials)
+}
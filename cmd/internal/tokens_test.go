@@ -0,0 +1,269 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type TokenGatewayStub struct {
+	mu            sync.Mutex
+	tokens        []OAuthToken
+	err           error
+	block         chan struct{}
+	calls         int
+	refreshTokens []string
+}
+
+func (g *TokenGatewayStub) GetToken(ctx context.Context, _ Credentials) (OAuthToken, error) {
+	return g.next(ctx, "")
+}
+
+func (g *TokenGatewayStub) RefreshAccessToken(ctx context.Context, _ Credentials, refreshToken string) (OAuthToken, error) {
+	return g.next(ctx, refreshToken)
+}
+
+func (g *TokenGatewayStub) next(ctx context.Context, refreshToken string) (OAuthToken, error) {
+	if g.block != nil {
+		select {
+		case <-g.block:
+		case <-ctx.Done():
+			return OAuthToken{}, ctx.Err()
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.calls++
+	g.refreshTokens = append(g.refreshTokens, refreshToken)
+	if g.err != nil {
+		return OAuthToken{}, g.err
+	}
+
+	token := g.tokens[0]
+	if len(g.tokens) > 1 {
+		g.tokens = g.tokens[1:]
+	}
+
+	return token, nil
+}
+
+var _testCredentials = Credentials{ClientID: "ABC123", ClientSecret: "123ABC"}
+
+func newTestTokenSource(g TokenGateway, now *time.Time) *TokenSource {
+	s := NewTokenSource(g)
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestTokenSource_AccessToken_Cached(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	g := &TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "FIRST", ExpiresIn: 21600}, {AccessToken: "SECOND", ExpiresIn: 21600}}}
+	s := newTestTokenSource(g, &now)
+
+	// When
+	first, err := s.AccessToken(context.Background(), _testCredentials)
+	require.NoError(t, err)
+	now = now.Add(time.Hour)
+	second, err := s.AccessToken(context.Background(), _testCredentials)
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, "FIRST", first)
+	require.Equal(t, "FIRST", second)
+	require.Equal(t, 1, g.calls)
+}
+
+func TestTokenSource_AccessToken_RefreshAhead(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	g := &TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "SECOND", ExpiresIn: 21600}}}
+	s := newTestTokenSource(g, &now)
+	s.Put(_testCredentials, OAuthToken{AccessToken: "FIRST", RefreshToken: "TG-1234", ExpiresIn: 600})
+
+	// When
+	before, err := s.AccessToken(context.Background(), _testCredentials)
+	require.NoError(t, err)
+	now = now.Add(6 * time.Minute)
+	after, err := s.AccessToken(context.Background(), _testCredentials)
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, "FIRST", before)
+	require.Equal(t, "SECOND", after)
+	require.Equal(t, []string{"TG-1234"}, g.refreshTokens)
+	require.Equal(t, "TG-1234", s.tokens[credentialsKey(_testCredentials)].token.RefreshToken)
+}
+
+func TestTokenSource_AccessToken_RefreshError(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	g := &TokenGatewayStub{err: NewError("invalid_grant", http.StatusBadRequest)}
+	s := newTestTokenSource(g, &now)
+	s.Put(_testCredentials, OAuthToken{AccessToken: "FIRST", RefreshToken: "TG-1234", ExpiresIn: 600})
+
+	// When
+	now = now.Add(6 * time.Minute)
+	stale, staleErr := s.AccessToken(context.Background(), _testCredentials)
+	now = now.Add(5 * time.Minute)
+	_, expiredErr := s.AccessToken(context.Background(), _testCredentials)
+
+	// Then
+	require.NoError(t, staleErr)
+	require.Equal(t, "FIRST", stale)
+	require.EqualError(t, expiredErr, "invalid_grant")
+	require.Equal(t, 2, g.calls)
+}
+
+func TestTokenSource_AccessToken_SingleFlight(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	g := &TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "FIRST", ExpiresIn: 21600}}, block: make(chan struct{})}
+	s := newTestTokenSource(g, &now)
+
+	// When
+	var wg sync.WaitGroup
+	tokens := make([]string, 20)
+	errs := make([]error, 20)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = s.AccessToken(context.Background(), _testCredentials)
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(g.block)
+	wg.Wait()
+
+	// Then
+	require.Equal(t, 1, g.calls)
+	for i := range tokens {
+		require.NoError(t, errs[i])
+		require.Equal(t, "FIRST", tokens[i])
+	}
+}
+
+func TestTokenSource_AccessToken_CallerCanceled(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	g := &TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "FIRST", ExpiresIn: 21600}}, block: make(chan struct{})}
+	s := newTestTokenSource(g, &now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := s.AccessToken(ctx, _testCredentials)
+		canceled <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// When
+	cancel()
+	canceledErr := <-canceled
+	waiting := make(chan string)
+	go func() {
+		token, _ := s.AccessToken(context.Background(), _testCredentials)
+		waiting <- token
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(g.block)
+
+	// Then
+	require.Equal(t, context.Canceled, canceledErr)
+	require.Equal(t, "FIRST", <-waiting)
+	require.Equal(t, 1, g.calls)
+}
+
+func TestTokenSource_AccessToken_PerCredentials(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	g := &TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "FIRST", ExpiresIn: 21600}, {AccessToken: "SECOND", ExpiresIn: 21600}}}
+	s := newTestTokenSource(g, &now)
+
+	// When
+	first, err := s.AccessToken(context.Background(), _testCredentials)
+	require.NoError(t, err)
+	second, err := s.AccessToken(context.Background(), Credentials{ClientID: "DEF456", ClientSecret: "456DEF"})
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, "FIRST", first)
+	require.Equal(t, "SECOND", second)
+}
+
+func TestHandler_getAccessToken(t *testing.T) {
+	now := time.Unix(1592092800, 0)
+	tt := []struct {
+		name       string
+		header     string
+		adminToken string
+		token      *ConfiguredToken
+		wantToken  string
+		wantError  error
+	}{
+		{
+			name:      "header",
+			header:    "FROM_HEADER",
+			token:     &ConfiguredToken{Tokens: newTestTokenSource(&TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "CONFIGURED"}}}, &now), Credentials: _testCredentials},
+			wantToken: "FROM_HEADER",
+		},
+		{
+			name:       "configured credentials",
+			adminToken: "ADMIN_TOKEN",
+			token:      &ConfiguredToken{Tokens: newTestTokenSource(&TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "CONFIGURED"}}}, &now), Credentials: _testCredentials},
+			wantToken:  "CONFIGURED",
+		},
+		{
+			name:      "configured credentials without the admin token",
+			token:     &ConfiguredToken{Tokens: newTestTokenSource(&TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "CONFIGURED"}}}, &now), Credentials: _testCredentials},
+			wantError: NewError("access token is required", http.StatusUnauthorized),
+		},
+		{
+			name:       "nothing configured",
+			adminToken: "ADMIN_TOKEN",
+			wantError:  NewError("access token is required", http.StatusUnauthorized),
+		},
+		{
+			name:       "configured credentials error",
+			adminToken: "ADMIN_TOKEN",
+			token:      &ConfiguredToken{Tokens: newTestTokenSource(&TokenGatewayStub{err: errors.New("invalid_client")}, &now), Credentials: _testCredentials},
+			wantError:  errors.New("invalid_client"),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := &Handler{Token: tc.token, AdminToken: "ADMIN_TOKEN"}
+			req, err := http.NewRequest(http.MethodGet, "/payments/123", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.header != "" {
+				req.Header.Add("access_token", tc.header)
+			}
+
+			if tc.adminToken != "" {
+				req.Header.Add("admin_token", tc.adminToken)
+			}
+
+			// When
+			token, err := h.getAccessToken(req)
+
+			// Then
+			require.Equal(t, tc.wantError, err)
+			require.Equal(t, tc.wantToken, token)
+		})
+	}
+}
@@ -0,0 +1,583 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_masterKeySize = 32
+	// _sellerTenantPrefix names the tenants of sellers connected through
+	// OAuth, followed by their Mercado Pago user id.
+	_sellerTenantPrefix = "seller"
+)
+
+var ErrInvalidMasterKey = errors.New("master key must be 32 bytes encoded in base64")
+
+type NewTenant struct {
+	ID           string      `json:"id" validate:"omitempty,alphanum,max=64"`
+	Name         string      `json:"name" validate:"required"`
+	ClientID     string      `json:"client_id" validate:"required"`
+	ClientSecret string      `json:"client_secret" validate:"required"`
+	Token        *OAuthToken `json:"token,omitempty"`
+}
+
+type TenantRotation struct {
+	ClientID     string      `json:"client_id" validate:"required"`
+	ClientSecret string      `json:"client_secret" validate:"required"`
+	Token        *OAuthToken `json:"token,omitempty"`
+}
+
+// Tenant is a merchant we process payments for. Its credentials and tokens
+// never leave the vault in a response. Version goes up on every rotation.
+// APIKey is what the tenant authenticates with; it's only set when the key is
+// issued, the vault keeps its hash.
+type Tenant struct {
+	ID              string      `json:"id"`
+	Name            string      `json:"name"`
+	Version         int         `json:"version"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+	RevokedAt       *time.Time  `json:"revoked_at,omitempty"`
+	APIKey          string      `json:"api_key,omitempty"`
+	APIKeyHash      string      `json:"-"`
+	Credentials     Credentials `json:"-"`
+	Token           OAuthToken  `json:"-"`
+	TokenObtainedAt time.Time   `json:"-"`
+}
+
+// tenantSecrets is the part of a Tenant that is encrypted at rest.
+type tenantSecrets struct {
+	ClientID        string     `json:"client_id"`
+	ClientSecret    string     `json:"client_secret"`
+	Token           OAuthToken `json:"token"`
+	TokenObtainedAt time.Time  `json:"token_obtained_at"`
+}
+
+type storedTenant struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Version    int        `json:"version"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	APIKeyHash string     `json:"api_key_hash,omitempty"`
+	Secrets    []byte     `json:"secrets,omitempty"`
+}
+
+// ParseMasterKey decodes the base64 master key the vault encrypts with.
+func ParseMasterKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != _masterKeySize {
+		return nil, ErrInvalidMasterKey
+	}
+
+	return key, nil
+}
+
+// TenantVault keeps every tenant's credentials and tokens in a local file,
+// sealed with AES-256-GCM under the master key. The tenant id is used as
+// additional data, so a sealed record can't be moved to another tenant.
+type TenantVault struct {
+	store *fileStore
+	aead  cipher.AEAD
+	now   func() time.Time
+
+	mu sync.Mutex
+}
+
+func OpenTenantVault(path string, masterKey []byte) (*TenantVault, error) {
+	if len(masterKey) != _masterKeySize {
+		return nil, ErrInvalidMasterKey
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openFileStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TenantVault{
+		store: store,
+		aead:  aead,
+		now:   time.Now,
+	}, nil
+}
+
+func (v *TenantVault) Close() error {
+	return v.store.Close()
+}
+
+// Register adds a tenant. Ids starting with "seller" are reserved for the
+// sellers connected through OAuth.
+func (v *TenantVault) Register(t NewTenant) (Tenant, error) {
+	if _, ok := sellerIDFromTenantID(t.ID); ok {
+		return Tenant{}, NewError(fmt.Sprintf("tenant id %s is reserved for connected sellers", t.ID), http.StatusBadRequest)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.register(t)
+}
+
+func (v *TenantVault) register(t NewTenant) (Tenant, error) {
+	id := t.ID
+	if id == "" {
+		id = randomID(8)
+	}
+
+	var existing storedTenant
+	ok, err := v.store.Get(id, &existing)
+	if err != nil {
+		return Tenant{}, err
+	}
+
+	if ok {
+		return Tenant{}, NewError(fmt.Sprintf("tenant %s already exists", id), http.StatusConflict)
+	}
+
+	now := v.now()
+	tenant := Tenant{
+		ID:        id,
+		Name:      t.Name,
+		Version:   1,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Credentials: Credentials{
+			ClientID:     t.ClientID,
+			ClientSecret: t.ClientSecret,
+		},
+	}
+
+	tenant.APIKey, tenant.APIKeyHash = newAPIKey()
+	if t.Token != nil {
+		tenant.Token = *t.Token
+		tenant.TokenObtainedAt = now
+	}
+
+	if err := v.put(tenant); err != nil {
+		return Tenant{}, err
+	}
+
+	return tenant, nil
+}
+
+// Rotate replaces a tenant's credentials. Tokens got with the old ones are
+// dropped.
+func (v *TenantVault) Rotate(id string, r TenantRotation) (Tenant, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.rotate(id, r)
+}
+
+func (v *TenantVault) rotate(id string, r TenantRotation) (Tenant, error) {
+	tenant, err := v.get(id)
+	if err != nil {
+		return Tenant{}, err
+	}
+
+	now := v.now()
+	tenant.Version++
+	tenant.UpdatedAt = now
+	tenant.Credentials = Credentials{
+		ClientID:     r.ClientID,
+		ClientSecret: r.ClientSecret,
+	}
+	tenant.Token = OAuthToken{}
+	tenant.TokenObtainedAt = time.Time{}
+	if r.Token != nil {
+		tenant.Token = *r.Token
+		tenant.TokenObtainedAt = now
+	}
+
+	if err := v.put(tenant); err != nil {
+		return Tenant{}, err
+	}
+
+	return tenant, nil
+}
+
+// ResetAPIKey issues a new API key for a tenant. The old one stops working.
+func (v *TenantVault) ResetAPIKey(id string) (Tenant, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	tenant, err := v.get(id)
+	if err != nil {
+		return Tenant{}, err
+	}
+
+	tenant.UpdatedAt = v.now()
+	tenant.APIKey, tenant.APIKeyHash = newAPIKey()
+	if err := v.put(tenant); err != nil {
+		return Tenant{}, err
+	}
+
+	return tenant, nil
+}
+
+// Authenticate checks apiKey is the key of tenant id. Unknown and revoked
+// tenants fail like a wrong key does, so callers can't tell them apart.
+func (v *TenantVault) Authenticate(id string, apiKey string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var stored storedTenant
+	ok, err := v.store.Get(id, &stored)
+	if err != nil {
+		return err
+	}
+
+	if !ok || stored.RevokedAt != nil || stored.APIKeyHash == "" ||
+		subtle.ConstantTimeCompare([]byte(hashAPIKey(apiKey)), []byte(stored.APIKeyHash)) != 1 {
+		return NewError("invalid api key", http.StatusUnauthorized)
+	}
+
+	return nil
+}
+
+// Revoke wipes a tenant's secrets. The tenant is kept so its id can't be
+// registered again by mistake.
+func (v *TenantVault) Revoke(id string) (Tenant, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	tenant, err := v.get(id)
+	if err != nil {
+		return Tenant{}, err
+	}
+
+	now := v.now()
+	stored := storedTenant{
+		ID:        tenant.ID,
+		Name:      tenant.Name,
+		Version:   tenant.Version + 1,
+		CreatedAt: tenant.CreatedAt,
+		UpdatedAt: now,
+		RevokedAt: &now,
+	}
+
+	if err := v.store.Put(id, stored); err != nil {
+		return Tenant{}, err
+	}
+
+	return tenantFromStored(stored), nil
+}
+
+// ConnectSeller stores the token a seller granted the marketplace under the
+// seller's tenant, registering it the first time. credentials are the
+// marketplace's, they are what refreshes the seller token. A revoked seller
+// granting access again is reinstated.
+func (v *TenantVault) ConnectSeller(credentials Credentials, token OAuthToken) (Tenant, error) {
+	if token.UserID == 0 {
+		return Tenant{}, NewError("the token doesn't say which seller it belongs to", http.StatusBadGateway)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	id := sellerTenantID(token.UserID)
+	var stored storedTenant
+	ok, err := v.store.Get(id, &stored)
+	if err != nil {
+		return Tenant{}, err
+	}
+
+	if !ok {
+		return v.register(NewTenant{
+			ID:           id,
+			Name:         fmt.Sprintf("Seller %d", token.UserID),
+			ClientID:     credentials.ClientID,
+			ClientSecret: credentials.ClientSecret,
+			Token:        &token,
+		})
+	}
+
+	if stored.RevokedAt != nil {
+		now := v.now()
+		tenant := tenantFromStored(stored)
+		tenant.Version++
+		tenant.UpdatedAt = now
+		tenant.RevokedAt = nil
+		tenant.Credentials = credentials
+		tenant.Token = token
+		tenant.TokenObtainedAt = now
+		if err := v.put(tenant); err != nil {
+			return Tenant{}, err
+		}
+
+		return tenant, nil
+	}
+
+	return v.rotate(id, TenantRotation{
+		ClientID:     credentials.ClientID,
+		ClientSecret: credentials.ClientSecret,
+		Token:        &token,
+	})
+}
+
+// SaveToken stores a token got for the given version of a tenant's
+// credentials. It is a no-op if the tenant was rotated or revoked meanwhile.
+func (v *TenantVault) SaveToken(id string, version int, token OAuthToken) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	tenant, err := v.get(id)
+	if err != nil {
+		return err
+	}
+
+	if tenant.Version != version {
+		return nil
+	}
+
+	tenant.Token = token
+	tenant.TokenObtainedAt = v.now()
+	return v.put(tenant)
+}
+
+// Get returns a tenant with its secrets decrypted.
+func (v *TenantVault) Get(id string) (Tenant, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.get(id)
+}
+
+// List returns every tenant, revoked ones included, without secrets.
+func (v *TenantVault) List() ([]Tenant, error) {
+	tenants := []Tenant{}
+	err := v.store.Each(func(_ string, value json.RawMessage) error {
+		var stored storedTenant
+		if err := json.Unmarshal(value, &stored); err != nil {
+			return err
+		}
+
+		tenants = append(tenants, tenantFromStored(stored))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(tenants, func(a, b int) bool {
+		return tenants[a].CreatedAt.Before(tenants[b].CreatedAt)
+	})
+
+	return tenants, nil
+}
+
+func (v *TenantVault) get(id string) (Tenant, error) {
+	var stored storedTenant
+	ok, err := v.store.Get(id, &stored)
+	if err != nil {
+		return Tenant{}, err
+	}
+
+	if !ok {
+		return Tenant{}, NewError(fmt.Sprintf("tenant %s not found", id), http.StatusNotFound)
+	}
+
+	if stored.RevokedAt != nil {
+		return Tenant{}, NewError(fmt.Sprintf("tenant %s is revoked", id), http.StatusForbidden)
+	}
+
+	plaintext, err := v.open(stored.ID, stored.Secrets)
+	if err != nil {
+		return Tenant{}, fmt.Errorf("couldn't decrypt tenant %s: %w", id, err)
+	}
+
+	var secrets tenantSecrets
+	if err := json.Unmarshal(plaintext, &secrets); err != nil {
+		return Tenant{}, err
+	}
+
+	tenant := tenantFromStored(stored)
+	tenant.Credentials = Credentials{
+		ClientID:     secrets.ClientID,
+		ClientSecret: secrets.ClientSecret,
+	}
+	tenant.Token = secrets.Token
+	tenant.TokenObtainedAt = secrets.TokenObtainedAt
+	return tenant, nil
+}
+
+func (v *TenantVault) put(tenant Tenant) error {
+	plaintext, err := json.Marshal(tenantSecrets{
+		ClientID:        tenant.Credentials.ClientID,
+		ClientSecret:    tenant.Credentials.ClientSecret,
+		Token:           tenant.Token,
+		TokenObtainedAt: tenant.TokenObtainedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return v.store.Put(tenant.ID, storedTenant{
+		ID:         tenant.ID,
+		Name:       tenant.Name,
+		Version:    tenant.Version,
+		CreatedAt:  tenant.CreatedAt,
+		UpdatedAt:  tenant.UpdatedAt,
+		APIKeyHash: tenant.APIKeyHash,
+		Secrets:    v.seal(tenant.ID, plaintext),
+	})
+}
+
+// seal returns the nonce followed by the ciphertext.
+func (v *TenantVault) seal(id string, plaintext []byte) []byte {
+	nonce := randomBytes(v.aead.NonceSize())
+	return v.aead.Seal(nonce, nonce, plaintext, []byte(id))
+}
+
+func (v *TenantVault) open(id string, sealed []byte) ([]byte, error) {
+	if len(sealed) < v.aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+
+	nonce, ciphertext := sealed[:v.aead.NonceSize()], sealed[v.aead.NonceSize():]
+	return v.aead.Open(nil, nonce, ciphertext, []byte(id))
+}
+
+// newAPIKey returns a random API key and the hash the vault keeps of it.
+func newAPIKey() (string, string) {
+	key := randomID(24)
+	return key, hashAPIKey(key)
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func sellerTenantID(sellerID int64) string {
+	return fmt.Sprintf("%s%d", _sellerTenantPrefix, sellerID)
+}
+
+func sellerIDFromTenantID(id string) (int64, bool) {
+	if !strings.HasPrefix(id, _sellerTenantPrefix) {
+		return 0, false
+	}
+
+	sellerID, err := strconv.ParseInt(strings.TrimPrefix(id, _sellerTenantPrefix), 10, 64)
+	return sellerID, err == nil
+}
+
+func tenantFromStored(stored storedTenant) Tenant {
+	return Tenant{
+		ID:         stored.ID,
+		Name:       stored.Name,
+		Version:    stored.Version,
+		CreatedAt:  stored.CreatedAt,
+		UpdatedAt:  stored.UpdatedAt,
+		RevokedAt:  stored.RevokedAt,
+		APIKeyHash: stored.APIKeyHash,
+	}
+}
+
+type TenantHandler struct {
+	Vault *TenantVault
+}
+
+func NewTenantHandler(vault *TenantVault) *TenantHandler {
+	return &TenantHandler{
+		Vault: vault,
+	}
+}
+
+func (h *TenantHandler) RegisterTenant(w http.ResponseWriter, r *http.Request) {
+	var tenant NewTenant
+	if err := json.NewDecoder(r.Body).Decode(&tenant); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(tenant); err != nil {
+		writeError(w, r, validationError(tenant, err))
+		return
+	}
+
+	registered, err := h.Vault.Register(tenant)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't register tenant: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, registered)
+}
+
+func (h *TenantHandler) ListTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := h.Vault.List()
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't list tenants: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tenants)
+}
+
+func (h *TenantHandler) RotateTenant(w http.ResponseWriter, r *http.Request) {
+	var rotation TenantRotation
+	if err := json.NewDecoder(r.Body).Decode(&rotation); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(rotation); err != nil {
+		writeError(w, r, validationError(rotation, err))
+		return
+	}
+
+	tenant, err := h.Vault.Rotate(mux.Vars(r)["id"], rotation)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't rotate tenant: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tenant)
+}
+
+func (h *TenantHandler) ResetTenantAPIKey(w http.ResponseWriter, r *http.Request) {
+	tenant, err := h.Vault.ResetAPIKey(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't reset tenant api key: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tenant)
+}
+
+func (h *TenantHandler) RevokeTenant(w http.ResponseWriter, r *http.Request) {
+	tenant, err := h.Vault.Revoke(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't revoke tenant: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tenant)
+}
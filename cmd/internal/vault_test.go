@@ -0,0 +1,466 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _testMasterKey = bytes.Repeat([]byte{7}, 32)
+
+func newTestVault(t *testing.T, path string, key []byte) *TenantVault {
+	v, err := OpenTenantVault(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { v.Close() })
+	return v
+}
+
+func TestParseMasterKey(t *testing.T) {
+	// Given
+	encoded := base64.StdEncoding.EncodeToString(_testMasterKey)
+
+	// When
+	key, err := ParseMasterKey(encoded)
+	_, shortErr := ParseMasterKey(base64.StdEncoding.EncodeToString([]byte("short")))
+	_, invalidErr := ParseMasterKey("not base64!")
+
+	// Then
+	require.NoError(t, err)
+	require.Equal(t, _testMasterKey, key)
+	require.Equal(t, ErrInvalidMasterKey, shortErr)
+	require.Equal(t, ErrInvalidMasterKey, invalidErr)
+}
+
+func TestTenantVault_Register(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "tenants.jsonl")
+	v := newTestVault(t, path, _testMasterKey)
+
+	// When
+	_, err := v.Register(NewTenant{ID: "shop1", Name: "Shop", ClientID: "ABC123", ClientSecret: "MY_CLIENT_SECRET", Token: &OAuthToken{AccessToken: "APP_USR-1234"}})
+	require.NoError(t, err)
+	require.NoError(t, v.Close())
+
+	reopened := newTestVault(t, path, _testMasterKey)
+	tenant, err := reopened.Get("shop1")
+	require.NoError(t, err)
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, Credentials{ClientID: "ABC123", ClientSecret: "MY_CLIENT_SECRET"}, tenant.Credentials)
+	require.Equal(t, "APP_USR-1234", tenant.Token.AccessToken)
+	require.Equal(t, 1, tenant.Version)
+	require.NotContains(t, string(content), "ABC123")
+	require.NotContains(t, string(content), "MY_CLIENT_SECRET")
+	require.NotContains(t, string(content), "APP_USR-1234")
+}
+
+func TestTenantVault_Register_Duplicated(t *testing.T) {
+	// Given
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	_, err := v.Register(NewTenant{ID: "shop1", Name: "Shop", ClientID: "ABC123", ClientSecret: "123ABC"})
+	require.NoError(t, err)
+
+	// When
+	_, err = v.Register(NewTenant{ID: "shop1", Name: "Other shop", ClientID: "DEF456", ClientSecret: "456DEF"})
+
+	// Then
+	require.Equal(t, http.StatusConflict, getStatusCodeFromError(err))
+}
+
+func TestTenantVault_Register_SellerID(t *testing.T) {
+	// Given
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+
+	// When
+	_, err := v.Register(NewTenant{ID: "seller987", Name: "Shop", ClientID: "ABC123", ClientSecret: "123ABC"})
+	_, otherErr := v.Register(NewTenant{ID: "sellers", Name: "Shop", ClientID: "ABC123", ClientSecret: "123ABC"})
+
+	// Then
+	require.Equal(t, http.StatusBadRequest, getStatusCodeFromError(err))
+	require.NoError(t, otherErr)
+}
+
+func TestTenantVault_ConnectSeller_Concurrent(t *testing.T) {
+	// Given
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+
+	// When
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = v.ConnectSeller(_testCredentials, OAuthToken{AccessToken: fmt.Sprintf("SELLER_%d", i), UserID: 987})
+		}(i)
+	}
+	wg.Wait()
+
+	tenant, err := v.Get("seller987")
+	require.NoError(t, err)
+
+	// Then
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 10, tenant.Version)
+}
+
+func TestTenantVault_ConnectSeller_Revoked(t *testing.T) {
+	// Given
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	_, err := v.ConnectSeller(_testCredentials, OAuthToken{AccessToken: "APP_USR-OLD", UserID: 987})
+	require.NoError(t, err)
+	_, err = v.Revoke("seller987")
+	require.NoError(t, err)
+
+	// When
+	connected, err := v.ConnectSeller(_testCredentials, OAuthToken{AccessToken: "APP_USR-NEW", UserID: 987})
+	require.NoError(t, err)
+
+	seller, err := v.Get("seller987")
+	require.NoError(t, err)
+
+	// Then
+	require.Nil(t, connected.RevokedAt)
+	require.Equal(t, 3, connected.Version)
+	require.Equal(t, "APP_USR-NEW", seller.Token.AccessToken)
+	require.Equal(t, _testCredentials, seller.Credentials)
+}
+
+func TestTenantVault_ConnectSeller_NoUserID(t *testing.T) {
+	// Given
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+
+	// When
+	_, err := v.ConnectSeller(_testCredentials, OAuthToken{AccessToken: "APP_USR-SELLER"})
+	tenants, listErr := v.List()
+	require.NoError(t, listErr)
+
+	// Then
+	require.Equal(t, http.StatusBadGateway, getStatusCodeFromError(err))
+	require.Empty(t, tenants)
+}
+
+func TestTenantVault_WrongMasterKey(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "tenants.jsonl")
+	v := newTestVault(t, path, _testMasterKey)
+	_, err := v.Register(NewTenant{ID: "shop1", Name: "Shop", ClientID: "ABC123", ClientSecret: "123ABC"})
+	require.NoError(t, err)
+	require.NoError(t, v.Close())
+
+	// When
+	_, err = newTestVault(t, path, bytes.Repeat([]byte{8}, 32)).Get("shop1")
+
+	// Then
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "couldn't decrypt tenant shop1")
+}
+
+func TestTenantVault_Rotate(t *testing.T) {
+	// Given
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	_, err := v.Register(NewTenant{ID: "shop1", Name: "Shop", ClientID: "ABC123", ClientSecret: "123ABC", Token: &OAuthToken{AccessToken: "APP_USR-1234"}})
+	require.NoError(t, err)
+
+	// When
+	rotated, err := v.Rotate("shop1", TenantRotation{ClientID: "ABC123", ClientSecret: "NEW_SECRET"})
+	require.NoError(t, err)
+	tenant, err := v.Get("shop1")
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, 2, rotated.Version)
+	require.Equal(t, "NEW_SECRET", tenant.Credentials.ClientSecret)
+	require.Empty(t, tenant.Token.AccessToken)
+}
+
+func TestTenantVault_Authenticate(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "tenants.jsonl")
+	v := newTestVault(t, path, _testMasterKey)
+	registered, err := v.Register(NewTenant{ID: "shop1", Name: "Shop", ClientID: "ABC123", ClientSecret: "123ABC"})
+	require.NoError(t, err)
+	_, err = v.Register(NewTenant{ID: "shop2", Name: "Other shop", ClientID: "DEF456", ClientSecret: "456DEF"})
+	require.NoError(t, err)
+	_, err = v.Rotate("shop1", TenantRotation{ClientID: "ABC123", ClientSecret: "NEW_SECRET"})
+	require.NoError(t, err)
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	// When
+	err = v.Authenticate("shop1", registered.APIKey)
+	wrongErr := v.Authenticate("shop1", "OTHER_API_KEY")
+	otherTenantErr := v.Authenticate("shop2", registered.APIKey)
+	unknownErr := v.Authenticate("shop3", registered.APIKey)
+	reset, resetErr := v.ResetAPIKey("shop1")
+	oldKeyErr := v.Authenticate("shop1", registered.APIKey)
+	newKeyErr := v.Authenticate("shop1", reset.APIKey)
+
+	// Then
+	require.NoError(t, err)
+	require.NotEmpty(t, registered.APIKey)
+	require.NotContains(t, string(content), registered.APIKey)
+	require.Equal(t, http.StatusUnauthorized, getStatusCodeFromError(wrongErr))
+	require.Equal(t, http.StatusUnauthorized, getStatusCodeFromError(otherTenantErr))
+	require.Equal(t, http.StatusUnauthorized, getStatusCodeFromError(unknownErr))
+	require.NoError(t, resetErr)
+	require.Equal(t, http.StatusUnauthorized, getStatusCodeFromError(oldKeyErr))
+	require.NoError(t, newKeyErr)
+}
+
+func TestTenantVault_Revoke(t *testing.T) {
+	// Given
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	_, err := v.Register(NewTenant{ID: "shop1", Name: "Shop", ClientID: "ABC123", ClientSecret: "123ABC"})
+	require.NoError(t, err)
+
+	// When
+	_, err = v.Revoke("shop1")
+	require.NoError(t, err)
+	_, getErr := v.Get("shop1")
+	_, rotateErr := v.Rotate("shop1", TenantRotation{ClientID: "ABC123", ClientSecret: "NEW_SECRET"})
+	tenants, err := v.List()
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, http.StatusForbidden, getStatusCodeFromError(getErr))
+	require.Equal(t, http.StatusForbidden, getStatusCodeFromError(rotateErr))
+	require.Len(t, tenants, 1)
+	require.NotNil(t, tenants[0].RevokedAt)
+}
+
+func TestController_GetTenantAccessToken(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	_, err := v.Register(NewTenant{ID: "shop1", Name: "Shop", ClientID: "ABC123", ClientSecret: "123ABC"})
+	require.NoError(t, err)
+
+	g := &TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "APP_USR-1234", ExpiresIn: 21600}}}
+	c := &Controller{Tenants: v, Tokens: newTestTokenSource(g, &now)}
+
+	// When
+	first, err := c.GetTenantAccessToken(context.Background(), "shop1")
+	require.NoError(t, err)
+	second, err := c.GetTenantAccessToken(context.Background(), "shop1")
+	require.NoError(t, err)
+	tenant, err := v.Get("shop1")
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, "APP_USR-1234", first)
+	require.Equal(t, "APP_USR-1234", second)
+	require.Equal(t, 1, g.calls)
+	require.Equal(t, "APP_USR-1234", tenant.Token.AccessToken)
+}
+
+func TestController_GetTenantAccessToken_NotFound(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	c := &Controller{Tenants: v, Tokens: newTestTokenSource(&TokenGatewayStub{}, &now)}
+
+	// When
+	_, err := c.GetTenantAccessToken(context.Background(), "shop1")
+
+	// Then
+	require.EqualError(t, err, "tenant shop1 not found")
+	require.Equal(t, http.StatusNotFound, getStatusCodeFromError(err))
+}
+
+func TestController_GetSellerAccessToken_NoRefreshToken(t *testing.T) {
+	// Given
+	now := time.Now().Add(24 * time.Hour)
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	_, err := v.ConnectSeller(_testCredentials, OAuthToken{AccessToken: "APP_USR-SELLER", UserID: 987, ExpiresIn: 21600})
+	require.NoError(t, err)
+
+	g := &TokenGatewayStub{tokens: []OAuthToken{{AccessToken: "APP_USR-MARKETPLACE", ExpiresIn: 21600}}}
+	c := &Controller{Tenants: v, Tokens: newTestTokenSource(g, &now)}
+
+	// When
+	accessToken, err := c.GetSellerAccessToken(context.Background(), "987")
+	seller, getErr := v.Get("seller987")
+	require.NoError(t, getErr)
+
+	// Then
+	require.Empty(t, accessToken)
+	require.Equal(t, http.StatusUnauthorized, getStatusCodeFromError(err))
+	require.Equal(t, "reconnect_required", getErrorCode(err))
+	require.Equal(t, 0, g.calls)
+	require.Equal(t, "APP_USR-SELLER", seller.Token.AccessToken)
+}
+
+func TestHandler_getAccessToken_Tenant(t *testing.T) {
+	tt := []struct {
+		name            string
+		header          string
+		value           string
+		wantAccessToken string
+		wantError       string
+	}{
+		{name: "api key", header: "api_key", value: "MY_API_KEY", wantAccessToken: "APP_USR-1234"},
+		{name: "admin token", header: "admin_token", value: "MY_ADMIN_TOKEN", wantAccessToken: "APP_USR-1234"},
+		{name: "no api key", wantError: "api key is required"},
+		{name: "wrong api key", header: "api_key", value: "OTHER_API_KEY", wantError: "invalid api key"},
+		{name: "wrong admin token", header: "admin_token", value: "OTHER_ADMIN_TOKEN", wantError: "api key is required"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{accessToken: "APP_USR-1234"})
+			h.AdminToken = "MY_ADMIN_TOKEN"
+			var accessToken string
+			var err error
+			router := mux.NewRouter()
+			router.HandleFunc("/tenants/{tenant_id}/payments", func(w http.ResponseWriter, r *http.Request) {
+				accessToken, err = h.getAccessToken(r)
+			})
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			// When
+			req, reqErr := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/tenants/shop1/payments", ts.URL), nil)
+			if reqErr != nil {
+				t.Fatal(reqErr)
+			}
+
+			if tc.header != "" {
+				req.Header.Add(tc.header, tc.value)
+			}
+
+			resp, reqErr := http.DefaultClient.Do(req)
+			if reqErr != nil {
+				t.Fatal(reqErr)
+			}
+			resp.Body.Close()
+
+			// Then
+			require.Equal(t, tc.wantAccessToken, accessToken)
+			if tc.wantError != "" {
+				require.EqualError(t, err, tc.wantError)
+				require.Equal(t, http.StatusUnauthorized, getStatusCodeFromError(err))
+			}
+		})
+	}
+}
+
+func TestHandler_getAccessToken_Seller(t *testing.T) {
+	tt := []struct {
+		name            string
+		adminToken      string
+		wantAccessToken string
+		wantError       string
+	}{
+		{name: "admin token", adminToken: "MY_ADMIN_TOKEN", wantAccessToken: "APP_USR-1234"},
+		{name: "no admin token", wantError: "admin token is required"},
+		{name: "wrong admin token", adminToken: "OTHER_ADMIN_TOKEN", wantError: "admin token is required"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Given
+			h := NewHandler(&ServiceStub{accessToken: "APP_USR-1234"})
+			h.AdminToken = "MY_ADMIN_TOKEN"
+			var accessToken string
+			var err error
+			router := mux.NewRouter()
+			router.HandleFunc("/sellers/{seller_id}/payments", func(w http.ResponseWriter, r *http.Request) {
+				accessToken, err = h.getAccessToken(r)
+			})
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			// When
+			req, reqErr := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/sellers/987/payments", ts.URL), nil)
+			if reqErr != nil {
+				t.Fatal(reqErr)
+			}
+
+			req.Header.Add("api_key", "MY_API_KEY")
+			if tc.adminToken != "" {
+				req.Header.Add("admin_token", tc.adminToken)
+			}
+
+			resp, reqErr := http.DefaultClient.Do(req)
+			if reqErr != nil {
+				t.Fatal(reqErr)
+			}
+			resp.Body.Close()
+
+			// Then
+			require.Equal(t, tc.wantAccessToken, accessToken)
+			if tc.wantError != "" {
+				require.EqualError(t, err, tc.wantError)
+				require.Equal(t, http.StatusUnauthorized, getStatusCodeFromError(err))
+			}
+		})
+	}
+}
+
+func TestTenantHandler_RegisterTenant(t *testing.T) {
+	// Given
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	ts := httptest.NewServer(http.HandlerFunc(NewTenantHandler(v).RegisterTenant))
+	defer ts.Close()
+
+	// When
+	resp, err := http.Post(ts.URL, "application/json", bytes.NewReader([]byte(`{"id": "shop1", "name": "Shop", "client_id": "ABC123", "client_secret": "MY_CLIENT_SECRET"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tenant Tenant
+	require.NoError(t, json.Unmarshal(b, &tenant))
+
+	// Then
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "shop1", tenant.ID)
+	require.NotEmpty(t, tenant.APIKey)
+	require.NotContains(t, string(b), "MY_CLIENT_SECRET")
+}
+
+func TestTenantHandler_RegisterTenant_ValidationError(t *testing.T) {
+	// Given
+	v := newTestVault(t, filepath.Join(t.TempDir(), "tenants.jsonl"), _testMasterKey)
+	ts := httptest.NewServer(http.HandlerFunc(NewTenantHandler(v).RegisterTenant))
+	defer ts.Close()
+
+	// When
+	resp, err := http.Post(ts.URL, "application/json", bytes.NewReader([]byte(`{"id": "shop/1", "name": "Shop"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Then
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
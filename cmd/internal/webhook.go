@@ -0,0 +1,704 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	_webhookQueueSize   = 256
+	_webhookMaxAttempts = 6
+	_webhookBaseBackoff = 10 * time.Second
+	_webhookMaxBackoff  = 30 * time.Minute
+	// _webhookSweepInterval is how often stored deliveries nobody is working
+	// on, like those the queue had no room for, are queued again.
+	_webhookSweepInterval = 30 * time.Second
+	// _webhookDeliveredRetention is how long a delivered delivery is
+	// remembered, so an event handled again meanwhile isn't sent twice.
+	_webhookDeliveredRetention = 24 * time.Hour
+
+	_subscriptionKeyPrefix = "subscription:"
+	_deliveryKeyPrefix     = "delivery:"
+	_deadLetterKeyPrefix   = "dead_letter:"
+)
+
+type NewWebhookSubscription struct {
+	URL    string   `json:"url" validate:"required,url"`
+	Events []string `json:"events" validate:"required,min=1,dive,required"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+// WebhookSubscription is one of our services listening for events. Events are
+// exact types like "payment.approved", a prefix like "payment.*" or "*".
+type WebhookSubscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s WebhookSubscription) accepts(eventType string) bool {
+	for _, e := range s.Events {
+		if e == "*" || e == eventType {
+			return true
+		}
+
+		if strings.HasSuffix(e, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(e, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type WebhookPayload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	SubscriptionID string          `json:"subscription_id"`
+	URL            string          `json:"url"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	LastAttemptAt  time.Time       `json:"last_attempt_at"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// Dispatcher fans events out to the subscribed services. Deliveries are
+// POSTed by a pool of workers, retried with exponential backoff and moved to
+// the dead letter list once they run out of attempts. Subscriptions,
+// deliveries and dead letters are kept on disk, so a restart or a full queue
+// only delays a delivery.
+type Dispatcher struct {
+	Client        Client
+	store         *fileStore
+	queue         chan WebhookDelivery
+	maxAttempts   int
+	baseBackoff   time.Duration
+	maxBackoff    time.Duration
+	sweepInterval time.Duration
+	retention     time.Duration
+	now           func() time.Time
+	// after runs f once d elapsed, unless the returned func stops it first.
+	after func(d time.Duration, f func()) (stop func() bool)
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	mu sync.Mutex
+	// scheduled holds the deliveries queued, in flight or waiting to be
+	// retried, which the sweep must leave alone.
+	scheduled map[string]bool
+	// timers stops the pending retry of each delivery waiting for one.
+	timers  map[string]func() bool
+	stopped bool
+}
+
+func OpenDispatcher(path string, client Client) (*Dispatcher, error) {
+	store, err := openFileStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Dispatcher{
+		Client:        client,
+		store:         store,
+		queue:         make(chan WebhookDelivery, _webhookQueueSize),
+		maxAttempts:   _webhookMaxAttempts,
+		baseBackoff:   _webhookBaseBackoff,
+		maxBackoff:    _webhookMaxBackoff,
+		sweepInterval: _webhookSweepInterval,
+		retention:     _webhookDeliveredRetention,
+		now:           time.Now,
+		after: func(d time.Duration, f func()) func() bool {
+			return time.AfterFunc(d, f).Stop
+		},
+		done:      make(chan struct{}),
+		scheduled: make(map[string]bool),
+		timers:    make(map[string]func() bool),
+	}, nil
+}
+
+// Start runs workers delivery workers until Stop is called, along with the
+// sweep, which first picks up the deliveries left from a previous run.
+func (d *Dispatcher) Start(workers int) {
+	d.wg.Add(workers + 1)
+	for n := 0; n < workers; n++ {
+		go func() {
+			defer d.wg.Done()
+			for {
+				select {
+				case <-d.done:
+					return
+				case delivery := <-d.queue:
+					d.deliver(delivery)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := d.sweep(); err != nil {
+				log.Printf("couldn't sweep webhook deliveries: %v", err)
+			}
+
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends the workers and the sweep and cancels the pending retries, which
+// the sweep picks up on the next start. It returns once the deliveries in
+// flight are done, so the store can be closed after it.
+func (d *Dispatcher) Stop() {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+
+	d.stopped = true
+	close(d.done)
+	for id, stop := range d.timers {
+		stop()
+		delete(d.timers, id)
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) Close() error {
+	return d.store.Close()
+}
+
+func (d *Dispatcher) Subscribe(s NewWebhookSubscription) (WebhookSubscription, error) {
+	secret := s.Secret
+	if secret == "" {
+		secret = randomID(32)
+	}
+
+	subscription := WebhookSubscription{
+		ID:        randomID(16),
+		URL:       s.URL,
+		Events:    s.Events,
+		Secret:    secret,
+		CreatedAt: d.now(),
+	}
+
+	if err := d.store.Put(_subscriptionKeyPrefix+subscription.ID, subscription); err != nil {
+		return WebhookSubscription{}, err
+	}
+
+	return subscription, nil
+}
+
+func (d *Dispatcher) Unsubscribe(id string) error {
+	if _, err := d.subscription(id); err != nil {
+		return err
+	}
+
+	return d.store.Delete(_subscriptionKeyPrefix + id)
+}
+
+// Subscriptions lists every subscription without its secret.
+func (d *Dispatcher) Subscriptions() ([]WebhookSubscription, error) {
+	subscriptions := []WebhookSubscription{}
+	err := d.each(_subscriptionKeyPrefix, func(value json.RawMessage) error {
+		var s WebhookSubscription
+		if err := json.Unmarshal(value, &s); err != nil {
+			return err
+		}
+
+		s.Secret = ""
+		subscriptions = append(subscriptions, s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(subscriptions, func(a, b int) bool {
+		return subscriptions[a].CreatedAt.Before(subscriptions[b].CreatedAt)
+	})
+
+	return subscriptions, nil
+}
+
+func (d *Dispatcher) DeadLetters() ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := d.each(_deadLetterKeyPrefix, func(value json.RawMessage) error {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(value, &delivery); err != nil {
+			return err
+		}
+
+		deliveries = append(deliveries, delivery)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(deliveries, func(a, b int) bool {
+		return deliveries[a].CreatedAt.Before(deliveries[b].CreatedAt)
+	})
+
+	return deliveries, nil
+}
+
+// Redeliver takes a delivery off the dead letter list and queues it again with
+// a fresh set of attempts.
+func (d *Dispatcher) Redeliver(id string) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	ok, err := d.store.Get(_deadLetterKeyPrefix+id, &delivery)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	if !ok {
+		return WebhookDelivery{}, NewError(fmt.Sprintf("dead letter %s not found", id), http.StatusNotFound)
+	}
+
+	delivery.Attempts = 0
+	delivery.LastError = ""
+	delivery.NextAttemptAt = d.now()
+	if err := d.store.Put(_deliveryKeyPrefix+id, delivery); err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	if err := d.store.Delete(_deadLetterKeyPrefix + id); err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	d.schedule(id)
+	return delivery, nil
+}
+
+// HandleEvent stores a delivery for every subscription interested in the
+// event and queues them, so the Dispatcher can be the NotificationHandler's
+// EventHandler. Delivery ids come from the event and the subscription: when
+// the event is handled again, deliveries we already have aren't made twice.
+func (d *Dispatcher) HandleEvent(event Event) error {
+	eventType, resourceID, data, ok := webhookEventType(event)
+	if !ok {
+		return nil
+	}
+
+	subscriptions, err := d.Subscriptions()
+	if err != nil {
+		return err
+	}
+
+	now := d.now()
+	var stored []string
+	for _, s := range subscriptions {
+		if !s.accepts(eventType) {
+			continue
+		}
+
+		id := deliveryID(event.ID, eventType, resourceID, s.ID)
+		known, err := d.known(id)
+		if err != nil {
+			return err
+		}
+
+		if known {
+			continue
+		}
+
+		payload, err := json.Marshal(WebhookPayload{
+			ID:        id,
+			Type:      eventType,
+			CreatedAt: now,
+			Data:      data,
+		})
+		if err != nil {
+			return err
+		}
+
+		delivery := WebhookDelivery{
+			ID:             id,
+			SubscriptionID: s.ID,
+			URL:            s.URL,
+			EventType:      eventType,
+			Payload:        payload,
+			CreatedAt:      now,
+			NextAttemptAt:  now,
+		}
+
+		if err := d.store.Put(_deliveryKeyPrefix+id, delivery); err != nil {
+			return err
+		}
+
+		stored = append(stored, id)
+	}
+
+	for _, id := range stored {
+		d.schedule(id)
+	}
+
+	return nil
+}
+
+// known tells whether the delivery was already made, is on its way or is a
+// dead letter.
+func (d *Dispatcher) known(id string) (bool, error) {
+	for _, key := range []string{_deliveryKeyPrefix + id, _deadLetterKeyPrefix + id} {
+		var raw json.RawMessage
+		ok, err := d.store.Get(key, &raw)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+
+	return false, nil
+}
+
+// schedule queues a stored delivery that is still pending, unless it already
+// is. When the queue is full the delivery is left for the sweep.
+func (d *Dispatcher) schedule(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.scheduled[id] {
+		return
+	}
+
+	var delivery WebhookDelivery
+	ok, err := d.store.Get(_deliveryKeyPrefix+id, &delivery)
+	if err != nil || !ok || delivery.DeliveredAt != nil {
+		return
+	}
+
+	select {
+	case d.queue <- delivery:
+		d.scheduled[id] = true
+	default:
+	}
+}
+
+func (d *Dispatcher) unschedule(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.scheduled, id)
+}
+
+// sweep queues the stored deliveries that are due, and forgets the ones
+// delivered longer than retention ago.
+func (d *Dispatcher) sweep() error {
+	now := d.now()
+	var due, expired []string
+	err := d.each(_deliveryKeyPrefix, func(value json.RawMessage) error {
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(value, &delivery); err != nil {
+			return err
+		}
+
+		switch {
+		case delivery.DeliveredAt != nil:
+			if now.Sub(*delivery.DeliveredAt) > d.retention {
+				expired = append(expired, delivery.ID)
+			}
+		case !delivery.NextAttemptAt.After(now):
+			due = append(due, delivery.ID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range expired {
+		if err := d.store.Delete(_deliveryKeyPrefix + id); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range due {
+		d.schedule(id)
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) deliver(delivery WebhookDelivery) {
+	subscription, err := d.subscription(delivery.SubscriptionID)
+	if err != nil {
+		log.Printf("dropping webhook delivery %s: %v", delivery.ID, err)
+		if err := d.store.Delete(_deliveryKeyPrefix + delivery.ID); err != nil {
+			log.Printf("couldn't delete webhook delivery %s: %v", delivery.ID, err)
+		}
+
+		d.unschedule(delivery.ID)
+		return
+	}
+
+	delivery.Attempts++
+	delivery.LastAttemptAt = d.now()
+	err = d.send(subscription, delivery)
+	if err != nil {
+		d.retry(delivery, err)
+		return
+	}
+
+	deliveredAt := d.now()
+	delivery.DeliveredAt = &deliveredAt
+	if err := d.store.Put(_deliveryKeyPrefix+delivery.ID, delivery); err != nil {
+		log.Printf("couldn't store webhook delivery %s: %v", delivery.ID, err)
+	}
+
+	d.unschedule(delivery.ID)
+}
+
+// retry stores the failed attempt and queues the delivery again once its
+// backoff elapsed, or moves it to the dead letter list.
+func (d *Dispatcher) retry(delivery WebhookDelivery, err error) {
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= d.maxAttempts {
+		if err := d.store.Put(_deadLetterKeyPrefix+delivery.ID, delivery); err != nil {
+			log.Printf("couldn't store dead letter %s: %v", delivery.ID, err)
+			d.unschedule(delivery.ID)
+			return
+		}
+
+		if err := d.store.Delete(_deliveryKeyPrefix + delivery.ID); err != nil {
+			log.Printf("couldn't delete webhook delivery %s: %v", delivery.ID, err)
+		}
+
+		d.unschedule(delivery.ID)
+		return
+	}
+
+	wait := backoff(d.baseBackoff, d.maxBackoff, delivery.Attempts)
+	delivery.NextAttemptAt = d.now().Add(wait)
+	if err := d.store.Put(_deliveryKeyPrefix+delivery.ID, delivery); err != nil {
+		log.Printf("couldn't store webhook delivery %s: %v", delivery.ID, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		return
+	}
+
+	d.timers[delivery.ID] = d.after(wait, func() {
+		d.mu.Lock()
+		if d.stopped {
+			d.mu.Unlock()
+			return
+		}
+
+		delete(d.timers, delivery.ID)
+		d.wg.Add(1)
+		d.mu.Unlock()
+		defer d.wg.Done()
+
+		d.unschedule(delivery.ID)
+		d.schedule(delivery.ID)
+	})
+}
+
+// send POSTs the payload signed with the subscription secret. The
+// X-Webhook-Signature header is "t=<unix timestamp>,v1=<hex hmac-sha256>"
+// over "<timestamp>.<body>".
+func (d *Dispatcher) send(subscription WebhookSubscription, delivery WebhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, subscription.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	ts := d.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", delivery.ID)
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Signature", fmt.Sprintf("t=%d,v1=%s", ts, signWebhook(subscription.Secret, ts, delivery.Payload)))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return NewError(fmt.Sprintf("subscriber answered %d: %s", resp.StatusCode, body), resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) subscription(id string) (WebhookSubscription, error) {
+	var s WebhookSubscription
+	ok, err := d.store.Get(_subscriptionKeyPrefix+id, &s)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+
+	if !ok {
+		return WebhookSubscription{}, NewError(fmt.Sprintf("subscription %s not found", id), http.StatusNotFound)
+	}
+
+	return s, nil
+}
+
+func (d *Dispatcher) each(prefix string, fn func(value json.RawMessage) error) error {
+	return d.store.Each(func(key string, value json.RawMessage) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		return fn(value)
+	})
+}
+
+func signWebhook(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookEventType names an event after its resource and status, e.g.
+// "payment.approved", and returns the resource's id and the resource sent as
+// payload data.
+func webhookEventType(event Event) (string, string, interface{}, bool) {
+	switch {
+	case event.Payment != nil:
+		return "payment." + event.Payment.Status, strconv.FormatInt(event.Payment.ID, 10), event.Payment, true
+	case event.MerchantOrder != nil:
+		return "merchant_order." + event.MerchantOrder.Status, strconv.FormatInt(event.MerchantOrder.ID, 10), event.MerchantOrder, true
+	case event.Preapproval != nil:
+		return "subscription." + event.Preapproval.Status, event.Preapproval.ID, event.Preapproval, true
+	default:
+		return "", "", nil, false
+	}
+}
+
+// deliveryID names the delivery of a notification's event to a subscription
+// the same way every time it's handled.
+func deliveryID(notificationID int64, eventType string, resourceID string, subscriptionID string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s:%s:%s", notificationID, eventType, resourceID, subscriptionID)))
+	return hex.EncodeToString(sum[:16])
+}
+
+func backoff(base time.Duration, max time.Duration, attempts int) time.Duration {
+	d := base
+	for n := 1; n < attempts && d < max; n++ {
+		d *= 2
+	}
+
+	if d > max {
+		d = max
+	}
+
+	return d
+}
+
+func randomID(n int) string {
+	return hex.EncodeToString(randomBytes(n))
+}
+
+type WebhookHandler struct {
+	Dispatcher *Dispatcher
+}
+
+func NewWebhookHandler(dispatcher *Dispatcher) *WebhookHandler {
+	return &WebhookHandler{
+		Dispatcher: dispatcher,
+	}
+}
+
+func (h *WebhookHandler) CreateSubscription(w http.ResponseWriter, r *http.Request) {
+	var subscription NewWebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	if err := _v.Struct(subscription); err != nil {
+		writeError(w, r, validationError(subscription, err))
+		return
+	}
+
+	created, err := h.Dispatcher.Subscribe(subscription)
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't create subscription: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (h *WebhookHandler) ListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := h.Dispatcher.Subscriptions()
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't list subscriptions: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, subscriptions)
+}
+
+func (h *WebhookHandler) DeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	if err := h.Dispatcher.Unsubscribe(mux.Vars(r)["id"]); err != nil {
+		writeError(w, r, fmt.Errorf("couldn't delete subscription: %w", err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *WebhookHandler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := h.Dispatcher.DeadLetters()
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't list dead letters: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+func (h *WebhookHandler) RedeliverDeadLetter(w http.ResponseWriter, r *http.Request) {
+	delivery, err := h.Dispatcher.Redeliver(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, fmt.Errorf("couldn't redeliver webhook: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, delivery)
+}
@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newTestDispatcher(t *testing.T, now time.Time) *Dispatcher {
+	return newTestDispatcherAt(t, filepath.Join(t.TempDir(), "webhooks.jsonl"), now)
+}
+
+func newTestDispatcherAt(t *testing.T, path string, now time.Time) *Dispatcher {
+	d, err := OpenDispatcher(path, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.now = func() time.Time { return now }
+	d.after = func(_ time.Duration, f func()) func() bool {
+		go f()
+		return func() bool { return false }
+	}
+
+	d.Start(2)
+	t.Cleanup(func() {
+		d.Stop()
+		d.Close()
+	})
+
+	return d
+}
+
+// newSubscriber answers with the given status codes in order and the last one
+// from then on, sending every request it gets to the returned channel.
+func newSubscriber(t *testing.T, statusCodes ...int) (*httptest.Server, chan receivedWebhook) {
+	received := make(chan receivedWebhook, 16)
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		statusCode := statusCodes[len(statusCodes)-1]
+		if calls < len(statusCodes) {
+			statusCode = statusCodes[calls]
+		}
+
+		calls++
+		w.WriteHeader(statusCode)
+		received <- receivedWebhook{header: r.Header, body: body}
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts, received
+}
+
+func waitWebhook(t *testing.T, received chan receivedWebhook) receivedWebhook {
+	select {
+	case r := <-received:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook wasn't delivered")
+		return receivedWebhook{}
+	}
+}
+
+func TestDispatcher_HandleEvent(t *testing.T) {
+	// Given
+	now := time.Unix(1592092800, 0)
+	d := newTestDispatcher(t, now)
+	ts, received := newSubscriber(t, http.StatusOK)
+
+	subscription, err := d.Subscribe(NewWebhookSubscription{URL: ts.URL, Events: []string{"payment.*"}, Secret: "MY_SECRET"})
+	require.NoError(t, err)
+
+	// When
+	err = d.HandleEvent(Event{Type: "payment", Payment: &Payment{ID: 123, Status: "approved"}})
+	require.NoError(t, err)
+	webhook := waitWebhook(t, received)
+
+	var payload struct {
+		Type string  `json:"type"`
+		Data Payment `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(webhook.body, &payload))
+
+	// Then
+	require.Equal(t, "payment.approved", payload.Type)
+	require.Equal(t, int64(123), payload.Data.ID)
+	require.Equal(t, "payment.approved", webhook.header.Get("X-Webhook-Event"))
+	require.Equal(t, fmt.Sprintf("t=%d,v1=%s", now.Unix(), signWebhook(subscription.Secret, now.Unix(), webhook.body)), webhook.header.Get("X-Webhook-Signature"))
+}
+
+func TestDispatcher_HandleEvent_NotSubscribed(t *testing.T) {
+	// Given
+	d := newTestDispatcher(t, time.Unix(1592092800, 0))
+	ts, received := newSubscriber(t, http.StatusOK)
+
+	_, err := d.Subscribe(NewWebhookSubscription{URL: ts.URL, Events: []string{"payment.refunded", "subscription.*"}})
+	require.NoError(t, err)
+
+	// When
+	err = d.HandleEvent(Event{Type: "payment", Payment: &Payment{ID: 123, Status: "approved"}})
+
+	// Then
+	require.NoError(t, err)
+	require.Empty(t, d.queue)
+	require.Empty(t, received)
+}
+
+func TestDispatcher_HandleEvent_Again(t *testing.T) {
+	// Given
+	d := newTestDispatcher(t, time.Unix(1592092800, 0))
+	ts, received := newSubscriber(t, http.StatusOK)
+
+	_, err := d.Subscribe(NewWebhookSubscription{URL: ts.URL, Events: []string{"*"}})
+	require.NoError(t, err)
+
+	event := Event{ID: 1, Type: "payment", Payment: &Payment{ID: 123, Status: "approved"}}
+	require.NoError(t, d.HandleEvent(event))
+	waitWebhook(t, received)
+
+	// When
+	err = d.HandleEvent(event)
+	otherErr := d.HandleEvent(Event{ID: 2, Type: "payment", Payment: &Payment{ID: 123, Status: "approved"}})
+	other := waitWebhook(t, received)
+
+	// Then
+	require.NoError(t, err)
+	require.NoError(t, otherErr)
+	require.NotEmpty(t, other.header.Get("X-Webhook-Id"))
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, received)
+}
+
+func TestDispatcher_HandleEvent_QueueFull(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "webhooks.jsonl")
+	d, err := OpenDispatcher(path, http.DefaultClient)
+	require.NoError(t, err)
+	d.queue = make(chan WebhookDelivery)
+	ts, received := newSubscriber(t, http.StatusOK)
+
+	_, err = d.Subscribe(NewWebhookSubscription{URL: ts.URL, Events: []string{"*"}})
+	require.NoError(t, err)
+	_, err = d.Subscribe(NewWebhookSubscription{URL: ts.URL, Events: []string{"payment.*"}})
+	require.NoError(t, err)
+
+	// When
+	err = d.HandleEvent(Event{ID: 1, Type: "payment", Payment: &Payment{ID: 123, Status: "approved"}})
+	require.NoError(t, d.Close())
+	newTestDispatcherAt(t, path, time.Now())
+
+	// Then
+	require.NoError(t, err)
+	first := waitWebhook(t, received)
+	second := waitWebhook(t, received)
+	require.NotEqual(t, first.header.Get("X-Webhook-Id"), second.header.Get("X-Webhook-Id"))
+}
+
+func TestDispatcher_Retry(t *testing.T) {
+	// Given
+	d := newTestDispatcher(t, time.Unix(1592092800, 0))
+	ts, received := newSubscriber(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK)
+
+	_, err := d.Subscribe(NewWebhookSubscription{URL: ts.URL, Events: []string{"*"}})
+	require.NoError(t, err)
+
+	// When
+	err = d.HandleEvent(Event{Type: "payment", Payment: &Payment{ID: 123, Status: "approved"}})
+	require.NoError(t, err)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, waitWebhook(t, received).header.Get("X-Webhook-Id"))
+	}
+
+	deadLetters, err := d.DeadLetters()
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, ids[0], ids[1])
+	require.Equal(t, ids[0], ids[2])
+	require.Empty(t, deadLetters)
+}
+
+func TestDispatcher_DeadLetter(t *testing.T) {
+	// Given
+	d := newTestDispatcher(t, time.Unix(1592092800, 0))
+	d.maxAttempts = 2
+	ts, received := newSubscriber(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK)
+
+	_, err := d.Subscribe(NewWebhookSubscription{URL: ts.URL, Events: []string{"*"}})
+	require.NoError(t, err)
+
+	err = d.HandleEvent(Event{Type: "payment", Payment: &Payment{ID: 123, Status: "approved"}})
+	require.NoError(t, err)
+	waitWebhook(t, received)
+	waitWebhook(t, received)
+
+	var deadLetters []WebhookDelivery
+	require.Eventually(t, func() bool {
+		deadLetters, err = d.DeadLetters()
+		return err == nil && len(deadLetters) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// When
+	redelivered, err := d.Redeliver(deadLetters[0].ID)
+	require.NoError(t, err)
+	waitWebhook(t, received)
+
+	remaining, err := d.DeadLetters()
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, 2, deadLetters[0].Attempts)
+	require.Contains(t, deadLetters[0].LastError, "subscriber answered 500")
+	require.Equal(t, deadLetters[0].ID, redelivered.ID)
+	require.Empty(t, remaining)
+}
+
+func TestDispatcher_Stop(t *testing.T) {
+	// Given
+	d := newTestDispatcher(t, time.Unix(1592092800, 0))
+	armed := make(chan struct{}, 1)
+	stopped := make(chan struct{}, 1)
+	d.after = func(_ time.Duration, _ func()) func() bool {
+		armed <- struct{}{}
+		return func() bool {
+			stopped <- struct{}{}
+			return true
+		}
+	}
+
+	ts, received := newSubscriber(t, http.StatusInternalServerError)
+	_, err := d.Subscribe(NewWebhookSubscription{URL: ts.URL, Events: []string{"*"}})
+	require.NoError(t, err)
+
+	require.NoError(t, d.HandleEvent(Event{Type: "payment", Payment: &Payment{ID: 123, Status: "approved"}}))
+	waitWebhook(t, received)
+
+	select {
+	case <-armed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("retry wasn't scheduled")
+	}
+
+	// When
+	d.Stop()
+
+	// Then
+	require.Len(t, stopped, 1)
+	require.Empty(t, d.timers)
+}
+
+func TestDispatcher_Redeliver_NotFound(t *testing.T) {
+	// Given
+	d := newTestDispatcher(t, time.Unix(1592092800, 0))
+
+	// When
+	_, err := d.Redeliver("123")
+
+	// Then
+	require.Equal(t, http.StatusNotFound, getStatusCodeFromError(err))
+}
+
+func TestWebhookHandler_CreateSubscription(t *testing.T) {
+	// Given
+	d := newTestDispatcher(t, time.Unix(1592092800, 0))
+	ts := httptest.NewServer(http.HandlerFunc(NewWebhookHandler(d).CreateSubscription))
+	defer ts.Close()
+
+	// When
+	resp, err := http.Post(ts.URL, "application/json", bytes.NewReader([]byte(`{"url": "https://orders.internal/webhooks", "events": ["payment.approved"]}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var created WebhookSubscription
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+	subscriptions, err := d.Subscriptions()
+	require.NoError(t, err)
+
+	// Then
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NotEmpty(t, created.Secret)
+	require.Len(t, subscriptions, 1)
+	require.Equal(t, created.ID, subscriptions[0].ID)
+	require.Empty(t, subscriptions[0].Secret)
+}
+
+func TestWebhookHandler_CreateSubscription_ValidationError(t *testing.T) {
+	// Given
+	d := newTestDispatcher(t, time.Unix(1592092800, 0))
+	ts := httptest.NewServer(http.HandlerFunc(NewWebhookHandler(d).CreateSubscription))
+	defer ts.Close()
+
+	// When
+	resp, err := http.Post(ts.URL, "application/json", bytes.NewReader([]byte(`{"url": "not a url", "events": []}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Then
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWebhookHandler_DeleteSubscription(t *testing.T) {
+	// Given
+	d := newTestDispatcher(t, time.Unix(1592092800, 0))
+	subscription, err := d.Subscribe(NewWebhookSubscription{URL: "https://orders.internal/webhooks", Events: []string{"*"}})
+	require.NoError(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/webhooks/{id}", NewWebhookHandler(d).DeleteSubscription)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// When
+	var statusCodes []int
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/webhooks/%s", ts.URL, subscription.ID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		statusCodes = append(statusCodes, resp.StatusCode)
+	}
+
+	// Then
+	require.Equal(t, []int{http.StatusNoContent, http.StatusNotFound}, statusCodes)
+}
@@ -1,23 +1,195 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/mateoferrari97/mercadopago/cmd/internal"
 	"github.com/mateoferrari97/mercadopago/cmd/server"
+	"log"
 	"net/http"
 	"os"
+	"time"
 )
 
 func main() {
+	if err := run(); err != nil {
+		log.Fatalf("couldn't serve: %v", err)
+	}
+}
+
+// run wires the service up and serves it. The stores are closed once it
+// returns, so whatever they buffered is flushed on shutdown.
+func run() error {
 	server := server.NewServer()
-	gateway := internal.NewClientGateway(&http.Client{})
+	server.Use(internal.WithRequestID)
+	server.Use(internal.WithIdempotencyKey)
+	environment, err := internal.ParseEnvironment(os.Getenv("MP_ENVIRONMENT"))
+	if err != nil {
+		return fmt.Errorf("couldn't read environment: %w", err)
+	}
+
+	timeouts, err := internal.ParseTimeouts(os.Getenv("MP_TIMEOUT"), os.Getenv("MP_OPERATION_TIMEOUTS"))
+	if err != nil {
+		return fmt.Errorf("couldn't read timeouts: %w", err)
+	}
+
+	breakers := internal.NewBreakerClient(&http.Client{})
+	gateway := internal.NewClientGateway(internal.NewRetryClient(breakers))
+	gateway.Environment = environment
+	gateway.BaseURL = os.Getenv("MP_BASE_URL")
+	gateway.Timeouts = timeouts
+	tokens := internal.NewTokenSource(gateway)
 	service := internal.NewController(gateway)
+	service.Tokens = tokens
 	handler := internal.NewHandler(service)
+	handler.Token = &internal.ConfiguredToken{
+		Tokens: tokens,
+		Credentials: internal.Credentials{
+			ClientID:     os.Getenv("MP_CLIENT_ID"),
+			ClientSecret: os.Getenv("MP_CLIENT_SECRET"),
+		},
+	}
+	handler.ShareToken = os.Getenv("MP_SHARE_TOKEN") == "true"
+
+	webhooksPath := os.Getenv("WEBHOOKS_PATH")
+	if webhooksPath == "" {
+		webhooksPath = "data/webhooks.jsonl"
+	}
+
+	dispatcher, err := internal.OpenDispatcher(webhooksPath, &http.Client{Timeout: 10 * time.Second})
+	if err != nil {
+		return fmt.Errorf("couldn't open webhook dispatcher: %w", err)
+	}
+	defer dispatcher.Close()
+
+	// Stop runs before Close, so no worker writes to a closed store.
+	dispatcher.Start(4)
+	defer dispatcher.Stop()
+	webhooks := internal.NewWebhookHandler(dispatcher)
+	oauth := internal.NewOAuthHandler(service, internal.OAuthConfig{
+		ClientID:     os.Getenv("MP_CLIENT_ID"),
+		ClientSecret: os.Getenv("MP_CLIENT_SECRET"),
+		RedirectURI:  os.Getenv("MP_REDIRECT_URI"),
+	})
+	webhookSecret := os.Getenv("MP_WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		log.Printf("MP_WEBHOOK_SECRET isn't set, every notification will be rejected")
+	}
+
+	notifications := internal.NewNotificationHandler(service, dispatcher, webhookSecret, os.Getenv("MP_ACCESS_TOKEN"))
+	notifications.Token = handler.Token
+	if webhookSecret != "" && os.Getenv("MP_ACCESS_TOKEN") == "" && os.Getenv("MP_CLIENT_ID") == "" {
+		return errors.New("couldn't resolve notifications: neither MP_ACCESS_TOKEN nor MP_CLIENT_ID is set")
+	}
+
+	inboxPath := os.Getenv("MP_INBOX_PATH")
+	if inboxPath == "" {
+		inboxPath = "data/notifications.jsonl"
+	}
+
+	inbox, err := internal.OpenInbox(inboxPath, notifications.Handle)
+	if err != nil {
+		return fmt.Errorf("couldn't open notification inbox: %w", err)
+	}
+	defer inbox.Close()
+
+	notifications.Inbox = inbox
+	inbox.Start(time.Minute)
+	defer inbox.Stop()
+	inboxHandler := internal.NewInboxHandler(inbox)
+	status := internal.NewStatusHandler(breakers)
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	handler.AdminToken = adminToken
+
+	if masterKey := os.Getenv("VAULT_MASTER_KEY"); masterKey != "" {
+		key, err := internal.ParseMasterKey(masterKey)
+		if err != nil {
+			return fmt.Errorf("couldn't read vault master key: %w", err)
+		}
+
+		vaultPath := os.Getenv("VAULT_PATH")
+		if vaultPath == "" {
+			vaultPath = "data/tenants.jsonl"
+		}
+
+		vault, err := internal.OpenTenantVault(vaultPath, key)
+		if err != nil {
+			return fmt.Errorf("couldn't open tenant vault: %w", err)
+		}
+		defer vault.Close()
+
+		service.Tenants = vault
+		oauth.Sellers = vault
+		tenants := internal.NewTenantHandler(vault)
+		server.HandleFunc("/admin/tenants", "POST", internal.RequireAdminToken(adminToken, tenants.RegisterTenant))
+		server.HandleFunc("/admin/tenants", "GET", internal.RequireAdminToken(adminToken, tenants.ListTenants))
+		server.HandleFunc("/admin/tenants/{id}/credentials", "PUT", internal.RequireAdminToken(adminToken, tenants.RotateTenant))
+		server.HandleFunc("/admin/tenants/{id}/api_key", "POST", internal.RequireAdminToken(adminToken, tenants.ResetTenantAPIKey))
+		server.HandleFunc("/admin/tenants/{id}", "DELETE", internal.RequireAdminToken(adminToken, tenants.RevokeTenant))
+		server.HandleFunc("/admin/marketplace/fees", "GET", internal.RequireAdminToken(adminToken, handler.GetMarketplaceFees))
+	}
+
+	// Every API route can also be scoped to a tenant or a connected seller,
+	// whose credentials are then resolved from the vault once the caller
+	// authenticated for it. Under /v0 it answers in the old plain-text
+	// format, for consumers still migrating.
+	api := func(path string, method string, h http.HandlerFunc) {
+		legacy := internal.Legacy(h)
+		for _, prefix := range []string{"", "/tenants/{tenant_id}", "/sellers/{seller_id:[0-9]+}"} {
+			server.HandleFunc(prefix+path, method, h)
+			server.HandleFunc("/v0"+prefix+path, method, legacy)
+		}
+	}
 
 	server.HandleFunc("/ping", "GET", handler.Ping)
+	server.HandleFunc("/status", "GET", internal.RequireAdminToken(adminToken, status.Status))
 	server.HandleFunc("/access_token", "GET", handler.GetAccessToken)
-	server.HandleFunc("/preferences", "POST", handler.CreatePreference)
-	server.HandleFunc("/total_payments", "GET", handler.GetTotalPayments)
+	server.HandleFunc("/v0/access_token", "GET", internal.Legacy(handler.GetAccessToken))
+	server.HandleFunc("/oauth/authorize", "GET", oauth.Authorize)
+	server.HandleFunc("/oauth/callback", "GET", oauth.Callback)
+	api("/preferences", "POST", handler.CreatePreference)
+	api("/preferences/search", "GET", handler.SearchPreferences)
+	api("/preferences/{id}", "GET", handler.GetPreference)
+	api("/preferences/{id}", "PUT", handler.UpdatePreference)
+	api("/total_payments", "GET", handler.GetTotalPayments)
+	api("/payments", "POST", handler.CreatePayment)
+	api("/payments/search", "GET", handler.SearchPayments)
+	api("/payments/{id:[0-9]+}", "GET", handler.GetPayment)
+	api("/payments/{id:[0-9]+}/refunds", "POST", handler.CreateRefund)
+	api("/payments/{id:[0-9]+}/refunds", "GET", handler.GetRefunds)
+	api("/payments/{id:[0-9]+}/capture", "POST", handler.CapturePayment)
+	api("/payments/{id:[0-9]+}/cancel", "POST", handler.CancelPayment)
+	api("/customers", "POST", handler.CreateCustomer)
+	api("/customers/search", "GET", handler.SearchCustomers)
+	api("/customers/{id}", "GET", handler.GetCustomer)
+	api("/customers/{id}", "PUT", handler.UpdateCustomer)
+	api("/customers/{id}", "DELETE", handler.DeleteCustomer)
+	api("/customers/{id}/cards", "POST", handler.CreateCard)
+	api("/customers/{id}/cards", "GET", handler.GetCards)
+	api("/customers/{id}/cards/{card_id}", "DELETE", handler.DeleteCard)
+	api("/payment_methods", "GET", handler.GetPaymentMethods)
+	api("/payment_methods/card_issuers", "GET", handler.GetCardIssuers)
+	api("/payment_methods/installments", "GET", handler.GetInstallments)
+	api("/merchant_orders/search", "GET", handler.SearchMerchantOrders)
+	api("/merchant_orders/{id:[0-9]+}", "GET", handler.GetMerchantOrder)
+	api("/preapproval_plans", "POST", handler.CreatePreapprovalPlan)
+	api("/preapproval_plans/{id}", "PUT", handler.UpdatePreapprovalPlan)
+	api("/preapprovals", "POST", handler.CreatePreapproval)
+	api("/preapprovals/search", "GET", handler.SearchPreapprovals)
+	api("/preapprovals/{id}", "GET", handler.GetPreapproval)
+	api("/preapprovals/{id}/pause", "POST", handler.PausePreapproval)
+	api("/preapprovals/{id}/resume", "POST", handler.ResumePreapproval)
+	api("/preapprovals/{id}/cancel", "POST", handler.CancelPreapproval)
+	server.HandleFunc("/notifications", "POST", notifications.ReceiveNotification)
+	server.HandleFunc("/admin/notifications", "GET", internal.RequireAdminToken(adminToken, inboxHandler.ListEvents))
+	server.HandleFunc("/admin/notifications/replay", "POST", internal.RequireAdminToken(adminToken, inboxHandler.ReplayEvents))
+	server.HandleFunc("/admin/notifications/{id}/replay", "POST", internal.RequireAdminToken(adminToken, inboxHandler.ReplayEvent))
+	server.HandleFunc("/admin/webhooks", "POST", internal.RequireAdminToken(adminToken, webhooks.CreateSubscription))
+	server.HandleFunc("/admin/webhooks", "GET", internal.RequireAdminToken(adminToken, webhooks.ListSubscriptions))
+	server.HandleFunc("/admin/webhooks/dead_letters", "GET", internal.RequireAdminToken(adminToken, webhooks.ListDeadLetters))
+	server.HandleFunc("/admin/webhooks/dead_letters/{id}/redeliver", "POST", internal.RequireAdminToken(adminToken, webhooks.RedeliverDeadLetter))
+	server.HandleFunc("/admin/webhooks/{id}", "DELETE", internal.RequireAdminToken(adminToken, webhooks.DeleteSubscription))
 
 	port := os.Getenv("PORT")
-	server.Run(port)
+	return server.Run(port)
 }
\ No newline at end of file
@@ -1,20 +1,33 @@
 package server
 
 import (
+	"context"
 	"github.com/gorilla/mux"
+	"github.com/mateoferrari97/mercadopago/cmd/internal"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+const _shutdownTimeout = 30 * time.Second
+
 type Server struct {
 	server *mux.Router
 }
 
 func NewServer() *Server{
-	return &Server{server: mux.NewRouter()}
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(internal.NotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(internal.MethodNotAllowed)
+	return &Server{server: router}
 }
 
-func (s *Server) Run(port string) {
+// Run serves until the listener fails, or until the process gets SIGINT or
+// SIGTERM, in which case requests in flight get to finish first.
+func (s *Server) Run(port string) error {
 	if port == "" {
 		port = "8081"
 		log.Printf("defaulting to port %s", port)
@@ -24,10 +37,35 @@ func (s *Server) Run(port string) {
 		port = port[1:]
 	}
 
+	srv := &http.Server{Addr: ":" + port, Handler: s.server}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
 	log.Printf("Listening on port %s", port)
-	http.ListenAndServe(":" + port, s.server)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Printf("received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), _shutdownTimeout)
+	defer cancel()
+
+	return srv.Shutdown(ctx)
 }
 
 func (s *Server) HandleFunc(path string, method string, h http.HandlerFunc) {
 	s.server.HandleFunc(path, h).Methods(method)
-}
\ No newline at end of file
+}
+
+// Use runs mw around every route.
+func (s *Server) Use(mw func(http.Handler) http.Handler) {
+	s.server.Use(mw)
+}